@@ -60,14 +60,12 @@ require (
 	github.com/goccy/go-yaml v1.15.15
 	github.com/golang/protobuf v1.5.4
 	github.com/google/cel-go v0.21.0
-	github.com/gorilla/websocket v1.5.3
 	github.com/libdns/libdns v0.2.2
 	github.com/logdyhq/logdy-core v0.13.0
 	github.com/mholt/caddy-events-exec v0.0.0-20231121214933-055bfd2e8b82
 	github.com/mitchellh/mapstructure v1.5.1-0.20220423185008-bf980b35cac4
 	github.com/mochi-co/mqtt v1.3.2
 	github.com/ollama/ollama v0.3.5
-	github.com/pires/go-proxyproto v0.7.1-0.20240628150027-b718e7ce4964
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
 	github.com/spf13/cobra v1.8.1
 	github.com/spf13/pflag v1.0.5
@@ -170,6 +168,7 @@ require (
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/googleapis/enterprise-certificate-proxy v0.3.4 // indirect
 	github.com/googleapis/gax-go/v2 v2.14.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/grpc-ecosystem/grpc-gateway/v2 v2.22.0 // indirect
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
 	github.com/hashicorp/go-retryablehttp v0.7.7 // indirect
@@ -217,6 +216,7 @@ require (
 	github.com/openshift/api v0.0.0-20240724184751-84047ef4a2ce // indirect
 	github.com/openshift/client-go v0.0.0-20240528061634-b054aa794d87 // indirect
 	github.com/pelletier/go-toml/v2 v2.2.2 // indirect
+	github.com/pires/go-proxyproto v0.7.1-0.20240628150027-b718e7ce4964 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pkg/sftp v1.13.7 // indirect
 	github.com/projectcontour/contour v1.29.1 // indirect
@@ -2,29 +2,75 @@ package cmd
 
 import (
 	"context"
-)
+	"errors"
+	"net"
+	"time"
 
-import "github.com/pires/go-proxyproto"
+	unio "github.com/costinm/ugate/nio"
+)
 
+// HAProxy is a listener for connections from a L4 load balancer or HAProxy,
+// using PROXY protocol v1 or v2 to pass the original client address.
 //
-// Istio uses pires/go-proxyproto
-// Also armon/proxyproto - text only, wraps conn and uses a bufio without optimization.
-
+// The accepted connections are *nio.StreamConn, RemoteAddr() returns the
+// original client and StreamState.ProxyHeader has the TLVs.
+//
+// Istio uses pires/go-proxyproto - this uses the nio implementation, which
+// parses the header before the conn is handed to the Handler.
 type HAProxy struct {
-	l *proxyproto.Listener
+	unio.ProxyProtocol
+
+	Address string `json:"address,omitempty"`
+
+	// HandlerName is the module handling the accepted connections -
+	// typically "sniff" or "sni". Resolved in Start, like the routes of a
+	// SniffListener.
+	HandlerName string `json:"handler,omitempty"`
+
+	// Handler for the accepted connections. Set from HandlerName, or
+	// directly by code.
+	Handler unio.ConnHandler `json:"-"`
+
+	NetListener net.Listener `json:"-"`
+}
+
+func (h *HAProxy) Provision(ctx context.Context) error {
+	if err := h.ProxyProtocol.Provision(ctx); err != nil {
+		return err
+	}
+	if h.NetListener == nil {
+		l, err := net.Listen("tcp", h.Address)
+		if err != nil {
+			return err
+		}
+		h.NetListener = l
+	}
+	return nil
 }
 
 func (h *HAProxy) Start(ctx context.Context) error {
-	//proxyproto.NewConn()
-	l := &proxyproto.Listener{}
-	h.l = l
+	if h.HandlerName != "" {
+		h.Handler = unio.GetConnHandler(h.HandlerName)
+	}
+	if h.Handler == nil {
+		return errors.New("haproxy: no handler " + h.HandlerName)
+	}
+	l := unio.NewProxyListener(h.NetListener, &h.ProxyProtocol)
 
 	go func() {
-		con, err := l.Accept()
-		if err != nil {
-			return
+		for {
+			con, err := l.Accept()
+			if err != nil {
+				if ne, ok := err.(interface {
+					Temporary() bool
+				}); ok && ne.Temporary() {
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+				return
+			}
+			go h.Handler.HandleConn(con)
 		}
-		con.Close()
 	}()
 
 	return nil
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"strconv"
@@ -10,6 +11,7 @@ import (
 	"github.com/costinm/meshauth/pkg/ugcp"
 	"github.com/costinm/meshauth/pkg/uk8s"
 	"github.com/costinm/ssh-mesh/nio"
+	unio "github.com/costinm/ugate/nio"
 	"github.com/costinm/ugate/pkg/h2r"
 	"github.com/costinm/ugate/pkg/local_discovery"
 	"github.com/costinm/ugate/pkg/smtpd"
@@ -23,13 +25,15 @@ import (
 	"github.com/costinm/ugate/pkg/dns"
 	"github.com/costinm/ugate/pkg/echo"
 	"github.com/costinm/ugate/pkg/http_proxy"
+	"github.com/costinm/ugate/pkg/lb"
+	"github.com/costinm/ugate/pkg/metrics"
+	"github.com/costinm/ugate/pkg/sni"
+	"github.com/costinm/ugate/pkg/socks"
 	"github.com/costinm/ugate/pkg/udp"
 	msgs "github.com/costinm/ugate/pkg/webpush"
+	"github.com/costinm/ugate/pkg/ws"
 )
 
-// TODO: HA_PROXY or callback support for getting peer info.
-// TODO: socks support for outbound calls
-
 func init() {
 	Register()
 }
@@ -48,8 +52,9 @@ func Register() {
 
 	appinit.RegisterN("k8s", uk8s.New) // uk8s.K8Service{})
 
-	// Networking - dialer, listeners
-	appinit.RegisterN("mesh", meshauth.New)
+	// Networking - dialer, listeners. The mesh is also the default dialer
+	// and certificate source for the nio and pkg modules.
+	appinit.RegisterN("mesh", newMesh)
 
 	appinit.RegisterN("mdsd", ugcp.NewServer)
 	appinit.RegisterN("mds", ugcp.New)
@@ -116,18 +121,118 @@ func Register() {
 
 	appinit.RegisterT("http_proxy", &http_proxy.HttpProxy{})
 
+	// Hosts with multiple endpoints, with LB policy and health checks - used
+	// by http_proxy. /debug/lb
+	appinit.RegisterT("lb", &lb.LB{})
+
 	appinit.RegisterN("udp", udp.New)
 	appinit.RegisterT("udp_tproxy", &udp.UDPTproxy{})
+	// CONNECT-UDP (MASQUE) handler - H2 with capsules. The quic module
+	// serves it on H3 with datagrams. Only targets in "allow" are relayed.
+	appinit.RegisterT("masque", &udp.MasqueServer{})
 	appinit.RegisterT("tcp", &nio.Listener{})
 
+	// Active stream registry - /debug/streams and /debug/streams/close
+	appinit.RegisterN("streams", func() *unio.Streams { return unio.DefaultStreams })
+
+	// Bandwidth limits per stream, peer and destination - /debug/ratelimits
+	appinit.RegisterT("ratelimits", &unio.RateLimits{})
+
+	// Idle, half-close and max duration timeouts per destination.
+	appinit.RegisterT("timeouts", &unio.RouteTimeouts{})
+
+	// One structured record per proxied stream, to a file, stdout or the
+	// message mux.
+	appinit.RegisterN("accesslog", func() *unio.AccessLog {
+		return &unio.AccessLog{Msgs: msgs.DefaultMux}
+	})
+
+	// Prometheus text format for all module metrics - /metrics
+	appinit.RegisterT("metrics", &metrics.Metrics{})
+
+	// Recording of selected streams as pcapng - /debug/pcap
+	appinit.RegisterT("pcap", &unio.PcapTap{})
+
+	// Multiplexed H2 client connections, keyed by destination, for
+	// H2Dialer - /debug/connpool. Dials with the mesh certificates.
+	appinit.RegisterT("connpool", &unio.ConnPool{})
+
+	// Happy eyeballs across all addresses of a mesh node, remembering the
+	// winner - /debug/dialer. Only the TCP addresses are raced, with TLS -
+	// no QUIC, SSH or WebRTC dialer is registered in Dialers.
+	appinit.RegisterT("dialer", &unio.MultiDialer{})
+
+	// Per destination circuit breakers in front of the http_proxy, sni and
+	// udp dialers - /debug/breakers
+	appinit.RegisterT("breakers", &unio.CircuitBreakers{})
+
+	// Outbound dialer selecting a parent SOCKS5 or HTTP CONNECT proxy by
+	// destination suffix. Used as Dialer in http_proxy, socks, sni and udp.
+	appinit.RegisterT("upstream", &unio.RouteDialer{})
+
+	// Listener for connections from a L4 LB using PROXY protocol - "handler"
+	// is the module handling the accepted connections, for example "sniff".
+	appinit.RegisterT("haproxy", &HAProxy{})
+
+	// SOCKS5 server - CONNECT and UDP ASSOCIATE, using the udp module for NAT.
+	appinit.RegisterN("socks", func() *socks.Socks {
+		s := socks.New()
+		unio.RegisterConnHandler("socks", s)
+		return s
+	})
+
+	// SNI routing of TLS connections, without termination.
+	appinit.RegisterN("sni", func() *sni.SNIHandler {
+		h := &sni.SNIHandler{}
+		unio.RegisterConnHandler("sni", h)
+		return h
+	})
+
+	// Single port for TLS, HTTP, SOCKS, SSH and PROXY protocol - "routes"
+	// selects the handler module for each detected protocol, for example
+	// {"tls": "sni", "socks5": "socks", "*": "echo"}.
+	appinit.RegisterN("sniff", func() *unio.SniffListener {
+		sl := &unio.SniffListener{}
+		unio.RegisterConnHandler("sniff", sl)
+		return sl
+	})
+
 	appinit.RegisterT("extauthz", &tokens.Authz{})
 
 	// TODO: expose http.DefaultServerMux with admin pass (for debug, etc)
 
 	appinit.RegisterT("h2r", &h2r.H2R{})
 
-	appinit.RegisterT("echo", &echo.EchoHandler{})
+	appinit.RegisterN("echo", func() *echo.EchoHandler {
+		h := &echo.EchoHandler{}
+		unio.RegisterConnHandler("echo", h)
+		return h
+	})
+
+	// WebSocket tunnels - HTTP/1.1 Upgrade and RFC 8441 over h2 - to a TCP
+	// destination, for paths that only allow WebSocket.
+	appinit.RegisterT("ws", &ws.WS{})
+
+}
+
+// meshTLS provides the mesh certificates to the nio and pkg modules.
+type meshTLS struct {
+	*meshauth.Mesh
+}
+
+func (m meshTLS) ServerConfig() *tls.Config {
+	return m.GenerateTLSConfigServer(true)
+}
+
+func (m meshTLS) ClientConfig(sni string) *tls.Config {
+	return m.TLSClientConf(&meshauth.Dest{}, sni, "")
+}
 
+func newMesh() *meshauth.Mesh {
+	m := meshauth.New()
+	unio.DefaultDialer = m
+	unio.DefaultTLS = meshTLS{m}
+	return m
 }
 
 func StartDiscovery() {
@@ -0,0 +1,224 @@
+package nio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log for proxied streams - one structured record for each completed
+// stream, for auditing who tunneled where.
+
+// AccessRecord is the access log entry for a stream.
+type AccessRecord struct {
+	StreamId string    `json:"id"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"`
+
+	// Listener is the module that accepted the stream.
+	Listener string `json:"listener,omitempty"`
+	Proto    string `json:"proto,omitempty"`
+
+	Src  string `json:"src,omitempty"`
+	Dest string `json:"dest,omitempty"`
+
+	// DestAddr is the address of the dialed connection.
+	DestAddr string `json:"dest_addr,omitempty"`
+
+	SNI  string `json:"sni,omitempty"`
+	ALPN string `json:"alpn,omitempty"`
+
+	// JA3 and JA4 are the fingerprints of the sniffed ClientHello.
+	JA3 string `json:"ja3,omitempty"`
+	JA4 string `json:"ja4,omitempty"`
+
+	// Peer is the authenticated peer ID.
+	Peer string `json:"peer,omitempty"`
+
+	SentBytes int64 `json:"sent_bytes"`
+	RcvdBytes int64 `json:"rcvd_bytes"`
+	SentReads int   `json:"sent_reads"`
+	RcvdReads int   `json:"rcvd_reads"`
+
+	// Reason the stream was closed - "eof" for normal close.
+	Reason string `json:"reason"`
+}
+
+// Publisher sends a message - implemented by webpush.Mux.
+type Publisher interface {
+	Send(msgType string, data interface{}, meta ...string) error
+}
+
+// AccessLog writes the records using slog.
+type AccessLog struct {
+	// Output is "stdout", "stderr" or a file name. If empty, the default
+	// slog logger is used.
+	Output string `json:"output,omitempty"`
+
+	// Text uses the slog text format instead of JSON.
+	Text bool `json:"text,omitempty"`
+
+	// Sample logs one in Sample streams. 0 or 1 logs all.
+	Sample int `json:"sample,omitempty"`
+
+	// Errors logs all streams closed with an error, regardless of Sample.
+	Errors bool `json:"errors,omitempty"`
+
+	// Messages sends each record as an "accesslog" message to Msgs.
+	Messages bool `json:"messages,omitempty"`
+
+	// Msgs is the message mux for the records - msgs.DefaultMux.
+	Msgs Publisher `json:"-"`
+
+	// Logger is used if set, instead of Output.
+	Logger *slog.Logger `json:"-"`
+
+	m sync.Mutex
+	f *os.File
+}
+
+// DefaultAccessLog is set when an AccessLog is provisioned, and used by
+// Proxy. If nil, nothing is logged.
+var DefaultAccessLog *AccessLog
+
+// Provision opens the output and makes the log active.
+func (al *AccessLog) Provision(ctx context.Context) error {
+	if al.Logger == nil && al.Output != "" {
+		var w io.Writer
+		switch al.Output {
+		case "stdout":
+			w = os.Stdout
+		case "stderr":
+			w = os.Stderr
+		default:
+			f, err := os.OpenFile(al.Output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+			if err != nil {
+				return err
+			}
+			al.f = f
+			w = f
+		}
+		if al.Text {
+			al.Logger = slog.New(slog.NewTextHandler(w, nil))
+		} else {
+			al.Logger = slog.New(slog.NewJSONHandler(w, nil))
+		}
+	}
+	DefaultAccessLog = al
+	return nil
+}
+
+// Close closes the output file. Records logged after Close are dropped.
+func (al *AccessLog) Close() error {
+	al.m.Lock()
+	defer al.m.Unlock()
+	if al.f == nil {
+		return nil
+	}
+	err := al.f.Close()
+	al.f = nil
+	al.Logger = slog.New(slog.DiscardHandler)
+	return err
+}
+
+// Log writes the record, subject to sampling.
+func (al *AccessLog) Log(r *AccessRecord) {
+	if al.Sample > 1 && rand.IntN(al.Sample) != 0 && !(al.Errors && r.Reason != "eof") {
+		return
+	}
+	al.m.Lock()
+	l := al.Logger
+	al.m.Unlock()
+	if l == nil {
+		l = slog.Default()
+	}
+	l.LogAttrs(context.Background(), slog.LevelInfo, "access",
+		slog.String("id", r.StreamId),
+		slog.Time("start", r.Start),
+		slog.Float64("duration", r.Duration),
+		slog.String("listener", r.Listener),
+		slog.String("proto", r.Proto),
+		slog.String("src", r.Src),
+		slog.String("dest", r.Dest),
+		slog.String("dest_addr", r.DestAddr),
+		slog.String("sni", r.SNI),
+		slog.String("alpn", r.ALPN),
+		slog.String("ja3", r.JA3),
+		slog.String("ja4", r.JA4),
+		slog.String("peer", r.Peer),
+		slog.Int64("sent_bytes", r.SentBytes),
+		slog.Int64("rcvd_bytes", r.RcvdBytes),
+		slog.Int("sent_reads", r.SentReads),
+		slog.Int("rcvd_reads", r.RcvdReads),
+		slog.String("reason", r.Reason))
+	if al.Messages && al.Msgs != nil {
+		al.Msgs.Send("accesslog", r)
+	}
+}
+
+// NewAccessRecord creates the record for a completed stream. outConn is
+// the dialed connection, s1 copies from the client and s2 from outConn.
+func NewAccessRecord(str Stream, outConn net.Conn, s1, s2 *ReaderCopier) *AccessRecord {
+	st := str.State()
+	r := &AccessRecord{
+		StreamId:  st.StreamId,
+		Start:     st.Open,
+		Duration:  time.Since(st.Open).Seconds(),
+		Listener:  st.ListenerName,
+		Proto:     st.Proto,
+		Src:       st.PeerAddr,
+		Dest:      st.Dest,
+		Peer:      st.Peer,
+		SentBytes: s1.Written,
+		RcvdBytes: s2.Written,
+		SentReads: s1.ReadCnt,
+		RcvdReads: s2.ReadCnt,
+		Reason:    CloseReason(s1.Err, s2.Err),
+	}
+	if ra := outConn.RemoteAddr(); ra != nil {
+		r.DestAddr = ra.String()
+	}
+	if ch := st.ClientHello; ch != nil {
+		r.SNI = ch.ServerName
+		r.ALPN = strings.Join(ch.AlpnProtocols, ",")
+		r.JA3 = ch.JA3()
+		r.JA4 = ch.JA4()
+	}
+	if cs := str.TLSConnectionState(); cs != nil {
+		if r.SNI == "" {
+			r.SNI = cs.ServerName
+		}
+		if cs.NegotiatedProtocol != "" {
+			r.ALPN = cs.NegotiatedProtocol
+		}
+	}
+	return r
+}
+
+// CloseReason returns a short reason for the copy errors - the timeouts
+// first, since the other direction fails after the stream is closed.
+func CloseReason(errs ...error) string {
+	for _, err := range errs {
+		switch {
+		case errors.Is(err, ErrIdleTimeout):
+			return "idle_timeout"
+		case errors.Is(err, ErrHalfCloseTimeout):
+			return "half_close_timeout"
+		case errors.Is(err, ErrMaxDuration):
+			return "max_duration"
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err.Error()
+		}
+	}
+	return "eof"
+}
@@ -0,0 +1,131 @@
+package nio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type syncBuffer struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.b.Write(p)
+}
+
+type testPublisher struct {
+	msgs []any
+}
+
+func (p *testPublisher) Send(msgType string, data interface{}, meta ...string) error {
+	p.msgs = append(p.msgs, data)
+	return nil
+}
+
+func TestAccessLog(t *testing.T) {
+	buf := &syncBuffer{}
+	pub := &testPublisher{}
+	al := &AccessLog{Logger: slog.New(slog.NewJSONHandler(buf, nil)), Messages: true, Msgs: pub}
+	old := DefaultAccessLog
+	DefaultAccessLog = al
+	defer func() { DefaultAccessLog = old }()
+
+	client, in := tcpPair(t)
+	out, server := tcpPair(t)
+	sc := NewStreamConn(in)
+	sc.ListenerName = "sniff"
+	sc.Peer = "spiffe://cluster.local/ns/a/sa/b"
+	sc.ClientHello = &ClientHelloMsg{ServerName: "example.com", AlpnProtocols: []string{"h2", "http/1.1"}}
+
+	done := make(chan error)
+	go func() {
+		done <- Proxy(out, sc, sc, "example.com:443")
+	}()
+	client.Write([]byte("hello"))
+	client.CloseWrite()
+	io.ReadAll(server)
+	server.Write([]byte("world!"))
+	server.Close()
+	io.ReadAll(client)
+	client.Close()
+	<-done
+
+	rec := map[string]any{}
+	if err := json.Unmarshal(buf.b.Bytes(), &rec); err != nil {
+		t.Fatal(err, buf.b.String())
+	}
+	for k, v := range map[string]any{
+		"msg":        "access",
+		"listener":   "sniff",
+		"dest":       "example.com:443",
+		"dest_addr":  out.RemoteAddr().String(),
+		"src":        client.LocalAddr().String(),
+		"sni":        "example.com",
+		"alpn":       "h2,http/1.1",
+		"ja3":        sc.ClientHello.JA3(),
+		"ja4":        sc.ClientHello.JA4(),
+		"peer":       "spiffe://cluster.local/ns/a/sa/b",
+		"sent_bytes": 5.0,
+		"rcvd_bytes": 6.0,
+		"reason":     "eof",
+	} {
+		if rec[k] != v {
+			t.Error("Unexpected", k, rec[k], v)
+		}
+	}
+	if len(pub.msgs) != 1 || pub.msgs[0].(*AccessRecord).SNI != "example.com" {
+		t.Error("Message not sent", pub.msgs)
+	}
+}
+
+func TestAccessLogSample(t *testing.T) {
+	buf := &syncBuffer{}
+	al := &AccessLog{Logger: slog.New(slog.NewJSONHandler(buf, nil)), Sample: 1 << 30, Errors: true}
+	for i := 0; i < 10; i++ {
+		al.Log(&AccessRecord{Reason: "eof"})
+	}
+	if buf.b.Len() != 0 {
+		t.Fatal("Expected sampled out", buf.b.String())
+	}
+	al.Log(&AccessRecord{Reason: CloseReason(nil, errors.Join(errors.New("x"), ErrIdleTimeout))})
+	if !bytes.Contains(buf.b.Bytes(), []byte(`"reason":"idle_timeout"`)) {
+		t.Fatal("Expected error record", buf.b.String())
+	}
+}
+
+func TestAccessLogClose(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "access.log")
+	al := &AccessLog{Output: fn}
+	old := DefaultAccessLog
+	defer func() { DefaultAccessLog = old }()
+	if err := al.Provision(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	al.Log(&AccessRecord{StreamId: "1", Reason: "eof"})
+	if err := al.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if al.Logger.Enabled(context.Background(), slog.LevelInfo) {
+		t.Fatal("Logger still writing to the closed file")
+	}
+	al.Log(&AccessRecord{StreamId: "2", Reason: "eof"})
+
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"id":"1"`)) || bytes.Contains(b, []byte(`"id":"2"`)) {
+		t.Fatal("Unexpected log", string(b))
+	}
+}
@@ -0,0 +1,400 @@
+package nio
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/costinm/ugate/pkg/metrics"
+)
+
+// Circuit breakers and outlier detection for upstream destinations.
+//
+// When a destination starts failing, each request would otherwise dial it
+// again - holding a goroutine and a socket until the dial timeout. The
+// breaker for a destination limits the dials in progress and the open
+// connections, and ejects the destination after consecutive dial failures.
+// After the ejection time one probe dial is allowed (half-open); if it
+// succeeds the breaker closes, else the ejection time doubles.
+//
+// Similar to Envoy circuit_breakers and outlier_detection, at L4 and only
+// counting dial errors.
+
+// Breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+var (
+	ErrCircuitOpen    = errors.New("circuit breaker open")
+	ErrTooManyPending = errors.New("too many pending dials")
+	ErrTooManyConns   = errors.New("too many connections")
+)
+
+var (
+	breakerRejected = metrics.NewCounterVec("ugate_breaker_rejected_total",
+		"Dials rejected by circuit breakers.", "reason")
+	breakerEjections = metrics.NewCounter("ugate_breaker_ejections_total",
+		"Destinations ejected after consecutive failures.")
+	breakerEjectedDest = metrics.NewGauge("ugate_breaker_ejected",
+		"Destinations currently ejected.")
+)
+
+// BreakerLimits configures the breaker for a destination.
+type BreakerLimits struct {
+	// MaxPending is the max concurrent dials. Default 64.
+	MaxPending int `json:"max_pending,omitempty"`
+
+	// MaxConns is the max open connections. 0 is unlimited.
+	MaxConns int `json:"max_conns,omitempty"`
+
+	// ConsecutiveFailures ejects the destination. Default 5.
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+
+	// EjectionTime is the base ejection time, doubled for each consecutive
+	// ejection up to MaxEjectionTime. Default 30s and 5 min.
+	EjectionTime    time.Duration `json:"ejection_time,omitempty"`
+	MaxEjectionTime time.Duration `json:"max_ejection_time,omitempty"`
+}
+
+func (bl BreakerLimits) merge(d BreakerLimits) BreakerLimits {
+	if bl.MaxPending == 0 {
+		bl.MaxPending = d.MaxPending
+	}
+	if bl.MaxConns == 0 {
+		bl.MaxConns = d.MaxConns
+	}
+	if bl.ConsecutiveFailures == 0 {
+		bl.ConsecutiveFailures = d.ConsecutiveFailures
+	}
+	if bl.EjectionTime == 0 {
+		bl.EjectionTime = d.EjectionTime
+	}
+	if bl.MaxEjectionTime == 0 {
+		bl.MaxEjectionTime = d.MaxEjectionTime
+	}
+	return bl
+}
+
+var defaultBreakerLimits = BreakerLimits{
+	MaxPending:          64,
+	ConsecutiveFailures: 5,
+	EjectionTime:        30 * time.Second,
+	MaxEjectionTime:     5 * time.Minute,
+}
+
+// CircuitBreakers holds the breakers for all destinations.
+type CircuitBreakers struct {
+	// Default limits, for destinations not in Dests.
+	Default BreakerLimits `json:"default,omitempty"`
+
+	// Dests has limits by host:port or host.
+	Dests map[string]BreakerLimits `json:"dests,omitempty"`
+
+	// IdleTimeout removes closed breakers without dials or connections
+	// for this time. Default 10 min.
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+
+	// Mux is used for the /debug/breakers handler. Defaults to
+	// http.DefaultServeMux.
+	Mux *http.ServeMux `json:"-"`
+
+	m         sync.Mutex
+	breakers  map[string]*Breaker
+	nextSweep time.Time
+}
+
+// DefaultBreakers is set when the breakers are provisioned - used by the
+// http_proxy, sni and udp modules in front of their dialer.
+var DefaultBreakers *CircuitBreakers
+
+func (cb *CircuitBreakers) Provision(ctx context.Context) error {
+	mux := cb.Mux
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("/debug/breakers", cb.HandleBreakers)
+	DefaultBreakers = cb
+	return nil
+}
+
+// Wrap returns a dialer using d, guarded by the breakers.
+func (cb *CircuitBreakers) Wrap(d ContextDialer) ContextDialer {
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	return &breakerDialer{cb: cb, d: d}
+}
+
+type breakerDialer struct {
+	cb *CircuitBreakers
+	d  ContextDialer
+}
+
+func (bd *breakerDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return bd.cb.Dial(ctx, bd.d, network, addr)
+}
+
+// Breaker returns the breaker for the destination, creating it if needed.
+func (cb *CircuitBreakers) Breaker(dest string) *Breaker {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+	now := time.Now()
+	if now.After(cb.nextSweep) {
+		cb.expire(now)
+	}
+	b, ok := cb.breakers[dest]
+	if ok {
+		return b
+	}
+	l, ok := cb.Dests[dest]
+	if !ok {
+		if host, _, err := net.SplitHostPort(dest); err == nil {
+			l = cb.Dests[host]
+		}
+	}
+	b = &Breaker{Dest: dest, Limits: l.merge(cb.Default).merge(defaultBreakerLimits),
+		state: BreakerClosed, last: now}
+	if cb.breakers == nil {
+		cb.breakers = map[string]*Breaker{}
+	}
+	cb.breakers[dest] = b
+	return b
+}
+
+// expire removes the idle breakers - a closed breaker has no state worth
+// keeping. Called with cb.m held.
+func (cb *CircuitBreakers) expire(now time.Time) {
+	idle := cb.IdleTimeout
+	if idle == 0 {
+		idle = 10 * time.Minute
+	}
+	cb.nextSweep = now.Add(idle / 2)
+	for k, b := range cb.breakers {
+		if b.idle(now, idle) {
+			delete(cb.breakers, k)
+		}
+	}
+}
+
+// Dial connects to addr using d, if the breaker for addr allows it.
+func (cb *CircuitBreakers) Dial(ctx context.Context, d ContextDialer, network, addr string) (net.Conn, error) {
+	b := cb.Breaker(addr)
+	probe, err := b.start()
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.DialContext(ctx, network, addr)
+	// A dial canceled by the caller says nothing about the destination.
+	b.done(probe, err, err != nil && ctx.Err() != nil)
+	if err != nil {
+		return nil, err
+	}
+	return &breakerConn{Conn: c, b: b}, nil
+}
+
+// Breaker tracks one destination.
+type Breaker struct {
+	Dest   string
+	Limits BreakerLimits
+
+	m         sync.Mutex
+	state     string
+	pending   int
+	conns     int
+	failures  int
+	ejections int
+	until     time.Time
+	probing   bool
+	lastErr   error
+
+	// last dial or connection close.
+	last time.Time
+}
+
+// start reserves a pending dial. Returns true if the dial is the half-open
+// probe.
+func (b *Breaker) start() (bool, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.last = time.Now()
+	probe := false
+	switch b.state {
+	case BreakerOpen:
+		if time.Now().Before(b.until) {
+			breakerRejected.With("open").Inc()
+			return false, ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			breakerRejected.With("open").Inc()
+			return false, ErrCircuitOpen
+		}
+		b.probing = true
+		probe = true
+	}
+	if b.pending >= b.Limits.MaxPending {
+		b.probing = b.probing && !probe
+		breakerRejected.With("pending").Inc()
+		return false, ErrTooManyPending
+	}
+	if b.Limits.MaxConns > 0 && b.conns >= b.Limits.MaxConns {
+		b.probing = b.probing && !probe
+		breakerRejected.With("conns").Inc()
+		return false, ErrTooManyConns
+	}
+	b.pending++
+	return probe, nil
+}
+
+func (b *Breaker) done(probe bool, err error, canceled bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.pending--
+	if probe {
+		b.probing = false
+	}
+	if err == nil {
+		b.conns++
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.state = BreakerClosed
+			b.ejections = 0
+			breakerEjectedDest.Add(-1)
+		}
+		return
+	}
+	if canceled {
+		return
+	}
+	b.lastErr = err
+	b.failures++
+	if probe || (b.state == BreakerClosed && b.failures >= b.Limits.ConsecutiveFailures) {
+		if b.state == BreakerClosed {
+			breakerEjectedDest.Add(1)
+		}
+		b.ejections++
+		et := b.Limits.EjectionTime << (b.ejections - 1)
+		if et > b.Limits.MaxEjectionTime || et <= 0 {
+			et = b.Limits.MaxEjectionTime
+		}
+		b.state = BreakerOpen
+		b.until = time.Now().Add(et)
+		breakerEjections.Inc()
+	}
+}
+
+func (b *Breaker) closeConn() {
+	b.m.Lock()
+	b.conns--
+	b.last = time.Now()
+	b.m.Unlock()
+}
+
+func (b *Breaker) idle(now time.Time, d time.Duration) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.state == BreakerClosed && b.pending == 0 && b.conns == 0 &&
+		now.Sub(b.last) > d
+}
+
+// BreakerState is the exported state of a breaker.
+type BreakerState struct {
+	Dest      string
+	State     string
+	Pending   int
+	Conns     int
+	Failures  int
+	Ejections int       `json:",omitempty"`
+	Until     time.Time `json:",omitempty"`
+	LastError string    `json:",omitempty"`
+}
+
+// State returns the current state.
+func (b *Breaker) State() *BreakerState {
+	b.m.Lock()
+	defer b.m.Unlock()
+	st := &BreakerState{Dest: b.Dest, State: b.state, Pending: b.pending, Conns: b.conns,
+		Failures: b.failures, Ejections: b.ejections}
+	if b.state == BreakerOpen {
+		st.Until = b.until
+	}
+	if b.lastErr != nil {
+		st.LastError = b.lastErr.Error()
+	}
+	return st
+}
+
+// States returns the state of all breakers, sorted by destination.
+func (cb *CircuitBreakers) States() []*BreakerState {
+	cb.m.Lock()
+	bl := make([]*Breaker, 0, len(cb.breakers))
+	for _, b := range cb.breakers {
+		bl = append(bl, b)
+	}
+	cb.m.Unlock()
+	res := make([]*BreakerState, 0, len(bl))
+	for _, b := range bl {
+		res = append(res, b.State())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Dest < res[j].Dest })
+	return res
+}
+
+// HandleBreakers returns the breaker states as JSON. DELETE with a dest
+// query parameter resets a breaker.
+//
+// curl localhost:15000/debug/breakers
+// curl -XDELETE "localhost:15000/debug/breakers?dest=10.1.1.1:443"
+func (cb *CircuitBreakers) HandleBreakers(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		dest := r.URL.Query().Get("dest")
+		cb.m.Lock()
+		b, ok := cb.breakers[dest]
+		cb.m.Unlock()
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		b.m.Lock()
+		if b.state != BreakerClosed {
+			b.state = BreakerClosed
+			breakerEjectedDest.Add(-1)
+		}
+		b.failures = 0
+		b.ejections = 0
+		b.m.Unlock()
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(cb.States())
+}
+
+// breakerConn releases the connection slot on Close.
+type breakerConn struct {
+	net.Conn
+	b    *Breaker
+	once sync.Once
+}
+
+func (c *breakerConn) Close() error {
+	c.once.Do(c.b.closeConn)
+	return c.Conn.Close()
+}
+
+// CloseWrite sends a FIN if the connection supports it. Closing the
+// connection instead would drop the data still to be read.
+func (c *breakerConn) CloseWrite() error {
+	if cw, ok := c.Conn.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,162 @@
+package nio
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var fail atomic.Bool
+	var dials atomic.Int32
+	block := make(chan struct{})
+	d := funcDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		if addr == "slow:80" {
+			<-block
+		}
+		if fail.Load() {
+			return nil, errors.New("refused")
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	})
+	mux := http.NewServeMux()
+	cb := &CircuitBreakers{Mux: mux,
+		Default: BreakerLimits{ConsecutiveFailures: 2, EjectionTime: 50 * time.Millisecond},
+		Dests:   map[string]BreakerLimits{"slow": {MaxPending: 1}, "limited:80": {MaxConns: 1}}}
+	cb.Provision(context.Background())
+	defer func() { DefaultBreakers = nil }()
+	bd := cb.Wrap(d)
+	ctx := context.Background()
+
+	t.Run("eject", func(t *testing.T) {
+		fail.Store(true)
+		for i := 0; i < 2; i++ {
+			if _, err := bd.DialContext(ctx, "tcp", "a:80"); err == nil {
+				t.Fatal("Expected dial error")
+			}
+		}
+		n := dials.Load()
+		if _, err := bd.DialContext(ctx, "tcp", "a:80"); err != ErrCircuitOpen {
+			t.Fatal("Expected open circuit", err)
+		}
+		if dials.Load() != n {
+			t.Fatal("Dialed while open")
+		}
+		if st := cb.Breaker("a:80").State(); st.State != BreakerOpen || st.Ejections != 1 {
+			t.Fatal("Unexpected state", st)
+		}
+
+		// Failed probe doubles the ejection time.
+		time.Sleep(60 * time.Millisecond)
+		bd.DialContext(ctx, "tcp", "a:80")
+		st := cb.Breaker("a:80").State()
+		if st.State != BreakerOpen || st.Ejections != 2 || time.Until(st.Until) < 60*time.Millisecond {
+			t.Fatal("Unexpected state after failed probe", st)
+		}
+
+		// Successful probe closes.
+		fail.Store(false)
+		time.Sleep(110 * time.Millisecond)
+		c, err := bd.DialContext(ctx, "tcp", "a:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if st := cb.Breaker("a:80").State(); st.State != BreakerClosed || st.Failures != 0 || st.Conns != 0 {
+			t.Fatal("Unexpected state after probe", st)
+		}
+	})
+
+	t.Run("pending", func(t *testing.T) {
+		done := make(chan error)
+		go func() {
+			c, err := bd.DialContext(ctx, "tcp", "slow:80")
+			if c != nil {
+				c.Close()
+			}
+			done <- err
+		}()
+		for cb.Breaker("slow:80").State().Pending == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if _, err := bd.DialContext(ctx, "tcp", "slow:80"); err != ErrTooManyPending {
+			t.Fatal("Expected pending limit", err)
+		}
+		close(block)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("conns", func(t *testing.T) {
+		c, err := bd.DialContext(ctx, "tcp", "limited:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bd.DialContext(ctx, "tcp", "limited:80"); err != ErrTooManyConns {
+			t.Fatal("Expected conn limit", err)
+		}
+		c.Close()
+		c.Close()
+		c, err = bd.DialContext(ctx, "tcp", "limited:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		fail.Store(true)
+		defer fail.Store(false)
+		cctx, cf := context.WithCancel(ctx)
+		cf()
+		for i := 0; i < 3; i++ {
+			bd.DialContext(cctx, "tcp", "b:80")
+		}
+		if st := cb.Breaker("b:80").State(); st.State != BreakerClosed || st.Failures != 0 {
+			t.Fatal("Canceled dials counted as failures", st)
+		}
+	})
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/breakers", nil))
+	if rr.Code != 200 || len(cb.States()) != 4 {
+		t.Fatal("Unexpected states", rr.Body.String())
+	}
+}
+
+func TestBreakerIdle(t *testing.T) {
+	d := funcDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, _ := net.Pipe()
+		return c, nil
+	})
+	cb := &CircuitBreakers{IdleTimeout: 20 * time.Millisecond}
+	bd := cb.Wrap(d)
+	ctx := context.Background()
+
+	c, err := bd.DialContext(ctx, "tcp", "open:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// net.Pipe doesn't support half close - the connection stays open.
+	if err := c.(CloseWriter).CloseWrite(); err == nil {
+		t.Fatal("Expected CloseWrite error")
+	}
+	c2, _ := bd.DialContext(ctx, "tcp", "idle:80")
+	c2.Close()
+
+	time.Sleep(30 * time.Millisecond)
+	cb.Breaker("new:80")
+	st := cb.States()
+	if len(st) != 2 || st[0].Dest != "new:80" || st[1].Dest != "open:80" || st[1].Conns != 1 {
+		t.Fatal("Unexpected breakers", st)
+	}
+	c.Close()
+}
@@ -0,0 +1,434 @@
+package nio
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/costinm/ugate/pkg/metrics"
+)
+
+// ConnPool holds multiplexed client connections - H2, H3, SSH - keyed by
+// the destination identity (mesh ID or host:port).
+//
+// Each connection carries up to MaxStreams concurrent streams, or the limit
+// advertised by the peer if lower. Get opens a new connection when all are
+// full. Connections that received a GOAWAY are drained: no new streams, and
+// closed when the last stream is released. A health check pings the
+// connections and evicts the ones that don't answer.
+//
+// See docs/client_conn_pool.md.
+type ConnPool struct {
+	// MaxStreams is the max concurrent streams on a connection. Default 100.
+	MaxStreams int `json:"max_streams,omitempty"`
+
+	// MaxConns is the max connections for a destination. Get blocks when
+	// all are full. 0 is unlimited.
+	MaxConns int `json:"max_conns,omitempty"`
+
+	// PingInterval is the interval for health check pings. Default 30s.
+	PingInterval time.Duration `json:"ping_interval,omitempty"`
+
+	// PingTimeout is the time to wait for a ping response. Default 5s.
+	PingTimeout time.Duration `json:"ping_timeout,omitempty"`
+
+	// IdleTimeout closes connections without streams. Default 5 min.
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+
+	// Dial creates a new multiplexed connection to the destination.
+	// Defaults to H2 with the mesh dialer and certificates.
+	Dial func(ctx context.Context, dest string) (MuxConn, error) `json:"-"`
+
+	// Mux is used for the /debug/connpool handler. Defaults to
+	// http.DefaultServeMux.
+	Mux *http.ServeMux `json:"-"`
+
+	m       sync.Mutex
+	conns   map[string][]*PoolConn
+	dialing map[string]chan struct{}
+
+	// released is closed and replaced when a stream slot is released.
+	released chan struct{}
+}
+
+// MuxConn is a multiplexed client connection.
+type MuxConn interface {
+	// Ping sends a ping and waits for the response.
+	Ping(ctx context.Context) error
+
+	// Available returns false if the connection can't take new streams -
+	// after GOAWAY or close.
+	Available() bool
+
+	Close() error
+}
+
+// streamLimiter is implemented by MuxConns where the peer advertises
+// a stream limit.
+type streamLimiter interface {
+	MaxConcurrentStreams() int
+}
+
+// PoolConn is a connection in the pool. Get returns it with a reserved
+// stream - Release must be called when the stream is done.
+type PoolConn struct {
+	Dest    string
+	Conn    MuxConn
+	Created time.Time
+
+	pool     *ConnPool
+	streams  int
+	total    int
+	lastUsed time.Time
+	draining bool
+}
+
+var (
+	poolDials = metrics.NewCounterVec("ugate_pool_dials_total",
+		"Connections dialed by the client pool.", "result")
+	poolEvictions = metrics.NewCounterVec("ugate_pool_evictions_total",
+		"Connections removed from the client pool.", "reason")
+	poolStreams = metrics.NewCounter("ugate_pool_streams_total",
+		"Streams started on pooled connections.")
+)
+
+// DefaultConnPool is set when a pool is provisioned. Used by H2Dialers
+// without Pool or HttpClient.
+var DefaultConnPool *ConnPool
+
+func NewConnPool() *ConnPool {
+	cp := &ConnPool{}
+	cp.init()
+	return cp
+}
+
+func (p *ConnPool) init() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.conns != nil {
+		return
+	}
+	if p.MaxStreams == 0 {
+		p.MaxStreams = 100
+	}
+	if p.PingInterval == 0 {
+		p.PingInterval = 30 * time.Second
+	}
+	if p.PingTimeout == 0 {
+		p.PingTimeout = 5 * time.Second
+	}
+	if p.IdleTimeout == 0 {
+		p.IdleTimeout = 5 * time.Minute
+	}
+	if p.Dial == nil {
+		p.Dial = MeshH2ConnDialer()
+	}
+	p.conns = map[string][]*PoolConn{}
+	p.dialing = map[string]chan struct{}{}
+	p.released = make(chan struct{})
+}
+
+func (p *ConnPool) Provision(ctx context.Context) error {
+	p.init()
+	mux := p.Mux
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("/debug/connpool", p.HandleStats)
+	DefaultConnPool = p
+	return nil
+}
+
+// Start runs the health checks until ctx is done.
+func (p *ConnPool) Start(ctx context.Context) error {
+	p.init()
+	go func() {
+		t := time.NewTicker(p.PingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				p.Close()
+				return
+			case <-t.C:
+				p.CheckHealth(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// Get returns a connection to dest with a reserved stream, dialing a new
+// one if all are full.
+func (p *ConnPool) Get(ctx context.Context, dest string) (*PoolConn, error) {
+	p.init()
+	if p.Dial == nil {
+		return nil, errors.New("connection pool without Dial")
+	}
+	for {
+		p.m.Lock()
+		pc, active := p.pick(dest)
+		if pc != nil {
+			p.m.Unlock()
+			return pc, nil
+		}
+		var wait chan struct{}
+		if ch, ok := p.dialing[dest]; ok {
+			wait = ch
+		} else if p.MaxConns > 0 && active >= p.MaxConns {
+			wait = p.released
+		}
+		if wait != nil {
+			p.m.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		ch := make(chan struct{})
+		p.dialing[dest] = ch
+		p.m.Unlock()
+
+		mc, err := p.Dial(ctx, dest)
+
+		p.m.Lock()
+		delete(p.dialing, dest)
+		close(ch)
+		if err != nil {
+			p.m.Unlock()
+			poolDials.With("error").Inc()
+			return nil, err
+		}
+		poolDials.With("ok").Inc()
+		pc = &PoolConn{Dest: dest, Conn: mc, Created: time.Now(), pool: p}
+		p.conns[dest] = append(p.conns[dest], pc)
+		p.reserve(pc)
+		p.m.Unlock()
+		return pc, nil
+	}
+}
+
+// pick returns the least loaded connection with a free stream, and the
+// number of connections that are not draining. Called with the lock held.
+func (p *ConnPool) pick(dest string) (*PoolConn, int) {
+	var best *PoolConn
+	active := 0
+	for _, pc := range p.conns[dest] {
+		if !pc.draining && !pc.Conn.Available() {
+			p.drain(pc, "goaway")
+		}
+		if pc.draining {
+			continue
+		}
+		active++
+		if pc.streams >= p.maxStreams(pc) {
+			continue
+		}
+		if best == nil || pc.streams < best.streams {
+			best = pc
+		}
+	}
+	if best != nil {
+		p.reserve(best)
+	}
+	return best, active
+}
+
+func (p *ConnPool) maxStreams(pc *PoolConn) int {
+	if sl, ok := pc.Conn.(streamLimiter); ok {
+		if n := sl.MaxConcurrentStreams(); n > 0 && n < p.MaxStreams {
+			return n
+		}
+	}
+	return p.MaxStreams
+}
+
+func (p *ConnPool) reserve(pc *PoolConn) {
+	pc.streams++
+	pc.total++
+	pc.lastUsed = time.Now()
+	poolStreams.Inc()
+}
+
+// drain stops new streams on the connection, and closes it if there are
+// none. Called with the lock held.
+func (p *ConnPool) drain(pc *PoolConn, reason string) {
+	if !pc.draining {
+		pc.draining = true
+		poolEvictions.With(reason).Inc()
+		slog.Info("connpool-evict", "dest", pc.Dest, "reason", reason, "streams", pc.streams)
+	}
+	if pc.streams == 0 {
+		p.remove(pc)
+	}
+}
+
+// remove closes the connection and removes it from the pool. Called with
+// the lock held.
+func (p *ConnPool) remove(pc *PoolConn) {
+	cl := p.conns[pc.Dest]
+	for i, c := range cl {
+		if c == pc {
+			cl = append(cl[:i:i], cl[i+1:]...)
+			break
+		}
+	}
+	if len(cl) == 0 {
+		delete(p.conns, pc.Dest)
+	} else {
+		p.conns[pc.Dest] = cl
+	}
+	go pc.Conn.Close()
+	p.broadcast()
+}
+
+func (p *ConnPool) broadcast() {
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+// Release returns the stream slot to the pool.
+func (pc *PoolConn) Release() {
+	p := pc.pool
+	p.m.Lock()
+	defer p.m.Unlock()
+	pc.streams--
+	pc.lastUsed = time.Now()
+	if pc.draining && pc.streams == 0 {
+		p.remove(pc)
+		return
+	}
+	p.broadcast()
+}
+
+// GoAway marks the connection as draining - used when the caller detects a
+// GOAWAY that the MuxConn doesn't report.
+func (pc *PoolConn) GoAway() {
+	p := pc.pool
+	p.m.Lock()
+	p.drain(pc, "goaway")
+	p.m.Unlock()
+}
+
+// CheckHealth pings all connections, evicting the ones that fail, and
+// closes the idle ones.
+func (p *ConnPool) CheckHealth(ctx context.Context) {
+	p.init()
+	now := time.Now()
+	var ping []*PoolConn
+	p.m.Lock()
+	for _, cl := range p.conns {
+		for _, pc := range cl {
+			switch {
+			case pc.draining:
+			case !pc.Conn.Available():
+				p.drain(pc, "goaway")
+			case pc.streams == 0 && now.Sub(pc.lastUsed) > p.IdleTimeout:
+				p.drain(pc, "idle")
+			default:
+				ping = append(ping, pc)
+			}
+		}
+	}
+	p.m.Unlock()
+
+	wg := sync.WaitGroup{}
+	for _, pc := range ping {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pctx, cf := context.WithTimeout(ctx, p.PingTimeout)
+			err := pc.Conn.Ping(pctx)
+			cf()
+			if err == nil {
+				return
+			}
+			p.m.Lock()
+			// Active streams are likely broken too - remove right away.
+			if !pc.draining {
+				poolEvictions.With("ping").Inc()
+				slog.Info("connpool-evict", "dest", pc.Dest, "reason", "ping", "err", err)
+			}
+			pc.draining = true
+			if p.contains(pc) {
+				p.remove(pc)
+			}
+			p.m.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *ConnPool) contains(pc *PoolConn) bool {
+	for _, c := range p.conns[pc.Dest] {
+		if c == pc {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes all connections.
+func (p *ConnPool) Close() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for _, cl := range p.conns {
+		for _, pc := range cl {
+			pc.draining = true
+			go pc.Conn.Close()
+		}
+	}
+	p.conns = map[string][]*PoolConn{}
+	p.broadcast()
+	return nil
+}
+
+// PoolStats has the connections for a destination.
+type PoolStats struct {
+	Dest  string
+	Conns []*PoolConnStats
+}
+
+// PoolConnStats is the state of a pooled connection.
+type PoolConnStats struct {
+	Created    time.Time
+	LastUsed   time.Time
+	Streams    int
+	MaxStreams int
+	Total      int
+	Draining   bool `json:",omitempty"`
+}
+
+// Stats returns the pooled connections, sorted by destination.
+func (p *ConnPool) Stats() []*PoolStats {
+	p.init()
+	p.m.Lock()
+	defer p.m.Unlock()
+	res := []*PoolStats{}
+	for dest, cl := range p.conns {
+		ps := &PoolStats{Dest: dest}
+		for _, pc := range cl {
+			ps.Conns = append(ps.Conns, &PoolConnStats{Created: pc.Created, LastUsed: pc.lastUsed,
+				Streams: pc.streams, MaxStreams: p.maxStreams(pc), Total: pc.total, Draining: pc.draining})
+		}
+		res = append(res, ps)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Dest < res[j].Dest })
+	return res
+}
+
+// HandleStats returns the pool stats as JSON.
+//
+// curl localhost:15000/debug/connpool
+func (p *ConnPool) HandleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(p.Stats())
+}
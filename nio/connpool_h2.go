@@ -0,0 +1,75 @@
+package nio
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"golang.org/x/net/http2"
+)
+
+// H2Conn adapts a http2.ClientConn to MuxConn. It is also a RoundTripper,
+// for the streams.
+type H2Conn struct {
+	*http2.ClientConn
+}
+
+// Available returns false after GOAWAY or if the connection is closed.
+func (c *H2Conn) Available() bool {
+	return c.CanTakeNewRequest()
+}
+
+// MaxConcurrentStreams returns the limit from the server SETTINGS.
+func (c *H2Conn) MaxConcurrentStreams() int {
+	return int(c.State().MaxConcurrentStreams)
+}
+
+// H2ConnDialer returns a ConnPool.Dial function creating H2 connections.
+//
+// The dest is dialed using d, or the mesh dialer if nil. If tlsConfig is nil
+// h2c with prior knowledge is used.
+func H2ConnDialer(d ContextDialer, tlsConfig *tls.Config) func(ctx context.Context, dest string) (MuxConn, error) {
+	if tlsConfig == nil {
+		return h2ConnDialer(d, nil)
+	}
+	return h2ConnDialer(d, func(host string) *tls.Config {
+		cfg := tlsConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+		return cfg
+	})
+}
+
+// MeshH2ConnDialer returns a ConnPool.Dial function creating H2 connections
+// with the mesh dialer and certificates. Used if the pool has no Dial.
+func MeshH2ConnDialer() func(ctx context.Context, dest string) (MuxConn, error) {
+	return h2ConnDialer(nil, ClientTLSConfig)
+}
+
+func h2ConnDialer(d ContextDialer, tlsConfig func(host string) *tls.Config) func(ctx context.Context, dest string) (MuxConn, error) {
+	t := &http2.Transport{}
+	return func(ctx context.Context, dest string) (MuxConn, error) {
+		nc, err := Dialer(d).DialContext(ctx, "tcp", dest)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig != nil {
+			host, _, _ := net.SplitHostPort(dest)
+			cfg := tlsConfig(host)
+			cfg.NextProtos = []string{"h2"}
+			tc := tls.Client(nc, cfg)
+			if err := tc.HandshakeContext(ctx); err != nil {
+				nc.Close()
+				return nil, err
+			}
+			nc = tc
+		}
+		cc, err := t.NewClientConn(nc)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		return &H2Conn{ClientConn: cc}, nil
+	}
+}
@@ -0,0 +1,207 @@
+package nio
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeMuxConn struct {
+	goaway  atomic.Bool
+	closed  atomic.Bool
+	pingErr atomic.Bool
+	max     int
+}
+
+func (c *fakeMuxConn) Ping(ctx context.Context) error {
+	if c.pingErr.Load() {
+		return errors.New("ping")
+	}
+	return nil
+}
+func (c *fakeMuxConn) Available() bool           { return !c.goaway.Load() && !c.closed.Load() }
+func (c *fakeMuxConn) Close() error              { c.closed.Store(true); return nil }
+func (c *fakeMuxConn) MaxConcurrentStreams() int { return c.max }
+
+func TestConnPool(t *testing.T) {
+	ctx := context.Background()
+	var dialed []*fakeMuxConn
+	p := &ConnPool{MaxStreams: 2, Dial: func(ctx context.Context, dest string) (MuxConn, error) {
+		c := &fakeMuxConn{}
+		if dest == "peer-limit" {
+			c.max = 1
+		}
+		dialed = append(dialed, c)
+		return c, nil
+	}}
+	get := func(dest string) *PoolConn {
+		pc, err := p.Get(ctx, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pc
+	}
+
+	t.Run("maxstreams", func(t *testing.T) {
+		s1, s2, s3 := get("a"), get("a"), get("a")
+		if s1.Conn != s2.Conn || s3.Conn == s1.Conn || len(dialed) != 2 {
+			t.Fatal("Expected 2 streams per connection", len(dialed))
+		}
+		s1.Release()
+		if get("a").Conn != s1.Conn {
+			t.Fatal("Expected reuse of the released slot")
+		}
+		if get("peer-limit").Conn == get("peer-limit").Conn {
+			t.Fatal("Expected the peer limit to be used")
+		}
+		st := p.Stats()
+		if len(st) != 2 || st[0].Dest != "a" || len(st[0].Conns) != 2 || st[0].Conns[0].Streams != 2 {
+			t.Fatal("Unexpected stats", st)
+		}
+		s2.Release()
+		s3.Release()
+	})
+
+	t.Run("goaway", func(t *testing.T) {
+		s := get("b")
+		c := s.Conn.(*fakeMuxConn)
+		c.goaway.Store(true)
+		s2 := get("b")
+		if s2.Conn == s.Conn {
+			t.Fatal("Expected new connection after GOAWAY")
+		}
+		if c.closed.Load() {
+			t.Fatal("Draining connection closed with active streams")
+		}
+		s.Release()
+		time.Sleep(10 * time.Millisecond)
+		if !c.closed.Load() {
+			t.Fatal("Drained connection not closed")
+		}
+		s2.Release()
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		s := get("c")
+		s.Release()
+		s.Conn.(*fakeMuxConn).pingErr.Store(true)
+		p.CheckHealth(ctx)
+		if get("c").Conn == s.Conn {
+			t.Fatal("Expected eviction after ping failure")
+		}
+	})
+
+	t.Run("maxconns", func(t *testing.T) {
+		p := &ConnPool{MaxStreams: 1, MaxConns: 1, Dial: p.Dial}
+		s, _ := p.Get(ctx, "d")
+		got := make(chan *PoolConn)
+		go func() {
+			s2, _ := p.Get(ctx, "d")
+			got <- s2
+		}()
+		select {
+		case <-got:
+			t.Fatal("Expected Get to wait")
+		case <-time.After(20 * time.Millisecond):
+		}
+		s.Release()
+		if s2 := <-got; s2.Conn != s.Conn {
+			t.Fatal("Expected the released connection")
+		}
+		tctx, cf := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cf()
+		if _, err := p.Get(tctx, "d"); err != context.DeadlineExceeded {
+			t.Fatal("Expected timeout", err)
+		}
+	})
+}
+
+func TestConnPoolH2(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ConnectOverrideHeader) != "10.0.0.1:80" {
+			w.WriteHeader(400)
+			return
+		}
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		io.Copy(w, r.Body)
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The pool dials with the mesh certificates, and is the default for
+	// H2Dialers.
+	oldTLS, oldPool := DefaultTLS, DefaultConnPool
+	DefaultTLS = testMeshTLS{}
+	defer func() { DefaultTLS, DefaultConnPool = oldTLS, oldPool }()
+	p := &ConnPool{Mux: http.NewServeMux()}
+	p.Provision(context.Background())
+	defer p.Close()
+	hd := &H2Dialer{H2TunURL: srv.URL + "/tun"}
+
+	for i := 0; i < 3; i++ {
+		c, err := hd.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("hello"))
+		c.(*StreamHttpClient).CloseWrite()
+		b, _ := io.ReadAll(c)
+		if string(b) != "hello" {
+			t.Fatal("Unexpected response", string(b))
+		}
+		c.Close()
+	}
+	if conns.Load() != 1 {
+		t.Fatal("Expected one connection", conns.Load())
+	}
+
+	// http URLs don't use the default pool, which dials with TLS.
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).EnableFullDuplex()
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer plain.Close()
+	hd = &H2Dialer{H2TunURL: plain.URL + "/tun"}
+	c, err := hd.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hello"))
+	c.(*StreamHttpClient).CloseWrite()
+	if b, _ := io.ReadAll(c); string(b) != "hello" {
+		t.Fatal("Unexpected h2c response", string(b))
+	}
+	c.Close()
+
+	st := p.Stats()
+	if len(st) != 1 || st[0].Conns[0].Total != 3 || st[0].Conns[0].Streams != 0 {
+		t.Fatal("Unexpected stats", st[0].Conns[0])
+	}
+	p.CheckHealth(context.Background())
+	if len(p.Stats()) != 1 {
+		t.Fatal("Healthy connection evicted")
+	}
+}
+
+type testMeshTLS struct{}
+
+func (testMeshTLS) ServerConfig() *tls.Config { return &tls.Config{} }
+
+func (testMeshTLS) ClientConfig(sni string) *tls.Config {
+	return &tls.Config{ServerName: sni, InsecureSkipVerify: true}
+}
@@ -0,0 +1,316 @@
+package nio
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Happy eyeballs (RFC 8305) dialing across all addresses and transports
+// known for a destination.
+//
+// Roaming laptops and phones often have one dead path - IPv6 without
+// routing, UDP blocked, a stale address. Dialing them in sequence waits for
+// each timeout; racing all at once wastes connections. Like RFC 8305, the
+// attempts are started in order, one every Delay, or right away when the
+// previous one fails. The first connection wins, the others are canceled.
+//
+// The winning target is remembered per destination and tried first next
+// time.
+//
+// Only "tcp" targets have a built-in dialer - the addresses of a
+// destination are raced, with TLS. Other transports (QUIC, SSH, WebRTC) are
+// raced only if a module sets their entry in Dialers; none of the modules in
+// this repo does yet.
+
+// DialTarget is one way to reach a destination.
+type DialTarget struct {
+	// Proto selects the dialer in MultiDialer.Dialers. "tcp" and empty
+	// use a net.Dialer.
+	Proto string `json:"proto,omitempty"`
+
+	// Addr is the host:port, or an address the proto dialer understands.
+	Addr string `json:"addr"`
+}
+
+// MultiDialer races the targets for a destination.
+type MultiDialer struct {
+	// Dialers by Proto. "tcp" and empty default to a net.Dialer. Other
+	// protos are set by the modules providing them - targets without a
+	// dialer fail right away.
+	Dialers map[string]ContextDialer `json:"-"`
+
+	// Delay is the time between attempts - RFC 8305 Connection Attempt
+	// Delay. Default 250ms.
+	Delay time.Duration `json:"delay,omitempty"`
+
+	// Remember is how long the winner is tried first. Default 10 min.
+	Remember time.Duration `json:"remember,omitempty"`
+
+	// Resolver expands host names to addresses, IPv6 and IPv4 interleaved.
+	// Defaults to net.DefaultResolver.
+	Resolver *net.Resolver `json:"-"`
+
+	// Mux is used for the /debug/dialer handler. Defaults to
+	// http.DefaultServeMux.
+	Mux *http.ServeMux `json:"-"`
+
+	m       sync.Mutex
+	winners map[string]*dialWinner
+}
+
+type dialWinner struct {
+	Target DialTarget
+	Time   time.Time
+}
+
+// DefaultMultiDialer is set when a MultiDialer is provisioned.
+var DefaultMultiDialer = &MultiDialer{}
+
+func (d *MultiDialer) Provision(ctx context.Context) error {
+	mux := d.Mux
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("/debug/dialer", d.HandleWinners)
+	DefaultMultiDialer = d
+	return nil
+}
+
+// Winner returns the remembered target for the destination.
+func (d *MultiDialer) Winner(dest string) (DialTarget, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	w, ok := d.winners[dest]
+	if !ok || time.Since(w.Time) > d.remember() {
+		return DialTarget{}, false
+	}
+	return w.Target, true
+}
+
+// Forget removes the remembered target - for example when the connection
+// fails after the dial.
+func (d *MultiDialer) Forget(dest string) {
+	d.m.Lock()
+	delete(d.winners, dest)
+	d.m.Unlock()
+}
+
+func (d *MultiDialer) remember() time.Duration {
+	if d.Remember == 0 {
+		return 10 * time.Minute
+	}
+	return d.Remember
+}
+
+// DialTargets connects to dest using the first target that succeeds. dest
+// is the identity of the destination, used to remember the winner.
+func (d *MultiDialer) DialTargets(ctx context.Context, dest string, targets []DialTarget) (net.Conn, DialTarget, error) {
+	return d.dialTargets(ctx, dest, targets, nil)
+}
+
+// DialTargetsTLS is like DialTargets, with a TLS handshake using cfg on
+// "tcp" targets as part of the attempt - a target failing the handshake
+// loses like a failed dial, and the next one is started. Other protos
+// return secure streams.
+func (d *MultiDialer) DialTargetsTLS(ctx context.Context, dest string, targets []DialTarget, cfg *tls.Config) (net.Conn, DialTarget, error) {
+	return d.dialTargets(ctx, dest, targets, cfg)
+}
+
+func (d *MultiDialer) dialTargets(ctx context.Context, dest string, targets []DialTarget, cfg *tls.Config) (net.Conn, DialTarget, error) {
+	targets = d.order(dest, d.expand(ctx, targets))
+	if len(targets) == 0 {
+		return nil, DialTarget{}, errors.New("no addresses for " + dest)
+	}
+	delay := d.Delay
+	if delay == 0 {
+		delay = 250 * time.Millisecond
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		t   DialTarget
+		err error
+	}
+	// Buffered, so late attempts don't block after the winner.
+	results := make(chan result, len(targets))
+	next := 0
+	pending := 0
+	var errs []error
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if next < len(targets) {
+				t := targets[next]
+				next++
+				pending++
+				go func() {
+					c, err := d.dial(ctx, t, cfg)
+					results <- result{c, t, err}
+				}()
+				timer.Reset(delay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// Close the connections that complete after the winner.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if lr := <-results; lr.c != nil {
+							lr.c.Close()
+						}
+					}
+				}(pending)
+				d.m.Lock()
+				if d.winners == nil {
+					d.winners = map[string]*dialWinner{}
+				}
+				d.winners[dest] = &dialWinner{Target: r.t, Time: time.Now()}
+				d.m.Unlock()
+				return r.c, r.t, nil
+			}
+			errs = append(errs, errors.New(r.t.Proto+" "+r.t.Addr+": "+r.err.Error()))
+			if next < len(targets) {
+				// Start the next attempt right away.
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			} else if pending == 0 {
+				d.Forget(dest)
+				return nil, DialTarget{}, errors.Join(errs...)
+			}
+		case <-ctx.Done():
+			go func(n int) {
+				for ; n > 0; n-- {
+					if lr := <-results; lr.c != nil {
+						lr.c.Close()
+					}
+				}
+			}(pending)
+			return nil, DialTarget{}, ctx.Err()
+		}
+	}
+}
+
+func (d *MultiDialer) dial(ctx context.Context, t DialTarget, cfg *tls.Config) (net.Conn, error) {
+	tcp := t.Proto == "" || t.Proto == "tcp"
+	cd, ok := d.Dialers[t.Proto]
+	if !ok {
+		if !tcp {
+			return nil, errors.New("no dialer for " + t.Proto)
+		}
+		cd = &net.Dialer{}
+	}
+	c, err := cd.DialContext(ctx, "tcp", t.Addr)
+	if err != nil || cfg == nil || !tcp {
+		return c, err
+	}
+	tc := tls.Client(c, cfg.Clone())
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// expand resolves host names to IP addresses, keeping the proto. Targets
+// that don't resolve are kept, the proto dialer may know them.
+func (d *MultiDialer) expand(ctx context.Context, targets []DialTarget) []DialTarget {
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	res := make([]DialTarget, 0, len(targets))
+	seen := map[DialTarget]bool{}
+	add := func(t DialTarget) {
+		if !seen[t] {
+			seen[t] = true
+			res = append(res, t)
+		}
+	}
+	for _, t := range targets {
+		host, port, err := net.SplitHostPort(t.Addr)
+		if err != nil || net.ParseIP(host) != nil {
+			add(t)
+			continue
+		}
+		ips, err := r.LookupIPAddr(ctx, host)
+		if err != nil || len(ips) == 0 {
+			add(t)
+			continue
+		}
+		for _, ip := range ips {
+			add(DialTarget{Proto: t.Proto, Addr: net.JoinHostPort(ip.String(), port)})
+		}
+	}
+	return res
+}
+
+// order puts the remembered winner first, and interleaves the address
+// families - RFC 8305 section 4. The order of the targets is otherwise
+// kept, so callers list the preferred transports first.
+func (d *MultiDialer) order(dest string, targets []DialTarget) []DialTarget {
+	var first []DialTarget
+	if w, ok := d.Winner(dest); ok {
+		for i, t := range targets {
+			if t == w {
+				first = append(first, t)
+				targets = append(targets[:i:i], targets[i+1:]...)
+				break
+			}
+		}
+	}
+
+	var v6, other []DialTarget
+	for _, t := range targets {
+		if host, _, err := net.SplitHostPort(t.Addr); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+				v6 = append(v6, t)
+				continue
+			}
+		}
+		other = append(other, t)
+	}
+	res := first
+	for len(v6) > 0 || len(other) > 0 {
+		if len(v6) > 0 {
+			res = append(res, v6[0])
+			v6 = v6[1:]
+		}
+		if len(other) > 0 {
+			res = append(res, other[0])
+			other = other[1:]
+		}
+	}
+	return res
+}
+
+// HandleWinners returns the remembered targets as JSON.
+//
+// curl localhost:15000/debug/dialer
+func (d *MultiDialer) HandleWinners(w http.ResponseWriter, r *http.Request) {
+	d.m.Lock()
+	res := map[string]*dialWinner{}
+	for k, v := range d.winners {
+		res[k] = v
+	}
+	d.m.Unlock()
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
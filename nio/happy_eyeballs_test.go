@@ -0,0 +1,179 @@
+package nio
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type funcDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f funcDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+func TestMultiDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	live := DialTarget{Proto: "tcp", Addr: l.Addr().String()}
+
+	var canceled atomic.Int32
+	d := &MultiDialer{Delay: 100 * time.Millisecond, Dialers: map[string]ContextDialer{
+		// A dead path - blocks until canceled.
+		"dead": funcDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			canceled.Add(1)
+			return nil, ctx.Err()
+		}),
+		"fail": funcDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		}),
+	}}
+	dead := DialTarget{Proto: "dead", Addr: "[2001:db8::1]:443"}
+
+	t0 := time.Now()
+	c, won, err := d.DialTargets(context.Background(), "node1", []DialTarget{dead, live})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if won != live || time.Since(t0) < d.Delay {
+		t.Fatal("Expected the second attempt after the delay", won, time.Since(t0))
+	}
+	time.Sleep(10 * time.Millisecond)
+	if canceled.Load() != 1 {
+		t.Fatal("Expected the dead attempt to be canceled")
+	}
+	if w, ok := d.Winner("node1"); !ok || w != live {
+		t.Fatal("Winner not remembered", w)
+	}
+
+	// The winner is tried first.
+	t0 = time.Now()
+	c, _, err = d.DialTargets(context.Background(), "node1", []DialTarget{dead, live})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if time.Since(t0) >= d.Delay {
+		t.Fatal("Expected the remembered target first", time.Since(t0))
+	}
+
+	// A failed attempt starts the next one without waiting.
+	t0 = time.Now()
+	c, _, err = d.DialTargets(context.Background(), "node2",
+		[]DialTarget{{Proto: "fail", Addr: "10.0.0.1:443"}, live})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if time.Since(t0) >= d.Delay {
+		t.Fatal("Expected no delay after failure", time.Since(t0))
+	}
+
+	_, _, err = d.DialTargets(context.Background(), "node2",
+		[]DialTarget{{Proto: "fail", Addr: "10.0.0.1:443"}, {Proto: "webrtc", Addr: "peer"}})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if _, ok := d.Winner("node2"); ok {
+		t.Fatal("Expected winner to be forgotten")
+	}
+
+	ctx, cf := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cf()
+	if _, _, err = d.DialTargets(ctx, "node3", []DialTarget{dead}); err != context.DeadlineExceeded {
+		t.Fatal("Expected timeout", err)
+	}
+}
+
+func TestMultiDialerTLS(t *testing.T) {
+	cert := testCert(t)
+	tl, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	// Accepts TCP but not TLS.
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	for _, l := range []net.Listener{tl, pl} {
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				if tc, ok := c.(*tls.Conn); ok {
+					tc.Handshake()
+				}
+				c.Close()
+			}
+		}()
+	}
+
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	cfg := &tls.Config{ServerName: "test", RootCAs: roots}
+
+	d := &MultiDialer{Delay: time.Second}
+	plain := DialTarget{Proto: "tcp", Addr: pl.Addr().String()}
+	secure := DialTarget{Proto: "tcp", Addr: tl.Addr().String()}
+	t0 := time.Now()
+	c, won, err := d.DialTargetsTLS(context.Background(), "node1", []DialTarget{plain, secure}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if won != secure || time.Since(t0) >= d.Delay {
+		t.Fatal("Expected fallback on handshake failure", won, time.Since(t0))
+	}
+	if _, ok := c.(*tls.Conn); !ok {
+		t.Fatal("Expected TLS conn")
+	}
+
+	if _, _, err := d.DialTargetsTLS(context.Background(), "node2", []DialTarget{plain}, cfg); err == nil {
+		t.Fatal("Expected handshake error")
+	}
+}
+
+func TestMultiDialerOrder(t *testing.T) {
+	d := &MultiDialer{}
+	v4a := DialTarget{Proto: "h2", Addr: "10.0.0.1:443"}
+	v4b := DialTarget{Proto: "quic", Addr: "10.0.0.1:443"}
+	v6a := DialTarget{Proto: "h2", Addr: "[fd00::1]:443"}
+	v6b := DialTarget{Proto: "quic", Addr: "[fd00::1]:443"}
+	rtc := DialTarget{Proto: "webrtc", Addr: "peer-id"}
+
+	got := d.order("n", []DialTarget{v4a, v4b, v6a, v6b, rtc})
+	if !reflect.DeepEqual(got, []DialTarget{v6a, v4a, v6b, v4b, rtc}) {
+		t.Fatal("Unexpected order", got)
+	}
+
+	got = d.expand(context.Background(), []DialTarget{v4a, v4a, {Proto: "h2", Addr: "localhost:443"}, rtc})
+	if len(got) < 3 || got[0] != v4a || got[len(got)-1] != rtc {
+		t.Fatal("Unexpected expand", got)
+	}
+}
@@ -11,7 +11,13 @@ import (
 
 // Helpers for HTTP proxy.
 // The SSH mesh can proxy HTTP 1 and 2 requests over SSH
-
+//
+// Besides plain request/response, the helpers handle:
+// - HTTP/1.1 upgrades (WebSocket) - the Upgrade header is kept, and
+// SendBackResponse hijacks the client connection on 101.
+// - gRPC - TE: trailers is kept, request and response trailers are
+// forwarded, and HTTP/1.1 handlers are full duplex.
+// - SSE and other streaming responses - flushed after each read.
 
 // CreateUpstremRequest shallow-copies r into a new request
 // that can be sent upstream.
@@ -39,6 +45,17 @@ func CreateUpstreamRequest(rw http.ResponseWriter, r *http.Request) *http.Reques
 	// URL, Form, TransferEncoding, Header, Trailer, URL
 	outreq := r.Clone(ctx)
 
+	// The request trailers are set by the server after the body is read -
+	// share the map, so the transport sends them.
+	outreq.Trailer = r.Trailer
+
+	if rw != nil {
+		// Bidirectional streams (gRPC) on HTTP/1.1 - the response is sent
+		// while the request body is read. Fails for HTTP/2, which is always
+		// full duplex.
+		http.NewResponseController(rw).EnableFullDuplex()
+	}
+
 	// We should set body to nil explicitly if request body is empty.
 	// For DmDns requests the Request Body is always non-nil.
 	if r.ContentLength == 0 {
@@ -92,9 +109,41 @@ func CreateUpstreamRequest(rw http.ResponseWriter, r *http.Request) *http.Reques
 		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
 
+	// Hop-by-hop, but needed end to end: the upgrade is handled by
+	// SendBackResponse, and gRPC servers require TE: trailers.
+	if up := upgradeType(r.Header); up != "" {
+		outreq.Header.Set("Connection", "Upgrade")
+		outreq.Header.Set("Upgrade", up)
+	}
+	if headerHasToken(r.Header, "Te", "trailers") {
+		outreq.Header.Set("Te", "trailers")
+	}
+
 	return outreq
 }
 
+// upgradeType returns the protocol in the Upgrade header, if Connection has
+// the upgrade token.
+func upgradeType(h http.Header) string {
+	if !headerHasToken(h, "Connection", "upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// headerHasToken checks the comma separated values of the header for the
+// token, case insensitive.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Hop-by-hop headers. These are removed when sent to the backend in createUpstreamRequest
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
 var hopHeaders = []string{
@@ -158,7 +207,8 @@ var skipHeaders = map[string]struct{}{
 
 
 // Used by both ForwardHTTP and ForwardMesh, after RoundTrip is done.
-// Will copy response headers and body
+// Will copy response headers and body, and the trailers.
+// A 101 response switches the client connection to the upgraded protocol.
 func SendBackResponse(w http.ResponseWriter, r *http.Request,
 		res *http.Response, err error) {
 
@@ -174,18 +224,115 @@ func SendBackResponse(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		sendBackUpgrade(w, r, res)
+		return
+	}
+
 	origBody := res.Body
 	defer origBody.Close()
 
 	CopyResponseHeaders(w.Header(), res.Header)
+
+	// Announce the trailers - the values are known after the body is read.
+	announced := len(res.Trailer)
+	if announced > 0 {
+		keys := make([]string, 0, announced)
+		for k := range res.Trailer {
+			keys = append(keys, k)
+		}
+		w.Header().Add("Trailer", strings.Join(keys, ", "))
+	}
+
 	w.WriteHeader(res.StatusCode)
 
+	fw := &flushWriter{w: w, rc: http.NewResponseController(w)}
+	if res.ContentLength == -1 {
+		// Streaming response - SSE, gRPC. Send the headers right away.
+		fw.Flush()
+	}
+
 	s1 := &ReaderCopier{
-		Out: w,
+		Out: fw,
 		In:  res.Body,
 	}
 	s1.Copy(nil, false)
 
+	if len(res.Trailer) == announced {
+		for k, vv := range res.Trailer {
+			w.Header()[k] = vv
+		}
+	} else {
+		// Trailers not announced in the response headers.
+		for k, vv := range res.Trailer {
+			for _, v := range vv {
+				w.Header().Add(http.TrailerPrefix+k, v)
+			}
+		}
+	}
+
 	log.Println("Done: ", r.URL, res.StatusCode, s1.Written, s1.Err)
 }
 
+// flushWriter flushes after each write, also for ResponseWriters wrapped by
+// middleware that don't implement Flusher.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	return fw.w.Write(b)
+}
+
+func (fw *flushWriter) Flush() {
+	fw.rc.Flush()
+}
+
+// sendBackUpgrade sends the 101 response on the hijacked client connection,
+// and copies in both directions until one side is closed.
+func sendBackUpgrade(w http.ResponseWriter, r *http.Request, res *http.Response) {
+	backConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		res.Body.Close()
+		http.Error(w, "upgrade response body not writable", http.StatusBadGateway)
+		return
+	}
+	defer backConn.Close()
+
+	reqUp := upgradeType(r.Header)
+	resUp := upgradeType(res.Header)
+	if !strings.EqualFold(reqUp, resUp) {
+		http.Error(w, "backend switched to unexpected protocol "+resUp, http.StatusBadGateway)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "upgrade not supported: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	res.Body = nil // only write the headers
+	if err := res.Write(brw); err != nil {
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	// The bufio.Reader may have data sent by the client after the request.
+	s1 := &ReaderCopier{Out: backConn, In: brw.Reader}
+	s2 := &ReaderCopier{Out: conn, In: backConn}
+	ch := make(chan int, 2)
+	go s1.Copy(ch, false)
+	go s2.Copy(ch, false)
+	<-ch
+	// One side is done - closing ends the other.
+	conn.Close()
+	backConn.Close()
+	<-ch
+
+	log.Println("Upgrade done: ", r.URL, resUp, s1.Written, s2.Written)
+}
@@ -0,0 +1,191 @@
+package nio
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// frontend forwards all requests to the backend using the helpers.
+func frontend(t *testing.T, backend *httptest.Server, rt http.RoundTripper) *httptest.Server {
+	bu, _ := url.Parse(backend.URL)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outreq := CreateUpstreamRequest(w, r)
+		outreq.URL.Scheme = bu.Scheme
+		outreq.URL.Host = bu.Host
+		outreq.Host = bu.Host
+		outreq.RequestURI = ""
+		res, err := rt.RoundTrip(outreq)
+		SendBackResponse(w, r, res, err)
+	}))
+}
+
+func TestHTTPProxyUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) != "websocket" {
+			http.Error(w, "expected upgrade", 400)
+			return
+		}
+		c, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		brw.Flush()
+		// Echo lines
+		for {
+			l, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString("echo " + l)
+			brw.Flush()
+		}
+	}))
+	defer backend.Close()
+	fe := frontend(t, backend, http.DefaultTransport)
+	defer fe.Close()
+
+	c, err := net.Dial("tcp", fe.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("GET /ws HTTP/1.1\r\nHost: test\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 101 || res.Header.Get("Upgrade") != "websocket" {
+		t.Fatal("Unexpected response", res.Status, res.Header)
+	}
+	for _, m := range []string{"hello\n", "world\n"} {
+		c.Write([]byte(m))
+		l, err := br.ReadString('\n')
+		if err != nil || l != "echo "+m {
+			t.Fatal("Unexpected echo", l, err)
+		}
+	}
+
+	// Mismatched protocol
+	backend.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", "other")
+		w.WriteHeader(101)
+	})
+	req, _ := http.NewRequest("GET", fe.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatal("Expected 502", res.StatusCode)
+	}
+}
+
+func TestHTTPProxyGRPCStream(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Te") != "trailers" {
+			http.Error(w, "missing te", 400)
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		// Echo each message as it is received - the client waits for the
+		// echo before sending the next.
+		br := bufio.NewReader(r.Body)
+		for {
+			l, err := br.ReadString('\n')
+			if err != nil {
+				break
+			}
+			w.Write([]byte("echo " + l))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", r.Trailer.Get("X-Client-Done"))
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	rt := &http.Transport{ForceAttemptHTTP2: true,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer rt.CloseIdleConnections()
+	fe := frontend(t, backend, rt)
+	defer fe.Close()
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", fe.URL+"/svc/Method", pr)
+	req.Header.Set("Te", "trailers")
+	req.Trailer = http.Header{"X-Client-Done": nil}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatal("Unexpected status", res.Status)
+	}
+	br := bufio.NewReader(res.Body)
+	for _, m := range []string{"one\n", "two\n"} {
+		pw.Write([]byte(m))
+		l, err := br.ReadString('\n')
+		if err != nil || l != "echo "+m {
+			t.Fatal("Unexpected echo", l, err)
+		}
+	}
+	req.Trailer.Set("X-Client-Done", "bye")
+	pw.Close()
+	if _, err := io.ReadAll(br); err != nil {
+		t.Fatal(err)
+	}
+	if res.Trailer.Get("Grpc-Status") != "0" || res.Trailer.Get("Grpc-Message") != "bye" {
+		t.Fatal("Unexpected trailers", res.Trailer)
+	}
+}
+
+func TestHTTPProxySSE(t *testing.T) {
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 2; i++ {
+			w.Write([]byte("data: event\n\n"))
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	defer backend.Close()
+	fe := frontend(t, backend, http.DefaultTransport)
+	defer fe.Close()
+
+	res, err := http.Get(fe.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	br := bufio.NewReader(res.Body)
+	for i := 0; i < 2; i++ {
+		l, err := br.ReadString('\n')
+		if err != nil || !strings.HasPrefix(l, "data: event") {
+			t.Fatal("Unexpected event", l, err)
+		}
+		br.ReadString('\n')
+		next <- struct{}{}
+	}
+}
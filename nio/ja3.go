@@ -0,0 +1,156 @@
+package nio
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TLS client fingerprints, computed from the ClientHello.
+//
+// JA3: https://github.com/salesforce/ja3 - MD5 of version, ciphers,
+// extensions, groups and point formats, in client order. Browsers now
+// randomize the extension order, making JA3 less stable.
+//
+// JA4: https://github.com/FoxIO-LLC/ja4 - readable prefix with protocol,
+// version, SNI, counts and ALPN, plus truncated SHA256 of the sorted ciphers
+// and extensions.
+//
+// GREASE values (RFC 8701) are ignored in both.
+
+// isGREASE returns true for the reserved 0x?a?a values.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func joinUint16(vals []uint16, sep string, format func(uint16) string) string {
+	sb := strings.Builder{}
+	for _, v := range vals {
+		if isGREASE(v) {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString(sep)
+		}
+		sb.WriteString(format(v))
+	}
+	return sb.String()
+}
+
+func decimal(v uint16) string {
+	return strconv.Itoa(int(v))
+}
+
+func hex4(v uint16) string {
+	return fmt.Sprintf("%04x", v)
+}
+
+// JA3String returns the un-hashed JA3 string:
+// SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+func (m *ClientHelloMsg) JA3String() string {
+	points := make([]string, len(m.SupportedPoints))
+	for i, p := range m.SupportedPoints {
+		points[i] = strconv.Itoa(int(p))
+	}
+	return strconv.Itoa(int(m.vers)) + "," +
+		joinUint16(m.CipherSuites, "-", decimal) + "," +
+		joinUint16(m.Extensions, "-", decimal) + "," +
+		joinUint16(m.SupportedGroups, "-", decimal) + "," +
+		strings.Join(points, "-")
+}
+
+// JA3 returns the MD5 hex of the JA3 string.
+func (m *ClientHelloMsg) JA3() string {
+	h := md5.Sum([]byte(m.JA3String()))
+	return hex.EncodeToString(h[:])
+}
+
+// JA4 returns the JA4 fingerprint for a TCP ClientHello, for example
+// t13d1516h2_8daaf6152771_e5627efa2ab1.
+func (m *ClientHelloMsg) JA4() string {
+	sb := strings.Builder{}
+	sb.WriteByte('t')
+
+	switch m.Version() {
+	case 0x0304:
+		sb.WriteString("13")
+	case 0x0303:
+		sb.WriteString("12")
+	case 0x0302:
+		sb.WriteString("11")
+	case 0x0301:
+		sb.WriteString("10")
+	case 0x0300:
+		sb.WriteString("s3")
+	default:
+		sb.WriteString("00")
+	}
+
+	if m.ServerName != "" {
+		sb.WriteByte('d')
+	} else {
+		sb.WriteByte('i')
+	}
+
+	var ciphers, exts []uint16
+	for _, c := range m.CipherSuites {
+		if !isGREASE(c) {
+			ciphers = append(ciphers, c)
+		}
+	}
+	for _, e := range m.Extensions {
+		if !isGREASE(e) {
+			exts = append(exts, e)
+		}
+	}
+	fmt.Fprintf(&sb, "%02d%02d", min(len(ciphers), 99), min(len(exts), 99))
+	sb.WriteString(ja4ALPN(m.AlpnProtocols))
+
+	sb.WriteByte('_')
+	slices.Sort(ciphers)
+	sb.WriteString(ja4Hash(joinUint16(ciphers, ",", hex4)))
+
+	// SNI and ALPN are not included in the hash - already in the prefix.
+	sorted := slices.DeleteFunc(slices.Clone(exts), func(e uint16) bool {
+		return e == extensionServerName || e == extensionALPN
+	})
+	slices.Sort(sorted)
+	es := joinUint16(sorted, ",", hex4)
+	if len(m.SignatureAlgorithms) > 0 && es != "" {
+		es += "_" + joinUint16(m.SignatureAlgorithms, ",", hex4)
+	}
+	sb.WriteByte('_')
+	sb.WriteString(ja4Hash(es))
+
+	return sb.String()
+}
+
+// ja4ALPN returns the first and last char of the first ALPN, "00" if none.
+// Non-alphanumeric values use the hex of the first and last byte.
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	a := alpn[0]
+	f, l := a[0], a[len(a)-1]
+	if isAlnum(f) && isAlnum(l) {
+		return string([]byte{f, l})
+	}
+	return hex.EncodeToString([]byte{f})[0:1] + hex.EncodeToString([]byte{l})[1:2]
+}
+
+func isAlnum(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])[0:12]
+}
@@ -0,0 +1,256 @@
+package nio
+
+import (
+	"bytes"
+	"context"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	nsys "github.com/costinm/ugate/nio/syscall"
+)
+
+// Kernel TLS for terminated TLS streams.
+//
+// The handshake is done by crypto/tls, the TLS 1.3 traffic secrets are
+// captured with KeyLogWriter and installed on the socket. The result is a
+// KTLSConn - a TCPConn with plaintext Read and Write, which can be spliced to
+// a plain TCP connection.
+//
+// Limitations:
+// - TLS 1.3 only, with AES-GCM or ChaCha20 ciphers.
+// - Session tickets are disabled - the kernel must start with sequence 0.
+// - KeyUpdate from the client fails the stream.
+// - close_notify is not sent on Close.
+//
+// In all other cases the *tls.Conn is returned.
+
+// KTLSConn is a TCP connection with kTLS keys installed.
+type KTLSConn struct {
+	*net.TCPConn
+
+	state tls.ConnectionState
+}
+
+// ConnectionState returns the state of the handshake done in user space.
+func (c *KTLSConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+// Read returns io.EOF if the client sent close_notify. Other alerts and
+// post-handshake messages are errors.
+func (c *KTLSConn) Read(b []byte) (int, error) {
+	n, err := c.TCPConn.Read(b)
+	if err != nil {
+		err = c.readErr(err)
+	}
+	return n, err
+}
+
+// readErr checks EIO returned by the kernel for non-data records.
+func (c *KTLSConn) readErr(err error) error {
+	if !errors.Is(err, syscall.EIO) {
+		return err
+	}
+	buf := make([]byte, 64)
+	typ, n, rerr := nsys.ReadKTLSRecord(c.TCPConn, buf)
+	if rerr != nil {
+		return rerr
+	}
+	// Alert: level, description. 0 is close_notify.
+	if typ == 21 && n >= 2 && buf[1] == 0 {
+		return io.EOF
+	}
+	return err
+}
+
+// ktlsRecordReader returns at most one TLS record for each Read, so
+// crypto/tls doesn't buffer data past the handshake.
+type ktlsRecordReader struct {
+	net.Conn
+
+	hdr  [5]byte
+	hdrN int
+	left int
+	done bool
+}
+
+func (r *ktlsRecordReader) Read(b []byte) (int, error) {
+	if r.done {
+		return r.Conn.Read(b)
+	}
+	if r.left == 0 {
+		if len(b) > 5-r.hdrN {
+			b = b[:5-r.hdrN]
+		}
+		n, err := r.Conn.Read(b)
+		copy(r.hdr[r.hdrN:], b[:n])
+		r.hdrN += n
+		if r.hdrN == 5 {
+			r.left = int(r.hdr[3])<<8 | int(r.hdr[4])
+			r.hdrN = 0
+		}
+		return n, err
+	}
+	if len(b) > r.left {
+		b = b[:r.left]
+	}
+	n, err := r.Conn.Read(b)
+	r.left -= n
+	return n, err
+}
+
+// ktlsKeyLog captures the TLS 1.3 application traffic secrets.
+type ktlsKeyLog struct {
+	m      sync.Mutex
+	client []byte
+	server []byte
+}
+
+func (kl *ktlsKeyLog) Write(b []byte) (int, error) {
+	f := bytes.Fields(b)
+	if len(f) != 3 {
+		return len(b), nil
+	}
+	secret, err := hex.DecodeString(string(f[2]))
+	if err != nil {
+		return len(b), nil
+	}
+	kl.m.Lock()
+	switch string(f[0]) {
+	case "CLIENT_TRAFFIC_SECRET_0":
+		kl.client = secret
+	case "SERVER_TRAFFIC_SECRET_0":
+		kl.server = secret
+	}
+	kl.m.Unlock()
+	return len(b), nil
+}
+
+// ktlsConfig returns a copy of the config capturing the secrets.
+func ktlsConfig(config *tls.Config, kl *ktlsKeyLog) *tls.Config {
+	c := config.Clone()
+	c.KeyLogWriter = kl
+	c.SessionTicketsDisabled = true
+	if gc := config.GetConfigForClient; gc != nil {
+		c.GetConfigForClient = func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			cc, err := gc(chi)
+			if cc == nil || err != nil {
+				return cc, err
+			}
+			return ktlsConfig(cc, kl), nil
+		}
+	}
+	return c
+}
+
+// KTLSServer does the server handshake on conn, and enables kTLS if the
+// kernel and negotiated parameters support it. Returns a *KTLSConn or the
+// *tls.Conn.
+//
+// conn must be a *net.TCPConn for kTLS, or a StreamConn or BufferedConn
+// wrapping one - for example with the sniffed ClientHello buffered. Other
+// conns return the *tls.Conn.
+func KTLSServer(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error) {
+	tcp := ktlsTCPConn(conn)
+	if tcp == nil {
+		tc := tls.Server(conn, config)
+		return tc, tc.HandshakeContext(ctx)
+	}
+
+	// The handshake reads through the wrappers, so the buffered ClientHello
+	// is used. The client doesn't send more before the server flight, so
+	// the buffer is empty when the keys are installed.
+	kl := &ktlsKeyLog{}
+	rr := &ktlsRecordReader{Conn: conn}
+	tc := tls.Server(rr, ktlsConfig(config, kl))
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	rr.done = true
+
+	cs := tc.ConnectionState()
+	kl.m.Lock()
+	client, server := kl.client, kl.server
+	kl.m.Unlock()
+	if cs.Version != tls.VersionTLS13 || client == nil || server == nil {
+		return tc, nil
+	}
+
+	rx, err := ktlsKeys(cs.CipherSuite, client)
+	if err != nil {
+		return tc, nil
+	}
+	tx, err := ktlsKeys(cs.CipherSuite, server)
+	if err != nil {
+		return tc, nil
+	}
+	err = nsys.EnableKTLS(tcp, tx, rx)
+	if errors.Is(err, nsys.ErrKTLSUnsupported) {
+		return tc, nil
+	}
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+	return &KTLSConn{TCPConn: tcp, state: cs}, nil
+}
+
+// ktlsTCPConn returns the TCPConn under the StreamConn and BufferedConn
+// wrappers, or nil.
+func ktlsTCPConn(c net.Conn) *net.TCPConn {
+	for {
+		switch w := c.(type) {
+		case *net.TCPConn:
+			return w
+		case *StreamConn:
+			c = w.Conn
+		case *BufferedConn:
+			c = w.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// ktlsKeys derives the key and IV from a traffic secret (RFC 8446 7.3).
+func ktlsKeys(suite uint16, secret []byte) (*nsys.KTLSKeys, error) {
+	var h func() hash.Hash
+	var keyLen int
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		h, keyLen = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		h, keyLen = sha512.New384, 32
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		h, keyLen = sha256.New, 32
+	default:
+		return nil, nsys.ErrKTLSUnsupported
+	}
+	key, err := hkdf.Expand(h, secret, hkdfLabel("key", keyLen), keyLen)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hkdf.Expand(h, secret, hkdfLabel("iv", 12), 12)
+	if err != nil {
+		return nil, err
+	}
+	return &nsys.KTLSKeys{CipherSuite: suite, Key: key, IV: iv}, nil
+}
+
+// hkdfLabel returns the HkdfLabel struct with an empty context.
+func hkdfLabel(label string, length int) string {
+	l := "tls13 " + label
+	b := []byte{byte(length >> 8), byte(length), byte(len(l))}
+	b = append(b, l...)
+	b = append(b, 0)
+	return string(b)
+}
@@ -0,0 +1,262 @@
+package nio
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T) tls.Certificate {
+	k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		DNSNames:     []string{"test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: k}
+}
+
+func TestKTLS(t *testing.T) {
+	conf := &tls.Config{Certificates: []tls.Certificate{testCert(t)}}
+
+	for _, tls12 := range []bool{false, true} {
+		t.Run(map[bool]string{false: "tls13", true: "tls12"}[tls12], func(t *testing.T) {
+			client, in := tcpPair(t)
+			defer client.Close()
+
+			// Client sends data right after the handshake, it must not be
+			// buffered by the server tls.Conn.
+			cc := &tls.Config{InsecureSkipVerify: true}
+			if tls12 {
+				cc.MaxVersion = tls.VersionTLS12
+			}
+			go func() {
+				tc := tls.Client(client, cc)
+				tc.Write([]byte("hello"))
+				b := make([]byte, 5)
+				io.ReadFull(tc, b)
+				tc.Write(b)
+				tc.Close()
+			}()
+
+			// Go picks the TLS 1.3 cipher based on hardware support.
+			sc, err := KTLSServer(context.Background(), in, conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sc.Close()
+			if kc, ok := sc.(*KTLSConn); ok {
+				t.Log("kTLS", tls.CipherSuiteName(kc.ConnectionState().CipherSuite))
+			} else {
+				t.Log("kTLS not available", sc.(*tls.Conn).ConnectionState().Version)
+			}
+			if _, ok := sc.(*KTLSConn); ok && tls12 {
+				t.Fatal("TLS 1.2 should not use kTLS")
+			}
+
+			b := make([]byte, 5)
+			if _, err := io.ReadFull(sc, b); err != nil || string(b) != "hello" {
+				t.Fatal("Read", err, string(b))
+			}
+			sc.Write([]byte("world"))
+			if _, err := io.ReadFull(sc, b); err != nil || string(b) != "world" {
+				t.Fatal("Echo", err, string(b))
+			}
+			// close_notify is EOF
+			if n, err := sc.Read(b); err != io.EOF {
+				t.Fatal("Expected EOF", n, err)
+			}
+		})
+	}
+}
+
+func TestKTLSSplice(t *testing.T) {
+	conf := &tls.Config{Certificates: []tls.Certificate{testCert(t)}}
+	client, in := tcpPair(t)
+	out, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		sc, err := KTLSServer(context.Background(), in, conf)
+		if err != nil {
+			return
+		}
+		if _, ok := sc.(*KTLSConn); ok && !CanSplice(sc, out) {
+			t.Error("kTLS conn should be spliced")
+		}
+		Proxy(out, sc, sc, "")
+	}()
+
+	tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	go func() {
+		tc.Write(data)
+		tc.CloseWrite()
+	}()
+	got, err := io.ReadAll(io.LimitReader(server, int64(len(data))))
+	if err != nil || string(got) != string(data) {
+		t.Fatal("Upstream data", err, len(got))
+	}
+	server.Write([]byte("bye"))
+	server.Close()
+	b, err := io.ReadAll(tc)
+	if string(b) != "bye" {
+		t.Fatal("Downstream data", err, string(b))
+	}
+}
+
+// TestKTLSKeys checks the derived keys by decrypting a client record.
+func TestKTLSKeys(t *testing.T) {
+	conf := &tls.Config{Certificates: []tls.Certificate{testCert(t)}}
+	client, in := tcpPair(t)
+	defer client.Close()
+	defer in.Close()
+
+	kl := &ktlsKeyLog{}
+	cc := &tls.Config{InsecureSkipVerify: true, KeyLogWriter: kl}
+	go func() {
+		tc := tls.Client(client, cc)
+		tc.Write([]byte("hello"))
+	}()
+
+	rr := &ktlsRecordReader{Conn: in}
+	sc := tls.Server(rr, conf)
+	if err := sc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	cs := sc.ConnectionState()
+	if cs.CipherSuite != tls.TLS_AES_128_GCM_SHA256 && cs.CipherSuite != tls.TLS_AES_256_GCM_SHA384 {
+		t.Skip("Non-AES suite", tls.CipherSuiteName(cs.CipherSuite))
+	}
+
+	// The first application record must not be read by the server.
+	rec := make([]byte, 5)
+	if _, err := io.ReadFull(in, rec); err != nil || rec[0] != 23 {
+		t.Fatal("Expected application record", err, rec)
+	}
+	rec = append(rec, make([]byte, int(rec[3])<<8|int(rec[4]))...)
+	io.ReadFull(in, rec[5:])
+
+	kl.m.Lock()
+	secret := kl.client
+	kl.m.Unlock()
+	k, err := ktlsKeys(cs.CipherSuite, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(k.Key)
+	aead, _ := cipher.NewGCM(block)
+	// Sequence 0 - nonce is the static IV.
+	pt, err := aead.Open(nil, k.IV, rec[5:], rec[:5])
+	if err != nil {
+		t.Fatal("Decrypt", err)
+	}
+	// Inner content type is the last byte.
+	if string(pt) != "hello\x17" {
+		t.Fatalf("Unexpected plaintext %q", pt)
+	}
+}
+
+// TestProxySplice checks splice is used through the StreamConn and
+// BufferedConn wrappers, once the buffer is drained.
+func TestProxySplice(t *testing.T) {
+	client, in := tcpPair(t)
+	out, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	sc := NewStreamConn(&BufferedConn{Conn: in, Reader: NewBufferReader(in)})
+	if !CanSplice(sc, out) {
+		t.Fatal("Expected StreamConn to be spliced")
+	}
+	n0 := VarzSplice.Value()
+	done := make(chan error, 1)
+	go func() {
+		done <- Proxy(out, sc, sc, "")
+	}()
+
+	client.Write([]byte("hello"))
+	client.CloseWrite()
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(server, b); err != nil || string(b) != "hello" {
+		t.Fatal("Upstream data", err, string(b))
+	}
+	server.Write([]byte("bye"))
+	server.Close()
+	if b, err := io.ReadAll(client); string(b) != "bye" {
+		t.Fatal("Downstream data", err, string(b))
+	}
+	<-done
+	if VarzSplice.Value()-n0 != 2 {
+		t.Fatal("Expected both directions spliced", VarzSplice.Value()-n0)
+	}
+
+	// Buffered data is copied first.
+	br := NewBufferReader(bytes.NewReader([]byte("data")))
+	br.Peek(1)
+	if CanSplice(&BufferedConn{Conn: in, Reader: br}, out) {
+		t.Fatal("Buffered conn spliced")
+	}
+}
+
+type connTypeHandler chan net.Conn
+
+func (h connTypeHandler) HandleConn(c net.Conn) error {
+	h <- c
+	return nil
+}
+
+// TestSniffTerminate checks the sniffed ClientHello is used by the kTLS
+// handshake.
+func TestSniffTerminate(t *testing.T) {
+	h := connTypeHandler(make(chan net.Conn, 1))
+	sl := &SniffListener{Terminate: true,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{testCert(t)}},
+		Handlers:  map[string]ConnHandler{ProtoTLS: h}}
+	if err := sl.Provision(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client, in := tcpPair(t)
+	defer client.Close()
+	go sl.HandleConn(in)
+
+	tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	go tc.Write([]byte("hello"))
+
+	c := <-h
+	defer c.Close()
+	sc := c.(*StreamConn)
+	if sc.TLS == nil || sc.Proto != ProtoTLS {
+		t.Fatal("Expected terminated TLS", sc.Proto)
+	}
+	_, ktls := sc.Conn.(*KTLSConn)
+	t.Log("kTLS", ktls)
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(sc, b); err != nil || string(b) != "hello" {
+		t.Fatal("Read", err, string(b))
+	}
+
+	if err := (&SniffListener{Terminate: true}).Provision(context.Background()); err == nil {
+		t.Fatal("Expected error without certificates")
+	}
+}
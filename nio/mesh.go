@@ -0,0 +1,102 @@
+package nio
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Mesh identity for the nio and pkg modules.
+//
+// nio doesn't depend on meshauth - the mesh module in cmd sets the defaults
+// when the Mesh is created, and modules without an explicit Dialer or TLS
+// config use them. Relays (MASQUE, WebSocket, SOCKS UDP) dial through the
+// mesh, so routes, parent proxies and authz apply.
+
+// DefaultDialer is the mesh dialer, used by modules without a Dialer.
+var DefaultDialer ContextDialer
+
+// MeshTLS provides TLS configs using the mesh workload certificate and
+// roots.
+type MeshTLS interface {
+	// ServerConfig returns a config for accepting mesh connections, with the
+	// workload certificate and client certificate verification.
+	ServerConfig() *tls.Config
+
+	// ClientConfig returns a config for dialing sni, presenting the workload
+	// certificate and verifying the peer with the mesh roots.
+	ClientConfig(sni string) *tls.Config
+}
+
+// DefaultTLS is the mesh TLS provider.
+var DefaultTLS MeshTLS
+
+// Dialer returns d, the DefaultDialer or a net.Dialer - in this order.
+func Dialer(d ContextDialer) ContextDialer {
+	if d != nil {
+		return d
+	}
+	if DefaultDialer != nil {
+		return DefaultDialer
+	}
+	return &net.Dialer{}
+}
+
+// MeshDialer uses Dialer(nil) when dialing - DefaultDialer may be set after
+// the module holding it is provisioned.
+type MeshDialer struct{}
+
+func (MeshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return Dialer(nil).DialContext(ctx, network, addr)
+}
+
+// ClientTLSConfig returns the mesh client config for sni. Without a mesh,
+// the system roots are used.
+func ClientTLSConfig(sni string) *tls.Config {
+	if DefaultTLS != nil {
+		return DefaultTLS.ClientConfig(sni)
+	}
+	return &tls.Config{ServerName: sni}
+}
+
+// AllowDest returns true if the "host:port" destination matches one of the
+// allow entries:
+//   - "*" - any destination
+//   - "example.com" or "*.example.com" - the domain and subdomains, any port
+//   - "example.com:53" - the host and port
+//   - "10.0.0.0/8" or "10.1.1.1" - IP addresses, any port
+//
+// An empty list doesn't allow any destination.
+func AllowDest(allow []string, dest string) bool {
+	host, _, err := net.SplitHostPort(dest)
+	if err != nil {
+		host = dest
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip, ipErr := netip.ParseAddr(host)
+	domains := map[string]bool{}
+	for _, a := range allow {
+		a = strings.ToLower(a)
+		switch {
+		case a == "*" || strings.EqualFold(a, dest):
+			return true
+		case strings.Contains(a, "/"):
+			if p, err := netip.ParsePrefix(a); err == nil && ipErr == nil && p.Contains(ip.Unmap()) {
+				return true
+			}
+		case ipErr == nil:
+			if ai, err := netip.ParseAddr(a); err == nil && ai == ip.Unmap() {
+				return true
+			}
+		case !strings.Contains(a, ":"):
+			domains[strings.TrimPrefix(a, "*.")] = true
+		}
+	}
+	if ipErr == nil || len(domains) == 0 {
+		return false
+	}
+	h, ok := suffixMatch(domains, host)
+	return ok && h != "*"
+}
@@ -0,0 +1,32 @@
+package nio
+
+import "testing"
+
+func TestAllowDest(t *testing.T) {
+	allow := []string{"example.com", "*.svc.cluster.local", "dns.example:53",
+		"10.0.0.0/8", "fd00::1"}
+	for dest, ok := range map[string]bool{
+		"example.com:443":          true,
+		"a.Example.com.:80":        true,
+		"notexample.com:443":       false,
+		"x.ns.svc.cluster.local:8": true,
+		"dns.example:53":           true,
+		"dns.example:54":           false,
+		"10.1.2.3:53":              true,
+		"[::ffff:10.1.2.3]:53":     true,
+		"11.1.2.3:53":              false,
+		"[fd00::1]:443":            true,
+		"[fd00::2]:443":            false,
+		"com:443":                  false,
+	} {
+		if AllowDest(allow, dest) != ok {
+			t.Error("Unexpected", dest, ok)
+		}
+	}
+	if AllowDest(nil, "example.com:443") {
+		t.Error("Empty list allows")
+	}
+	if !AllowDest([]string{"*"}, "10.1.1.1:22") {
+		t.Error("Expected * to allow")
+	}
+}
@@ -0,0 +1,256 @@
+package nio
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+)
+
+// Metadata frames carry headers and trailers on raw streams, where there is
+// no HTTP framing - QUIC raw streams (pkg/quic QuicMUX and handleRaw), h2r
+// tunnel bodies, UDS.
+//
+// Frame format, version 1:
+//
+//	type    1B  MetadataHeaders (2), MetadataTrailers (3) or MetadataData (4)
+//	version 1B  MetadataVersion
+//	len     4B  payload length, little endian
+//	payload     headers and trailers:
+//	              repeated: uvarint(len(key)) key uvarint(len(value)) value
+//	            data: body bytes
+//
+// The type is never 0 or 1, so the first byte differentiates the stream from
+// H3, which starts with a DATA(0) or HEADERS(1) frame.
+//
+// A key with multiple values is repeated, in order. Keys are canonicalized
+// when read, like textproto - values are opaque bytes and may contain
+// newlines or \0.
+//
+// The reader consumes exactly the frame, so the body can follow without
+// buffering. A raw body ends with the stream - to send trailers the body is
+// written as data frames instead (MetadataBodyWriter), and the trailers
+// frame ends it, before the write side is closed.
+
+// Metadata frame types.
+const (
+	MetadataHeaders  = 0x02
+	MetadataTrailers = 0x03
+	MetadataData     = 0x04
+)
+
+// MetadataVersion is the current frame version.
+const MetadataVersion = 1
+
+const metadataPrefixLen = 6
+
+var (
+	// MaxMetadataSize is the max payload size for a frame.
+	MaxMetadataSize = 32 * 1024
+
+	// MaxMetadataFields is the max number of key/value pairs in a frame.
+	MaxMetadataFields = 256
+
+	// MaxMetadataDataSize is the max payload written in a data frame - larger
+	// writes are split.
+	MaxMetadataDataSize = 64 * 1024
+
+	ErrMetadataTooLarge = errors.New("metadata too large")
+	ErrMetadataVersion  = errors.New("unsupported metadata version")
+	ErrMetadataType     = errors.New("unexpected metadata frame")
+	ErrMetadataFormat   = errors.New("invalid metadata frame")
+)
+
+// AppendMetadata encodes the frame and appends it to b. Keys are sorted, so
+// the encoding is deterministic.
+func AppendMetadata(b []byte, typ byte, h http.Header) ([]byte, error) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	start := len(b)
+	b = append(b, typ, MetadataVersion, 0, 0, 0, 0)
+	n := 0
+	for _, k := range keys {
+		for _, v := range h[k] {
+			n++
+			b = binary.AppendUvarint(b, uint64(len(k)))
+			b = append(b, k...)
+			b = binary.AppendUvarint(b, uint64(len(v)))
+			b = append(b, v...)
+		}
+	}
+	plen := len(b) - start - metadataPrefixLen
+	if plen > MaxMetadataSize || n > MaxMetadataFields {
+		return b[:start], ErrMetadataTooLarge
+	}
+	binary.LittleEndian.PutUint32(b[start+2:], uint32(plen))
+	return b, nil
+}
+
+// WriteMetadata writes a frame to w, in a single Write.
+func WriteMetadata(w io.Writer, typ byte, h http.Header) error {
+	b, err := AppendMetadata(nil, typ, h)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadMetadata reads one headers or trailers frame from r, returning the
+// frame type.
+func ReadMetadata(r io.Reader) (byte, http.Header, error) {
+	typ, plen, err := readMetadataPrefix(r)
+	if err != nil {
+		return typ, nil, err
+	}
+	if typ == MetadataData {
+		return typ, nil, ErrMetadataType
+	}
+	if plen > uint32(MaxMetadataSize) {
+		return typ, nil, ErrMetadataTooLarge
+	}
+	buf := make([]byte, plen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return typ, nil, err
+	}
+	h, err := ParseMetadata(buf)
+	return typ, h, err
+}
+
+func readMetadataPrefix(r io.Reader) (byte, uint32, error) {
+	var prefix [metadataPrefixLen]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return 0, 0, err
+	}
+	typ := prefix[0]
+	if typ != MetadataHeaders && typ != MetadataTrailers && typ != MetadataData {
+		return typ, 0, ErrMetadataType
+	}
+	if prefix[1] != MetadataVersion {
+		return typ, 0, ErrMetadataVersion
+	}
+	return typ, binary.LittleEndian.Uint32(prefix[2:]), nil
+}
+
+// MetadataBodyWriter writes the body as data frames, so a trailers frame
+// can follow it.
+type MetadataBodyWriter struct {
+	W io.Writer
+}
+
+func (mw *MetadataBodyWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), MaxMetadataDataSize)]
+		prefix := []byte{MetadataData, MetadataVersion, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(prefix[2:], uint32(len(chunk)))
+		bufs := net.Buffers{prefix, chunk}
+		if _, err := bufs.WriteTo(mw.W); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// MetadataBodyReader reads a body written by MetadataBodyWriter. Read
+// returns io.EOF after the trailers frame, which is saved in Trailer.
+type MetadataBodyReader struct {
+	R       io.Reader
+	Trailer http.Header
+
+	// Bytes left in the current data frame.
+	remaining uint32
+	eof       bool
+}
+
+func (mr *MetadataBodyReader) Read(b []byte) (int, error) {
+	for mr.remaining == 0 {
+		if mr.eof {
+			return 0, io.EOF
+		}
+		typ, plen, err := readMetadataPrefix(mr.R)
+		if err == io.EOF {
+			// The stream must end with the trailers.
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case MetadataData:
+			mr.remaining = plen
+		case MetadataTrailers:
+			if plen > uint32(MaxMetadataSize) {
+				return 0, ErrMetadataTooLarge
+			}
+			buf := make([]byte, plen)
+			if _, err := io.ReadFull(mr.R, buf); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+			h, err := ParseMetadata(buf)
+			if err != nil {
+				return 0, err
+			}
+			mr.Trailer = h
+			mr.eof = true
+		default:
+			return 0, ErrMetadataType
+		}
+	}
+	if uint32(len(b)) > mr.remaining {
+		b = b[:mr.remaining]
+	}
+	n, err := mr.R.Read(b)
+	mr.remaining -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// ParseMetadata decodes a frame payload.
+func ParseMetadata(b []byte) (http.Header, error) {
+	h := http.Header{}
+	n := 0
+	for len(b) > 0 {
+		n++
+		if n > MaxMetadataFields {
+			return nil, ErrMetadataTooLarge
+		}
+		k, rest, ok := readMetadataString(b)
+		if !ok || len(k) == 0 {
+			return nil, ErrMetadataFormat
+		}
+		v, rest, ok := readMetadataString(rest)
+		if !ok {
+			return nil, ErrMetadataFormat
+		}
+		ck := textproto.CanonicalMIMEHeaderKey(string(k))
+		h[ck] = append(h[ck], string(v))
+		b = rest
+	}
+	return h, nil
+}
+
+func readMetadataString(b []byte) ([]byte, []byte, bool) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > uint64(len(b)-n) {
+		return nil, nil, false
+	}
+	return b[n : n+int(l)], b[n+int(l):], true
+}
@@ -0,0 +1,226 @@
+package nio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func unixPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+// h2Pair returns the body of a H2 request and the body received by the
+// server.
+func h2Pair(t *testing.T) (io.WriteCloser, io.ReadCloser) {
+	bodies := make(chan io.ReadCloser, 1)
+	done := make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodies <- r.Body
+		<-done
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(done) })
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", srv.URL, pr)
+	go func() {
+		res, err := srv.Client().Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	return pw, <-bodies
+}
+
+func TestMetadata(t *testing.T) {
+	// Each transport returns the writer and reader ends.
+	transports := map[string]func(t *testing.T) (io.WriteCloser, io.ReadCloser){
+		"pipe": func(t *testing.T) (io.WriteCloser, io.ReadCloser) {
+			c, s := net.Pipe()
+			return c, s
+		},
+		"tcp": func(t *testing.T) (io.WriteCloser, io.ReadCloser) {
+			c, s := tcpPair(t)
+			return c, s
+		},
+		"uds": func(t *testing.T) (io.WriteCloser, io.ReadCloser) {
+			return unixPair(t)
+		},
+		"iopipe": func(t *testing.T) (io.WriteCloser, io.ReadCloser) {
+			r, w := io.Pipe()
+			return w, r
+		},
+		// H2 request body, used by h2r tunnels.
+		"h2": h2Pair,
+	}
+	headers := map[string]http.Header{
+		"empty":  {},
+		"simple": {"Dest": {"example.com:443"}},
+		"multi":  {"X-Forwarded-For": {"10.0.0.1", "10.0.0.2"}, "Status": {"200"}},
+		"binary": {"Bin": {"a\x00b\r\nc: d"}, "Empty": {""}},
+		"utf8":   {"X-Name": {"ünïcødé"}},
+		"large":  {"Big": {strings.Repeat("x", MaxMetadataSize-8)}},
+	}
+	body := []byte("body")
+
+	for tn, tf := range transports {
+		for hn, h := range headers {
+			t.Run(tn+"/"+hn, func(t *testing.T) {
+				w, r := tf(t)
+				defer r.Close()
+				trailer := http.Header{"Grpc-Status": {"0"}, "X-Count": {strconv.Itoa(len(h))}}
+
+				errc := make(chan error, 1)
+				go func() {
+					out := &InOutStream{}
+					err := out.SendHeader(w, h)
+					if err == nil {
+						_, err = (&MetadataBodyWriter{W: w}).Write(body)
+					}
+					if err == nil {
+						err = out.SendTrailer(w, trailer)
+					}
+					w.Close()
+					errc <- err
+				}()
+
+				in := &InOutStream{}
+				if err := in.ReadHeader(r); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(in.InHeader, h) {
+					t.Error("Header mismatch", in.InHeader)
+				}
+				mr := &MetadataBodyReader{R: r}
+				b, err := io.ReadAll(mr)
+				if err != nil || !bytes.Equal(b, body) {
+					t.Fatal("Body mismatch", err, string(b))
+				}
+				if err := in.ReadTrailer(mr); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(in.InTrailer, trailer) {
+					t.Error("Trailer mismatch", in.InTrailer)
+				}
+				if err := <-errc; err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestMetadataCanonical(t *testing.T) {
+	b, _ := AppendMetadata(nil, MetadataHeaders, http.Header{"dest": {"a"}, "x-mesh-id": {"b"}})
+	_, h, err := ReadMetadata(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("dest") != "a" || h["X-Mesh-Id"][0] != "b" {
+		t.Fatal("Keys not canonical", h)
+	}
+	b2, _ := AppendMetadata(nil, MetadataHeaders, http.Header{"x-mesh-id": {"b"}, "dest": {"a"}})
+	if !bytes.Equal(b, b2) {
+		t.Fatal("Encoding not deterministic")
+	}
+}
+
+func TestMetadataErrors(t *testing.T) {
+	if _, err := AppendMetadata(nil, MetadataHeaders,
+		http.Header{"Big": {strings.Repeat("x", MaxMetadataSize)}}); err != ErrMetadataTooLarge {
+		t.Error("Expected too large", err)
+	}
+	many := http.Header{}
+	for i := 0; i <= MaxMetadataFields; i++ {
+		many.Add("K", "v")
+	}
+	if _, err := AppendMetadata(nil, MetadataHeaders, many); err != ErrMetadataTooLarge {
+		t.Error("Expected too many fields", err)
+	}
+
+	valid, _ := AppendMetadata(nil, MetadataHeaders, http.Header{"Dest": {"a"}})
+	frame := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+	for n, tc := range map[string]struct {
+		b   []byte
+		err error
+	}{
+		"h3data":    {frame(func(b []byte) []byte { b[0] = 0; return b }), ErrMetadataType},
+		"version":   {frame(func(b []byte) []byte { b[1] = 2; return b }), ErrMetadataVersion},
+		"size":      {[]byte{MetadataHeaders, MetadataVersion, 0xff, 0xff, 0xff, 0}, ErrMetadataTooLarge},
+		"truncated": {valid[:len(valid)-1], io.ErrUnexpectedEOF},
+		"prefix":    {valid[:3], io.ErrUnexpectedEOF},
+		"eof":       {nil, io.EOF},
+		"keylen":    {frame(func(b []byte) []byte { b[6] = 10; return b }), ErrMetadataFormat},
+		"emptykey":  {[]byte{MetadataHeaders, MetadataVersion, 2, 0, 0, 0, 0, 0}, ErrMetadataFormat},
+	} {
+		if _, _, err := ReadMetadata(bytes.NewReader(tc.b)); !errors.Is(err, tc.err) {
+			t.Error(n, err)
+		}
+	}
+
+	tr, _ := AppendMetadata(nil, MetadataTrailers, http.Header{})
+	if err := (&InOutStream{}).ReadHeader(bytes.NewReader(tr)); err != ErrMetadataType {
+		t.Error("Expected headers frame", err)
+	}
+}
+
+func TestMetadataBody(t *testing.T) {
+	var buf bytes.Buffer
+	body := bytes.Repeat([]byte("x"), 2*MaxMetadataDataSize+10)
+	if n, err := (&MetadataBodyWriter{W: &buf}).Write(body); err != nil || n != len(body) {
+		t.Fatal(n, err)
+	}
+	framed := append([]byte{}, buf.Bytes()...)
+	if len(framed) != len(body)+3*metadataPrefixLen {
+		t.Fatal("Expected 3 data frames", len(framed))
+	}
+	str := &InOutStream{}
+	str.SendTrailer(&buf, http.Header{"Status": {"ok"}})
+
+	// ReadTrailer skips the rest of the body.
+	if err := str.ReadTrailer(&buf); err != nil || str.InTrailer.Get("status") != "ok" {
+		t.Fatal(err, str.InTrailer)
+	}
+
+	for n, b := range map[string][]byte{
+		"notrailer": framed,
+		"truncated": framed[:len(framed)-1],
+		"headers":   append(framed, tr(MetadataHeaders)...),
+	} {
+		_, err := io.ReadAll(&MetadataBodyReader{R: bytes.NewReader(b)})
+		if err == nil {
+			t.Error("Expected error", n)
+		}
+	}
+}
+
+func tr(typ byte) []byte {
+	b, _ := AppendMetadata(nil, typ, http.Header{"A": {"b"}})
+	return b
+}
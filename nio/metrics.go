@@ -0,0 +1,51 @@
+package nio
+
+import (
+	"time"
+
+	"github.com/costinm/ugate/pkg/metrics"
+)
+
+// Metrics for proxied streams. The expvar counters are also exported on
+// /metrics, with the same names.
+
+// StreamBuckets are duration buckets in seconds, up to 1 hour.
+var StreamBuckets = []float64{.01, .1, .5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+var (
+	StreamDuration = metrics.NewHistogramVec("ugate_stream_duration_seconds",
+		"Duration of completed proxied streams.", StreamBuckets, "proto")
+
+	StreamBytes = metrics.NewCounterVec("ugate_stream_bytes_total",
+		"Bytes proxied, sent is from client to destination.", "direction")
+
+	StreamCount = metrics.NewCounterVec("ugate_streams_total",
+		"Completed proxied streams.", "proto", "result")
+)
+
+func init() {
+	metrics.Expvar("ugate_srv_err_read_total", "Server read errors.", metrics.TypeCounter, VarzSErrRead)
+	metrics.Expvar("ugate_srv_err_write_total", "Server write errors.", metrics.TypeCounter, VarzSErrWrite)
+	metrics.Expvar("ugate_client_err_read_total", "Client read errors.", metrics.TypeCounter, VarzCErrRead)
+	metrics.Expvar("ugate_client_err_write_total", "Client write errors.", metrics.TypeCounter, VarzCErrWrite)
+	metrics.Expvar("ugate_max_read_bytes", "Largest read.", metrics.TypeGauge, VarzMaxRead)
+	metrics.Expvar("ugate_splice_total", "Copies done with splice.", metrics.TypeCounter, VarzSplice)
+	metrics.Expvar("gate_tcp_total", "Proxied streams.", metrics.TypeCounter, TcpConTotal)
+	metrics.Expvar("gate_tcp_active", "Active proxied streams.", metrics.TypeGauge, TcpConActive)
+}
+
+// streamMetrics records a completed stream.
+func streamMetrics(st *StreamState, t0 time.Time, sent, rcvd int64, err error) {
+	proto := st.Proto
+	if proto == "" {
+		proto = "tcp"
+	}
+	res := "ok"
+	if err != nil {
+		res = "error"
+	}
+	StreamDuration.With(proto).ObserveDuration(t0)
+	StreamCount.With(proto, res).Inc()
+	StreamBytes.With("sent").Add(sent)
+	StreamBytes.With("rcvd").Add(rcvd)
+}
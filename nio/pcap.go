@@ -0,0 +1,483 @@
+package nio
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recording of selected streams in pcapng files, for debugging.
+//
+// The payload is captured by ReaderCopier - for terminated TLS streams it
+// is the decrypted data. TCP/IP headers are synthesized from the client and
+// destination addresses, with a handshake at start and FIN at the end, so
+// Wireshark can follow the stream and decode the protocol.
+//
+// Interface level captures (cmd/capture.sh) only see the encrypted mesh
+// traffic.
+
+// PcapTap selects the streams to record and holds the config.
+type PcapTap struct {
+	// Dests are destination host suffixes to record, "*" for all.
+	Dests []string `json:"dests,omitempty"`
+
+	// SNI are TLS server name suffixes to record.
+	SNI []string `json:"sni,omitempty"`
+
+	// Peers are peer identities or IP addresses to record. A trailing
+	// "*" matches a prefix.
+	Peers []string `json:"peers,omitempty"`
+
+	// Dir is the directory for the pcapng files. Defaults to
+	// $TMPDIR/ugate-pcap.
+	Dir string `json:"dir,omitempty"`
+
+	// MaxBytes is the max payload recorded for each stream. Default 16M.
+	MaxBytes int `json:"max_bytes,omitempty"`
+
+	// MaxTotal is the max size of the recordings in Dir, with MaxBytes
+	// reserved for each active recording. The oldest recordings are removed
+	// to make room for new streams - if the active ones use the budget, new
+	// streams are not recorded. Default 256M.
+	MaxTotal int64 `json:"max_total,omitempty"`
+
+	// MaxFiles is the max number of recordings in Dir. Default 100.
+	MaxFiles int `json:"max_files,omitempty"`
+
+	// Mux is used for the /debug/pcap handler. Defaults to http.DefaultServeMux.
+	Mux *http.ServeMux `json:"-"`
+
+	m sync.RWMutex
+
+	// rm serializes the rotation, active has the names of the files still
+	// written.
+	rm     sync.Mutex
+	active map[string]bool
+}
+
+// DefaultPcap is used by Proxy to record streams. Nil disables recording.
+var DefaultPcap *PcapTap
+
+// Provision creates the directory and registers the admin handler.
+func (pt *PcapTap) Provision(ctx context.Context) error {
+	if pt.Dir == "" {
+		pt.Dir = filepath.Join(os.TempDir(), "ugate-pcap")
+	}
+	if pt.MaxBytes == 0 {
+		pt.MaxBytes = 16 * 1024 * 1024
+	}
+	if pt.MaxTotal == 0 {
+		pt.MaxTotal = 256 * 1024 * 1024
+	}
+	if pt.MaxFiles == 0 {
+		pt.MaxFiles = 100
+	}
+	if err := os.MkdirAll(pt.Dir, 0o700); err != nil {
+		return err
+	}
+	mux := pt.Mux
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("/debug/pcap", pt.HandlePcap)
+	DefaultPcap = pt
+	return nil
+}
+
+// Match returns true if the stream should be recorded.
+func (pt *PcapTap) Match(st *StreamState) bool {
+	pt.m.RLock()
+	defer pt.m.RUnlock()
+
+	host, _, err := net.SplitHostPort(st.Dest)
+	if err != nil {
+		host = st.Dest
+	}
+	if hostMatch(pt.Dests, host) {
+		return true
+	}
+	if st.ClientHello != nil && hostMatch(pt.SNI, st.ClientHello.ServerName) {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(st.PeerAddr)
+	if err != nil {
+		ip = st.PeerAddr
+	}
+	for _, p := range pt.Peers {
+		if pp, ok := strings.CutSuffix(p, "*"); ok {
+			if (st.Peer != "" && strings.HasPrefix(st.Peer, pp)) ||
+				(ip != "" && strings.HasPrefix(ip, pp)) {
+				return true
+			}
+		} else if p == st.Peer || p == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func hostMatch(suffixes []string, host string) bool {
+	if len(suffixes) == 0 || host == "" {
+		return false
+	}
+	m := make(map[string]bool, len(suffixes))
+	for _, s := range suffixes {
+		m[strings.TrimPrefix(s, "*.")] = true
+	}
+	_, ok := suffixMatch(m, host)
+	return ok
+}
+
+// Attach returns the recorder for the stream, or nil if the stream doesn't
+// match or the file can't be created. server is the dialed conn.
+func (pt *PcapTap) Attach(str Stream, server net.Conn) *PcapStream {
+	st := str.State()
+	if !pt.Match(st) {
+		return nil
+	}
+	name := st.StreamId + "-" + sanitizeName(st.Dest) + ".pcapng"
+	if !pt.reserve(name) {
+		return nil
+	}
+	f, err := os.Create(filepath.Join(pt.Dir, name))
+	if err != nil {
+		pt.release(name)
+		return nil
+	}
+	// PeerAddr is the accepted client - RemoteAddr is the server if the
+	// tracked stream wraps the dialed conn.
+	client := str.RemoteAddr()
+	if ta, err := net.ResolveTCPAddr("tcp", st.PeerAddr); err == nil && st.PeerAddr != "" {
+		client = ta
+	}
+	ps := NewPcapStream(f, client, server.RemoteAddr())
+	ps.MaxBytes = pt.MaxBytes
+	ps.onClose = func() { pt.release(name) }
+	return ps
+}
+
+// reserve removes the oldest recordings until there is room for a new one
+// within MaxFiles and MaxTotal, and marks name active. Returns false if the
+// active recordings use the budget.
+func (pt *PcapTap) reserve(name string) bool {
+	pt.rm.Lock()
+	defer pt.rm.Unlock()
+	if pt.active == nil {
+		pt.active = map[string]bool{}
+	}
+
+	var old []*PcapFile
+	var total int64
+	entries, _ := os.ReadDir(pt.Dir)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".pcapng") || pt.active[e.Name()] {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		old = append(old, &PcapFile{Name: e.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+		total += fi.Size()
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i].ModTime.Before(old[j].ModTime) })
+
+	files := len(pt.active) + 1
+	reserved := int64(files) * int64(pt.MaxBytes)
+	over := func() bool {
+		return pt.MaxFiles > 0 && files+len(old) > pt.MaxFiles ||
+			pt.MaxTotal > 0 && total+reserved > pt.MaxTotal
+	}
+	for over() && len(old) > 0 {
+		os.Remove(filepath.Join(pt.Dir, old[0].Name))
+		total -= old[0].Size
+		old = old[1:]
+	}
+	if over() {
+		return false
+	}
+	pt.active[name] = true
+	return true
+}
+
+func (pt *PcapTap) release(name string) {
+	pt.rm.Lock()
+	delete(pt.active, name)
+	pt.rm.Unlock()
+}
+
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// PcapStream writes one stream as a pcapng file with raw IP packets.
+type PcapStream struct {
+	// MaxBytes is the max payload to record, 0 for unlimited.
+	MaxBytes int
+
+	m       sync.Mutex
+	f       *os.File
+	closed  bool
+	bytes   int
+	onClose func()
+
+	client, server    tcpEndpoint
+	clientSeq, srvSeq uint32
+	ipv6              bool
+	ipID              uint16
+}
+
+type tcpEndpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+func endpoint(a net.Addr, def net.IP) tcpEndpoint {
+	if ta, ok := a.(*net.TCPAddr); ok && ta.IP != nil {
+		return tcpEndpoint{ip: ta.IP, port: uint16(ta.Port)}
+	}
+	if a != nil {
+		if ap, err := net.ResolveTCPAddr("tcp", a.String()); err == nil && ap.IP != nil {
+			return tcpEndpoint{ip: ap.IP, port: uint16(ap.Port)}
+		}
+	}
+	return tcpEndpoint{ip: def, port: 0}
+}
+
+// TCP flags
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// NewPcapStream writes the pcapng header and the TCP handshake. Unknown
+// addresses are replaced with 10.0.0.1 for the client and 10.0.0.2 for the
+// server.
+func NewPcapStream(f *os.File, client, server net.Addr) *PcapStream {
+	ps := &PcapStream{
+		f:         f,
+		client:    endpoint(client, net.IPv4(10, 0, 0, 1)),
+		server:    endpoint(server, net.IPv4(10, 0, 0, 2)),
+		clientSeq: 1000,
+		srvSeq:    5000,
+	}
+	ps.ipv6 = ps.client.ip.To4() == nil || ps.server.ip.To4() == nil
+
+	f.Write(pcapngHeader())
+	ps.packet(false, tcpSYN, nil)
+	ps.clientSeq++
+	ps.packet(true, tcpSYN|tcpACK, nil)
+	ps.srvSeq++
+	ps.packet(false, tcpACK, nil)
+	return ps
+}
+
+// Write records data sent by the server if fromServer is true, else by the
+// client. Large writes are split in multiple packets.
+func (ps *PcapStream) Write(data []byte, fromServer bool) {
+	if ps == nil {
+		return
+	}
+	ps.m.Lock()
+	defer ps.m.Unlock()
+	if ps.closed {
+		return
+	}
+	if ps.MaxBytes > 0 && ps.bytes+len(data) > ps.MaxBytes {
+		data = data[:max(0, ps.MaxBytes-ps.bytes)]
+	}
+	ps.bytes += len(data)
+	for len(data) > 0 {
+		n := min(len(data), 32*1024)
+		ps.packet(fromServer, tcpPSH|tcpACK, data[:n])
+		if fromServer {
+			ps.srvSeq += uint32(n)
+		} else {
+			ps.clientSeq += uint32(n)
+		}
+		data = data[n:]
+	}
+}
+
+// CloseWrite records a FIN from the server or client.
+func (ps *PcapStream) CloseWrite(fromServer bool) {
+	if ps == nil {
+		return
+	}
+	ps.m.Lock()
+	defer ps.m.Unlock()
+	if ps.closed {
+		return
+	}
+	ps.packet(fromServer, tcpFIN|tcpACK, nil)
+	if fromServer {
+		ps.srvSeq++
+	} else {
+		ps.clientSeq++
+	}
+}
+
+// Close closes the file.
+func (ps *PcapStream) Close() error {
+	if ps == nil {
+		return nil
+	}
+	ps.m.Lock()
+	defer ps.m.Unlock()
+	if ps.closed {
+		return nil
+	}
+	ps.closed = true
+	err := ps.f.Close()
+	if ps.onClose != nil {
+		ps.onClose()
+	}
+	return err
+}
+
+// packet writes an Enhanced Packet Block with the IP and TCP headers.
+func (ps *PcapStream) packet(fromServer bool, flags byte, payload []byte) {
+	src, dst := ps.client, ps.server
+	seq, ack := ps.clientSeq, ps.srvSeq
+	if fromServer {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	tcp = append(tcp, payload...)
+
+	var ip []byte
+	var pseudo []byte
+	if ps.ipv6 {
+		ip = make([]byte, 40, 40+len(tcp))
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6 // TCP
+		ip[7] = 64
+		copy(ip[8:24], src.ip.To16())
+		copy(ip[24:40], dst.ip.To16())
+
+		pseudo = make([]byte, 40)
+		copy(pseudo, ip[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = 6
+	} else {
+		ps.ipID++
+		ip = make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[4:], ps.ipID)
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // DF
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:16], src.ip.To4())
+		copy(ip[16:20], dst.ip.To4())
+		binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+
+		pseudo = make([]byte, 12)
+		copy(pseudo, ip[12:20])
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo), tcp))
+	ip = append(ip, tcp...)
+
+	ps.f.Write(enhancedPacketBlock(time.Now(), ip))
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns the internet checksum (RFC 1071) of b, with the initial
+// sum s.
+func checksum(s uint32, b []byte) uint16 {
+	s = sum(s, b)
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return ^uint16(s)
+}
+
+// pcapng block types and link type.
+const (
+	pcapngSHB = 0x0A0D0D0A
+	pcapngIDB = 1
+	pcapngEPB = 6
+
+	linkTypeRaw = 101
+)
+
+// pcapngHeader returns the Section Header and Interface Description blocks.
+func pcapngHeader() []byte {
+	le := binary.LittleEndian
+	b := make([]byte, 0, 48)
+	b = le.AppendUint32(b, pcapngSHB)
+	b = le.AppendUint32(b, 28)
+	b = le.AppendUint32(b, 0x1A2B3C4D) // byte order magic
+	b = le.AppendUint16(b, 1)
+	b = le.AppendUint16(b, 0)
+	b = le.AppendUint64(b, 0xffffffffffffffff) // section length unknown
+	b = le.AppendUint32(b, 28)
+
+	b = le.AppendUint32(b, pcapngIDB)
+	b = le.AppendUint32(b, 20)
+	b = le.AppendUint16(b, linkTypeRaw)
+	b = le.AppendUint16(b, 0)
+	b = le.AppendUint32(b, 0) // snaplen
+	b = le.AppendUint32(b, 20)
+	return b
+}
+
+// enhancedPacketBlock returns an EPB for interface 0, with microsecond
+// timestamp.
+func enhancedPacketBlock(t time.Time, pkt []byte) []byte {
+	le := binary.LittleEndian
+	pad := (4 - len(pkt)%4) % 4
+	l := 32 + len(pkt) + pad
+	ts := uint64(t.UnixMicro())
+
+	b := make([]byte, 0, l)
+	b = le.AppendUint32(b, pcapngEPB)
+	b = le.AppendUint32(b, uint32(l))
+	b = le.AppendUint32(b, 0)
+	b = le.AppendUint32(b, uint32(ts>>32))
+	b = le.AppendUint32(b, uint32(ts))
+	b = le.AppendUint32(b, uint32(len(pkt)))
+	b = le.AppendUint32(b, uint32(len(pkt)))
+	b = append(b, pkt...)
+	b = append(b, make([]byte, pad)...)
+	b = le.AppendUint32(b, uint32(l))
+	return b
+}
@@ -0,0 +1,77 @@
+package nio
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Admin handler for recorded streams:
+//
+// curl localhost:15000/debug/pcap
+// curl -XPOST localhost:15000/debug/pcap -d '{"sni":["example.com"],"peers":["10.1.*"]}'
+// curl -o s.pcapng "localhost:15000/debug/pcap?name=12-example.com_443.pcapng"
+// curl -XDELETE "localhost:15000/debug/pcap?name=12-example.com_443.pcapng"
+
+// PcapFile is the JSON representation of a recording.
+type PcapFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// HandlePcap lists the recordings, or returns the file with the name query
+// parameter. POST updates the filters, DELETE removes a recording.
+func (pt *PcapTap) HandlePcap(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name != "" {
+		if filepath.Base(name) != name || !strings.HasSuffix(name, ".pcapng") {
+			http.Error(w, "invalid name", http.StatusBadRequest)
+			return
+		}
+		fn := filepath.Join(pt.Dir, name)
+		if r.Method == http.MethodDelete {
+			if err := os.Remove(fn); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("content-type", "application/x-pcapng")
+		w.Header().Set("content-disposition", "attachment; filename="+name)
+		http.ServeFile(w, r, fn)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		upd := &PcapTap{}
+		if err := json.NewDecoder(r.Body).Decode(upd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pt.m.Lock()
+		pt.Dests = upd.Dests
+		pt.SNI = upd.SNI
+		pt.Peers = upd.Peers
+		pt.m.Unlock()
+	}
+
+	res := []*PcapFile{}
+	entries, _ := os.ReadDir(pt.Dir)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".pcapng") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		res = append(res, &PcapFile{Name: e.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
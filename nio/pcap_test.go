@@ -0,0 +1,142 @@
+package nio
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readPcapng returns the packets in the Enhanced Packet Blocks.
+func readPcapng(t *testing.T, b []byte) [][]byte {
+	le := binary.LittleEndian
+	if len(b) < 28 || le.Uint32(b) != pcapngSHB || le.Uint32(b[8:]) != 0x1A2B3C4D {
+		t.Fatal("Invalid section header")
+	}
+	var pkts [][]byte
+	for len(b) > 0 {
+		l := int(le.Uint32(b[4:]))
+		if l < 12 || l > len(b) || le.Uint32(b[l-4:]) != uint32(l) {
+			t.Fatal("Invalid block length", l)
+		}
+		if le.Uint32(b) == pcapngEPB {
+			cl := int(le.Uint32(b[20:]))
+			pkts = append(pkts, b[28:28+cl])
+		}
+		b = b[l:]
+	}
+	return pkts
+}
+
+func TestPcap(t *testing.T) {
+	mux := http.NewServeMux()
+	pt := &PcapTap{Dests: []string{"example.com"}, Dir: t.TempDir(), Mux: mux}
+	pt.Provision(nil)
+	defer func() { DefaultPcap = nil }()
+
+	run := func(dest string) {
+		client, in := tcpPair(t)
+		out, server := tcpPair(t)
+		done := make(chan error)
+		go func() {
+			done <- Proxy(out, NewStreamConn(in), in, dest)
+		}()
+		client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		client.CloseWrite()
+		b, _ := io.ReadAll(server)
+		server.Write([]byte("HTTP/1.1 200 OK\r\n\r\n" + string(b)))
+		server.Close()
+		io.ReadAll(client)
+		client.Close()
+		<-done
+	}
+	run("other.com:80")
+	run("www.example.com:80")
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/pcap", nil))
+	var files []*PcapFile
+	json.Unmarshal(rr.Body.Bytes(), &files)
+	if len(files) != 1 {
+		t.Fatal("Expected 1 recording", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/pcap?name="+files[0].Name, nil))
+	pkts := readPcapng(t, rr.Body.Bytes())
+
+	// SYN, SYN-ACK, ACK, request, FIN, response, FIN
+	if len(pkts) != 7 {
+		t.Fatal("Unexpected packets", len(pkts))
+	}
+	var sent, rcvd string
+	for _, p := range pkts {
+		if p[0]>>4 != 4 || checksum(0, p[:20]) != 0 {
+			t.Fatal("Invalid IP header", p[:20])
+		}
+		pseudo := append(append([]byte{}, p[12:20]...), 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(p)-20))
+		if checksum(sum(0, pseudo), p[20:]) != 0 {
+			t.Fatal("Invalid TCP checksum")
+		}
+		// The first packet is the client SYN.
+		if binary.BigEndian.Uint16(p[20:]) == binary.BigEndian.Uint16(pkts[0][20:]) {
+			sent += string(p[40:])
+		} else {
+			rcvd += string(p[40:])
+		}
+	}
+	if sent != "GET / HTTP/1.1\r\n\r\n" || rcvd != "HTTP/1.1 200 OK\r\n\r\n"+sent {
+		t.Fatalf("Unexpected payload %q %q", sent, rcvd)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/pcap?name=../x.pcapng", nil))
+	if rr.Code != 400 {
+		t.Fatal("Expected 400", rr.Code)
+	}
+}
+
+func TestPcapRotate(t *testing.T) {
+	pt := &PcapTap{Dir: t.TempDir(), MaxBytes: 100, MaxTotal: 1000, MaxFiles: 3}
+	now := time.Now()
+	for i, n := range []string{"a", "b", "c"} {
+		fn := filepath.Join(pt.Dir, n+".pcapng")
+		os.WriteFile(fn, make([]byte, 400-i*150), 0o600)
+		mt := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(fn, mt, mt)
+	}
+	exists := func(n string) bool {
+		_, err := os.Stat(filepath.Join(pt.Dir, n+".pcapng"))
+		return err == nil
+	}
+
+	// The oldest recordings are removed to stay under MaxFiles.
+	if !pt.reserve("d.pcapng") || exists("a") || !exists("b") {
+		t.Fatal("Expected the oldest file removed")
+	}
+	pt.reserve("e.pcapng")
+	pt.reserve("f.pcapng")
+	if exists("b") || exists("c") {
+		t.Fatal("Expected old files removed")
+	}
+	// Active recordings are not removed.
+	if pt.reserve("g.pcapng") {
+		t.Fatal("Expected no room")
+	}
+	pt.release("d.pcapng")
+	if !pt.reserve("g.pcapng") {
+		t.Fatal("Expected room after release")
+	}
+
+	// MaxBytes is reserved for each active recording.
+	pt = &PcapTap{Dir: t.TempDir(), MaxBytes: 400, MaxTotal: 1000}
+	if !pt.reserve("a.pcapng") || !pt.reserve("b.pcapng") || pt.reserve("c.pcapng") {
+		t.Fatal("Unexpected reservations", pt.active)
+	}
+}
@@ -1,11 +1,11 @@
 package nio
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log"
 	"net"
-	"strconv"
 	"sync/atomic"
 	"time"
 )
@@ -15,24 +15,80 @@ var ProxyCnt atomic.Int32
 // Proxy forwards from nc to in/w.
 // outConn is typically the result of DialContext - egressing.
 // dest is used for logging and tracking.
+//
+// The stream is registered in DefaultStreams while the proxy is active.
+//
+// Idle, half-close and max duration timeouts are applied from the stream
+// Timeouts and DefaultTimeouts. The reason is set in the stream ReadErr
+// (client to destination) or WriteErr.
+//
+// Streams matching DefaultPcap are recorded. A record is written to the
+// DefaultAccessLog when the stream is done.
 func Proxy(outConn net.Conn, in io.Reader, w io.Writer, dest string) error {
 	t1 := time.Now()
 
+	str := proxyStream(outConn, in, w)
+	st := str.State()
+	if st.Dest == "" {
+		st.Dest = dest
+	}
+	// Attached before the stream is visible to SetLimit.
+	if rl := DefaultRateLimits; rl != nil {
+		rl.Attach(st)
+	}
+	DefaultStreams.OnStream(str)
+	defer DefaultStreams.OnStreamDone(str)
+
+	var tap *PcapStream
+	if pt := DefaultPcap; pt != nil {
+		tap = pt.Attach(str, outConn)
+		defer tap.Close()
+	}
+
+	to := streamTimeouts(st)
+	active := &atomic.Int64{}
+	active.Store(t1.UnixNano())
+
+	// Canceled when the stream or one of the directions is closed, so
+	// limiter waits don't hold the copiers.
+	ctx := str.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	ch := make(chan int)
 	ch2 := make(chan int)
 
 	s1 := &ReaderCopier{
-		Out: outConn,
-		In:  in,
+		Out:     outConn,
+		In:      in,
+		Stats:   &st.Stats,
+		Limiter: st.Limiter,
+		Ctx:     ctx,
+		Idle:    to.Idle,
+		Tap:     tap,
+		active:  active,
 	}
 	s2 := &ReaderCopier{
-		Out: w,
-		In:  outConn,
+		Out:     w,
+		In:      outConn,
+		Stats:   &st.Stats,
+		Rcvd:    true,
+		Limiter: st.Limiter,
+		Ctx:     ctx,
+		Idle:    to.Idle,
+		Tap:     tap,
+		active:  active,
+	}
+	if to.MaxDuration > 0 {
+		s1.SetDeadline(t1.Add(to.MaxDuration), ErrMaxDuration)
+		s2.SetDeadline(t1.Add(to.MaxDuration), ErrMaxDuration)
 	}
-	ids := ""
+	ids := st.StreamId
 	if dest != "" {
-		id := ProxyCnt.Add(1)
-		ids = strconv.Itoa(int(id))
+		ProxyCnt.Add(1)
 		s1.ID = dest + "-o-" + ids
 		s2.ID = dest + "-i-" + ids
 	}
@@ -44,17 +100,25 @@ func Proxy(outConn net.Conn, in io.Reader, w io.Writer, dest string) error {
 		select {
 		case <-ch:
 			if s1.Err != nil {
+				cancel()
 				s2.Close()
 				break
 			}
+			if to.HalfClose > 0 {
+				s2.SetDeadline(time.Now().Add(to.HalfClose), ErrHalfCloseTimeout)
+			}
 			if Debug {
 				log.Println("Proxy in done", ids, s1.Err, s1.InError, s1.Written)
 			}
 		case <-ch2:
 			if s2.Err != nil {
+				cancel()
 				s1.Close()
 				break
 			}
+			if to.HalfClose > 0 {
+				s1.SetDeadline(time.Now().Add(to.HalfClose), ErrHalfCloseTimeout)
+			}
 			if Debug {
 				log.Println("Proxy out done", ids, s2.Err, s2.InError, s2.Written)
 			}
@@ -62,18 +126,21 @@ func Proxy(outConn net.Conn, in io.Reader, w io.Writer, dest string) error {
 	}
 
 	err := proxyError(s1.Err, s2.Err, s1.InError, s2.InError)
+	streamMetrics(st, t1, s1.Written, s2.Written, err)
+	if s1.Err != nil && st.ReadErr == nil {
+		st.ReadErr = s1.Err
+	}
+	if s2.Err != nil && st.WriteErr == nil {
+		st.WriteErr = s2.Err
+	}
 
-	if dest != "" {
-		log.Println("proxy-copy-done", ids,
-			dest,
-			//"conTime", t1.Sub(t0),
-			"dur", time.Since(t1),
+	if al := DefaultAccessLog; al != nil {
+		al.Log(NewAccessRecord(str, outConn, s1, s2))
+	}
+	if Debug {
+		log.Println("proxy-copy-done", ids, dest,
 			"maxRead", s1.MaxRead, s2.MaxRead,
-			"readCnt", s1.ReadCnt, s2.ReadCnt,
-			"avgCnt", int(s1.Written)/(s1.ReadCnt+1), int(s2.Written)/(s2.ReadCnt+1),
-			"in", s1.Written,
-			"out", s2.Written,
-			"err", err)
+			"avgCnt", int(s1.Written)/(s1.ReadCnt+1), int(s2.Written)/(s2.ReadCnt+1))
 	}
 
 	outConn.Close()
@@ -87,6 +154,28 @@ func Proxy(outConn net.Conn, in io.Reader, w io.Writer, dest string) error {
 	return err
 }
 
+// proxyStream returns the Stream to track - the accepted stream if in or w
+// is a Stream, else a StreamConn wrapping the dialed conn.
+func proxyStream(outConn net.Conn, in io.Reader, w io.Writer) Stream {
+	if s, ok := in.(Stream); ok {
+		return s
+	}
+	if s, ok := w.(Stream); ok {
+		return s
+	}
+	if s, ok := outConn.(Stream); ok {
+		return s
+	}
+	sc := NewStreamConn(outConn)
+	// The accepted conn is the remote peer.
+	if c, ok := in.(net.Conn); ok {
+		sc.PeerAddr = c.RemoteAddr().String()
+	} else if c, ok := w.(net.Conn); ok {
+		sc.PeerAddr = c.RemoteAddr().String()
+	}
+	return sc
+}
+
 func proxyError(errout error, errorin error, outInErr bool, inInerr bool) error {
 	if errout == nil && errorin == nil {
 		return nil
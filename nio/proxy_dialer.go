@@ -0,0 +1,534 @@
+package nio
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbound chaining: dial through a parent proxy. Used in networks where
+// egress is only allowed using a corporate proxy, or to reach a network using
+// a SOCKS server (ssh -D).
+//
+// Supported:
+// - socks5://[user:pass@]host:port - CONNECT and UDP ASSOCIATE
+// - http://[user:pass@]host:port and https:// - CONNECT only, TCP
+//
+// The RouteDialer selects the parent proxy based on destination suffix.
+
+var ErrProxyUnsupported = errors.New("unsupported proxy network")
+
+// ProxyDialer is a ContextDialer tunneling connections through a parent proxy.
+type ProxyDialer struct {
+	// URL of the parent proxy.
+	URL *url.URL
+
+	// Dialer used to connect to the parent proxy. Defaults to net.Dialer.
+	Dialer ContextDialer
+
+	// Timeout for the proxy handshake. Default 10 seconds.
+	HandshakeTimeout time.Duration
+}
+
+// NewProxyDialer creates a dialer for a parent proxy URL, with scheme
+// socks5, socks5h, http or https.
+func NewProxyDialer(proxyURL string) (*ProxyDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1080")
+		}
+	case "http":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "https":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	return &ProxyDialer{URL: u}, nil
+}
+
+func (pd *ProxyDialer) String() string {
+	return pd.URL.Redacted()
+}
+
+func (pd *ProxyDialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	d := pd.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	nc, err := d.DialContext(ctx, "tcp", pd.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if pd.URL.Scheme == "https" {
+		tc := tls.Client(nc, &tls.Config{ServerName: pd.URL.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+	return nc, nil
+}
+
+// DialContext connects to addr using the parent proxy. For socks5 proxies
+// "udp" is supported using UDP ASSOCIATE - the returned conn is connected
+// to addr, each Write is sent as one packet.
+func (pd *ProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	isUDP := strings.HasPrefix(network, "udp")
+	if !isUDP && !strings.HasPrefix(network, "tcp") {
+		return nil, ErrProxyUnsupported
+	}
+	if isUDP && !strings.HasPrefix(pd.URL.Scheme, "socks5") {
+		return nil, ErrProxyUnsupported
+	}
+
+	nc, err := pd.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	to := pd.HandshakeTimeout
+	if to == 0 {
+		to = 10 * time.Second
+	}
+	dl := time.Now().Add(to)
+	if d, ok := ctx.Deadline(); ok && d.Before(dl) {
+		dl = d
+	}
+	nc.SetDeadline(dl)
+
+	var rc net.Conn
+	switch {
+	case isUDP:
+		rc, err = pd.socksAssociate(nc, addr)
+	case strings.HasPrefix(pd.URL.Scheme, "socks5"):
+		err = pd.socksConnect(nc, addr)
+		rc = nc
+	default:
+		rc, err = pd.httpConnect(nc, addr)
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+	return rc, nil
+}
+
+// httpConnect sends a CONNECT request. Bytes sent by the server after the
+// response are preserved.
+func (pd *ProxyDialer) httpConnect(nc net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := pd.URL.User; u != nil {
+		p, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+p)))
+	}
+	if err := req.Write(nc); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(nc)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", addr, res.Status)
+	}
+	if br.Buffered() > 0 {
+		return &readerConn{Conn: nc, r: br}, nil
+	}
+	return nc, nil
+}
+
+// readerConn is used when the handshake reader has buffered data.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *readerConn) CloseWrite() error {
+	if cw, ok := c.Conn.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// socksHandshake negotiates the auth method and sends the request.
+// Returns the bound address from the reply.
+func (pd *ProxyDialer) socksHandshake(nc net.Conn, cmd byte, addr string) (string, error) {
+	user := pd.URL.User
+	methods := []byte{5, 1, 0}
+	if user != nil {
+		methods = []byte{5, 2, 0, 2}
+	}
+	if _, err := nc.Write(methods); err != nil {
+		return "", err
+	}
+	res := make([]byte, 2, 262)
+	if _, err := io.ReadFull(nc, res); err != nil {
+		return "", err
+	}
+	if res[0] != 5 {
+		return "", errors.New("socks: invalid version")
+	}
+	switch res[1] {
+	case 0:
+	case 2:
+		if user == nil {
+			return "", errors.New("socks: auth required")
+		}
+		p, _ := user.Password()
+		u := user.Username()
+		if len(u) > 255 || len(p) > 255 {
+			return "", errors.New("socks: credentials too long")
+		}
+		b := append([]byte{1, byte(len(u))}, u...)
+		b = append(b, byte(len(p)))
+		b = append(b, p...)
+		if _, err := nc.Write(b); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(nc, res[0:2]); err != nil {
+			return "", err
+		}
+		if res[1] != 0 {
+			return "", errors.New("socks: auth failed")
+		}
+	default:
+		return "", errors.New("socks: no acceptable auth method")
+	}
+
+	req, err := socksAppendAddr([]byte{5, cmd, 0}, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err = nc.Write(req); err != nil {
+		return "", err
+	}
+
+	// VER REP RSV ATYP
+	res = res[0:4]
+	if _, err := io.ReadFull(nc, res); err != nil {
+		return "", err
+	}
+	if res[1] != 0 {
+		return "", fmt.Errorf("socks: request failed %d", res[1])
+	}
+	var host string
+	switch res[3] {
+	case 1:
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(nc, b); err != nil {
+			return "", err
+		}
+		host = net.IP(b).String()
+	case 4:
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(nc, b); err != nil {
+			return "", err
+		}
+		host = net.IP(b).String()
+	case 3:
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(nc, b); err != nil {
+			return "", err
+		}
+		b = make([]byte, int(b[0]))
+		if _, err := io.ReadFull(nc, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", errors.New("socks: invalid address type")
+	}
+	pb := make([]byte, 2)
+	if _, err := io.ReadFull(nc, pb); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(pb)))), nil
+}
+
+func (pd *ProxyDialer) socksConnect(nc net.Conn, addr string) error {
+	_, err := pd.socksHandshake(nc, 1, addr)
+	return err
+}
+
+// socksAppendAddr appends ATYP, address and port. Host names are sent
+// to the proxy without resolving.
+func socksAppendAddr(b []byte, addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, 1)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, 4)
+			b = append(b, ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks: host too long")
+		}
+		b = append(b, 3, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(p)), nil
+}
+
+// socksAssociate creates a UDP association. The TCP connection is kept open
+// for the life of the association.
+func (pd *ProxyDialer) socksAssociate(nc net.Conn, addr string) (net.Conn, error) {
+	relay, err := pd.socksHandshake(nc, 3, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	rh, rp, _ := net.SplitHostPort(relay)
+	if ip := net.ParseIP(rh); ip == nil || ip.IsUnspecified() {
+		// Server didn't specify - use the address of the TCP connection.
+		rh, _, _ = net.SplitHostPort(nc.RemoteAddr().String())
+		relay = net.JoinHostPort(rh, rp)
+	}
+	ua, err := net.ResolveUDPAddr("udp", relay)
+	if err != nil {
+		return nil, err
+	}
+	uc, err := net.DialUDP("udp", nil, ua)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr, err := socksAppendAddr([]byte{0, 0, 0}, addr)
+	if err != nil {
+		uc.Close()
+		return nil, err
+	}
+	ra, _ := net.ResolveUDPAddr("udp", addr)
+	sc := &socksUDPConn{UDPConn: uc, ctrl: nc, hdr: hdr, raddr: ra}
+
+	// The association terminates when the TCP connection closes.
+	go func() {
+		io.Copy(io.Discard, nc)
+		sc.Close()
+	}()
+	return sc, nil
+}
+
+// socksUDPConn sends packets to a single destination using a SOCKS5 UDP relay.
+type socksUDPConn struct {
+	*net.UDPConn
+	ctrl  net.Conn
+	hdr   []byte
+	raddr *net.UDPAddr
+
+	closeOnce sync.Once
+}
+
+func (c *socksUDPConn) Write(b []byte) (int, error) {
+	buf := make([]byte, 0, len(c.hdr)+len(b))
+	buf = append(buf, c.hdr...)
+	buf = append(buf, b...)
+	_, err := c.UDPConn.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the payload of the next packet, without the SOCKS header.
+// Fragmented packets are dropped.
+func (c *socksUDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, err := c.UDPConn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		off := 4
+		switch buf[3] {
+		case 1:
+			off += 4
+		case 4:
+			off += 16
+		case 3:
+			off += 1 + int(buf[4])
+		default:
+			continue
+		}
+		off += 2
+		if off > n {
+			continue
+		}
+		return copy(b, buf[off:n]), nil
+	}
+}
+
+func (c *socksUDPConn) RemoteAddr() net.Addr {
+	if c.raddr != nil {
+		return c.raddr
+	}
+	return c.UDPConn.RemoteAddr()
+}
+
+func (c *socksUDPConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.ctrl.Close()
+		c.UDPConn.Close()
+	})
+	return nil
+}
+
+// RouteDialer selects a dialer based on the suffix of the destination host.
+//
+// A route "example.com" matches "example.com" and "*.example.com".
+// The longest matching suffix is used.
+type RouteDialer struct {
+	// Routes maps destination suffix to a parent proxy URL, or "direct".
+	// "proxyv2" and "proxyv1" are direct connections sending a PROXY header
+	// with the original client address.
+	// The "*" key is used as default.
+	Routes map[string]string `json:"routes,omitempty"`
+
+	// Direct is used for "direct" routes, destinations without a match and
+	// to connect to the parent proxies. Defaults to the mesh dialer.
+	Direct ContextDialer `json:"-"`
+
+	m       sync.RWMutex
+	dialers map[string]ContextDialer
+}
+
+// NewRouteDialer returns a dialer using the given suffix to proxy URL routes.
+func NewRouteDialer(routes map[string]string) (*RouteDialer, error) {
+	rd := &RouteDialer{Routes: routes}
+	return rd, rd.Provision(context.Background())
+}
+
+// Provision creates the dialers for the configured routes.
+func (rd *RouteDialer) Provision(ctx context.Context) error {
+	if rd.Direct == nil {
+		rd.Direct = MeshDialer{}
+	}
+	dialers := map[string]ContextDialer{}
+	for k, v := range rd.Routes {
+		k = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(k, "*"), "."))
+		if k == "" {
+			k = "*"
+		}
+		switch v {
+		case "direct", "":
+			dialers[k] = nil
+			continue
+		case "proxyv2":
+			dialers[k] = &ProxyProtoDialer{Dialer: rd.Direct}
+			continue
+		case "proxyv1":
+			dialers[k] = &ProxyProtoDialer{Dialer: rd.Direct, V1: true}
+			continue
+		}
+		pd, err := NewProxyDialer(v)
+		if err != nil {
+			return err
+		}
+		pd.Dialer = rd.Direct
+		dialers[k] = pd
+	}
+	rd.m.Lock()
+	rd.dialers = dialers
+	rd.m.Unlock()
+	return nil
+}
+
+// AddRoute sets the dialer for a destination suffix. A nil dialer means
+// direct connections.
+func (rd *RouteDialer) AddRoute(suffix string, d ContextDialer) {
+	suffix = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(suffix, "*"), "."))
+	if suffix == "" {
+		suffix = "*"
+	}
+	rd.m.Lock()
+	if rd.dialers == nil {
+		rd.dialers = map[string]ContextDialer{}
+	}
+	rd.dialers[suffix] = d
+	rd.m.Unlock()
+}
+
+// DialerFor returns the dialer to use for the host. Returns the Direct
+// dialer if no proxy is configured.
+func (rd *RouteDialer) DialerFor(host string) ContextDialer {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	rd.m.RLock()
+	defer rd.m.RUnlock()
+
+	var d ContextDialer
+	found := false
+	for h := host; ; {
+		if pd, ok := rd.dialers[h]; ok {
+			d, found = pd, true
+			break
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+	if !found {
+		d = rd.dialers["*"]
+	}
+	if d == nil {
+		d = Dialer(rd.Direct)
+	}
+	return d
+}
+
+func (rd *RouteDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return rd.DialerFor(host).DialContext(ctx, network, addr)
+}
@@ -0,0 +1,131 @@
+package nio
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyDialer(t *testing.T) {
+	el, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer el.Close()
+	go func() {
+		for {
+			c, err := el.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	// Minimal HTTP CONNECT parent proxy.
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			w.WriteHeader(400)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic dTpw" {
+			w.WriteHeader(407)
+			return
+		}
+		nc, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(503)
+			return
+		}
+		c, _, _ := w.(http.Hijacker).Hijack()
+		c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		go io.Copy(nc, c)
+		io.Copy(c, nc)
+		c.Close()
+	}))
+	defer ps.Close()
+	paddr := ps.Listener.Addr().String()
+
+	t.Run("connect", func(t *testing.T) {
+		pd, err := NewProxyDialer("http://u:p@" + paddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := pd.DialContext(context.Background(), "tcp", el.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte("hello"))
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+			t.Fatal("Unexpected", string(b), err)
+		}
+	})
+
+	t.Run("noauth", func(t *testing.T) {
+		pd, _ := NewProxyDialer("http://" + paddr)
+		_, err := pd.DialContext(context.Background(), "tcp", el.Addr().String())
+		if err == nil {
+			t.Fatal("Expected 407")
+		}
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		pd, _ := NewProxyDialer("http://" + paddr)
+		_, err := pd.DialContext(context.Background(), "udp", "127.0.0.1:53")
+		if err != ErrProxyUnsupported {
+			t.Fatal("Expected unsupported", err)
+		}
+	})
+}
+
+func TestRouteDialer(t *testing.T) {
+	rd, err := NewRouteDialer(map[string]string{
+		".corp.example.com":  "http://proxy.example.com:3128",
+		"example.com":        "socks5://127.0.0.1",
+		"direct.example.com": "direct",
+		"Upper.Example.NET":  "socks5://127.0.0.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for h, exp := range map[string]string{
+		"a.corp.example.com":   "http://proxy.example.com:3128",
+		"corp.example.com":     "http://proxy.example.com:3128",
+		"www.example.com":      "socks5://127.0.0.1:1080",
+		"example.com.":         "socks5://127.0.0.1:1080",
+		"x.direct.example.com": "",
+		"other.com":            "",
+		"a.upper.example.net":  "socks5://127.0.0.2:1080",
+	} {
+		d := rd.DialerFor(h)
+		pd, ok := d.(*ProxyDialer)
+		if exp == "" {
+			if ok {
+				t.Error("Expected direct", h, pd)
+			}
+			continue
+		}
+		if !ok || pd.String() != exp {
+			t.Error("Unexpected dialer", h, d)
+		}
+	}
+
+	if _, ok := rd.DialerFor("other.com").(MeshDialer); !ok {
+		t.Error("Expected the mesh dialer for direct")
+	}
+
+	rd.AddRoute("*", &ProxyDialer{})
+	if _, ok := rd.DialerFor("other.com").(*ProxyDialer); !ok {
+		t.Error("Expected default route")
+	}
+
+	if _, err := NewRouteDialer(map[string]string{"a": "ftp://x"}); err == nil {
+		t.Error("Expected invalid scheme")
+	}
+}
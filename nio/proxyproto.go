@@ -0,0 +1,523 @@
+package nio
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HAProxy PROXY protocol, v1 (text) and v2 (binary, with TLVs).
+//
+// Cloud L4 load balancers (and HAProxy, Envoy) use it to pass the original
+// client address. The header is only trusted if the connection comes from
+// one of the configured CIDRs - otherwise any client could claim any address.
+//
+// Spec: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+//
+// Istio uses pires/go-proxyproto, which wraps the conn and parses lazily.
+// This implementation parses before the conn is returned, using the
+// BufferReader - so the StreamState is populated when handlers get it.
+
+// PROXY v2 TLV types.
+const (
+	PP2TypeALPN      = 0x01
+	PP2TypeAuthority = 0x02
+	PP2TypeCRC32C    = 0x03
+	PP2TypeNoop      = 0x04
+	PP2TypeUniqueID  = 0x05
+	PP2TypeSSL       = 0x20
+	PP2TypeNetNS     = 0x30
+)
+
+const (
+	proxyV1MaxLen = 107
+
+	proxyCmdLocal = 0x20
+	proxyCmdProxy = 0x21
+)
+
+var (
+	ErrProxyHeader = errors.New("invalid PROXY header")
+
+	proxyV1Sig = []byte("PROXY ")
+)
+
+// TLV is a type-length-value extension from the PROXY v2 header.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is the decoded PROXY protocol header.
+type ProxyHeader struct {
+	Version int
+
+	// Local is set for health checks from the proxy (v2 LOCAL command or
+	// v1 UNKNOWN) - the connection addresses should be used.
+	Local bool `json:",omitempty"`
+
+	// "tcp", "udp" or "unix"
+	Network string `json:",omitempty"`
+
+	// Original client address
+	Src net.Addr `json:",omitempty"`
+
+	// Original destination address
+	Dst net.Addr `json:",omitempty"`
+
+	TLVs []TLV `json:",omitempty"`
+}
+
+// TLV returns the value of the first TLV with the given type, or nil.
+func (h *ProxyHeader) TLV(t byte) []byte {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value
+		}
+	}
+	return nil
+}
+
+// ReadProxyHeader parses a v1 or v2 PROXY header and removes it from the
+// buffer. Returns ErrProxyHeader if the stream doesn't start with a header.
+func ReadProxyHeader(br *BufferReader) (*ProxyHeader, error) {
+	// Read incrementally - clients without a header may send fewer bytes
+	// than the signature and wait for the server.
+	buf, err := br.Peek(1)
+	for err == nil {
+		switch {
+		case bytes.HasPrefix(buf, proxyV2Sig):
+			return readProxyV2(br)
+		case bytes.HasPrefix(buf, proxyV1Sig):
+			return readProxyV1(br)
+		case !isPrefix(buf, proxyV2Sig) && !isPrefix(buf, proxyV1Sig):
+			return nil, ErrProxyHeader
+		}
+		buf, err = br.Peek(len(buf) + 1)
+	}
+	return nil, err
+}
+
+// isPrefix returns true if buf is a prefix of sig.
+func isPrefix(buf, sig []byte) bool {
+	return len(buf) < len(sig) && bytes.HasPrefix(sig, buf)
+}
+
+func readProxyV1(br *BufferReader) (*ProxyHeader, error) {
+	var line []byte
+	for n := 8; ; n++ {
+		buf, err := br.Peek(n)
+		if i := bytes.Index(buf, []byte("\r\n")); i > 0 && i+2 <= proxyV1MaxLen {
+			line = buf[0:i]
+			break
+		}
+		if len(buf) >= proxyV1MaxLen {
+			return nil, ErrProxyHeader
+		}
+		if err != nil {
+			return nil, err
+		}
+		n = len(buf)
+	}
+	hl := len(line) + 2
+
+	h := &ProxyHeader{Version: 1}
+	parts := strings.Split(string(line), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		h.Local = true
+		br.Discard(hl)
+		return h, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+	sip, dip := net.ParseIP(parts[2]), net.ParseIP(parts[3])
+	sp, err1 := strconv.ParseUint(parts[4], 10, 16)
+	dp, err2 := strconv.ParseUint(parts[5], 10, 16)
+	if sip == nil || dip == nil || err1 != nil || err2 != nil {
+		return nil, ErrProxyHeader
+	}
+	h.Network = "tcp"
+	h.Src = &net.TCPAddr{IP: sip, Port: int(sp)}
+	h.Dst = &net.TCPAddr{IP: dip, Port: int(dp)}
+	br.Discard(hl)
+	return h, nil
+}
+
+func readProxyV2(br *BufferReader) (*ProxyHeader, error) {
+	buf, err := br.Peek(16)
+	if err != nil {
+		return nil, err
+	}
+	if buf[12]&0xF0 != 0x20 {
+		return nil, ErrProxyHeader
+	}
+	cmd := buf[12]
+	fam := buf[13]
+	l := int(binary.BigEndian.Uint16(buf[14:16]))
+	buf, err = br.Peek(16 + l)
+	if err != nil {
+		return nil, err
+	}
+	body := buf[16 : 16+l]
+
+	h := &ProxyHeader{Version: 2}
+	switch cmd {
+	case proxyCmdLocal:
+		h.Local = true
+	case proxyCmdProxy:
+	default:
+		return nil, ErrProxyHeader
+	}
+
+	var alen int
+	switch fam >> 4 {
+	case 0:
+		alen = 0
+	case 1:
+		alen = 12
+	case 2:
+		alen = 36
+	case 3:
+		alen = 216
+	default:
+		return nil, ErrProxyHeader
+	}
+	if len(body) < alen {
+		return nil, ErrProxyHeader
+	}
+	a := body[0:alen]
+	switch fam {
+	case 0x11, 0x21:
+		h.Network = "tcp"
+		ipl := alen/2 - 2
+		h.Src = &net.TCPAddr{IP: net.IP(bytes.Clone(a[0:ipl])), Port: int(binary.BigEndian.Uint16(a[2*ipl:]))}
+		h.Dst = &net.TCPAddr{IP: net.IP(bytes.Clone(a[ipl : 2*ipl])), Port: int(binary.BigEndian.Uint16(a[2*ipl+2:]))}
+	case 0x12, 0x22:
+		h.Network = "udp"
+		ipl := alen/2 - 2
+		h.Src = &net.UDPAddr{IP: net.IP(bytes.Clone(a[0:ipl])), Port: int(binary.BigEndian.Uint16(a[2*ipl:]))}
+		h.Dst = &net.UDPAddr{IP: net.IP(bytes.Clone(a[ipl : 2*ipl])), Port: int(binary.BigEndian.Uint16(a[2*ipl+2:]))}
+	case 0x31, 0x32:
+		h.Network = "unix"
+		h.Src = &net.UnixAddr{Name: string(bytes.TrimRight(a[0:108], "\x00")), Net: "unix"}
+		h.Dst = &net.UnixAddr{Name: string(bytes.TrimRight(a[108:216], "\x00")), Net: "unix"}
+	}
+
+	tlvs := body[alen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, ErrProxyHeader
+		}
+		tl := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+tl {
+			return nil, ErrProxyHeader
+		}
+		if tlvs[0] != PP2TypeNoop {
+			h.TLVs = append(h.TLVs, TLV{Type: tlvs[0], Value: bytes.Clone(tlvs[3 : 3+tl])})
+		}
+		tlvs = tlvs[3+tl:]
+	}
+
+	br.Discard(16 + l)
+	return h, nil
+}
+
+// AppendV2 appends the binary v2 encoding of the header. If the addresses
+// are missing or of different families, a LOCAL header is generated.
+func (h *ProxyHeader) AppendV2(b []byte) []byte {
+	b = append(b, proxyV2Sig...)
+	start := len(b)
+
+	var fam byte
+	var addr []byte
+	sip, sport := addrIPPort(h.Src)
+	dip, dport := addrIPPort(h.Dst)
+	if !h.Local && sip != nil && dip != nil {
+		s4, d4 := sip.To4(), dip.To4()
+		switch {
+		case s4 != nil && d4 != nil:
+			fam = 0x10
+			addr = append(append(addr, s4...), d4...)
+		case s4 == nil && d4 == nil:
+			fam = 0x20
+			addr = append(append(addr, sip.To16()...), dip.To16()...)
+		}
+		if fam != 0 {
+			addr = binary.BigEndian.AppendUint16(addr, uint16(sport))
+			addr = binary.BigEndian.AppendUint16(addr, uint16(dport))
+			if _, ok := h.Src.(*net.UDPAddr); ok {
+				fam |= 2
+			} else {
+				fam |= 1
+			}
+		}
+	}
+	if fam == 0 {
+		b = append(b, proxyCmdLocal, 0)
+	} else {
+		b = append(b, proxyCmdProxy, fam)
+	}
+	b = append(b, 0, 0)
+	b = append(b, addr...)
+	for _, t := range h.TLVs {
+		b = append(b, t.Type)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(t.Value)))
+		b = append(b, t.Value...)
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start-4))
+	return b
+}
+
+// AppendV1 appends the text encoding. Only TCP is supported, for anything
+// else "PROXY UNKNOWN" is generated.
+func (h *ProxyHeader) AppendV1(b []byte) []byte {
+	sip, sport := addrIPPort(h.Src)
+	dip, dport := addrIPPort(h.Dst)
+	if h.Local || sip == nil || dip == nil || (sip.To4() == nil) != (dip.To4() == nil) {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	p := "TCP6"
+	if sip.To4() != nil {
+		p = "TCP4"
+		sip, dip = sip.To4(), dip.To4()
+	}
+	return append(b, "PROXY "+p+" "+sip.String()+" "+dip.String()+" "+
+		strconv.Itoa(sport)+" "+strconv.Itoa(dport)+"\r\n"...)
+}
+
+func addrIPPort(a net.Addr) (net.IP, int) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// ProxyProtocol holds the config for accepting PROXY headers.
+type ProxyProtocol struct {
+	// Trusted is the list of CIDRs allowed to send a PROXY header - typically
+	// the load balancer ranges. "*" trusts all sources, for listeners only
+	// reachable from the load balancer. If empty, no source is trusted.
+	Trusted []string `json:"trusted,omitempty"`
+
+	// Required rejects connections from trusted sources without a header.
+	// Connections from untrusted sources are never parsed.
+	Required bool `json:"required,omitempty"`
+
+	// HeaderTimeout is the max time to wait for the header. Default 5 sec.
+	HeaderTimeout time.Duration `json:"header_timeout,omitempty"`
+
+	trusted  []*net.IPNet
+	trustAll bool
+}
+
+// Provision parses the trusted CIDRs. Must be called before the listener
+// accepts connections.
+func (pp *ProxyProtocol) Provision(ctx context.Context) error {
+	pp.trusted = nil
+	pp.trustAll = false
+	for _, c := range pp.Trusted {
+		if c == "*" {
+			pp.trustAll = true
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c = c + "/32"
+			} else {
+				c = c + "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return err
+		}
+		pp.trusted = append(pp.trusted, n)
+	}
+	return nil
+}
+
+// IsTrusted returns true if the address is allowed to send PROXY headers.
+// Only the provisioned CIDRs are trusted.
+func (pp *ProxyProtocol) IsTrusted(a net.Addr) bool {
+	if pp.trustAll {
+		return true
+	}
+	ip, _ := addrIPPort(a)
+	if ip == nil {
+		return false
+	}
+	for _, n := range pp.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleHeader parses the PROXY header from a trusted conn, returning a
+// StreamConn with RemoteAddr() set to the original client. Untrusted conns
+// are returned unmodified, wrapped in a StreamConn.
+func (pp *ProxyProtocol) HandleHeader(conn net.Conn, br *BufferReader) (*StreamConn, error) {
+	if br == nil {
+		br = NewBufferReader(conn)
+	}
+	sc := NewStreamConn(&BufferedConn{Conn: conn, Reader: br})
+	if !pp.IsTrusted(conn.RemoteAddr()) {
+		return sc, nil
+	}
+
+	to := pp.HeaderTimeout
+	if to == 0 {
+		to = 5 * time.Second
+	}
+	conn.SetReadDeadline(time.Now().Add(to))
+	h, err := ReadProxyHeader(br)
+	conn.SetReadDeadline(time.Time{})
+
+	if err == ErrProxyHeader && !pp.Required {
+		return sc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc.ProxyHeader = h
+	return sc, nil
+}
+
+// ProxyListener wraps a listener, parsing PROXY headers.
+// Parsing happens in a goroutine per connection, a slow client doesn't
+// block Accept.
+type ProxyListener struct {
+	net.Listener
+	*ProxyProtocol
+
+	ch     chan net.Conn
+	err    error
+	once   sync.Once
+	closed chan struct{}
+}
+
+// NewProxyListener wraps l. The ProxyProtocol must be provisioned - a nil
+// or unprovisioned ProxyProtocol doesn't trust any source.
+func NewProxyListener(l net.Listener, pp *ProxyProtocol) *ProxyListener {
+	if pp == nil {
+		pp = &ProxyProtocol{}
+	}
+	return &ProxyListener{Listener: l, ProxyProtocol: pp,
+		ch: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (pl *ProxyListener) serve() {
+	for {
+		c, err := pl.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(interface {
+				Temporary() bool
+			}); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			pl.err = err
+			close(pl.closed)
+			return
+		}
+		go func() {
+			sc, err := pl.HandleHeader(c, nil)
+			if err != nil {
+				slog.Info("proxyproto-err", "remote", c.RemoteAddr(), "err", err)
+				c.Close()
+				return
+			}
+			select {
+			case pl.ch <- sc:
+			case <-pl.closed:
+				c.Close()
+			}
+		}()
+	}
+}
+
+// Accept returns a *StreamConn, with ProxyHeader set if the client sent one.
+func (pl *ProxyListener) Accept() (net.Conn, error) {
+	pl.once.Do(func() {
+		go pl.serve()
+	})
+	select {
+	case c := <-pl.ch:
+		return c, nil
+	case <-pl.closed:
+		return nil, pl.err
+	}
+}
+
+type proxyHeaderKey struct{}
+
+// ContextWithProxyHeader returns a context used with ProxyProtoDialer, to
+// send the header on the dialed connection.
+func ContextWithProxyHeader(ctx context.Context, h *ProxyHeader) context.Context {
+	return context.WithValue(ctx, proxyHeaderKey{}, h)
+}
+
+// ContextWithClient returns a context holding the addresses of the accepted
+// conn - the original client if it had a PROXY header.
+func ContextWithClient(ctx context.Context, c net.Conn) context.Context {
+	h := &ProxyHeader{Version: 2, Src: c.RemoteAddr(), Dst: c.LocalAddr()}
+	if sc, ok := c.(*StreamConn); ok && sc.ProxyHeader != nil && !sc.ProxyHeader.Local {
+		h.Dst = sc.ProxyHeader.Dst
+		h.TLVs = sc.ProxyHeader.TLVs
+	}
+	return ContextWithProxyHeader(ctx, h)
+}
+
+// ProxyHeaderFromContext returns the header set with ContextWithProxyHeader.
+func ProxyHeaderFromContext(ctx context.Context) *ProxyHeader {
+	h, _ := ctx.Value(proxyHeaderKey{}).(*ProxyHeader)
+	return h
+}
+
+// ProxyProtoDialer sends a PROXY v2 header on each dialed connection, so
+// backends see the real client address. The header is taken from the context,
+// if missing a LOCAL header is sent.
+type ProxyProtoDialer struct {
+	Dialer ContextDialer
+
+	// V1 sends the text header, for older backends.
+	V1 bool
+}
+
+func (pd *ProxyProtoDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := pd.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	nc, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	h := ProxyHeaderFromContext(ctx)
+	if h == nil {
+		h = &ProxyHeader{Local: true}
+	}
+	var b []byte
+	if pd.V1 {
+		b = h.AppendV1(nil)
+	} else {
+		b = h.AppendV2(nil)
+	}
+	if _, err = nc.Write(b); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return nc, nil
+}
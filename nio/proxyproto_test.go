@@ -0,0 +1,142 @@
+package nio
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+func TestProxyHeader(t *testing.T) {
+	src4 := &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 4321}
+	dst4 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 4321}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 443}
+
+	cases := []struct {
+		name string
+		h    *ProxyHeader
+		v1   bool
+	}{
+		{"v1-tcp4", &ProxyHeader{Src: src4, Dst: dst4}, true},
+		{"v1-tcp6", &ProxyHeader{Src: src6, Dst: dst6}, true},
+		{"v1-unknown", &ProxyHeader{Local: true}, true},
+		{"v2-tcp4", &ProxyHeader{Src: src4, Dst: dst4}, false},
+		{"v2-tcp6", &ProxyHeader{Src: src6, Dst: dst6,
+			TLVs: []TLV{{PP2TypeAuthority, []byte("example.com")}, {PP2TypeALPN, []byte("h2")}}}, false},
+		{"v2-udp4", &ProxyHeader{Src: &net.UDPAddr{IP: src4.IP, Port: 53}, Dst: &net.UDPAddr{IP: dst4.IP, Port: 53}}, false},
+		{"v2-local", &ProxyHeader{Local: true}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var b []byte
+			if c.v1 {
+				b = c.h.AppendV1(nil)
+			} else {
+				b = c.h.AppendV2(nil)
+			}
+			data := append(b, []byte("GET / HTTP/1.1\r\n")...)
+			br := NewBufferReader(iotest.OneByteReader(bytes.NewReader(data)))
+			h, err := ReadProxyHeader(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Local != c.h.Local {
+				t.Fatal("Local mismatch")
+			}
+			if !c.h.Local {
+				if h.Src.String() != c.h.Src.String() || h.Dst.String() != c.h.Dst.String() {
+					t.Fatal("Address mismatch", h.Src, h.Dst)
+				}
+				if h.Src.Network() != c.h.Src.Network() {
+					t.Fatal("Network mismatch", h.Network)
+				}
+			}
+			if string(h.TLV(PP2TypeAuthority)) != string(c.h.TLV(PP2TypeAuthority)) {
+				t.Fatal("TLV mismatch", h.TLVs)
+			}
+			rest, _ := io.ReadAll(br)
+			if string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Fatal("Unexpected data after header", string(rest))
+			}
+		})
+	}
+
+	for _, d := range []string{"GET / HTTP/1.1\r\n", "PROXY TCP4 1.2.3.4\r\n", "PROXY TCP4 a b 1 2\r\n", "\r\n\r\nX"} {
+		if _, err := ReadProxyHeader(NewBufferReader(bytes.NewReader([]byte(d)))); err == nil {
+			t.Error("Expected error", d)
+		}
+	}
+
+	// Short client - less bytes than the signature.
+	if _, err := ReadProxyHeader(NewBufferReader(bytes.NewReader([]byte{5, 1, 0}))); err != ErrProxyHeader {
+		t.Error("Expected ErrProxyHeader", err)
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pp := &ProxyProtocol{Trusted: []string{"127.0.0.0/8"}}
+	if err := pp.Provision(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pl := NewProxyListener(l, pp)
+	defer pl.Close()
+
+	// Dial using the PROXY dialer, with the client from the context.
+	client := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 5555}
+	ctx := ContextWithProxyHeader(context.Background(),
+		&ProxyHeader{Src: client, Dst: l.Addr(), TLVs: []TLV{{PP2TypeUniqueID, []byte("id1")}}})
+	pd := &ProxyProtoDialer{}
+	nc, err := pd.DialContext(ctx, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.Write([]byte("hello"))
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RemoteAddr().String() != client.String() {
+		t.Fatal("Unexpected remote", c.RemoteAddr())
+	}
+	sc := c.(*StreamConn)
+	if string(sc.ProxyHeader.TLV(PP2TypeUniqueID)) != "id1" {
+		t.Fatal("Missing TLV")
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatal("Unexpected data", string(b), err)
+	}
+	c.Close()
+	nc.Close()
+
+	// Untrusted source - header is passed as data.
+	pp2 := &ProxyProtocol{Trusted: []string{"10.0.0.0/8"}}
+	pp2.Provision(context.Background())
+	if pp2.IsTrusted(nc.LocalAddr()) {
+		t.Fatal("Expected untrusted")
+	}
+	if !pp2.IsTrusted(&net.TCPAddr{IP: net.IPv4(10, 1, 1, 1)}) {
+		t.Fatal("Expected trusted")
+	}
+
+	// Default is deny, "*" trusts all sources.
+	for _, tr := range [][]string{nil, {"*"}} {
+		pp3 := &ProxyProtocol{Trusted: tr}
+		pp3.Provision(context.Background())
+		if pp3.IsTrusted(nc.LocalAddr()) != (tr != nil) {
+			t.Fatal("Unexpected trust", tr)
+		}
+	}
+	if (&ProxyProtocol{Trusted: []string{"*"}}).IsTrusted(nc.LocalAddr()) {
+		t.Fatal("Expected untrusted before Provision")
+	}
+}
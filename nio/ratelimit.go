@@ -0,0 +1,272 @@
+package nio
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Bandwidth shaping using token buckets.
+//
+// Limits apply per stream, per peer (identity or IP) and per destination
+// (host suffix), for each direction. Peer and destination buckets are shared
+// by all streams of the peer or destination - a bulk transfer can't saturate
+// a metered link.
+
+// Bandwidth is the config for a limit. 0 means unlimited.
+type Bandwidth struct {
+	// Up is the max bytes per second sent to the destination.
+	Up int `json:"up,omitempty"`
+
+	// Down is the max bytes per second received from the destination.
+	Down int `json:"down,omitempty"`
+
+	// Burst in bytes. Defaults to 1/4 sec of traffic, min 32k.
+	Burst int `json:"burst,omitempty"`
+}
+
+// Limiter holds the token buckets for one stream, peer or destination.
+type Limiter struct {
+	Up   *rate.Limiter
+	Down *rate.Limiter
+
+	// Parents are shared limiters - for the peer and destination.
+	Parents []*Limiter
+}
+
+// NewLimiter creates a limiter. Directions with 0 rate are not limited.
+func NewLimiter(bw Bandwidth) *Limiter {
+	l := &Limiter{}
+	l.Set(bw)
+	return l
+}
+
+func newBucket(r, burst int) *rate.Limiter {
+	if r <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	if burst == 0 {
+		burst = r / 4
+	}
+	if burst < 32*1024 {
+		burst = 32 * 1024
+	}
+	return rate.NewLimiter(rate.Limit(r), burst)
+}
+
+func setBucket(b **rate.Limiter, r, burst int) {
+	nb := newBucket(r, burst)
+	if *b == nil {
+		*b = nb
+		return
+	}
+	(*b).SetLimit(nb.Limit())
+	(*b).SetBurst(nb.Burst())
+}
+
+// Set changes the rates. Can be called while streams are active.
+func (l *Limiter) Set(bw Bandwidth) {
+	setBucket(&l.Up, bw.Up, bw.Burst)
+	setBucket(&l.Down, bw.Down, bw.Burst)
+}
+
+// WaitN blocks until n bytes can be sent in the direction. Down is for
+// data received from the destination.
+func (l *Limiter) WaitN(ctx context.Context, n int, down bool) error {
+	for _, p := range l.Parents {
+		if err := p.WaitN(ctx, n, down); err != nil {
+			return err
+		}
+	}
+	b := l.Up
+	if down {
+		b = l.Down
+	}
+	if b == nil || b.Limit() == rate.Inf {
+		return nil
+	}
+	// rate.WaitN fails if n > burst.
+	for n > 0 {
+		c := n
+		if burst := b.Burst(); c > burst {
+			c = burst
+		}
+		if err := b.WaitN(ctx, c); err != nil {
+			return err
+		}
+		n -= c
+	}
+	return nil
+}
+
+// RateLimits holds the configured limits, and the shared peer and
+// destination buckets.
+type RateLimits struct {
+	// Stream is the default limit for each stream.
+	Stream Bandwidth `json:"stream,omitempty"`
+
+	// Peers has limits keyed by peer identity or IP address.
+	Peers map[string]Bandwidth `json:"peers,omitempty"`
+
+	// Dests has limits keyed by destination host suffix, like RouteDialer.
+	Dests map[string]Bandwidth `json:"dests,omitempty"`
+
+	// Mux is used for the /debug/ratelimits handler. Defaults to http.DefaultServeMux.
+	Mux *http.ServeMux `json:"-"`
+
+	m     sync.Mutex
+	peers map[string]*Limiter
+	dests map[string]*Limiter
+}
+
+// DefaultRateLimits is used by Proxy. If nil, only the limits set on the
+// stream by the listener are applied.
+var DefaultRateLimits *RateLimits
+
+// Provision registers the admin handler and makes the limits active.
+func (rl *RateLimits) Provision(ctx context.Context) error {
+	mux := rl.Mux
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("/debug/ratelimits", rl.HandleLimits)
+	DefaultRateLimits = rl
+	return nil
+}
+
+// Attach sets the Limiter on the stream state, combining the stream limit
+// with the shared peer and destination limits. A limiter already set on the
+// stream - by the listener - is kept.
+//
+// Streams without a matching limit get an unlimited limiter, so the limit
+// can be changed while the stream is active - see Streams.SetLimit.
+func (rl *RateLimits) Attach(st *StreamState) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+
+	var parents []*Limiter
+	if pk, ok := rl.peerKey(st); ok {
+		parents = append(parents, rl.limiter(&rl.peers, pk, rl.Peers[pk]))
+	}
+	host, _, err := net.SplitHostPort(st.Dest)
+	if err != nil {
+		host = st.Dest
+	}
+	if dk, ok := suffixMatch(rl.Dests, host); ok {
+		parents = append(parents, rl.limiter(&rl.dests, dk, rl.Dests[dk]))
+	}
+
+	if st.Limiter == nil {
+		// Streams with a limiter don't use splice, even if unlimited.
+		st.Limiter = NewLimiter(rl.Stream)
+	}
+	st.Limiter.Parents = append(st.Limiter.Parents, parents...)
+}
+
+func (rl *RateLimits) peerKey(st *StreamState) (string, bool) {
+	if st.Peer != "" {
+		if _, ok := rl.Peers[st.Peer]; ok {
+			return st.Peer, true
+		}
+	}
+	if st.PeerAddr != "" {
+		ip, _, err := net.SplitHostPort(st.PeerAddr)
+		if err != nil {
+			ip = st.PeerAddr
+		}
+		if _, ok := rl.Peers[ip]; ok {
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+func (rl *RateLimits) limiter(m *map[string]*Limiter, k string, bw Bandwidth) *Limiter {
+	if *m == nil {
+		*m = map[string]*Limiter{}
+	}
+	l := (*m)[k]
+	if l == nil {
+		l = NewLimiter(bw)
+		(*m)[k] = l
+	}
+	return l
+}
+
+// SetPeer changes the limit for a peer, including active streams.
+func (rl *RateLimits) SetPeer(peer string, bw Bandwidth) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if rl.Peers == nil {
+		rl.Peers = map[string]Bandwidth{}
+	}
+	rl.Peers[peer] = bw
+	if l := rl.peers[peer]; l != nil {
+		l.Set(bw)
+	}
+}
+
+// SetDest changes the limit for a destination suffix, including active streams.
+func (rl *RateLimits) SetDest(dest string, bw Bandwidth) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if rl.Dests == nil {
+		rl.Dests = map[string]Bandwidth{}
+	}
+	rl.Dests[dest] = bw
+	if l := rl.dests[dest]; l != nil {
+		l.Set(bw)
+	}
+}
+
+// HandleLimits returns the config on GET. On POST, the body is a RateLimits
+// JSON and the peer and destination limits are updated.
+//
+// curl -XPOST localhost:15000/debug/ratelimits -d '{"peers":{"10.1.1.2":{"down":100000}}}'
+func (rl *RateLimits) HandleLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		upd := &RateLimits{}
+		if err := json.NewDecoder(r.Body).Decode(upd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for k, v := range upd.Peers {
+			rl.SetPeer(k, v)
+		}
+		for k, v := range upd.Dests {
+			rl.SetDest(k, v)
+		}
+	}
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(rl)
+}
+
+// suffixMatch returns the longest key in m matching host - either equal
+// or a parent domain. "*" is the default.
+func suffixMatch[V any](m map[string]V, host string) (string, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for h := host; ; {
+		if _, ok := m[h]; ok {
+			return h, true
+		}
+		if _, ok := m["."+h]; ok {
+			return "." + h, true
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+	if _, ok := m["*"]; ok {
+		return "*", true
+	}
+	return "", false
+}
@@ -0,0 +1,108 @@
+package nio
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(Bandwidth{Up: 256 * 1024})
+	out := &bytes.Buffer{}
+	rc := &ReaderCopier{
+		In:      bytes.NewReader(make([]byte, 160*1024)),
+		Out:     out,
+		Limiter: l,
+	}
+	t0 := time.Now()
+	rc.Copy(nil, false)
+	// 64k burst, the rest at 256k/s
+	if d := time.Since(t0); d < 300*time.Millisecond {
+		t.Error("Not limited", d)
+	}
+	if out.Len() != 160*1024 {
+		t.Error("Short copy", out.Len())
+	}
+
+	// Down direction is not limited.
+	rc = &ReaderCopier{
+		In:      bytes.NewReader(make([]byte, 1024*1024)),
+		Out:     io.Discard,
+		Limiter: l,
+		Rcvd:    true,
+	}
+	t0 = time.Now()
+	rc.Copy(nil, false)
+	if d := time.Since(t0); d > 200*time.Millisecond {
+		t.Error("Unexpected limit", d)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	rl := &RateLimits{
+		Peers: map[string]Bandwidth{"10.1.1.1": {Down: 100000}},
+		Dests: map[string]Bandwidth{"example.com": {Up: 200000}},
+	}
+
+	st := &StreamState{Dest: "www.example.com:443", PeerAddr: "10.1.1.1:5555"}
+	rl.Attach(st)
+	if st.Limiter == nil || len(st.Limiter.Parents) != 2 {
+		t.Fatal("Expected peer and dest limiters", st.Limiter)
+	}
+	peer, dest := st.Limiter.Parents[0], st.Limiter.Parents[1]
+	if peer.Down.Limit() != 100000 || dest.Up.Limit() != 200000 || dest.Down.Limit() != rate.Inf {
+		t.Fatal("Unexpected limits")
+	}
+
+	// Shared with other streams of the peer.
+	st2 := &StreamState{Dest: "other.com:443", PeerAddr: "10.1.1.1:5556"}
+	rl.Attach(st2)
+	if len(st2.Limiter.Parents) != 1 || st2.Limiter.Parents[0] != peer {
+		t.Fatal("Expected shared peer limiter")
+	}
+
+	// Runtime change applies to active streams.
+	rl.SetPeer("10.1.1.1", Bandwidth{Down: 50000})
+	if peer.Down.Limit() != 50000 {
+		t.Fatal("Limit not updated", peer.Down.Limit())
+	}
+
+	// No match - unlimited, but can be changed at runtime.
+	st3 := &StreamState{Dest: "other.com:443", PeerAddr: "10.2.2.2:1"}
+	rl.Attach(st3)
+	if st3.Limiter == nil || len(st3.Limiter.Parents) != 0 ||
+		st3.Limiter.Up.Limit() != rate.Inf || st3.Limiter.Down.Limit() != rate.Inf {
+		t.Fatal("Expected unlimited stream", st3.Limiter)
+	}
+
+	rl.Stream = Bandwidth{Up: 1000}
+	st4 := &StreamState{Dest: "other.com:443", PeerAddr: "10.2.2.2:1"}
+	rl.Attach(st4)
+	if st4.Limiter == nil || len(st4.Limiter.Parents) != 0 || st4.Limiter.Up.Limit() != 1000 {
+		t.Fatal("Expected stream limit")
+	}
+	st4.Limiter.Set(Bandwidth{Up: 2000})
+	if st4.Limiter.Up.Limit() != 2000 {
+		t.Fatal("Stream limit not updated")
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := &ReaderCopier{
+		In:      bytes.NewReader(make([]byte, 1024*1024)),
+		Out:     io.Discard,
+		Limiter: NewLimiter(Bandwidth{Up: 32 * 1024}),
+		Ctx:     ctx,
+	}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	t0 := time.Now()
+	rc.Copy(nil, false)
+	if rc.Err != context.Canceled || time.Since(t0) > time.Second {
+		t.Fatal("Expected the wait to be canceled", rc.Err, time.Since(t0))
+	}
+}
@@ -10,26 +10,67 @@ var sniErr = errors.New("Invalid TLS")
 
 // ClientHelloMsg is a subset of the TLS ClientHello
 type ClientHelloMsg struct {
-	Raw []byte
+	Raw []byte `json:"-"`
 
 	vers uint16
 	//random              []byte
-	SessionID    []byte
+	SessionID    []byte `json:"-"`
 	CipherSuites []uint16
 	//compressionMethods  []uint8
 	ServerName string
 	//ocspStapling        bool
 	//scts                bool
-	//supportedPoints     []uint8
+	SupportedPoints []uint8 `json:",omitempty"`
 	//ticketSupported     bool
 	//sessionTicket       []uint8
 	//secureRenegotiation []byte
-	//AlpnProtocols                    []string
+	AlpnProtocols []string `json:",omitempty"`
+
+	// SupportedVersions from the supported_versions extension, in client
+	// preference order. TLS 1.3 clients use this instead of the legacy version.
+	SupportedVersions []uint16 `json:",omitempty"`
+
+	// SupportedGroups (elliptic curves) offered by the client.
+	SupportedGroups []uint16 `json:",omitempty"`
+
+	// KeyShareGroups are the groups with a key share in the hello.
+	KeyShareGroups []uint16 `json:",omitempty"`
+
+	SignatureAlgorithms []uint16 `json:",omitempty"`
+
+	// PSKModes from psk_key_exchange_modes.
+	PSKModes []uint8 `json:",omitempty"`
+
+	// ECH is the encrypted_client_hello extension payload, if present. The
+	// ServerName is the public (outer) name.
+	ECH []byte `json:"-"`
+
+	// Extensions in the order sent by the client, including GREASE.
+	Extensions []uint16 `json:",omitempty"`
+}
+
+// Version returns the highest version offered by the client.
+func (m *ClientHelloMsg) Version() uint16 {
+	v := m.vers
+	for _, sv := range m.SupportedVersions {
+		if !isGREASE(sv) && sv > v {
+			v = sv
+		}
+	}
+	return v
 }
 
 // TLS extension numbers
 const (
-	extensionServerName uint16 = 0
+	extensionServerName          uint16 = 0
+	extensionSupportedGroups     uint16 = 10
+	extensionSupportedPoints     uint16 = 11
+	extensionSignatureAlgorithms uint16 = 13
+	extensionALPN                uint16 = 16
+	extensionSupportedVersions   uint16 = 43
+	extensionPSKModes            uint16 = 45
+	extensionKeyShare            uint16 = 51
+	extensionECH                 uint16 = 0xfe0d
 )
 
 // SniffClientHello will peek into acc and read enough for parsing a
@@ -62,7 +103,7 @@ func SniffClientHello(acc *BufferReader) (*ClientHelloMsg, string, error) {
 		return nil, "", err
 	}
 	vers := uint16(buf[1])<<8 | uint16(buf[2])
-	if vers != 0x301 {
+	if vers < 0x301 || vers > 0x303 {
 		log.Println("Version ", vers)
 	}
 
@@ -131,55 +172,152 @@ func SniffClientHello(acc *BufferReader) (*ClientHelloMsg, string, error) {
 	}
 
 	for off < rlen {
+		if off+4 > rlen {
+			return nil, "", sniErr
+		}
 		extension := uint16(clientHello[off])<<8 | uint16(clientHello[off+1])
 		off += 2
 		length := int(clientHello[off])<<8 | int(clientHello[off+1])
 		off += 2
-		if off >= end {
+		if off+length > rlen {
 			return nil, "", sniErr
 		}
+		d := clientHello[off : off+length]
+		off += length
+
+		m.Extensions = append(m.Extensions, extension)
+		if err := m.parseExtension(extension, d); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Does not contain port !!! Assume the port is 443, or map it.
 
-		switch extension {
-		case extensionServerName:
-			d := clientHello[off : off+length]
-			if len(d) < 2 {
-				return nil, "", sniErr
+	return &m, m.ServerName, nil
+}
+
+func (m *ClientHelloMsg) parseExtension(extension uint16, d []byte) error {
+	switch extension {
+	case extensionServerName:
+		if len(d) < 2 {
+			return sniErr
+		}
+		namesLen := int(d[0])<<8 | int(d[1])
+		d = d[2:]
+		if len(d) != namesLen {
+			return sniErr
+		}
+		for len(d) > 0 {
+			if len(d) < 3 {
+				return sniErr
 			}
-			namesLen := int(d[0])<<8 | int(d[1])
-			d = d[2:]
-			if len(d) != namesLen {
-				return nil, "", sniErr
+			nameType := d[0]
+			nameLen := int(d[1])<<8 | int(d[2])
+			d = d[3:]
+			if len(d) < nameLen {
+				return sniErr
 			}
-			for len(d) > 0 {
-				if len(d) < 3 {
-					return nil, "", sniErr
-				}
-				nameType := d[0]
-				nameLen := int(d[1])<<8 | int(d[2])
-				d = d[3:]
-				if len(d) < nameLen {
-					return nil, "", sniErr
+			if nameType == 0 {
+				m.ServerName = string(d[:nameLen])
+				// An SNI value may not include a
+				// trailing dot. See
+				// https://tools.ietf.org/html/rfc6066#section-3.
+				if strings.HasSuffix(m.ServerName, ".") {
+					return sniErr
 				}
-				if nameType == 0 {
-					m.ServerName = string(d[:nameLen])
-					// An SNI value may not include a
-					// trailing dot. See
-					// https://tools.ietf.org/html/rfc6066#section-3.
-					if strings.HasSuffix(m.ServerName, ".") {
-						return nil, "", sniErr
-					}
-					break
-				}
-				d = d[nameLen:]
+				break
 			}
-		default:
-			//log.Println("TLS Ext", extension, length)
+			d = d[nameLen:]
 		}
-
-		off += length
+	case extensionALPN:
+		l, ok := vec16(d)
+		if !ok {
+			return sniErr
+		}
+		for len(l) > 0 {
+			pl := int(l[0])
+			if pl == 0 || len(l) < 1+pl {
+				return sniErr
+			}
+			m.AlpnProtocols = append(m.AlpnProtocols, string(l[1:1+pl]))
+			l = l[1+pl:]
+		}
+	case extensionSupportedVersions:
+		if len(d) < 1 || len(d) != 1+int(d[0]) {
+			return sniErr
+		}
+		vs, ok := uint16s(d[1:])
+		if !ok {
+			return sniErr
+		}
+		m.SupportedVersions = vs
+	case extensionSupportedGroups:
+		l, ok := vec16(d)
+		if !ok {
+			return sniErr
+		}
+		if m.SupportedGroups, ok = uint16s(l); !ok {
+			return sniErr
+		}
+	case extensionSupportedPoints:
+		if len(d) < 1 || len(d) != 1+int(d[0]) {
+			return sniErr
+		}
+		m.SupportedPoints = d[1:]
+	case extensionSignatureAlgorithms:
+		l, ok := vec16(d)
+		if !ok {
+			return sniErr
+		}
+		if m.SignatureAlgorithms, ok = uint16s(l); !ok {
+			return sniErr
+		}
+	case extensionPSKModes:
+		if len(d) < 1 || len(d) != 1+int(d[0]) {
+			return sniErr
+		}
+		m.PSKModes = d[1:]
+	case extensionKeyShare:
+		l, ok := vec16(d)
+		if !ok {
+			return sniErr
+		}
+		for len(l) > 0 {
+			if len(l) < 4 {
+				return sniErr
+			}
+			group := uint16(l[0])<<8 | uint16(l[1])
+			kl := int(l[2])<<8 | int(l[3])
+			if len(l) < 4+kl {
+				return sniErr
+			}
+			m.KeyShareGroups = append(m.KeyShareGroups, group)
+			l = l[4+kl:]
+		}
+	case extensionECH:
+		m.ECH = d
+	default:
+		//log.Println("TLS Ext", extension, length)
 	}
+	return nil
+}
 
-	// Does not contain port !!! Assume the port is 443, or map it.
+// vec16 returns the content of a vector with a 2-byte length, which must
+// be the entire d.
+func vec16(d []byte) ([]byte, bool) {
+	if len(d) < 2 || len(d) != 2+(int(d[0])<<8|int(d[1])) {
+		return nil, false
+	}
+	return d[2:], true
+}
 
-	return &m, m.ServerName, nil
+func uint16s(d []byte) ([]uint16, bool) {
+	if len(d)%2 != 0 {
+		return nil, false
+	}
+	r := make([]uint16, len(d)/2)
+	for i := range r {
+		r[i] = uint16(d[2*i])<<8 | uint16(d[2*i+1])
+	}
+	return r, true
 }
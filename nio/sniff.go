@@ -1,61 +1,386 @@
 package nio
 
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
 // Auto-detect protocol on the wire, so routing info can be
-// extracted:
-// - TLS ( 22, 3)
-// - HTTP
-// - WS ( CONNECT )
-// - SOCKS (5)
-// - H2
-// - TODO: HAproxy
-//func sniff(pl *ugate.Listener, br *stream.Buffer) error {
-//	br.Sniff()
-//	var proto string
-//
-//	for {
-//		_, err := br.Fill()
-//		if err != nil {
-//			return err
-//		}
-//		off := br.end
-//		if off >= 2 {
-//			b0 := br.buf[0]
-//			b1 := br.buf[1]
-//			if b0 == 5 {
-//				proto = ProtoSocks
-//				break
-//			}
-//			// TLS or SNI - based on the hostname we may terminate locally !
-//			if b0 == 22 && b1 == 3 {
-//				// 22 03 01..03
-//				proto = ProtoTLS
-//				break
-//			}
-//		}
-//		if off >= 7 {
-//			if bytes.Equal(br.buf[0:7], []byte("CONNECT")) {
-//				proto = ProtoConnect
-//				break
-//			}
-//		}
-//		if off >= len(h2ClientPreface) {
-//			if bytes.Equal(br.buf[0:len(h2ClientPreface)], h2ClientPreface) {
-//				proto = ProtoH2
-//				break
-//			}
-//		}
-//	}
+// extracted and a single port can serve multiple protocols:
+// - TLS ( 22, 3) - SNI routing or termination
+// - HTTP/1.x, including absolute URL (proxy) requests
+// - CONNECT
+// - H2 prior knowledge (h2c)
+// - SOCKS (4, 5)
+// - HAProxy PROXY protocol v1 and v2
+// - SSH - client sends the version banner first.
 //
-//	// All bytes in the buffer will be Read again
-//	br.Reset(0)
+// Server-first protocols (SMTP, MySQL) can't be detected - use a dedicated
+// port or the Default handler.
+
+const (
+	ProtoTLS     = "tls"
+	ProtoHTTP    = "http"
+	ProtoConnect = "connect"
+	ProtoH2      = "h2c"
+	ProtoSocks4  = "socks4"
+	ProtoSocks5  = "socks5"
+	ProtoProxyV1 = "proxy1"
+	ProtoProxyV2 = "proxy2"
+	ProtoSSH     = "ssh"
+)
+
+var (
+	h2ClientPreface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+	// PROXY protocol v2 signature
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrUnknownProto = errors.New("unknown protocol")
+)
+
+// Fixed prefixes, matched as data arrives. Binary protocols (TLS, SOCKS) are
+// checked separately.
+var sniffPrefixes = []struct {
+	prefix []byte
+	proto  string
+}{
+	{h2ClientPreface, ProtoH2},
+	{[]byte("PROXY "), ProtoProxyV1},
+	{proxyV2Sig, ProtoProxyV2},
+	{[]byte("SSH-"), ProtoSSH},
+	{[]byte("CONNECT "), ProtoConnect},
+	{[]byte("GET "), ProtoHTTP},
+	{[]byte("HEAD "), ProtoHTTP},
+	{[]byte("POST "), ProtoHTTP},
+	{[]byte("PUT "), ProtoHTTP},
+	{[]byte("DELETE "), ProtoHTTP},
+	{[]byte("OPTIONS "), ProtoHTTP},
+	{[]byte("PATCH "), ProtoHTTP},
+	{[]byte("TRACE "), ProtoHTTP},
+}
+
+// Sniff will peek into the stream until the protocol can be determined.
+// All bytes are left in the buffer - the next Read will return them.
 //
-//	switch proto {
-//	case ProtoSocks:
-//		pl.gate.readSocksHeader(br)
-//	case ProtoTLS:
-//		pl.gate.sniffSNI(br)
-//	}
-//	br.InOutStream.Type = proto
+// Returns "" and ErrUnknownProto if the first bytes don't match any known protocol.
+func Sniff(br *BufferReader) (string, error) {
+	buf, err := br.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		proto, more := sniffBytes(buf)
+		if proto != "" {
+			return proto, nil
+		}
+		if !more {
+			return "", ErrUnknownProto
+		}
+		// Partial match - wait for at least one more byte.
+		buf, err = br.Peek(len(buf) + 1)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// sniffBytes checks the available data. If the protocol can't be determined
+// yet, returns "" and more=true if additional bytes may match.
+func sniffBytes(buf []byte) (proto string, more bool) {
+	switch buf[0] {
+	case 0x16:
+		// TLS handshake record: 22 3 [1..4]
+		if len(buf) < 2 {
+			return "", true
+		}
+		if buf[1] == 3 {
+			return ProtoTLS, false
+		}
+		return "", false
+	case 5:
+		// VER, NMETHODS - at least one method
+		if len(buf) < 2 {
+			return "", true
+		}
+		if buf[1] > 0 {
+			return ProtoSocks5, false
+		}
+		return "", false
+	case 4:
+		// VER, CMD (CONNECT or BIND)
+		if len(buf) < 2 {
+			return "", true
+		}
+		if buf[1] == 1 || buf[1] == 2 {
+			return ProtoSocks4, false
+		}
+		return "", false
+	}
+
+	for _, p := range sniffPrefixes {
+		n := len(buf)
+		if n > len(p.prefix) {
+			n = len(p.prefix)
+		}
+		if !bytes.Equal(buf[0:n], p.prefix[0:n]) {
+			continue
+		}
+		if n == len(p.prefix) {
+			return p.proto, false
+		}
+		more = true
+	}
+	return "", more
+}
+
+// ConnHandler handles an accepted connection. Implemented by SNIHandler, echo
+// and other protocol modules, so they can be plugged into a SniffListener.
+type ConnHandler interface {
+	HandleConn(conn net.Conn) error
+}
+
+var (
+	connHandlersM sync.RWMutex
+	connHandlers  = map[string]ConnHandler{}
+)
+
+// RegisterConnHandler makes a handler module available by name, for the
+// Routes of a SniffListener.
+func RegisterConnHandler(name string, h ConnHandler) {
+	connHandlersM.Lock()
+	connHandlers[name] = h
+	connHandlersM.Unlock()
+}
+
+// GetConnHandler returns the handler registered with the name, or nil.
+func GetConnHandler(name string) ConnHandler {
+	connHandlersM.RLock()
+	defer connHandlersM.RUnlock()
+	return connHandlers[name]
+}
+
+// SniffListener accepts connections on a single port and dispatches them to
+// a handler based on the detected protocol.
 //
-//	return nil
-//}
+// The handler gets a *StreamConn with the Proto set - reading from it will
+// first return the sniffed bytes, so handlers can parse the stream as if
+// they were the only protocol on the port.
+type SniffListener struct {
+	// Address to listen on. If empty, and NetListener is not set, the
+	// SniffListener is only used as a ConnHandler.
+	Address string `json:"address,omitempty"`
+
+	NetListener net.Listener `json:"-"`
+
+	// Routes selects the handler for each protocol by module name - for
+	// example {"tls": "sni", "socks5": "socks"}. "*" sets the Default.
+	// Resolved in Start from the handlers registered with
+	// RegisterConnHandler.
+	Routes map[string]string `json:"routes,omitempty"`
+
+	// Handlers by protocol - ProtoTLS, ProtoSocks5, etc. Set from Routes,
+	// or directly by code.
+	Handlers map[string]ConnHandler `json:"-"`
+
+	// Default is used for unknown protocols or if no handler is registered.
+	// If nil, the connection is closed.
+	Default ConnHandler `json:"-"`
+
+	// SniffTimeout is the max time to wait for the client to send enough bytes.
+	// Default 5 seconds.
+	SniffTimeout time.Duration
+
+	// ProxyProtocol, if set, enables parsing PROXY headers from trusted
+	// sources. The protocol is detected after the header.
+	ProxyProtocol *ProxyProtocol `json:"proxy_protocol,omitempty"`
+
+	// Bandwidth, if set, limits each accepted stream.
+	Bandwidth *Bandwidth `json:"bandwidth,omitempty"`
+
+	// Timeouts, if set, apply to each accepted stream.
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+
+	// Terminate makes the listener do the TLS handshake, using kTLS if
+	// possible, and pass the plaintext stream to the ProtoTLS handler.
+	// Otherwise the handler gets the TLS stream, for SNI routing.
+	Terminate bool `json:"terminate,omitempty"`
+
+	// TLSConfig for Terminate. Defaults to the mesh certificates.
+	TLSConfig *tls.Config `json:"-"`
+}
+
+// Provision parses the ProxyProtocol trusted sources, sets the TLSConfig if
+// Terminate is set and listens on Address.
+func (sl *SniffListener) Provision(ctx context.Context) error {
+	if sl.Terminate && sl.TLSConfig == nil {
+		if DefaultTLS == nil {
+			return errors.New("sniff: terminate requires a TLSConfig or mesh certificates")
+		}
+		sl.TLSConfig = DefaultTLS.ServerConfig()
+	}
+	if sl.ProxyProtocol != nil {
+		if err := sl.ProxyProtocol.Provision(ctx); err != nil {
+			return err
+		}
+	}
+	if sl.NetListener == nil && sl.Address != "" {
+		l, err := net.Listen("tcp", sl.Address)
+		if err != nil {
+			return err
+		}
+		sl.NetListener = l
+	}
+	return nil
+}
+
+// Start resolves the Routes - all modules are provisioned - and starts
+// accepting connections.
+func (sl *SniffListener) Start(ctx context.Context) error {
+	for proto, name := range sl.Routes {
+		h := GetConnHandler(name)
+		if h == nil {
+			return errors.New("sniff: no handler " + name + " for " + proto)
+		}
+		if proto == "*" {
+			sl.Default = h
+			continue
+		}
+		if sl.Handlers == nil {
+			sl.Handlers = map[string]ConnHandler{}
+		}
+		sl.Handlers[proto] = h
+	}
+	if sl.NetListener != nil {
+		go sl.serve()
+	}
+	return nil
+}
+
+func (sl *SniffListener) serve() {
+	for {
+		c, err := sl.NetListener.Accept()
+		if err != nil {
+			if ne, ok := err.(interface {
+				Temporary() bool
+			}); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go sl.HandleConn(c)
+	}
+}
+
+// HandleConn detects the protocol and calls the matching handler.
+// The SniffListener can also be used as the handler for another listener.
+func (sl *SniffListener) HandleConn(conn net.Conn) error {
+	to := sl.SniffTimeout
+	if to == 0 {
+		to = 5 * time.Second
+	}
+	br := NewBufferReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(to))
+	proto, err := Sniff(br)
+	conn.SetReadDeadline(time.Time{})
+
+	var ph *ProxyHeader
+	if err == nil && (proto == ProtoProxyV1 || proto == ProtoProxyV2) &&
+		sl.ProxyProtocol != nil && sl.ProxyProtocol.IsTrusted(conn.RemoteAddr()) {
+		conn.SetReadDeadline(time.Now().Add(to))
+		ph, err = ReadProxyHeader(br)
+		if err == nil {
+			proto, err = Sniff(br)
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+
+	if err != nil && err != ErrUnknownProto {
+		conn.Close()
+		return err
+	}
+
+	h := sl.Handlers[proto]
+	if h == nil {
+		h = sl.Default
+	}
+	if h == nil {
+		slog.Info("sniff-nohandler", "proto", proto, "remote", conn.RemoteAddr())
+		conn.Close()
+		if err == nil {
+			err = ErrUnknownProto
+		}
+		return err
+	}
+
+	var c net.Conn = &BufferedConn{Conn: conn, Reader: br}
+	if proto == ProtoTLS && sl.Terminate {
+		ctx, cancel := context.WithTimeout(context.Background(), to)
+		c, err = KTLSServer(ctx, c, sl.TLSConfig)
+		cancel()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	sc := NewStreamConn(c)
+	sc.Proto = proto
+	sc.ListenerName = "sniff"
+	sc.ProxyHeader = ph
+	if sl.Bandwidth != nil {
+		sc.Limiter = NewLimiter(*sl.Bandwidth)
+	}
+	sc.Timeouts = sl.Timeouts
+	return h.HandleConn(sc)
+}
+
+// BufferedConn is a net.Conn that first returns the data buffered in Reader,
+// typically after sniffing or parsing a header.
+type BufferedConn struct {
+	net.Conn
+	Reader *BufferReader
+}
+
+func (c *BufferedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+// CloseWrite sends a FIN, if the underlying connection supports it.
+func (c *BufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// WriteTo drains the buffer, then copies directly from the connection,
+// allowing splice if the destination is a TCPConn.
+func (c *BufferedConn) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	b := c.Reader.Buffer
+	if b.Size() > 0 {
+		bn, err := w.Write(b.Bytes())
+		n += int64(bn)
+		b.Discard(bn)
+		if err != nil {
+			return n, err
+		}
+	}
+	if rf, ok := w.(io.ReaderFrom); ok {
+		cn, err := rf.ReadFrom(c.Conn)
+		return n + cn, err
+	}
+	cn, err := io.Copy(w, c.Conn)
+	return n + cn, err
+}
@@ -0,0 +1,212 @@
+package nio
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSniff(t *testing.T) {
+	cases := []struct {
+		name  string
+		data  []byte
+		proto string
+	}{
+		{"tls", []byte{0x16, 3, 1, 0, 200, 1}, ProtoTLS},
+		{"socks5", []byte{5, 1, 0}, ProtoSocks5},
+		{"socks4", []byte{4, 1, 0, 80, 1, 2, 3, 4, 0}, ProtoSocks4},
+		{"h2", append(h2ClientPreface, 0, 0, 0), ProtoH2},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), ProtoHTTP},
+		{"post", []byte("POST /x HTTP/1.1\r\n"), ProtoHTTP},
+		{"connect", []byte("CONNECT a:443 HTTP/1.1\r\n"), ProtoConnect},
+		{"proxy1", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 2\r\n"), ProtoProxyV1},
+		{"proxy2", append(proxyV2Sig, 0x21, 0x11, 0, 0), ProtoProxyV2},
+		{"ssh", []byte("SSH-2.0-OpenSSH_9.6\r\n"), ProtoSSH},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// One byte at a time, to check partial prefixes.
+			br := NewBufferReader(iotest.OneByteReader(bytes.NewReader(c.data)))
+			p, err := Sniff(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != c.proto {
+				t.Fatal("Expected", c.proto, "got", p)
+			}
+			all, _ := io.ReadAll(br)
+			if !bytes.Equal(all, c.data) {
+				t.Fatal("Data not preserved", all)
+			}
+		})
+	}
+
+	for _, d := range [][]byte{[]byte("HELO x\r\n"), {0x16, 1}, {5, 0}, []byte("PRX")} {
+		br := NewBufferReader(bytes.NewReader(d))
+		p, err := Sniff(br)
+		if err == nil {
+			t.Error("Expected error", d, p)
+		}
+	}
+}
+
+type testConnHandler struct {
+	ch chan []byte
+}
+
+func (h *testConnHandler) HandleConn(c net.Conn) error {
+	b := make([]byte, 1024)
+	n, _ := io.ReadAtLeast(c, b, 7)
+	if sc, ok := c.(*StreamConn); ok && sc.Proto == ProtoSocks5 {
+		h.ch <- b[0:n]
+	}
+	return c.Close()
+}
+
+func TestSniffListener(t *testing.T) {
+	h := &testConnHandler{ch: make(chan []byte, 1)}
+	sl := &SniffListener{Handlers: map[string]ConnHandler{ProtoSocks5: h}}
+
+	c1, c2 := net.Pipe()
+	go sl.HandleConn(c2)
+
+	c1.Write([]byte{5, 1, 0})
+	c1.Write([]byte{5, 1, 0, 1})
+	got := <-h.ch
+	if !bytes.Equal(got, []byte{5, 1, 0, 5, 1, 0, 1}) {
+		t.Fatal("Unexpected data", got)
+	}
+	c1.Close()
+
+	// Handlers by module name, from the config.
+	RegisterConnHandler("test-socks", h)
+	sl = &SniffListener{Address: "127.0.0.1:0", Routes: map[string]string{ProtoSocks5: "test-socks"}}
+	if err := sl.Provision(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer sl.NetListener.Close()
+	if err := sl.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", sl.NetListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{5, 1, 0, 5, 1, 0, 1})
+	if got := <-h.ch; !bytes.Equal(got, []byte{5, 1, 0, 5, 1, 0, 1}) {
+		t.Fatal("Unexpected data", got)
+	}
+
+	sl = &SniffListener{Routes: map[string]string{"*": "missing"}}
+	if err := sl.Start(context.Background()); err == nil {
+		t.Fatal("Expected error for missing handler")
+	}
+}
+
+func TestSniffClientHello(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go func() {
+		tc := tls.Client(c1, &tls.Config{
+			ServerName: "www.example.com",
+			NextProtos: []string{"h2", "http/1.1"},
+		})
+		tc.Handshake()
+	}()
+	defer c1.Close()
+
+	br := NewBufferReader(c2)
+	ch, sni, err := SniffClientHello(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sni != "www.example.com" {
+		t.Fatal("Unexpected SNI", sni)
+	}
+	if len(ch.AlpnProtocols) != 2 || ch.AlpnProtocols[0] != "h2" {
+		t.Fatal("Unexpected ALPN", ch.AlpnProtocols)
+	}
+	if ch.Version() != tls.VersionTLS13 || len(ch.SupportedVersions) == 0 {
+		t.Fatal("Expected TLS 1.3", ch.SupportedVersions)
+	}
+	// Go only sends psk_key_exchange_modes if it has a session ticket.
+	if len(ch.KeyShareGroups) == 0 || len(ch.SignatureAlgorithms) == 0 ||
+		len(ch.SupportedGroups) == 0 {
+		t.Fatal("Missing extensions", ch.Extensions)
+	}
+
+	if !strings.HasPrefix(ch.JA3String(), "771,") || len(ch.JA3()) != 32 {
+		t.Fatal("Unexpected JA3", ch.JA3String())
+	}
+	ja4 := ch.JA4()
+	parts := strings.Split(ja4, "_")
+	if len(parts) != 3 || !strings.HasPrefix(ja4, "t13d") || !strings.HasSuffix(parts[0], "h2") ||
+		len(parts[1]) != 12 || len(parts[2]) != 12 {
+		t.Fatal("Unexpected JA4", ja4)
+	}
+
+	// GREASE values don't change the fingerprints.
+	ch2 := *ch
+	ch2.CipherSuites = append([]uint16{0x0a0a}, ch.CipherSuites...)
+	ch2.Extensions = append([]uint16{0x1a1a}, ch.Extensions...)
+	if ch2.JA4() != ja4 || ch2.JA3() != ch.JA3() {
+		t.Fatal("GREASE not ignored")
+	}
+
+	// Bytes are left in the buffer.
+	b, _ := br.Peek(5)
+	if b[0] != 0x16 {
+		t.Fatal("ClientHello consumed")
+	}
+}
+
+// TestClientHelloFingerprints checks JA3 and JA4 against the reference
+// values for fixed ClientHello captures. The chrome captures have the same
+// hello with GREASE ciphers, groups, versions and extensions, and the
+// extensions in a different order - the JA4 values are the example from the
+// JA4 spec, the JA3 string and MD5 are computed like the salesforce/ja3
+// script. The ja3 capture is the example in the JA3 README.
+func TestClientHelloFingerprints(t *testing.T) {
+	for _, tc := range []struct {
+		file, ja3s, ja3, ja4 string
+	}{
+		{"clienthello_chrome1.hex",
+			"771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+				"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+			"cd08e31494f9531f560d64c695473da9", "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		{"clienthello_chrome2.hex",
+			"771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+				"51-27-16-43-5-17513-0-13-18-65281-45-35-10-23-11-21,29-23-24,0",
+			"9e71dab4cadeca1ec656dc97141cf5c7", "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		{"clienthello_ja3.hex",
+			"769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0",
+			"ada70206e40642a3e4461f35503241d5", ""},
+	} {
+		h, err := os.ReadFile(filepath.Join("testdata", tc.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := hex.DecodeString(strings.TrimSpace(string(h)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch, _, err := SniffClientHello(NewBufferReader(bytes.NewReader(b)))
+		if err != nil || ch == nil {
+			t.Fatal(tc.file, err)
+		}
+		if ch.JA3String() != tc.ja3s || ch.JA3() != tc.ja3 {
+			t.Error(tc.file, "unexpected JA3", ch.JA3String(), ch.JA3())
+		}
+		if tc.ja4 != "" && ch.JA4() != tc.ja4 {
+			t.Error(tc.file, "unexpected JA4", ch.JA4())
+		}
+	}
+}
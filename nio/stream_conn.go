@@ -36,11 +36,24 @@ func (s *StreamConn) Close() error {
 	return s.Conn.Close()
 }
 
+// CloseWrite sends a FIN if the connection supports it, otherwise closes it.
+func (s *StreamConn) CloseWrite() error {
+	if cw, ok := s.Conn.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return s.Conn.Close()
+}
+
 func (s *StreamConn) LocalAddr() net.Addr {
 	return s.Conn.LocalAddr()
 }
 
+// RemoteAddr returns the original client address if the conn had a PROXY
+// header.
 func (s *StreamConn) RemoteAddr() net.Addr {
+	if h := s.ProxyHeader; h != nil && !h.Local && h.Src != nil {
+		return h.Src
+	}
 	return s.Conn.RemoteAddr()
 }
 
@@ -89,6 +102,9 @@ func NewStreamConn(r net.Conn) *StreamConn { // *StreamHttpServer {
 	if tc, ok := r.(*tls.Conn); ok {
 		cs := tc.ConnectionState()
 		ss.TLS = &cs
+	} else if kc, ok := r.(*KTLSConn); ok {
+		cs := kc.ConnectionState()
+		ss.TLS = &cs
 	}
 	return ss
 }
@@ -3,11 +3,13 @@ package nio
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"log/slog"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -36,6 +38,15 @@ type H2Dialer struct {
 
 	// TODO: just RoundTripper.
 	HttpClient *http.Client
+
+	// Pool, if set, is used instead of HttpClient - the streams are
+	// created on pooled connections to DestID. If neither is set, the
+	// DefaultConnPool is used for https URLs - it dials with TLS.
+	Pool *ConnPool
+
+	// DestID is the identity of the tunnel server - mesh ID or host:port.
+	// It is the pool key, defaults to the host of H2TunURL.
+	DestID string
 }
 
 func (h2d *H2Dialer) DialContext(ctx context.Context, net, addr string) (net.Conn, error) {
@@ -47,21 +58,39 @@ func (h2d *H2Dialer) DialContext(ctx context.Context, net, addr string) (net.Con
 
 	r, w := io.Pipe()
 
-	req, res, err := h2d.CopyTo(ctx, net, addr, r)
+	req, res, release, err := h2d.roundTrip(ctx, addr, r)
 	if err != nil {
 		return nil, err
 	}
-	return newStreamHttpRequest(w, req, res), nil
+	s := newStreamHttpRequest(w, req, res)
+	if release != nil {
+		var once sync.Once
+		s.ReadCloser = func() {
+			once.Do(release)
+		}
+	}
+	return s, nil
 }
 
 func (h2d *H2Dialer) CopyTo(ctx context.Context, net, addr string, r io.Reader) (*http.Request, *http.Response, error) {
-	req, _ := http.NewRequest("POST", h2d.H2TunURL, r)
+	req, res, release, err := h2d.roundTrip(ctx, addr, r)
+	if release != nil {
+		// The caller owns the body - the slot is released when it is closed.
+		res.Body = &releaseBody{ReadCloser: res.Body, release: release}
+	}
+	return req, res, err
+}
+
+// roundTrip sends the tunnel request. If a pool is used, release must be
+// called when the stream is done.
+func (h2d *H2Dialer) roundTrip(ctx context.Context, addr string, r io.Reader) (*http.Request, *http.Response, func(), error) {
+	req, _ := http.NewRequestWithContext(ctx, "POST", h2d.H2TunURL, r)
 
 	// TODO: JWT from MDS
 	if h2d.MDS != nil {
 		t, err := h2d.MDS.GetToken(ctx, addr)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		if t != "" {
 			req.Header["authorization"] = []string{"Bearer " + t}
@@ -70,28 +99,78 @@ func (h2d *H2Dialer) CopyTo(ctx context.Context, net, addr string, r io.Reader)
 	req.Header[ConnectOverrideHeader] = []string{addr}
 
 	// HBone uses CONNECT IP:port - we need to use POST and can't use the header. For now use x-host
-	if h2d.HttpClient == nil {
-		h2d.HttpClient = http.DefaultClient
+	var res *http.Response
+	var release func()
+	pool := h2d.Pool
+	if pool == nil && h2d.HttpClient == nil && req.URL.Scheme == "https" {
+		pool = DefaultConnPool
 	}
-
-	res, err := h2d.HttpClient.Do(req)
-	if err != nil {
-		if res == nil {
+	if pool != nil {
+		dest := h2d.DestID
+		if dest == "" {
+			dest = req.URL.Host
+			if req.URL.Port() == "" {
+				port := "443"
+				if req.URL.Scheme == "http" {
+					port = "80"
+				}
+				dest = net.JoinHostPort(dest, port)
+			}
+		}
+		pc, err := pool.Get(ctx, dest)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		rt, ok := pc.Conn.(http.RoundTripper)
+		if !ok {
+			pc.Release()
+			return nil, nil, nil, errors.New("pooled connection is not a RoundTripper")
+		}
+		res, err = rt.RoundTrip(req)
+		if err != nil {
+			pc.Release()
 			log.Println("H2T error", err)
-		} else {
-			log.Println("H2T error", err, res.StatusCode, res.Header)
+			return nil, nil, nil, err
+		}
+		release = pc.Release
+	} else {
+		if h2d.HttpClient == nil {
+			h2d.HttpClient = http.DefaultClient
+		}
+
+		var err error
+		res, err = h2d.HttpClient.Do(req)
+		if err != nil {
+			if res == nil {
+				log.Println("H2T error", err)
+			} else {
+				log.Println("H2T error", err, res.StatusCode, res.Header)
+			}
+			return nil, nil, nil, err
 		}
-		return nil, nil, err
 	}
 
 	log.Println("H2T", res.StatusCode, res.Header)
 
-	return req, res, nil
+	return req, res, release, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (rb *releaseBody) Close() error {
+	err := rb.ReadCloser.Close()
+	rb.once.Do(rb.release)
+	return err
 }
 
 // NewStreamH2 creates a H2 stream using POST.
 //
-// Will use the token provider if not nil.
+// Will use the token provider if not nil. If hc is nil, the stream uses the
+// DefaultConnPool.
 func NewStreamH2(ctx context.Context, hc *http.Client, addr string, tcpaddr string, mds TokenSource) (*StreamHttpClient, error) {
 	hd := &H2Dialer{
 		HttpClient: hc,
@@ -175,9 +254,7 @@ func (s *StreamHttpClient) Write(b []byte) (n int, err error) {
 	//if f, ok := s.ResponseWriter.(http.Flusher); ok {
 	//	f.Flush()
 	//}
-	s.SentBytes += n
-	s.SentPackets++
-	s.LastWrite = time.Now()
+	s.AddSent(n)
 
 	return
 }
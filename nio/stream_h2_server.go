@@ -56,9 +56,7 @@ func (s *StreamHttpServer) Write(b []byte) (n int, err error) {
 	if f, ok := s.ResponseWriter.(http.Flusher); ok {
 		f.Flush()
 	}
-	s.SentBytes += n
-	s.SentPackets++
-	s.LastWrite = time.Now()
+	s.AddSent(n)
 
 	return
 }
@@ -1,8 +1,6 @@
 package nio
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
@@ -12,7 +10,6 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"net/textproto"
 	"strings"
 	"syscall"
 	"time"
@@ -98,6 +95,10 @@ type InOutStream struct {
 	// @Deprecated - use a buf, packed format, id-based headers.
 	InHeader http.Header `json:"-"`
 
+	// Trailers received from the remote, for transports using metadata
+	// frames.
+	InTrailer http.Header `json:"-"`
+
 	// Set if the connection finished a TLS handshake.
 	// A 'dummy' value may be set if a sidecar terminated the connection.
 	TLS *tls.ConnectionState `json:"-"`
@@ -384,9 +385,7 @@ func (s *InOutStream) Write(b []byte) (n int, err error) {
 		s.WriteErr = err
 		return n, err
 	}
-	s.SentBytes += n
-	s.SentPackets++
-	s.LastWrite = time.Now()
+	s.AddSent(n)
 	if f, ok := s.Out.(http.Flusher); ok {
 		f.Flush()
 	}
@@ -407,16 +406,13 @@ func (s *InOutStream) Read(out []byte) (int, error) {
 		b := s.rbuffer
 		if b.Size() > 0 {
 			n, err := b.ReadData(out)
-			s.RcvdBytes += n
-			s.RcvdPackets++
+			s.AddRcvd(n)
 			return n, err
 		}
 	}
 	n, err := s.In.Read(out)
 
-	s.RcvdBytes += n
-	s.RcvdPackets++
-	s.LastRead = time.Now()
+	s.AddRcvd(n)
 
 	if err != nil {
 		s.ReadErr = err
@@ -538,8 +534,11 @@ func (s *InOutStream) RequestHeader() http.Header {
 	return s.Request.Header
 }
 
+// TransportConn returns the Out connection, or nil if Out is not a
+// net.Conn - like a QUIC stream.
 func (s *InOutStream) TransportConn() net.Conn {
-	return s.Out.(net.Conn)
+	c, _ := s.Out.(net.Conn)
+	return c
 }
 
 func (s *InOutStream) TLSConnectionState() *tls.ConnectionState {
@@ -608,13 +607,15 @@ func (s *InOutStream) CopyBuffered(dst io.Writer, src io.Reader, srcIsRemote boo
 		}
 		if nr > 0 {
 			if srcIsRemote {
-				s.LastRead = time.Now()
-				s.RcvdPackets++
-				s.RcvdBytes += int(nr)
+				s.AddRcvd(nr)
 			} else {
-				s.SentPackets++
-				s.SentBytes += int(nr)
-				s.LastWrite = time.Now()
+				s.AddSent(nr)
+			}
+			if s.Limiter != nil {
+				// Canceled when the stream is closed.
+				if err = s.Limiter.WaitN(s.Context(), nr, srcIsRemote); err != nil {
+					break
+				}
 			}
 			nw, ew := dst.Write(buf[0:nr])
 			if nw > 0 {
@@ -639,31 +640,10 @@ func (s *InOutStream) CopyBuffered(dst io.Writer, src io.Reader, srcIsRemote boo
 	return written, err
 }
 
-// Send will marshall the metadata (headers) and start sending the body to w.
-func (s *InOutStream) SendHeader(w io.WriteCloser, h http.Header) error {
-	// First format: TAG(=2), 4B LEN, Text headers. Required len, buffer
-
-	bb := s.WBuffer()
-
-	for k, vv := range h {
-		for _, v := range vv {
-			bb.WriteByte(1)
-			bb.WriteVarint(int64(len(k)))
-			bb.Write([]byte(k))
-			bb.WriteVarint(int64(len(v)))
-			bb.Write([]byte(v))
-		}
-	}
-	bb.WriteByte(0)
-
-	bb.WriteByte(2) // To differentiate from regular H3, using 0
-	bb.Write([]byte{0, 0, 0, 0})
-	err := s.OutHeader.Write(bb)
-	binary.LittleEndian.PutUint32(bb.Bytes()[1:], uint32(bb.Size()-5))
-	if err != nil {
-		return err
-	}
-	_, err = w.Write(bb.Bytes())
+// SendHeader writes the metadata frame with the headers to w. The body can
+// be written after. See metadata.go for the format.
+func (s *InOutStream) SendHeader(w io.Writer, h http.Header) error {
+	err := WriteMetadata(w, MetadataHeaders, h)
 	if err != nil {
 		return err
 	}
@@ -673,25 +653,16 @@ func (s *InOutStream) SendHeader(w io.WriteCloser, h http.Header) error {
 	return nil
 }
 
+// ReadHeader reads the headers frame from in, setting InHeader.
 func (s *InOutStream) ReadHeader(in io.Reader) error {
-	// TODO: move to buffered stream, unify
-	buf1 := GetDataBufferChunk(16 * 64 * 1024)
-	defer PutDataBufferChunk(buf1)
-	bufCap := cap(buf1)
-	buf := buf1[0:bufCap:bufCap]
-
-	n, err := io.ReadFull(in, buf[0:5])
-	len := binary.LittleEndian.Uint32(buf[1:])
-	if len > 32*1024 {
-		return errors.New("header size")
-	}
-	n, err = io.ReadFull(in, buf[0:len])
+	typ, h, err := ReadMetadata(in)
 	if err != nil {
 		return err
 	}
-	hr := textproto.NewReader(bufio.NewReader(bytes.NewBuffer(buf[0:n])))
-	mh, err := hr.ReadMIMEHeader()
-	s.InHeader = http.Header(mh)
+	if typ != MetadataHeaders {
+		return ErrMetadataType
+	}
+	s.InHeader = h
 
 	if DebugClose {
 		log.Println("InOutStream.receiveHeaders ", s.StreamId, s.InHeader)
@@ -699,6 +670,27 @@ func (s *InOutStream) ReadHeader(in io.Reader) error {
 	return nil
 }
 
+// SendTrailer writes the trailers frame to w, ending a body written with
+// MetadataBodyWriter. It must be sent before the write side is closed.
+func (s *InOutStream) SendTrailer(w io.Writer, h http.Header) error {
+	return WriteMetadata(w, MetadataTrailers, h)
+}
+
+// ReadTrailer reads the rest of a body written as data frames, discarding
+// it, and the trailers frame, setting InTrailer. in is the stream, or the
+// MetadataBodyReader used to read the body.
+func (s *InOutStream) ReadTrailer(in io.Reader) error {
+	mr, ok := in.(*MetadataBodyReader)
+	if !ok {
+		mr = &MetadataBodyReader{R: in}
+	}
+	if _, err := io.Copy(io.Discard, mr); err != nil {
+		return err
+	}
+	s.InTrailer = mr.Trailer
+	return nil
+}
+
 func (s *InOutStream) LocalAddr() net.Addr {
 	if s.LocalA != nil {
 		return s.LocalA
@@ -753,8 +745,7 @@ func (s *InOutStream) ReadFrom(cin io.Reader) (n int64, err error) {
 		if wt, ok := s.Out.(io.ReaderFrom); ok {
 			//VarzReadFromC.Add(1)
 			n, err = wt.ReadFrom(cin)
-			s.SentPackets++
-			s.SentBytes += int(n)
+			s.AddSent(int(n))
 			return
 		}
 	}
@@ -773,8 +764,7 @@ func (s *InOutStream) ReadFrom(cin io.Reader) (n int64, err error) {
 		if nr > 0 {
 			nw, err := s.Out.Write(buf[0:nr])
 			n += int64(nw)
-			s.SentBytes += nw
-			s.SentPackets++
+			s.AddSent(nw)
 			if f, ok := s.Out.(http.Flusher); ok {
 				f.Flush()
 			}
@@ -901,9 +891,7 @@ func (s *InOutStream) WriteTo(w io.Writer) (n int64, err error) {
 		if wt, ok := w.(io.ReaderFrom); ok {
 			//VarzReadFromC.Add(1)
 			n, err = wt.ReadFrom(s.In)
-			s.RcvdPackets++
-			s.RcvdBytes += int(n)
-			s.LastRead = time.Now()
+			s.AddRcvd(int(n))
 			return
 		}
 	}
@@ -923,8 +911,7 @@ func (s *InOutStream) WriteTo(w io.Writer) (n int64, err error) {
 			srcc.SetReadDeadline(time.Now().Add(15 * time.Minute))
 		}
 		sn, sErr := s.In.Read(buf)
-		s.RcvdPackets++
-		s.RcvdBytes += sn
+		s.AddRcvd(sn)
 
 		if sn > 0 {
 			wn, wErr := w.Write(buf[0:sn])
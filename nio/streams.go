@@ -10,6 +10,7 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"os"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -41,15 +42,119 @@ type Stream interface {
 // Streams tracks active streams. Some streams are long-lived and used to mux other streams.
 type Streams struct {
 	active sync.Map // streamID -> Stream
+
+	// Mux is used for the /debug/streams handlers. Defaults to http.DefaultServeMux.
+	Mux *http.ServeMux `json:"-"`
 }
 
+// DefaultStreams is the registry used by Proxy.
+var DefaultStreams = &Streams{}
+
+// OnStream registers an active stream. The StreamId is allocated if not set,
+// and the peer info is populated from the connection.
 func (ug *Streams) OnStream(str Stream) {
+	st := str.State()
+	if st.StreamId == "" {
+		st.StreamId = strconv.Itoa(int(atomic.AddUint32(&StreamId, 1)))
+	}
+	if st.Open.IsZero() {
+		st.Open = time.Now()
+	}
+	if st.PeerAddr == "" {
+		if ra := str.RemoteAddr(); ra != nil {
+			st.PeerAddr = ra.String()
+		}
+	}
+	if st.Peer == "" {
+		st.Peer = PeerID(str.TLSConnectionState())
+	}
+	ug.active.Store(st.StreamId, str)
+	TcpConTotal.Add(1)
+	TcpConActive.Add(1)
+}
+
+// Get returns the active stream with the given ID, or nil.
+func (ug *Streams) Get(id string) Stream {
+	if s, ok := ug.active.Load(id); ok {
+		return s.(Stream)
+	}
+	return nil
+}
+
+// Active returns the streams matching the filter. An empty filter matches
+// all. dest and peer are matched as substrings of Dest and Peer or PeerAddr.
+func (ug *Streams) Active(dest, peer string) []Stream {
+	res := []Stream{}
+	ug.active.Range(func(key, value any) bool {
+		str := value.(Stream)
+		st := str.State()
+		if dest != "" && !strings.Contains(st.Dest, dest) {
+			return true
+		}
+		if peer != "" && !strings.Contains(st.Peer, peer) && !strings.Contains(st.PeerAddr, peer) {
+			return true
+		}
+		res = append(res, str)
+		return true
+	})
+	return res
+}
+
+// SetLimit changes the bandwidth limit of an active stream. All streams
+// have a limiter when the RateLimits module is provisioned - otherwise only
+// streams with a listener limit can be changed.
+func (ug *Streams) SetLimit(id string, bw Bandwidth) error {
+	str := ug.Get(id)
+	if str == nil {
+		return ErrStreamNotFound
+	}
+	st := str.State()
+	if st.Limiter == nil {
+		// Only set at start, the copiers use the limiter from Proxy.
+		return ErrStreamNotShaped
+	}
+	st.Limiter.Set(bw)
+	return nil
+}
+
+// Close terminates the stream with the given ID. The proxy handling it will
+// get an error and clean up.
+func (ug *Streams) Close(id string) error {
+	str := ug.Get(id)
+	if str == nil {
+		return ErrStreamNotFound
+	}
+	return str.Close()
+}
+
+var (
+	ErrStreamNotFound  = errors.New("stream not found")
+	ErrStreamNotShaped = errors.New("stream has no limiter")
+)
+
+// PeerID returns the identity from the peer certificate - SPIFFE or other
+// URI SAN, DNS SAN or the subject CN.
+func PeerID(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	c := cs.PeerCertificates[0]
+	if len(c.URIs) > 0 {
+		return c.URIs[0].String()
+	}
+	if len(c.DNSNames) > 0 {
+		return c.DNSNames[0]
+	}
+	return c.Subject.CommonName
 }
 
 // Called at the end of the connection handling. After this point
 // nothing should use or refer to the connection, both proxy directions
 // should already be closed for write or fully closed.
 func (ug *Streams) OnStreamDone(str Stream) {
+	if _, ok := ug.active.LoadAndDelete(str.State().StreamId); ok {
+		TcpConActive.Add(-1)
+	}
 	if r := recover(); r != nil {
 		debug.PrintStack()
 
@@ -89,10 +194,13 @@ var (
 
 	VarzMaxRead = expvar.NewInt("ugate_max_read_bytes")
 
-	// Managed by 'NewTCPProxy' - before dial.
+	// Copies done with splice - ReaderCopier.Copy on TCP or kTLS conns.
+	VarzSplice = expvar.NewInt("ugate_splice_total")
+
+	// Managed by Streams.OnStream - for proxied streams.
 	TcpConTotal = expvar.NewInt("gate_tcp_total")
 
-	// Managed by updateStatsOnClose - including error cases.
+	// Managed by Streams.OnStreamDone - including error cases.
 	TcpConActive = expvar.NewInt("gate_tcp_active")
 )
 
@@ -109,7 +217,12 @@ var (
 // ContextClientTrace(ctx) -> *ClientTrace
 
 // Stats holds telemetry for a stream or peer.
+//
+// The counters are updated by the copiers while the stream is active - use
+// AddSent and AddRcvd to update and Snapshot to read them.
 type Stats struct {
+	m sync.Mutex
+
 	Open time.Time
 
 	// last receive from local (and send to remote)
@@ -127,6 +240,39 @@ type Stats struct {
 	RcvdPackets int
 }
 
+// AddSent records n bytes sent from client to server.
+func (st *Stats) AddSent(n int) {
+	st.m.Lock()
+	st.SentBytes += n
+	st.SentPackets++
+	st.LastWrite = time.Now()
+	st.m.Unlock()
+}
+
+// AddRcvd records n bytes received from server.
+func (st *Stats) AddRcvd(n int) {
+	st.m.Lock()
+	st.RcvdBytes += n
+	st.RcvdPackets++
+	st.LastRead = time.Now()
+	st.m.Unlock()
+}
+
+// Snapshot returns a copy of the stats.
+func (st *Stats) Snapshot() Stats {
+	st.m.Lock()
+	defer st.m.Unlock()
+	return Stats{
+		Open:        st.Open,
+		LastWrite:   st.LastWrite,
+		LastRead:    st.LastRead,
+		SentBytes:   st.SentBytes,
+		SentPackets: st.SentPackets,
+		RcvdBytes:   st.RcvdBytes,
+		RcvdPackets: st.RcvdPackets,
+	}
+}
+
 // StreamState provides metadata about a stream.
 //
 // It includes errors, stats, other metadata.
@@ -150,6 +296,56 @@ type StreamState struct {
 
 	// Original or infered destination.
 	Dest string
+
+	// Proto is the protocol detected on the stream (ProtoTLS, ProtoH2, ...)
+	// or set by the listener.
+	Proto string
+
+	// ListenerName is the module that accepted the stream - "sniff",
+	// "socks", "sni", "http_proxy".
+	ListenerName string `json:",omitempty"`
+
+	// Peer is the authenticated identity of the remote, if known.
+	Peer string `json:",omitempty"`
+
+	// PeerAddr is the address of the remote - the original client for
+	// accepted streams.
+	PeerAddr string `json:",omitempty"`
+
+	// ClientHello is set for TLS streams where the hello was parsed - for
+	// routing and logging on SNI, ALPN and fingerprints.
+	ClientHello *ClientHelloMsg `json:"-"`
+
+	// Limiter, if set, shapes the bandwidth of the stream. Set by the
+	// listener or RateLimits.
+	Limiter *Limiter `json:"-"`
+
+	// Timeouts, if set, are the listener timeouts for the stream.
+	// RouteTimeouts may override them for the destination.
+	Timeouts *Timeouts `json:"-"`
+
+	// ProxyHeader is set if the stream was accepted from a trusted source
+	// with a PROXY header. Src is the original client address.
+	ProxyHeader *ProxyHeader `json:",omitempty"`
+}
+
+// Snapshot returns a copy of the state, with a consistent copy of the stats.
+func (s *StreamState) Snapshot() *StreamState {
+	return &StreamState{
+		StreamId:     s.StreamId,
+		WriteErr:     s.WriteErr,
+		ReadErr:      s.ReadErr,
+		Stats:        s.Stats.Snapshot(),
+		Dest:         s.Dest,
+		Proto:        s.Proto,
+		ListenerName: s.ListenerName,
+		Peer:         s.Peer,
+		PeerAddr:     s.PeerAddr,
+		ClientHello:  s.ClientHello,
+		Limiter:      s.Limiter,
+		Timeouts:     s.Timeouts,
+		ProxyHeader:  s.ProxyHeader,
+	}
 }
 
 // TODO: benchmark different sizes.
@@ -176,9 +372,123 @@ type ReaderCopier struct {
 	// An ID of the copier, for debug purpose.
 	ID string
 
+	// Stats, if set, is updated as data is copied. Rcvd selects the Rcvd
+	// counters - for the server to client direction.
+	Stats *Stats
+	Rcvd  bool
+
+	// Limiter, if set, is used to wait before each write. Rcvd selects
+	// the Down bucket.
+	Limiter *Limiter
+
+	// Ctx interrupts the Limiter waits - canceled when the stream is
+	// closed. Defaults to context.Background().
+	Ctx context.Context
+
 	// Set if out doesn't implement Flusher and a separate function is needed.
 	// Example: tunneled mTLS over http, Out is a tls.Conn which writes to a http Body.
 	Flusher http.Flusher
+
+	// Tap, if set, records the copied data. Rcvd selects the server side.
+	Tap *PcapStream
+
+	// Idle is the read timeout. If the other direction had activity, the
+	// read is retried. Default 15 min, without checking the other side.
+	Idle time.Duration
+
+	// active is the last read time on either direction, in unix nanos.
+	// Shared by the 2 copiers of a Proxy.
+	active *atomic.Int64
+
+	m           sync.Mutex
+	deadline    time.Time
+	deadlineErr error
+	timer       *time.Timer
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// SetDeadline sets an absolute deadline for the copy - for max duration
+// and half-close. Copy fails with reason after the deadline. An earlier
+// deadline is kept.
+//
+// If In doesn't support read deadlines, it is closed.
+func (s *ReaderCopier) SetDeadline(t time.Time, reason error) {
+	s.m.Lock()
+	if !s.deadline.IsZero() && !t.Before(s.deadline) {
+		s.m.Unlock()
+		return
+	}
+	s.deadline = t
+	s.deadlineErr = reason
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	c, ok := s.In.(readDeadliner)
+	if !ok {
+		s.timer = time.AfterFunc(time.Until(t), s.Close)
+	}
+	s.m.Unlock()
+	if ok {
+		c.SetReadDeadline(t)
+	}
+}
+
+// expired returns the reason if the absolute deadline passed.
+func (s *ReaderCopier) expired() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.deadline.IsZero() && !time.Now().Before(s.deadline) {
+		return s.deadlineErr
+	}
+	return nil
+}
+
+// readDeadline returns the deadline for the next read - the idle timeout,
+// capped by the absolute deadline.
+func (s *ReaderCopier) readDeadline() time.Time {
+	idle := s.Idle
+	if idle == 0 {
+		idle = 15 * time.Minute
+	}
+	t := time.Now().Add(idle)
+	s.m.Lock()
+	if !s.deadline.IsZero() && s.deadline.Before(t) {
+		t = s.deadline
+	}
+	s.m.Unlock()
+	return t
+}
+
+// idle returns true if the read timed out and there was no activity on
+// either direction for the Idle duration.
+func (s *ReaderCopier) idle(er error) bool {
+	if !errors.Is(er, os.ErrDeadlineExceeded) {
+		return false
+	}
+	if s.Idle == 0 || s.active == nil {
+		return true
+	}
+	return time.Since(time.Unix(0, s.active.Load())) >= s.Idle
+}
+
+func (s *ReaderCopier) context() context.Context {
+	if s.Ctx == nil {
+		return context.Background()
+	}
+	return s.Ctx
+}
+
+func (s *ReaderCopier) stopTimer() {
+	s.m.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.m.Unlock()
 }
 
 func (rc *ReaderCopier) Close() {
@@ -191,18 +501,59 @@ func (rc *ReaderCopier) Close() {
 
 }
 
+func (s *ReaderCopier) updateStats(n int) {
+	st := s.Stats
+	if st == nil || n == 0 {
+		return
+	}
+	if s.Rcvd {
+		st.AddRcvd(n)
+	} else {
+		st.AddSent(n)
+	}
+}
+
 // Verify if in and out can be spliced. Used by proxy code to determine best
 // method to copy.
 //
 // Tcp connections implement ReadFrom, not WriteTo
 // ReadFrom is only spliced in few cases
+//
+// A KTLSConn can be spliced - the kernel does the encryption.
 func CanSplice(in io.Reader, out io.Writer) bool {
-	if _, ok := in.(*net.TCPConn); ok {
-		if _, ok := out.(*net.TCPConn); ok {
-			return true
+	return spliceConn(in) != nil && spliceConn(out) != nil
+}
+
+// spliceConn returns the TCPConn to use for splice, or nil.
+func spliceConn(c any) *net.TCPConn {
+	switch c := unwrapConn(c).(type) {
+	case *net.TCPConn:
+		return c
+	case *KTLSConn:
+		return c.TCPConn
+	}
+	return nil
+}
+
+// unwrapConn returns the connection under StreamConn, BufferedConn and
+// breaker wrappers, which don't change the data. A BufferedConn with
+// buffered data is returned as is.
+func unwrapConn(c any) any {
+	for {
+		switch w := c.(type) {
+		case *StreamConn:
+			c = w.Conn
+		case *BufferedConn:
+			if w.Reader.Buffer.Size() > 0 {
+				return c
+			}
+			c = w.Conn
+		case *breakerConn:
+			c = w.Conn
+		default:
+			return c
 		}
 	}
-	return false
 }
 
 // Old style buffer pool
@@ -239,12 +590,32 @@ func (s *ReaderCopier) Copy(ch chan int, close bool) {
 		}()
 	}
 
-	if CanSplice(s.In, s.Out) {
-		n, err := s.Out.(io.ReaderFrom).ReadFrom(s.In)
+	defer s.stopTimer()
+
+	if s.Limiter == nil && s.Idle == 0 && s.Tap == nil && CanSplice(s.In, s.Out) {
+		VarzSplice.Add(1)
+		n, err := spliceConn(s.Out).ReadFrom(spliceConn(s.In))
 		s.Written += n
+		s.updateStats(int(n))
+		if kc, ok := unwrapConn(s.In).(*KTLSConn); ok && err != nil {
+			err = kc.readErr(err)
+			if err == io.EOF {
+				err = nil
+			}
+		}
+		if err == nil {
+			// ReadFrom returns nil on EOF.
+			if close {
+				closeWriter(s.Out)
+			}
+		}
 		if err != nil {
+			if reason := s.expired(); reason != nil {
+				err = reason
+			}
 			s.rstWriter(err)
 			s.Err = err
+			s.InError = true
 		}
 		//VarzReadFromC.Add(1)
 		return
@@ -279,8 +650,8 @@ func (s *ReaderCopier) Copy(ch chan int, close bool) {
 		log.Println(s.ID, "startCopy()")
 	}
 	for {
-		if srcc, ok := s.In.(net.Conn); ok {
-			srcc.SetReadDeadline(time.Now().Add(15 * time.Minute))
+		if srcc, ok := s.In.(readDeadliner); ok {
+			srcc.SetReadDeadline(s.readDeadline())
 		}
 		nr, er := s.In.Read(buf)
 		if DebugRW && nr < 1024 {
@@ -289,6 +660,22 @@ func (s *ReaderCopier) Copy(ch chan int, close bool) {
 		if nr > s.MaxRead {
 			s.MaxRead = nr
 		}
+		if nr > 0 && s.active != nil {
+			s.active.Store(time.Now().UnixNano())
+		}
+		if er != nil && er != io.EOF {
+			if reason := s.expired(); reason != nil {
+				er = reason
+			} else if s.idle(er) {
+				er = ErrIdleTimeout
+			} else if errors.Is(er, os.ErrDeadlineExceeded) {
+				// The other direction is active.
+				if nr == 0 {
+					continue
+				}
+				er = nil
+			}
+		}
 
 		// Even if we have an error, send the bytes we've read.
 		if nr > 0 { // before dealing with the read error
@@ -305,12 +692,23 @@ func (s *ReaderCopier) Copy(ch chan int, close bool) {
 
 			// DoneServing is checked - so it is possible to do this in background, but only works for proxy.
 
+			if s.Limiter != nil {
+				if ew := s.Limiter.WaitN(s.context(), nr, s.Rcvd); ew != nil {
+					s.Err = ew
+					if close {
+						s.rstWriter(ew)
+					}
+					return
+				}
+			}
 			nw, ew := s.Out.Write(buf[0:nr])
 			if DebugRW && nw < 1024 {
 				log.Println(s.ID, "write()", nw, ew)
 			}
 			if nw > 0 {
 				s.Written += int64(nw)
+				s.updateStats(nw)
+				s.Tap.Write(buf[0:nw], s.Rcvd)
 			}
 			if f, ok := s.Out.(http.Flusher); ok {
 				f.Flush()
@@ -342,6 +740,7 @@ func (s *ReaderCopier) Copy(ch chan int, close bool) {
 				if Debug {
 					log.Println(s.ID, "EOF received, closing writer", close)
 				}
+				s.Tap.CloseWrite(s.Rcvd)
 				if close {
 					// read is already closed - we need to close out
 					// TODO: if err is not nil, we should send RST not FIN
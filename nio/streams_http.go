@@ -0,0 +1,102 @@
+package nio
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Admin handlers for active streams:
+//
+// curl localhost:15000/debug/streams?dest=example.com&peer=10.1.
+// curl -XPOST localhost:15000/debug/streams/close?id=12
+// curl -XPOST "localhost:15000/debug/streams/limit?id=12&up=100000&down=1000000"
+
+// StreamInfo is the JSON representation of an active stream.
+type StreamInfo struct {
+	*StreamState
+
+	Local  string `json:",omitempty"`
+	Remote string `json:",omitempty"`
+
+	// Age of the stream in seconds.
+	Age int64
+}
+
+// Provision registers the debug handlers on the Mux.
+func (ug *Streams) Provision(ctx context.Context) error {
+	mux := ug.Mux
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("/debug/streams", ug.HandleStreams)
+	mux.HandleFunc("/debug/streams/close", ug.HandleClose)
+	mux.HandleFunc("/debug/streams/limit", ug.HandleLimit)
+	return nil
+}
+
+// HandleStreams returns the active streams as a JSON list, optionally
+// filtered using the dest and peer query parameters.
+func (ug *Streams) HandleStreams(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	res := []*StreamInfo{}
+	for _, str := range ug.Active(q.Get("dest"), q.Get("peer")) {
+		si := &StreamInfo{StreamState: str.State().Snapshot()}
+		if la := str.LocalAddr(); la != nil {
+			si.Local = la.String()
+		}
+		if ra := str.RemoteAddr(); ra != nil {
+			si.Remote = ra.String()
+		}
+		si.Age = int64(time.Since(si.Open) / time.Second)
+		res = append(res, si)
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// HandleClose terminates the stream with the id query parameter.
+// Requires POST.
+func (ug *Streams) HandleClose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	err := ug.Close(id)
+	if err == ErrStreamNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLimit changes the bandwidth of an active stream, using the up, down
+// and burst query parameters (bytes per second). Requires POST.
+func (ug *Streams) HandleLimit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	bw := Bandwidth{}
+	bw.Up, _ = strconv.Atoi(q.Get("up"))
+	bw.Down, _ = strconv.Atoi(q.Get("down"))
+	bw.Burst, _ = strconv.Atoi(q.Get("burst"))
+	err := ug.SetLimit(q.Get("id"), bw)
+	if err == ErrStreamNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
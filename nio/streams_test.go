@@ -0,0 +1,89 @@
+package nio
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreams(t *testing.T) {
+	mux := http.NewServeMux()
+	streams := &Streams{Mux: mux}
+	streams.Provision(nil)
+	old := DefaultStreams
+	DefaultStreams = streams
+	defer func() { DefaultStreams = old }()
+	oldRL := DefaultRateLimits
+	(&RateLimits{Mux: http.NewServeMux()}).Provision(nil)
+	defer func() { DefaultRateLimits = oldRL }()
+
+	client, in := net.Pipe()
+	out, server := net.Pipe()
+	sc := NewStreamConn(in)
+	sc.Peer = "spiffe://cluster.local/ns/a/sa/b"
+
+	done := make(chan error)
+	go func() {
+		done <- Proxy(out, sc, sc, "example.com:443")
+	}()
+
+	client.Write([]byte("hello"))
+	b := make([]byte, 5)
+	server.Read(b)
+	// Stats are updated after the write completes.
+	for i := 0; i < 100 && sc.Stats.Snapshot().SentBytes == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var res []*StreamInfo
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		q := "/debug/streams?dest=example.com"
+		if i == 1 {
+			q = "/debug/streams?peer=ns/a/"
+		}
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", q, nil))
+		res = nil
+		json.Unmarshal(rr.Body.Bytes(), &res)
+		if len(res) != 1 || res[0].Dest != "example.com:443" || res[0].SentBytes != 5 {
+			t.Fatal("Unexpected streams", rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/streams?dest=other", nil))
+	if rr.Body.String() != "[]\n" {
+		t.Fatal("Expected empty", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/debug/streams/close?id=none", nil))
+	if rr.Code != 404 {
+		t.Fatal("Expected 404", rr.Code)
+	}
+
+	// Unlimited streams can be limited while active.
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/debug/streams/limit?down=100000&id="+res[0].StreamId, nil))
+	if rr.Code != 204 || sc.Limiter.Down.Limit() != 100000 {
+		t.Fatal("Limit failed", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/debug/streams/close?id="+res[0].StreamId, nil))
+	if rr.Code != 204 {
+		t.Fatal("Close failed", rr.Code)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Proxy not terminated")
+	}
+	if len(streams.Active("", "")) != 0 {
+		t.Fatal("Stream not removed")
+	}
+}
@@ -0,0 +1,27 @@
+package syscall
+
+import "errors"
+
+// Kernel TLS (kTLS) offload: after the handshake is done in user space, the
+// traffic keys are installed on the socket and the kernel encrypts and
+// decrypts the records. Read and Write on the TCP socket use plaintext, and
+// splice/sendfile can be used.
+
+// ErrKTLSUnsupported is returned if the OS, kernel or cipher suite doesn't
+// support kTLS. The caller should use the user space TLS conn.
+var ErrKTLSUnsupported = errors.New("ktls: not supported")
+
+// KTLSKeys holds the TLS 1.3 traffic key for one direction.
+type KTLSKeys struct {
+	// CipherSuite is the negotiated suite - tls.TLS_AES_128_GCM_SHA256,
+	// TLS_AES_256_GCM_SHA384 or TLS_CHACHA20_POLY1305_SHA256.
+	CipherSuite uint16
+
+	Key []byte
+
+	// IV is the 12 byte static IV.
+	IV []byte
+
+	// Seq is the sequence number of the next record.
+	Seq uint64
+}
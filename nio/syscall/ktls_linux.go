@@ -0,0 +1,136 @@
+package syscall
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// From linux/tls.h - not defined in x/sys/unix.
+const (
+	tlsTX = 1
+	tlsRX = 2
+
+	tlsGetRecordType = 2
+
+	tls13Version = 0x0304
+
+	tlsCipherAESGCM128        = 51
+	tlsCipherAESGCM256        = 52
+	tlsCipherChaCha20Poly1305 = 54
+)
+
+// cryptoInfo returns the tls12_crypto_info_* struct for the keys:
+// version, cipher_type, iv, key, salt, rec_seq.
+//
+// For AES-GCM the salt is the first 4 bytes of the static IV, for ChaCha20
+// the IV has the full 12 bytes and there is no salt.
+func cryptoInfo(k *KTLSKeys) ([]byte, error) {
+	var cipher uint16
+	var keyLen, saltLen int
+	switch k.CipherSuite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		cipher, keyLen, saltLen = tlsCipherAESGCM128, 16, 4
+	case tls.TLS_AES_256_GCM_SHA384:
+		cipher, keyLen, saltLen = tlsCipherAESGCM256, 32, 4
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		cipher, keyLen, saltLen = tlsCipherChaCha20Poly1305, 32, 0
+	default:
+		return nil, ErrKTLSUnsupported
+	}
+	if len(k.Key) != keyLen || len(k.IV) != 12 {
+		return nil, errors.New("ktls: invalid key size")
+	}
+
+	b := make([]byte, 0, 4+12+keyLen+8)
+	b = binary.NativeEndian.AppendUint16(b, tls13Version)
+	b = binary.NativeEndian.AppendUint16(b, cipher)
+	b = append(b, k.IV[saltLen:]...)
+	b = append(b, k.Key...)
+	b = append(b, k.IV[:saltLen]...)
+	b = binary.BigEndian.AppendUint64(b, k.Seq)
+	return b, nil
+}
+
+// EnableKTLS installs the TLS ULP and the keys on the socket. Both
+// directions are required.
+//
+// Returns ErrKTLSUnsupported if the kernel doesn't have the tls module or
+// the cipher. If the receive keys fail after the transmit keys are set, the
+// connection can't be used.
+func EnableKTLS(conn *net.TCPConn, tx, rx *KTLSKeys) error {
+	txInfo, err := cryptoInfo(tx)
+	if err != nil {
+		return err
+	}
+	rxInfo, err := cryptoInfo(rx)
+	if err != nil {
+		return err
+	}
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("error getting raw connection: %v", err)
+	}
+	var serr error
+	err = rawConn.Control(func(fd uintptr) {
+		serr = unix.SetsockoptString(int(fd), unix.SOL_TCP, unix.TCP_ULP, "tls")
+		if serr != nil {
+			serr = fmt.Errorf("%w: %v", ErrKTLSUnsupported, serr)
+			return
+		}
+		// Without keys, the ULP is a pass-through. Unsupported ciphers
+		// fail on the first call.
+		serr = unix.SetsockoptString(int(fd), unix.SOL_TLS, tlsTX, string(txInfo))
+		if serr != nil {
+			serr = fmt.Errorf("%w: %v", ErrKTLSUnsupported, serr)
+			return
+		}
+		serr = unix.SetsockoptString(int(fd), unix.SOL_TLS, tlsRX, string(rxInfo))
+		if serr != nil {
+			serr = fmt.Errorf("ktls: setting receive keys: %v", serr)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error setting option on socket: %v", err)
+	}
+	return serr
+}
+
+// ReadKTLSRecord reads a non-data record from a kTLS socket - Read returns
+// EIO if the next record is an alert or handshake message. Returns the
+// record type and the decrypted content.
+func ReadKTLSRecord(conn *net.TCPConn, buf []byte) (byte, int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, fmt.Errorf("error getting raw connection: %v", err)
+	}
+	oob := make([]byte, unix.CmsgSpace(1))
+	var n, oobn int
+	var rerr error
+	err = rawConn.Read(func(fd uintptr) bool {
+		n, oobn, _, _, rerr = unix.Recvmsg(int(fd), buf, oob, 0)
+		return rerr != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if rerr != nil {
+		return 0, 0, rerr
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.SOL_TLS && m.Header.Type == tlsGetRecordType && len(m.Data) > 0 {
+			return m.Data[0], n, nil
+		}
+	}
+	// Application data
+	return 23, n, nil
+}
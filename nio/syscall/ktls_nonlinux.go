@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package syscall
+
+import "net"
+
+// EnableKTLS is not supported under non-linux environments.
+func EnableKTLS(conn *net.TCPConn, tx, rx *KTLSKeys) error {
+	return ErrKTLSUnsupported
+}
+
+// ReadKTLSRecord is not supported under non-linux environments.
+func ReadKTLSRecord(conn *net.TCPConn, buf []byte) (byte, int, error) {
+	return 0, 0, ErrKTLSUnsupported
+}
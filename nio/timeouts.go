@@ -0,0 +1,113 @@
+package nio
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Timeouts for proxied streams, enforced with read deadlines by Proxy.
+//
+// Without timeouts, a stream where one side half-closed and the other never
+// finishes is kept forever.
+
+var (
+	ErrIdleTimeout      = errors.New("idle timeout")
+	ErrHalfCloseTimeout = errors.New("half-close timeout")
+	ErrMaxDuration      = errors.New("max stream duration")
+)
+
+// Timeouts is the config for a listener or route. 0 means no timeout.
+type Timeouts struct {
+	// Idle closes the stream if no data is received in either direction.
+	// If not set, each read has a 15 minute deadline.
+	// Streams with an idle timeout don't use splice.
+	Idle time.Duration `json:"idle,omitempty"`
+
+	// HalfClose is the max time to wait for the other side to finish,
+	// after one side sent a FIN.
+	HalfClose time.Duration `json:"half_close,omitempty"`
+
+	// MaxDuration is the absolute max lifetime of the stream.
+	MaxDuration time.Duration `json:"max_duration,omitempty"`
+}
+
+// merge returns t with the non-zero fields of o.
+func (t Timeouts) merge(o Timeouts) Timeouts {
+	if o.Idle != 0 {
+		t.Idle = o.Idle
+	}
+	if o.HalfClose != 0 {
+		t.HalfClose = o.HalfClose
+	}
+	if o.MaxDuration != 0 {
+		t.MaxDuration = o.MaxDuration
+	}
+	return t
+}
+
+// RouteTimeouts holds the default and per destination timeouts.
+type RouteTimeouts struct {
+	// Default applies to streams without listener timeouts.
+	Default Timeouts `json:"default,omitempty"`
+
+	// Dests has timeouts keyed by destination host suffix, like RouteDialer.
+	// Non-zero values override the listener timeouts.
+	Dests map[string]Timeouts `json:"dests,omitempty"`
+
+	m sync.RWMutex
+}
+
+// DefaultTimeouts is used by Proxy. If nil, only the timeouts set on the
+// stream by the listener are applied.
+var DefaultTimeouts *RouteTimeouts
+
+// Provision makes the timeouts active.
+func (rt *RouteTimeouts) Provision(ctx context.Context) error {
+	DefaultTimeouts = rt
+	return nil
+}
+
+// SetDest changes the timeouts for a destination suffix. Active streams are
+// not changed.
+func (rt *RouteTimeouts) SetDest(dest string, t Timeouts) {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+	if rt.Dests == nil {
+		rt.Dests = map[string]Timeouts{}
+	}
+	rt.Dests[dest] = t
+}
+
+// For returns the timeouts for the stream - the listener timeouts or the
+// default, with the destination overrides.
+func (rt *RouteTimeouts) For(st *StreamState) Timeouts {
+	rt.m.RLock()
+	defer rt.m.RUnlock()
+
+	t := rt.Default
+	if st.Timeouts != nil {
+		t = *st.Timeouts
+	}
+	host, _, err := net.SplitHostPort(st.Dest)
+	if err != nil {
+		host = st.Dest
+	}
+	if dk, ok := suffixMatch(rt.Dests, host); ok {
+		t = t.merge(rt.Dests[dk])
+	}
+	return t
+}
+
+// streamTimeouts returns the timeouts to apply by Proxy.
+func streamTimeouts(st *StreamState) Timeouts {
+	if rt := DefaultTimeouts; rt != nil {
+		return rt.For(st)
+	}
+	if st.Timeouts != nil {
+		return *st.Timeouts
+	}
+	return Timeouts{}
+}
@@ -0,0 +1,117 @@
+package nio
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the 2 ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+func TestTimeouts(t *testing.T) {
+	// Client -> (in) Proxy (out) -> server
+	proxy := func(to *Timeouts) (client, server *net.TCPConn, str *StreamConn, done chan error) {
+		client, in := tcpPair(t)
+		out, server := tcpPair(t)
+		str = NewStreamConn(in)
+		str.Timeouts = to
+		done = make(chan error, 1)
+		go func() {
+			done <- Proxy(out, str, str, "")
+		}()
+		t.Cleanup(func() {
+			client.Close()
+			server.Close()
+		})
+		return
+	}
+	wait := func(done chan error, min, max time.Duration, t0 time.Time) {
+		t.Helper()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Proxy not terminated")
+		}
+		if d := time.Since(t0); d < min || d > max {
+			t.Fatal("Unexpected duration", d)
+		}
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		client, server, str, done := proxy(&Timeouts{Idle: 200 * time.Millisecond})
+		t0 := time.Now()
+		// Activity in one direction keeps the stream open.
+		b := make([]byte, 1)
+		for i := 0; i < 4; i++ {
+			server.Write([]byte{1})
+			client.Read(b)
+			time.Sleep(100 * time.Millisecond)
+		}
+		wait(done, 500*time.Millisecond, 2*time.Second, t0)
+		if str.ReadErr != ErrIdleTimeout && str.WriteErr != ErrIdleTimeout {
+			t.Fatal("Expected idle timeout", str.ReadErr, str.WriteErr)
+		}
+	})
+
+	t.Run("halfclose", func(t *testing.T) {
+		client, _, str, done := proxy(&Timeouts{HalfClose: 200 * time.Millisecond})
+		t0 := time.Now()
+		client.CloseWrite()
+		wait(done, 150*time.Millisecond, 2*time.Second, t0)
+		if str.WriteErr != ErrHalfCloseTimeout {
+			t.Fatal("Expected half-close timeout", str.ReadErr, str.WriteErr)
+		}
+	})
+
+	t.Run("max", func(t *testing.T) {
+		client, server, str, done := proxy(&Timeouts{MaxDuration: 300 * time.Millisecond})
+		t0 := time.Now()
+		go func() {
+			b := make([]byte, 1024)
+			for {
+				if _, err := server.Read(b); err != nil {
+					return
+				}
+			}
+		}()
+		for time.Since(t0) < 200*time.Millisecond {
+			client.Write([]byte("data"))
+			time.Sleep(10 * time.Millisecond)
+		}
+		wait(done, 250*time.Millisecond, 2*time.Second, t0)
+		if str.ReadErr != ErrMaxDuration && str.WriteErr != ErrMaxDuration {
+			t.Fatal("Expected max duration", str.ReadErr, str.WriteErr)
+		}
+	})
+
+	t.Run("dest", func(t *testing.T) {
+		rt := &RouteTimeouts{
+			Default: Timeouts{Idle: time.Minute},
+			Dests:   map[string]Timeouts{"example.com": {MaxDuration: time.Second}},
+		}
+		to := rt.For(&StreamState{Dest: "www.example.com:443", Timeouts: &Timeouts{HalfClose: time.Second}})
+		if to.Idle != 0 || to.HalfClose != time.Second || to.MaxDuration != time.Second {
+			t.Fatal("Unexpected timeouts", to)
+		}
+		to = rt.For(&StreamState{Dest: "other.com:443"})
+		if to.Idle != time.Minute || to.MaxDuration != 0 {
+			t.Fatal("Unexpected default", to)
+		}
+	})
+}
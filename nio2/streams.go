@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
-	"expvar"
 	"io"
 	"log"
 	"log/slog"
@@ -16,6 +15,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/costinm/ugate/nio"
 )
 
 // CloseWriter is one of possible interfaces implemented by RequestInPipe to send a FIN, without closing
@@ -81,19 +82,18 @@ type StreamMeta interface {
 	TLSConnectionState() *tls.ConnectionState
 }
 
+// The counters are shared with nio - binaries linking both packages can't
+// register the same expvar names twice.
 var (
-	VarzSErrRead  = expvar.NewInt("ugate_srv_err_read_total")
-	VarzSErrWrite = expvar.NewInt("ugate_srv_err_write_total")
-	VarzCErrRead  = expvar.NewInt("ugate_client_err_read_total")
-	VarzCErrWrite = expvar.NewInt("ugate_client_err_write_total")
-
-	VarzMaxRead = expvar.NewInt("ugate_max_read_bytes")
+	VarzSErrRead  = nio.VarzSErrRead
+	VarzSErrWrite = nio.VarzSErrWrite
+	VarzCErrRead  = nio.VarzCErrRead
+	VarzCErrWrite = nio.VarzCErrWrite
 
-	// Managed by 'NewTCPProxy' - before dial.
-	TcpConTotal = expvar.NewInt("gate_tcp_total")
+	VarzMaxRead = nio.VarzMaxRead
 
-	// Managed by updateStatsOnClose - including error cases.
-	TcpConActive = expvar.NewInt("gate_tcp_active")
+	TcpConTotal  = nio.TcpConTotal
+	TcpConActive = nio.TcpConActive
 )
 
 // TODO: use net.Dialer.DialContext(ctx context.Context, network, address string) (InOutStream, error)
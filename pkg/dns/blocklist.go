@@ -0,0 +1,421 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/costinm/ugate/pkg/metrics"
+	"github.com/miekg/dns"
+)
+
+// Blocking of ad, tracking and malware domains, for all captured DNS.
+//
+// Lists are loaded from files or URLs and reloaded periodically. Each line
+// can be:
+//   - hosts file: "0.0.0.0 ads.example.com" - blocks the exact names.
+//   - domain: "ads.example.com" or "*.ads.example.com" - blocks the domain
+//     and subdomains.
+//   - Adblock: "||ads.example.com^" - the domain and subdomains.
+//     "@@||cdn.example.com^" allows a domain. Rules with other modifiers
+//     are browser specific and skipped.
+//
+// Comments start with '#' or '!'. Allowed domains - from Allow, allowlists
+// or Adblock exceptions - are never blocked.
+
+// Block responses.
+const (
+	BlockNXDomain = "nxdomain"
+	BlockNull     = "null"
+)
+
+var blockedQueries = metrics.NewCounterVec("ugate_dns_blocked_total",
+	"DNS queries blocked, by list.", "list")
+
+type Blocker struct {
+	// Lists to load.
+	Lists []*BlockList `json:"lists,omitempty"`
+
+	// Allow has domains that are never blocked, with their subdomains.
+	Allow []string `json:"allow,omitempty"`
+
+	// Response for blocked names: "nxdomain" (default), "null" for
+	// 0.0.0.0 and ::, or a sinkhole IP - returned for queries of the same
+	// family, with an empty answer for the other.
+	Response string `json:"response,omitempty"`
+
+	// TTL of the block responses. Default 60.
+	TTL uint32 `json:"ttl,omitempty"`
+
+	// Refresh is the interval for reloading the lists. Default 24h.
+	Refresh time.Duration `json:"refresh,omitempty"`
+
+	// MaxSize is the max size of a list downloaded from a URL. Larger lists
+	// fail to load. Default 64M.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// HTTP client for lists loaded from URLs. Defaults to
+	// http.DefaultClient.
+	HTTP *http.Client `json:"-"`
+
+	allowOnce sync.Once
+	allow     *BlockList
+}
+
+// BlockList is a list of blocked or allowed domains.
+type BlockList struct {
+	// Name of the list, for stats. Defaults to Source.
+	Name string `json:"name,omitempty"`
+
+	// Source is a file name or a http(s) URL.
+	Source string `json:"source"`
+
+	// Allow makes this an allowlist.
+	Allow bool `json:"allow,omitempty"`
+
+	m            sync.RWMutex
+	exact        map[string]struct{}
+	subtree      map[string]struct{}
+	allowSubtree map[string]struct{}
+	loaded       time.Time
+	err          string
+
+	hits atomic.Int64
+}
+
+// BlockListState is the state of a list.
+type BlockListState struct {
+	Name    string    `json:"name"`
+	Source  string    `json:"source,omitempty"`
+	Allow   bool      `json:"allow,omitempty"`
+	Entries int       `json:"entries"`
+	Hits    int64     `json:"hits"`
+	Loaded  time.Time `json:"loaded,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (l *BlockList) name() string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return l.Source
+}
+
+// Parse replaces the entries of the list.
+func (l *BlockList) Parse(r io.Reader) error {
+	exact := map[string]struct{}{}
+	subtree := map[string]struct{}{}
+	allow := map[string]struct{}{}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		// Inline comments in hosts files. Adblock cosmetic rules use ##
+		// without a space, and are rejected as domains.
+		if i := strings.Index(line, " #"); i > 0 {
+			line = line[:i]
+		} else if i := strings.Index(line, "\t#"); i > 0 {
+			line = line[:i]
+		}
+
+		switch {
+		case strings.HasPrefix(line, "@@||"):
+			if d, ok := adblockDomain(line[4:]); ok {
+				allow[d] = struct{}{}
+			}
+		case strings.HasPrefix(line, "||"):
+			if d, ok := adblockDomain(line[2:]); ok {
+				subtree[d] = struct{}{}
+			}
+		default:
+			f := strings.Fields(line)
+			if len(f) > 1 && net.ParseIP(f[0]) != nil {
+				for _, h := range f[1:] {
+					if d, ok := domainName(h); ok && !localHost(d) {
+						exact[d] = struct{}{}
+					}
+				}
+			} else if len(f) == 1 {
+				if d, ok := domainName(strings.TrimPrefix(f[0], "*.")); ok {
+					subtree[d] = struct{}{}
+				}
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	if l.Allow {
+		// All entries of an allowlist allow the domain and subdomains.
+		for d := range exact {
+			allow[d] = struct{}{}
+		}
+		for d := range subtree {
+			allow[d] = struct{}{}
+		}
+		exact, subtree = map[string]struct{}{}, map[string]struct{}{}
+	}
+
+	l.m.Lock()
+	l.exact, l.subtree, l.allowSubtree = exact, subtree, allow
+	l.loaded = time.Now()
+	l.err = ""
+	l.m.Unlock()
+	return nil
+}
+
+// adblockDomain returns the domain of a "domain^" rule, skipping rules
+// with paths, wildcards or modifiers other than $important.
+func adblockDomain(r string) (string, bool) {
+	d, rest, ok := strings.Cut(r, "^")
+	if !ok || rest != "" && rest != "$important" {
+		return "", false
+	}
+	return domainName(d)
+}
+
+func domainName(d string) (string, bool) {
+	if d == "" || strings.ContainsAny(d, "/*:#$^|@") {
+		return "", false
+	}
+	d = dns.CanonicalName(d)
+	if _, ok := dns.IsDomainName(d); !ok || d == "." {
+		return "", false
+	}
+	return d, true
+}
+
+func localHost(d string) bool {
+	switch d {
+	case "localhost.", "localhost.localdomain.", "local.", "broadcasthost.",
+		"ip6-localhost.", "ip6-loopback.", "0.0.0.0.":
+		return true
+	}
+	return false
+}
+
+// matchName returns true if the name is in exact, or the name or a parent
+// is in subtree.
+func matchName(exact, subtree map[string]struct{}, name string) bool {
+	if _, ok := exact[name]; ok {
+		return true
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := subtree[name[off:]]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *BlockList) blocks(name string) bool {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	return matchName(l.exact, l.subtree, name)
+}
+
+func (l *BlockList) allows(name string) bool {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	return matchName(nil, l.allowSubtree, name)
+}
+
+// State returns the stats of the list.
+func (l *BlockList) State() *BlockListState {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	return &BlockListState{
+		Name:    l.name(),
+		Source:  l.Source,
+		Allow:   l.Allow,
+		Entries: len(l.exact) + len(l.subtree) + len(l.allowSubtree),
+		Hits:    l.hits.Load(),
+		Loaded:  l.loaded,
+		Error:   l.err,
+	}
+}
+
+func (b *Blocker) allowList() *BlockList {
+	b.allowOnce.Do(func() {
+		b.allow = &BlockList{Name: "allow", Allow: true}
+		b.allow.Parse(strings.NewReader(strings.Join(b.Allow, "\n")))
+	})
+	return b.allow
+}
+
+// Match returns the list blocking the name, or nil if the name is not
+// blocked.
+func (b *Blocker) Match(name string) *BlockList {
+	name = dns.CanonicalName(name)
+	al := b.allowList()
+	if al.allows(name) {
+		al.hits.Add(1)
+		return nil
+	}
+	for _, l := range b.Lists {
+		if l.allows(name) {
+			l.hits.Add(1)
+			return nil
+		}
+	}
+	for _, l := range b.Lists {
+		if l.blocks(name) {
+			l.hits.Add(1)
+			blockedQueries.With(l.name()).Inc()
+			return l
+		}
+	}
+	return nil
+}
+
+// answer returns the block response, or nil if the query is not blocked.
+func (b *Blocker) answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if b.Match(q.Name) == nil {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if b.Response == "" || b.Response == BlockNXDomain {
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+
+	var ip net.IP
+	if b.Response == BlockNull {
+		if q.Qtype == dns.TypeAAAA {
+			ip = net.IPv6zero
+		} else {
+			ip = net.IPv4zero
+		}
+	} else {
+		ip = net.ParseIP(b.Response)
+	}
+	ttl := b.TTL
+	if ttl == 0 {
+		ttl = 60
+	}
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: ttl}
+	switch {
+	case q.Qtype == dns.TypeA && ip.To4() != nil:
+		hdr.Rrtype = dns.TypeA
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+	case q.Qtype == dns.TypeAAAA && ip != nil && ip.To4() == nil:
+		hdr.Rrtype = dns.TypeAAAA
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+	}
+	return m
+}
+
+// Load loads or reloads all lists. A list that fails to load keeps the
+// previous entries.
+func (b *Blocker) Load(ctx context.Context) error {
+	var errs []error
+	for _, l := range b.Lists {
+		if err := b.load(ctx, l); err != nil {
+			log.Println("DNS: blocklist", l.name(), err)
+			l.m.Lock()
+			l.err = err.Error()
+			l.m.Unlock()
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *Blocker) load(ctx context.Context, l *BlockList) error {
+	if !strings.HasPrefix(l.Source, "http://") && !strings.HasPrefix(l.Source, "https://") {
+		f, err := os.Open(l.Source)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return l.Parse(f)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, l.Source, nil)
+	if err != nil {
+		return err
+	}
+	hc := b.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	res, err := hc.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New("status " + res.Status)
+	}
+	// Read the full list first - a truncated download shouldn't replace
+	// the previous entries.
+	limit := b.MaxSize
+	if limit == 0 {
+		limit = 64 * 1024 * 1024
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		return errors.New("list larger than max_size")
+	}
+	return l.Parse(bytes.NewReader(body))
+}
+
+// Run loads the lists, and reloads them every Refresh until ctx is done.
+func (b *Blocker) Run(ctx context.Context) {
+	refresh := b.Refresh
+	if refresh == 0 {
+		refresh = 24 * time.Hour
+	}
+	b.Load(ctx)
+	t := time.NewTicker(refresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			b.Load(ctx)
+		}
+	}
+}
+
+// States returns the stats of the lists, starting with the Allow list.
+func (b *Blocker) States() []*BlockListState {
+	res := []*BlockListState{b.allowList().State()}
+	for _, l := range b.Lists {
+		res = append(res, l.State())
+	}
+	return res
+}
+
+// HandleBlock returns the list stats as JSON. POST reloads the lists.
+//
+// curl localhost:15000/debug/dnsblock
+// curl -XPOST localhost:15000/debug/dnsblock
+func (b *Blocker) HandleBlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		b.Load(r.Context())
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(b.States())
+}
@@ -0,0 +1,174 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testList = `# hosts file
+0.0.0.0 ads.example.com tracker.example.com # inline comment
+127.0.0.1 localhost
+0.0.0.0 0.0.0.0
+
+! Adblock
+[Adblock Plus 2.0]
+||doubleclick.example^
+||important.example^$important
+||script.example^$third-party
+||cdn.doubleclick.example/ads.js
+@@||ok.doubleclick.example^
+example.org##.banner
+
+malware.example
+*.wild.example
+`
+
+func TestBlockListParse(t *testing.T) {
+	l := &BlockList{Name: "test"}
+	if err := l.Parse(strings.NewReader(testList)); err != nil {
+		t.Fatal(err)
+	}
+	for name, blocked := range map[string]bool{
+		"ads.example.com.":         true,
+		"x.ads.example.com.":       false, // hosts entries are exact
+		"tracker.example.com.":     true,
+		"localhost.":               false,
+		"doubleclick.example.":     true,
+		"a.b.doubleclick.example.": true,
+		"important.example.":       true,
+		"script.example.":          false, // browser specific
+		"cdn.doubleclick.example.": true,
+		"example.org.":             false,
+		"Malware.Example.":         false, // Match canonicalizes
+		"www.malware.example.":     true,
+		"wild.example.":            true,
+		"x.wild.example.":          true,
+		"example.":                 false,
+		"ok.doubleclick.example.":  true, // blocks, but allowed in Match
+		"notdoubleclick.example.":  false,
+	} {
+		if l.blocks(name) != blocked {
+			t.Error("Unexpected", name, blocked)
+		}
+	}
+	if !l.allows("x.ok.doubleclick.example.") {
+		t.Error("Expected exception")
+	}
+	if st := l.State(); st.Entries != 7 || st.Loaded.IsZero() {
+		t.Error("Unexpected state", st)
+	}
+}
+
+func TestBlocker(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "hosts")
+	os.WriteFile(f, []byte(testList), 0o644)
+
+	var served atomic.Int32
+	lists := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		if r.URL.Path == "/allow.txt" {
+			w.Write([]byte("cdn.ads.example.net\n"))
+			return
+		}
+		w.Write([]byte("||ads.example.net^\n||allowed.example^\n"))
+	}))
+	defer lists.Close()
+
+	ns, cnt := fakeUpstream(t, 300)
+	s := New()
+	s.Nameservers = []string{ns}
+	s.Block = &Blocker{
+		Lists: []*BlockList{
+			{Name: "file", Source: f},
+			{Source: lists.URL + "/list.txt"},
+			{Name: "allowlist", Source: lists.URL + "/allow.txt", Allow: true},
+			{Name: "missing", Source: filepath.Join(dir, "missing")},
+		},
+		Allow: []string{"allowed.example"},
+	}
+	err := s.Block.Load(context.Background())
+	if err == nil || served.Load() != 2 {
+		t.Fatal("Expected error for the missing list", err)
+	}
+
+	if res := query(s, "ads.example.com."); res.Rcode != dns.RcodeNameError {
+		t.Fatal("Expected NXDOMAIN", res)
+	}
+	if res := query(s, "x.ads.example.net."); res.Rcode != dns.RcodeNameError {
+		t.Fatal("Expected NXDOMAIN", res)
+	}
+	for _, n := range []string{"a.cdn.ads.example.net.", "allowed.example.", "ok.doubleclick.example."} {
+		query(s, n)
+	}
+	if cnt.Load() != 3 {
+		t.Fatal("Expected allowed names forwarded", cnt.Load())
+	}
+
+	// Null and sinkhole responses
+	s.Block.Response = BlockNull
+	if ip := answerIP(query(s, "ads.example.com.")); ip != "0.0.0.0" {
+		t.Fatal("Unexpected null response", ip)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("ads.example.com.", dns.TypeAAAA)
+	if res := s.Do(m); len(res.Answer) != 1 || res.Answer[0].(*dns.AAAA).AAAA.String() != "::" {
+		t.Fatal("Unexpected null AAAA", res)
+	}
+	s.Block.Response = "10.1.1.1"
+	if ip := answerIP(query(s, "ads.example.com.")); ip != "10.1.1.1" {
+		t.Fatal("Unexpected sinkhole", ip)
+	}
+	if res := s.Do(m); res.Rcode != dns.RcodeSuccess || len(res.Answer) != 0 {
+		t.Fatal("Expected NODATA for AAAA", res)
+	}
+
+	// Reload with a failed download keeps the entries.
+	lists.Close()
+	s.Block.Load(context.Background())
+
+	srv := httptest.NewServer(http.HandlerFunc(s.Block.HandleBlock))
+	defer srv.Close()
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st []*BlockListState
+	json.NewDecoder(res.Body).Decode(&st)
+	res.Body.Close()
+	if len(st) != 5 || st[0].Name != "allow" || st[0].Hits != 1 {
+		t.Fatal("Unexpected states", st)
+	}
+	if st[1].Name != "file" || st[1].Hits != 6 || st[1].Error != "" {
+		t.Fatal("Unexpected file list", st[1])
+	}
+	if st[2].Entries != 2 || st[2].Error == "" || st[2].Hits != 1 {
+		t.Fatal("Unexpected url list", st[2])
+	}
+	if st[4].Error == "" {
+		t.Fatal("Expected error", st[4])
+	}
+
+	// Lists larger than MaxSize are rejected.
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testList))
+	}))
+	defer srv.Close()
+	b := &Blocker{Lists: []*BlockList{{Source: srv.URL}}, MaxSize: int64(len(testList)) - 1}
+	if err := b.Load(context.Background()); err == nil || b.Lists[0].State().Entries != 0 {
+		t.Fatal("Expected max size error", err)
+	}
+	b.MaxSize = int64(len(testList))
+	if err := b.Load(context.Background()); err != nil || b.Lists[0].State().Entries != 7 {
+		t.Fatal("Unexpected list", err, b.Lists[0].State())
+	}
+}
@@ -0,0 +1,423 @@
+package dns
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/costinm/ugate/pkg/metrics"
+	"github.com/miekg/dns"
+)
+
+// Response cache for forwarded queries.
+//
+// Entries are keyed by name, type, class and the DO and CD bits of the
+// query, and expire with the lowest TTL in the response. NXDOMAIN and
+// NODATA responses are cached using the SOA in the authority section
+// (RFC 2308) - without a SOA they are not cached.
+//
+// With ServeStale, expired entries are returned for up to StaleTTL while
+// the query is refreshed in background (RFC 8767). Entries with at least
+// PrefetchHits hits are refreshed before they expire, so popular names
+// don't pay the upstream round trip.
+
+var (
+	cacheLookups = metrics.NewCounterVec("ugate_dns_cache_lookups_total",
+		"DNS cache lookups by result - hit, negative, stale, miss.", "result")
+	cachePrefetch = metrics.NewCounter("ugate_dns_cache_prefetch_total",
+		"Background refreshes of cached entries.")
+	cacheEvictions = metrics.NewCounter("ugate_dns_cache_evictions_total",
+		"Entries evicted from the DNS cache to stay under MaxEntries.")
+	cacheEntries = metrics.NewGauge("ugate_dns_cache_entries",
+		"Entries in the DNS cache.")
+)
+
+// ednsSize is the UDP size advertised in cached responses, if the upstream
+// response didn't have an OPT record.
+const ednsSize = 1232
+
+// staleAnswerTTL is the TTL of stale answers, as recommended by RFC 8767.
+const staleAnswerTTL = 30
+
+// refreshInterval is the min time between refreshes of an entry, in case
+// the upstream fails.
+const refreshInterval = 10 * time.Second
+
+type Cache struct {
+	// MaxEntries is the max number of cached responses, least recently
+	// used are evicted. Default 10000.
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// MinTTL and MaxTTL clamp the TTL of positive responses. Default
+	// 0 and 24h.
+	MinTTL time.Duration `json:"min_ttl,omitempty"`
+	MaxTTL time.Duration `json:"max_ttl,omitempty"`
+
+	// MaxNegativeTTL caps the TTL of NXDOMAIN and NODATA. Default 15 min.
+	MaxNegativeTTL time.Duration `json:"max_negative_ttl,omitempty"`
+
+	// ServeStale returns expired entries while refreshing them.
+	ServeStale bool `json:"serve_stale,omitempty"`
+
+	// StaleTTL is how long expired entries can be served. Default 1 day.
+	StaleTTL time.Duration `json:"stale_ttl,omitempty"`
+
+	// PrefetchHits is the number of hits that makes an entry eligible for
+	// refresh in the last 10% of its TTL. 0 disables prefetch.
+	PrefetchHits int `json:"prefetch_hits,omitempty"`
+
+	m       sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+
+	stats CacheStats
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	view   string
+
+	// DNSSEC OK and Checking Disabled change the upstream response.
+	do, cd bool
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	msg      *dns.Msg
+	stored   time.Time
+	expires  time.Time
+	ttl      time.Duration
+	negative bool
+	hits     int
+
+	// refreshed is the time of the last background refresh.
+	refreshed time.Time
+}
+
+// CacheStats are the counters of a cache.
+type CacheStats struct {
+	Entries    int `json:"entries"`
+	Hits       int `json:"hits"`
+	Negative   int `json:"negative"`
+	Stale      int `json:"stale"`
+	Misses     int `json:"misses"`
+	Prefetches int `json:"prefetches"`
+	Evictions  int `json:"evictions"`
+}
+
+// CacheEntryInfo describes a cached response, for debug.
+type CacheEntryInfo struct {
+	Name     string        `json:"name"`
+	View     string        `json:"view,omitempty"`
+	Type     string        `json:"type"`
+	Rcode    string        `json:"rcode"`
+	TTL      time.Duration `json:"ttl"`
+	Expires  time.Time     `json:"expires"`
+	Hits     int           `json:"hits"`
+	Negative bool          `json:"negative,omitempty"`
+}
+
+func (c *Cache) init() {
+	if c.entries != nil {
+		return
+	}
+	if c.MaxEntries == 0 {
+		c.MaxEntries = 10000
+	}
+	if c.MaxTTL == 0 {
+		c.MaxTTL = 24 * time.Hour
+	}
+	if c.MaxNegativeTTL == 0 {
+		c.MaxNegativeTTL = 15 * time.Minute
+	}
+	if c.StaleTTL == 0 {
+		c.StaleTTL = 24 * time.Hour
+	}
+	c.entries = map[cacheKey]*list.Element{}
+	c.lru = list.New()
+}
+
+func keyOf(view string, req *dns.Msg) cacheKey {
+	q := req.Question[0]
+	k := cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass, view: view,
+		cd: req.CheckingDisabled}
+	if opt := req.IsEdns0(); opt != nil {
+		k.do = opt.Do()
+	}
+	return k
+}
+
+// Get returns a cached response for the query, with the TTLs decremented
+// and the ID of the request. If refresh is true the caller should resolve
+// the query again and Put the result - the entry is stale or about to
+// expire.
+//
+// The view separates the answers of split-horizon zones - empty for the
+// default upstreams.
+func (c *Cache) Get(view string, req *dns.Msg) (res *dns.Msg, refresh bool) {
+	if len(req.Question) != 1 {
+		return nil, false
+	}
+	k := keyOf(view, req)
+	now := time.Now()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.init()
+
+	el, ok := c.entries[k]
+	if !ok {
+		c.miss()
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	stale := now.After(e.expires)
+	if stale && (!c.ServeStale || now.Sub(e.expires) > c.StaleTTL) {
+		c.remove(el)
+		c.miss()
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	e.hits++
+	switch {
+	case stale:
+		c.stats.Stale++
+		cacheLookups.With("stale").Inc()
+		refresh = true
+	case e.negative:
+		c.stats.Negative++
+		cacheLookups.With("negative").Inc()
+	default:
+		c.stats.Hits++
+		cacheLookups.With("hit").Inc()
+		refresh = c.PrefetchHits > 0 && e.hits >= c.PrefetchHits &&
+			e.expires.Sub(now) < e.ttl/10
+	}
+	if refresh {
+		if now.Sub(e.refreshed) < refreshInterval {
+			refresh = false
+		} else {
+			e.refreshed = now
+			c.stats.Prefetches++
+			cachePrefetch.Inc()
+		}
+	}
+
+	res = e.msg.Copy()
+	res.Id = req.Id
+	res.Question = req.Question
+	ednsReply(req, res)
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, s := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range s {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			switch {
+			case stale:
+				h.Ttl = staleAnswerTTL
+			case h.Ttl > age:
+				h.Ttl -= age
+			default:
+				h.Ttl = 0
+			}
+		}
+	}
+	return res, refresh
+}
+
+// ednsReply replaces the OPT record of a cached response - OPT is per hop
+// (RFC 6891), the client gets one only if the query had one, with the DO
+// bit of the query.
+func ednsReply(req, res *dns.Msg) {
+	size := uint16(ednsSize)
+	extra := res.Extra[:0]
+	for _, rr := range res.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			size = opt.UDPSize()
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	res.Extra = extra
+	if opt := req.IsEdns0(); opt != nil {
+		res.SetEdns0(size, opt.Do())
+	}
+}
+
+func (c *Cache) miss() {
+	c.stats.Misses++
+	cacheLookups.With("miss").Inc()
+}
+
+// Put caches the response to a query, if it is cacheable: success with
+// answers, NXDOMAIN or NODATA with a SOA. Truncated responses and errors
+// are not cached.
+func (c *Cache) Put(view string, req *dns.Msg, res *dns.Msg) {
+	if res == nil || len(req.Question) != 1 || res.Truncated {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.init()
+
+	ttl, negative, ok := c.cacheTTL(res)
+	if !ok || ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{
+		key:      keyOf(view, req),
+		msg:      res.Copy(),
+		stored:   now,
+		expires:  now.Add(ttl),
+		ttl:      ttl,
+		negative: negative,
+	}
+	if el, ok := c.entries[e.key]; ok {
+		old := el.Value.(*cacheEntry)
+		e.hits = old.hits
+		e.refreshed = old.refreshed
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	cacheEntries.Add(1)
+	for c.lru.Len() > c.MaxEntries {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+		cacheEvictions.Inc()
+	}
+}
+
+// cacheTTL returns the TTL for a response, and if it is a negative response.
+func (c *Cache) cacheTTL(res *dns.Msg) (time.Duration, bool, bool) {
+	switch {
+	case res.Rcode == dns.RcodeSuccess && len(res.Answer) > 0:
+		ttl := time.Duration(minTTL(res.Answer, res.Ns, res.Extra)) * time.Second
+		if ttl < c.MinTTL {
+			ttl = c.MinTTL
+		}
+		if ttl > c.MaxTTL {
+			ttl = c.MaxTTL
+		}
+		return ttl, false, true
+	case res.Rcode == dns.RcodeSuccess || res.Rcode == dns.RcodeNameError:
+		// RFC 2308 section 5 - the TTL is the min of the SOA TTL and
+		// the SOA MINIMUM field.
+		for _, rr := range res.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				d := time.Duration(ttl) * time.Second
+				if d > c.MaxNegativeTTL {
+					d = c.MaxNegativeTTL
+				}
+				return d, true, true
+			}
+		}
+	}
+	return 0, false, false
+}
+
+func minTTL(sections ...[]dns.RR) uint32 {
+	first := true
+	var ttl uint32
+	for _, s := range sections {
+		for _, rr := range s {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || h.Ttl < ttl {
+				ttl = h.Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+	cacheEntries.Add(-1)
+}
+
+// Flush removes the entries for a name, or all entries if name is empty.
+// Returns the number of removed entries.
+func (c *Cache) Flush(name string) int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.init()
+	name = strings.ToLower(dns.Fqdn(name))
+	n := 0
+	for k, el := range c.entries {
+		if name == "." || k.name == name {
+			c.remove(el)
+			n++
+		}
+	}
+	return n
+}
+
+// Stats returns the cache counters.
+func (c *Cache) Stats() CacheStats {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.init()
+	st := c.stats
+	st.Entries = c.lru.Len()
+	return st
+}
+
+// Entries returns the cached entries, most recently used first.
+func (c *Cache) Entries() []*CacheEntryInfo {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.init()
+	res := make([]*CacheEntryInfo, 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*cacheEntry)
+		res = append(res, &CacheEntryInfo{
+			Name:     e.key.name,
+			View:     e.key.view,
+			Type:     dns.TypeToString[e.key.qtype],
+			Rcode:    dns.RcodeToString[e.msg.Rcode],
+			TTL:      e.ttl,
+			Expires:  e.expires,
+			Hits:     e.hits,
+			Negative: e.negative,
+		})
+	}
+	return res
+}
+
+// HandleCache returns the cache stats and entries as JSON. DELETE flushes
+// the cache, or only a name if the name query parameter is set.
+//
+// curl localhost:15000/debug/dnscache
+// curl -XDELETE "localhost:15000/debug/dnscache?name=example.com"
+func (c *Cache) HandleCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		n := c.Flush(r.URL.Query().Get("name"))
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"flushed": n})
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Stats   CacheStats        `json:"stats"`
+		Entries []*CacheEntryInfo `json:"entries"`
+	}{c.Stats(), c.Entries()})
+}
@@ -0,0 +1,294 @@
+package dns
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream answers A queries for *.example. with 10.0.0.1, and NXDOMAIN
+// for everything else - with a SOA for *.nx. names. *.big. names have 50
+// addresses, and are truncated on UDP. Counts the UDP queries.
+func fakeUpstream(t *testing.T, ttl uint32) (string, *atomic.Int32) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnt := &atomic.Int32{}
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		_, udp := w.RemoteAddr().(*net.UDPAddr)
+		if udp {
+			cnt.Add(1)
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		switch {
+		case dns.IsSubDomain("big.", q.Name) && udp:
+			m.Truncated = true
+		case dns.IsSubDomain("big.", q.Name):
+			for i := 0; i < 50; i++ {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+					A:   net.IPv4(10, 0, 1, byte(i))})
+			}
+		case dns.IsSubDomain("slow.", q.Name):
+			time.Sleep(300 * time.Millisecond)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   net.IPv4(10, 0, 0, 2)})
+		case dns.IsSubDomain("example.", q.Name):
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   net.IPv4(10, 0, 0, 1)})
+		case dns.IsSubDomain("nx.", q.Name):
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, &dns.SOA{
+				Hdr: dns.RR_Header{Name: "nx.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+				Ns:  "ns.nx.", Mbox: "admin.nx.", Minttl: 60})
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})
+	srv := &dns.Server{PacketConn: pc, Handler: h}
+	go srv.ActivateAndServe()
+	tsrv := &dns.Server{Listener: l, Handler: h}
+	go tsrv.ActivateAndServe()
+	t.Cleanup(func() {
+		srv.Shutdown()
+		tsrv.Shutdown()
+	})
+	return pc.LocalAddr().String(), cnt
+}
+
+func query(s *DmDns, name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	return s.Do(m)
+}
+
+func TestCache(t *testing.T) {
+	ns, cnt := fakeUpstream(t, 300)
+	s := New()
+	s.Nameservers = []string{ns}
+
+	res := query(s, "www.example.")
+	if len(res.Answer) != 1 || cnt.Load() != 1 {
+		t.Fatal("Unexpected response", res, cnt.Load())
+	}
+	res = query(s, "WWW.example.")
+	if len(res.Answer) != 1 || cnt.Load() != 1 {
+		t.Fatal("Expected cached response", res, cnt.Load())
+	}
+	if res.Question[0].Name != "WWW.example." {
+		t.Fatal("Expected the question of the request", res.Question)
+	}
+
+	// TTL decreases with the age of the entry.
+	s.Cache.m.Lock()
+	s.Cache.entries[cacheKey{name: "www.example.", qtype: dns.TypeA, qclass: dns.ClassINET}].Value.(*cacheEntry).stored = time.Now().Add(-100 * time.Second)
+	s.Cache.m.Unlock()
+	res = query(s, "www.example.")
+	if ttl := res.Answer[0].Header().Ttl; ttl != 200 {
+		t.Fatal("Unexpected TTL", ttl)
+	}
+
+	// Negative answers are cached with the SOA TTL, but only if they have a
+	// SOA.
+	for i := 0; i < 2; i++ {
+		res = query(s, "a.nx.")
+		if res.Rcode != dns.RcodeNameError {
+			t.Fatal("Expected NXDOMAIN", res)
+		}
+	}
+	if cnt.Load() != 2 {
+		t.Fatal("Expected cached NXDOMAIN", cnt.Load())
+	}
+	query(s, "a.other.")
+	query(s, "a.other.")
+	if cnt.Load() != 4 {
+		t.Fatal("Expected uncached NXDOMAIN", cnt.Load())
+	}
+	for _, e := range s.Cache.Entries() {
+		if e.Name == "a.nx." && (!e.Negative || e.TTL != time.Minute) {
+			t.Fatal("Unexpected negative entry", e)
+		}
+	}
+
+	st := s.Cache.Stats()
+	if st.Entries != 2 || st.Hits != 2 || st.Negative != 1 || st.Misses != 4 {
+		t.Fatal("Unexpected stats", st)
+	}
+
+	if n := s.Cache.Flush("www.example"); n != 1 {
+		t.Fatal("Unexpected flush", n)
+	}
+	query(s, "www.example.")
+	if cnt.Load() != 5 {
+		t.Fatal("Expected query after flush", cnt.Load())
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	ns, cnt := fakeUpstream(t, 300)
+	s := New()
+	s.Cache.MaxEntries = 2
+	s.Nameservers = []string{ns}
+
+	query(s, "a.example.")
+	query(s, "b.example.")
+	query(s, "a.example.") // a is now the most recently used
+	query(s, "c.example.") // evicts b
+	query(s, "a.example.")
+	if cnt.Load() != 3 {
+		t.Fatal("Expected a cached", cnt.Load())
+	}
+	query(s, "b.example.")
+	if cnt.Load() != 4 {
+		t.Fatal("Expected b evicted", cnt.Load())
+	}
+	if st := s.Cache.Stats(); st.Entries != 2 || st.Evictions != 2 {
+		t.Fatal("Unexpected stats", st)
+	}
+}
+
+func expire(c *Cache, name string, d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	e := c.entries[cacheKey{name: name, qtype: dns.TypeA, qclass: dns.ClassINET}].Value.(*cacheEntry)
+	e.expires = time.Now().Add(d)
+	e.refreshed = time.Time{}
+}
+
+func waitFor(t *testing.T, cnt *atomic.Int32, n int32) {
+	for i := 0; i < 100 && cnt.Load() < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cnt.Load() != n {
+		t.Fatal("Expected upstream queries", n, cnt.Load())
+	}
+}
+
+func TestCacheStaleAndPrefetch(t *testing.T) {
+	ns, cnt := fakeUpstream(t, 300)
+	s := New()
+	s.Cache.ServeStale = true
+	s.Cache.PrefetchHits = 2
+	s.Nameservers = []string{ns}
+
+	// Expired entries are returned with a short TTL and refreshed.
+	query(s, "a.example.")
+	expire(s.Cache, "a.example.", -time.Minute)
+	res := query(s, "a.example.")
+	if len(res.Answer) != 1 || res.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Fatal("Expected stale answer", res)
+	}
+	waitFor(t, cnt, 2)
+	res = query(s, "a.example.")
+	if res.Answer[0].Header().Ttl < 299 {
+		t.Fatal("Expected refreshed entry", res)
+	}
+
+	// Entries past StaleTTL are removed.
+	expire(s.Cache, "a.example.", -2*s.Cache.StaleTTL)
+	query(s, "a.example.")
+	waitFor(t, cnt, 3)
+
+	// Popular entries are refreshed before they expire.
+	query(s, "b.example.")
+	expire(s.Cache, "b.example.", 10*time.Second)
+	query(s, "b.example.") // 1 hit - not popular
+	time.Sleep(50 * time.Millisecond)
+	if cnt.Load() != 4 {
+		t.Fatal("Unexpected prefetch", cnt.Load())
+	}
+	query(s, "b.example.")
+	waitFor(t, cnt, 5)
+	if st := s.Cache.Stats(); st.Stale != 1 || st.Prefetches != 2 {
+		t.Fatal("Unexpected stats", st)
+	}
+}
+
+func TestCacheHandler(t *testing.T) {
+	ns, _ := fakeUpstream(t, 300)
+	s := New()
+	s.Nameservers = []string{ns}
+	query(s, "a.example.")
+	query(s, "b.example.")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/dnscache", s.Cache.HandleCache)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/debug/dnscache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st struct {
+		Stats   CacheStats
+		Entries []*CacheEntryInfo
+	}
+	json.NewDecoder(res.Body).Decode(&st)
+	res.Body.Close()
+	if st.Stats.Entries != 2 || len(st.Entries) != 2 || st.Entries[0].Name != "b.example." {
+		t.Fatal("Unexpected stats", st)
+	}
+
+	r, _ := http.NewRequest(http.MethodDelete, srv.URL+"/debug/dnscache", nil)
+	res, err = http.DefaultClient.Do(r)
+	if err != nil || res.StatusCode != 200 {
+		t.Fatal("Flush failed", res, err)
+	}
+	if n := s.Cache.Stats().Entries; n != 0 {
+		t.Fatal("Expected empty cache", n)
+	}
+}
+
+func TestCacheEDNS(t *testing.T) {
+	c := &Cache{}
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Answer = append(res.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(10, 0, 0, 1)})
+	res.SetEdns0(1400, false)
+	c.Put("", req, res)
+
+	// The OPT record is only returned to EDNS clients.
+	plain := new(dns.Msg)
+	plain.SetQuestion("a.example.", dns.TypeA)
+	if got, _ := c.Get("", plain); got == nil || got.IsEdns0() != nil {
+		t.Fatal("Unexpected response for non-EDNS client", got)
+	}
+	got, _ := c.Get("", req)
+	if opt := got.IsEdns0(); opt == nil || opt.UDPSize() != 1400 || opt.Do() {
+		t.Fatal("Unexpected OPT", got)
+	}
+
+	// DO and CD queries are cached separately.
+	do := req.Copy()
+	do.IsEdns0().SetDo()
+	if got, _ := c.Get("", do); got != nil {
+		t.Fatal("Unexpected cached response for DO", got)
+	}
+	cd := plain.Copy()
+	cd.CheckingDisabled = true
+	if got, _ := c.Get("", cd); got != nil {
+		t.Fatal("Unexpected cached response for CD", got)
+	}
+}
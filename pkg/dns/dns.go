@@ -2,13 +2,13 @@ package dns
 
 import (
 	"context"
-	"encoding/binary"
+	"crypto/tls"
 	"expvar"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,11 +28,6 @@ import (
 
 var (
 	// createBuffer to get a buffer. Inspired from caddy.
-	// See PooledIOCopy for example
-	bufferPoolCopy = sync.Pool{New: func() interface{} {
-		return make([]byte, 0, 32*1024)
-	}}
-
 	bufferPoolHttp = sync.Pool{New: func() interface{} {
 		return make([]byte, 0, 4096)
 	}}
@@ -86,14 +81,64 @@ type DmDns struct {
 	// local DNS entries. Both server and 'client'
 	dnsEntries map[string]map[uint16]dns.RR
 
-	// Nameservers to use for direct calls, without a VPN.
+	// Nameservers to use for direct calls, without a VPN - UDP. Used if
+	// Upstreams is empty.
 	// Overriden from "DNS" env variable.
 	Nameservers []string
 	Port        int
 
+	// Mux is used for the /debug/dnscache, /debug/dnsupstreams and
+	// /debug/dnsblock handlers, if set.
 	Mux *http.ServeMux
 
 	Capture bool
+
+	// Upstreams are the resolvers for forwarded queries - UDP, TCP, DoT or
+	// DoH.
+	Upstreams []*Upstream `json:"upstreams,omitempty"`
+
+	// Strategy for using the upstreams - sequential (default), parallel or
+	// fastest.
+	Strategy string `json:"strategy,omitempty"`
+
+	upOnce          sync.Once
+	activeUpstreams []*Upstream
+
+	// Zones forward domain suffixes to specific upstreams or answer them
+	// locally, optionally only for some client subnets.
+	Zones []*Zone `json:"zones,omitempty"`
+
+	zonesOnce   sync.Once
+	activeZones []*Zone
+
+	// Block has the blocklists for ads and malware domains.
+	Block *Blocker `json:"block,omitempty"`
+
+	// Cache for forwarded queries. Nil disables caching.
+	Cache *Cache `json:"cache,omitempty"`
+
+	// DoTPort is the port for DNS over TLS (RFC 7858), usually 853. DNS
+	// over TCP is always served on Port.
+	DoTPort int `json:"dot_port,omitempty"`
+
+	// TCPIdleTimeout closes idle TCP and DoT connections. Default 30s.
+	TCPIdleTimeout time.Duration `json:"tcp_idle_timeout,omitempty"`
+
+	// TLSConfig for DoT. If nil, Certs is used.
+	TLSConfig *tls.Config `json:"-"`
+
+	// Certs provides the certificates for DoT. If nil, the mesh config
+	// (nio.DefaultTLS) is used.
+	Certs CertSource `json:"-"`
+
+	tcpListener net.Listener
+	dotListener net.Listener
+}
+
+// CertSource returns the certificate for a SNI - implemented by
+// meshauth.Mesh.
+type CertSource interface {
+	GetCertificate(ctx context.Context, sni string) (*tls.Certificate, error)
 }
 
 type Record map[string][]string
@@ -123,6 +168,7 @@ func New() *DmDns {
 		dnsEntries:   map[string]map[uint16]dns.RR{},
 		dnsByAddr:    make(map[string]*DnsEntry),
 		dnsByName:    make(map[string]*DnsEntry),
+		Cache:        &Cache{},
 	}
 }
 
@@ -148,9 +194,10 @@ func (d *DmDns) Provision(ctx context.Context) error {
 		WriteTimeout: 3 * time.Second,
 		ReadTimeout:  15 * time.Minute}
 
-	// Can also set Handler instead of using ServerMux
-	dns.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
-		m := d.Do(req)
+	d.dnsServer.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := d.DoClient(req, clientAddr(w.RemoteAddr()))
+		// Clients retry on TCP if the answer doesn't fit.
+		m.Truncate(udpSize(req))
 		writeMsg(w, m)
 	})
 
@@ -174,8 +221,32 @@ func (d *DmDns) Provision(ctx context.Context) error {
 	// if d.Mux != nil {
 	// 	d.Mux.Handle("/dns/", d)
 	// }
+	if d.Mux != nil {
+		if d.Cache != nil {
+			d.Mux.HandleFunc("/debug/dnscache", d.Cache.HandleCache)
+		}
+		d.Mux.HandleFunc("/debug/dnsupstreams", d.HandleUpstreams)
+		if d.Block != nil {
+			d.Mux.HandleFunc("/debug/dnsblock", d.Block.HandleBlock)
+		}
+	}
+
+	d.tcpListener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
 
-	// TODO: also on TCP
+	if d.DoTPort > 0 {
+		cfg, err := d.dotConfig()
+		if err != nil {
+			return err
+		}
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(d.DoTPort))
+		if err != nil {
+			return err
+		}
+		d.dotListener = tls.NewListener(l, cfg)
+	}
 
 	return nil
 }
@@ -202,10 +273,32 @@ func (s *DmDns) Start(ctx context.Context) error {
 		net.DefaultResolver.Dial = DNSDialer(s.Port)
 	}
 
+	if s.Block != nil {
+		go s.Block.Run(ctx)
+	}
+
 	if s.Port > 0 {
 		// Will use PacketConn if not nil - and set the socket options.
 		// Will also serve on the Listener as DOT.
 		go s.dnsServer.ActivateAndServe()
+		go s.serveTCP(s.tcpListener)
+	}
+	if s.dotListener != nil {
+		go s.serveTCP(s.dotListener)
+	}
+	return nil
+}
+
+// Close stops the listeners.
+func (s *DmDns) Close() error {
+	if s.UDPConn != nil {
+		s.UDPConn.Close()
+	}
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+	if s.dotListener != nil {
+		s.dotListener.Close()
 	}
 	return nil
 }
@@ -239,89 +332,6 @@ func (s *DmDns) IPResolve(ip string) string {
 	return de.Name
 }
 
-// DNSOverTCP implements DNS over TCP protocol. Used in TCP capture, for port 53.
-// TODO: also as a standalone server.
-func (s *DmDns) DNSOverTCP(in io.ReadCloser, out io.Writer) error {
-	pbuf := bufferPoolCopy.Get().([]byte)
-	defer bufferPoolCopy.Put(pbuf)
-	bufCap := cap(pbuf)
-	buf := pbuf[0:bufCap:bufCap]
-
-	var err error
-	var er error
-
-	// data between 0 and off
-	off := 0
-
-	// incomplete packet - needs to fill the buffer
-	needRead := true
-
-	// number read in last Read operation
-	nr := 0
-
-	resB := bufferPoolHttp.Get().([]byte)
-	defer bufferPoolHttp.Put(resB)
-	resB = resB[0:4096:4096]
-	nreq := 0
-
-	defer log.Print("DNS TCP Close", nreq, err)
-
-	for {
-		if needRead {
-			nr, er = in.Read(buf[off:])
-			if er != nil || nr <= 0 {
-				return er
-			}
-		} else {
-			nr = off
-			needRead = true
-		}
-		end := off + nr
-		if end < 2 {
-			off += nr
-			//log.Println("TCPDNS: Short read, shouldn't happen ", nr, off)
-			needRead = true
-			continue
-		}
-		packetLen := int(buf[0])*256 + int(buf[1])
-		if packetLen+2 < end {
-			//log.Println("TCPDNS: Short packet read, shouldn't happen ", nr, off)
-			off += nr
-			needRead = true
-			continue
-		}
-
-		req := new(dns.Msg)
-		err = req.Unpack(buf[2 : 2+packetLen])
-
-		// TODO: in a go routine, to not block
-		res := s.Do(req)
-
-		resBB, _ := res.PackBuffer(resB[2:])
-		binary.BigEndian.PutUint16(resB[0:], uint16(len(resBB)))
-		nw, ew := out.Write(resB[0 : len(resBB)+2])
-
-		nreq++
-
-		if ew != nil {
-			return ew
-		}
-		if nr != nw {
-			return io.ErrShortWrite
-		}
-
-		if 2+packetLen < end {
-			copy(buf[0:], buf[2+packetLen:end])
-			off = end - 2 - packetLen
-			end = off
-			needRead = false
-			continue
-		}
-	}
-
-	return err
-}
-
 /*
 
 CoreDNS:
@@ -345,6 +355,12 @@ func (s *DmDns) ServeDNS(req *dns.Msg, w dns.ResponseWriter) (int, error) {
 //
 // Wrapps the real process method with stats gathering and builds a reverse map of IP to names
 func (s *DmDns) Do(req *dns.Msg) *dns.Msg {
+	return s.DoClient(req, netip.Addr{})
+}
+
+// DoClient resolves a query from a client - the client address selects
+// the split-horizon zones.
+func (s *DmDns) DoClient(req *dns.Msg, client netip.Addr) *dns.Msg {
 	//ClientMetrics.Total.StartListener(1)
 	if len(req.Question) == 0 {
 		m := new(dns.Msg)
@@ -382,7 +398,7 @@ func (s *DmDns) Do(req *dns.Msg) *dns.Msg {
 	}
 	s.dnsLock.Unlock()
 
-	res := s.process(req)
+	res := s.process(req, client)
 
 	if len(res.Answer) > 0 {
 		d := time.Since(t0)
@@ -431,31 +447,17 @@ func (s *DmDns) Do(req *dns.Msg) *dns.Msg {
 	return res
 }
 
-func (s *DmDns) process(req *dns.Msg) *dns.Msg {
-	name := req.Question[0].Name
-
-	if strings.HasSuffix(name, ".dm.") {
-		m := new(dns.Msg)
-		m.SetReply(req)
-		m.Compress = false
-
-		switch req.Opcode {
-		case dns.OpcodeQuery:
-			s.localQuery(m)
+func (s *DmDns) process(req *dns.Msg, client netip.Addr) *dns.Msg {
+	z := s.Match(req.Question[0].Name, client)
+	if z != nil {
+		if m := s.localAnswer(z, req); m != nil {
+			return m
 		}
-		return m
 	}
-	if strings.HasSuffix(name, ".m.") {
-		m := new(dns.Msg)
-		m.SetReply(req)
-		m.Compress = false
-
-		switch req.Opcode {
-		case dns.OpcodeQuery:
-			// TODO: resolve to 'next hop' in the mesh
-			s.localQuery(m)
+	if s.Block != nil {
+		if m := s.Block.answer(req); m != nil {
+			return m
 		}
-		return m
 	}
 
 	var res *dns.Msg
@@ -466,7 +468,7 @@ func (s *DmDns) process(req *dns.Msg) *dns.Msg {
 	//} else {
 
 	// TODO: use upstream control message for DNS
-	res, err = s.ForwardRealDNS(req)
+	res, err = s.forward(req, z)
 	//	}
 
 	if err == nil {
@@ -482,94 +484,42 @@ func (s *DmDns) process(req *dns.Msg) *dns.Msg {
 	return m
 }
 
-const dnsTest = false
-
-type dnsRes struct {
-	msg *dns.Msg
-	s   string
-	err error
-}
-
-// ForwardRealDNS sends the query to real nameservers.
-func (s *DmDns) ForwardRealDNS(req *dns.Msg) (*dns.Msg, error) {
-	var nsIdx int
-	var r *dns.Msg
-	var err error
-
-	nservers := s.Nameservers
-
-	// Send to all nameservers, find the fastest
-	if dnsTest {
-		t0 := time.Now()
-		res := make(chan dnsRes, 10)
-
-		for _, ns := range nservers {
-			ns := ns
-			go func() {
-				r, _, err = s.dnsUDPclient.Exchange(req, ns)
-				//log.Println("Got res ", ns, time.Since(t0))
-				res <- dnsRes{msg: r, s: ns, err: err}
-			}()
-
-		}
-		rr := <-res
-		r := rr.msg
-
-		if rr.err == nil {
-			switch r.Rcode {
-			// SUCCESS
-			case dns.RcodeSuccess:
-				fallthrough
-			case dns.RcodeNameError:
-				fallthrough
-				// NO RECOVERY
-			case dns.RcodeFormatError:
-				fallthrough
-			case dns.RcodeRefused:
-				fallthrough
-			case dns.RcodeNotImplemented:
-				log.Println("DNS", time.Since(t0), rr.s)
-				return r, err
-			}
-		}
-		return r, rr.err
-	}
-
-	for try := 1; try <= 2; try++ {
-
-		r, _, err = s.dnsUDPclient.Exchange(req, nservers[nsIdx])
-
-		if err == nil {
-			switch r.Rcode {
-			// SUCCESS
-			case dns.RcodeSuccess:
-				fallthrough
-			case dns.RcodeNameError:
-				fallthrough
-				// NO RECOVERY
-			case dns.RcodeFormatError:
-				fallthrough
-			case dns.RcodeRefused:
-				fallthrough
-			case dns.RcodeNotImplemented:
-				return r, err
-			}
-		}
-
-		if err != nil {
-			//log.Println("DNS err:", req.muxID, nservers[nsIdx], req.Question[0].Name, err)
+// forward resolves the query using the cache or the upstream nameservers
+// of the zone. Stale and popular entries are refreshed in background.
+func (s *DmDns) forward(req *dns.Msg, z *Zone) (*dns.Msg, error) {
+	view := ""
+	if z != nil {
+		view = z.view
+	}
+	if s.Cache == nil {
+		return s.forwardZone(req, z)
+	}
+	if res, refresh := s.Cache.Get(view, req); res != nil {
+		if refresh {
+			go s.refresh(req.Copy(), z, view)
 		}
+		return res, nil
+	}
+	res, err := s.forwardZone(req, z)
+	if err == nil {
+		s.Cache.Put(view, req, res)
+	}
+	return res, err
+}
 
-		// Continue with next available DmDns
-		if len(nservers)-1 > nsIdx {
-			nsIdx++
-		} else {
-			nsIdx = 0
-			break
-		}
+func (s *DmDns) forwardZone(req *dns.Msg, z *Zone) (*dns.Msg, error) {
+	if z == nil {
+		return s.ForwardRealDNS(req)
 	}
+	return s.forwardTo(req, z.upstreams(s), z.strategy(s))
+}
 
-	return r, err
+func (s *DmDns) refresh(req *dns.Msg, z *Zone, view string) {
+	req.Id = dns.Id()
+	res, err := s.forwardZone(req, z)
+	if err == nil {
+		s.Cache.Put(view, req, res)
+	}
 }
 
 func writeMsg(w dns.ResponseWriter, m *dns.Msg) {
@@ -578,8 +528,7 @@ func writeMsg(w dns.ResponseWriter, m *dns.Msg) {
 	}
 }
 
-// Local request handling, for .dm. virtual domain
-//
+// Local records, for the local zones - .dm. by default.
 
 func (s *DmDns) getRecord(domain string, rtype uint16) (rr dns.RR, found bool) {
 	s.dnsLock.RLock()
@@ -592,31 +541,22 @@ func (s *DmDns) getRecord(domain string, rtype uint16) (rr dns.RR, found bool) {
 	return
 }
 
-func (s *DmDns) AddRecord(domain string, rtype uint16, rr dns.RR) {
+func (s *DmDns) hasRecords(domain string) bool {
 	s.dnsLock.RLock()
 	defer s.dnsLock.RUnlock()
+	_, found := s.dnsEntries[domain]
+	return found
+}
+
+func (s *DmDns) AddRecord(domain string, rtype uint16, rr dns.RR) {
+	s.dnsLock.Lock()
+	defer s.dnsLock.Unlock()
 	rrmap, found := s.dnsEntries[domain]
 	if !found {
 		rrmap = map[uint16]dns.RR{}
+		s.dnsEntries[domain] = rrmap
 	}
 	rrmap[rtype] = rr
-	return
-}
-
-// Called for queries matching the authoritative domains.
-func (s *DmDns) localQuery(m *dns.Msg) bool {
-	var rr dns.RR
-
-	needsFwd := false
-	for _, q := range m.Question {
-		if read_rr, e := s.getRecord(q.Name, q.Qtype); e {
-			rr = read_rr.(dns.RR)
-			m.Answer = append(m.Answer, rr)
-		} else {
-			// No explicit override.
-		}
-	}
-	return needsFwd
 }
 
 // DNSDialer will return a dialer function that ignores network and address and
@@ -639,7 +579,9 @@ func (gw *DmDns) HandleUdp(dstAddr net.IP, dstPort uint16,
 	req := new(dns.Msg)
 	req.Unpack(data)
 
-	res := gw.Do(req)
+	client, _ := netip.AddrFromSlice(localAddr)
+	res := gw.DoClient(req, client.Unmap())
+	res.Truncate(udpSize(req))
 
 	data1, _ := res.Pack()
 	src := &net.UDPAddr{Port: int(localPort), IP: localAddr}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/netip"
 	"os"
 	"strconv"
 	"time"
@@ -71,7 +72,7 @@ func (s *DmDns) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	} else if r.Method == http.MethodPost {
 		n, err = io.ReadFull(r.Body, m)
-		if err != nil {
+		if err != nil && err != io.ErrUnexpectedEOF {
 			return
 		}
 	} else {
@@ -85,7 +86,11 @@ func (s *DmDns) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	req.Id = dns.Id()
 
-	res := s.Do(req)
+	var client netip.Addr
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		client = ap.Addr().Unmap()
+	}
+	res := s.DoClient(req, client)
 
 	sendRes(w, res, r, m)
 	if len(res.Answer) > 0 {
@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/costinm/ugate/nio"
+	"github.com/miekg/dns"
+)
+
+// DNS over TCP (RFC 7766) and over TLS (RFC 7858). Both use 2-byte length
+// prefixed messages - clients may pipeline queries on a connection, and
+// the responses are sent as they complete, possibly out of order.
+
+// maxPipelined is the max queries in progress on a TCP connection. The
+// connection is not read while at the limit.
+const maxPipelined = 32
+
+// dotConfig returns the TLS config for DoT - TLSConfig, the Certs or the
+// mesh certificates from nio.DefaultTLS, in this order.
+func (d *DmDns) dotConfig() (*tls.Config, error) {
+	if d.TLSConfig != nil {
+		cfg := d.TLSConfig.Clone()
+		cfg.NextProtos = []string{"dot"}
+		return cfg, nil
+	}
+	if d.Certs == nil {
+		if nio.DefaultTLS == nil {
+			return nil, errors.New("dns: DoT requires TLSConfig, Certs or a mesh")
+		}
+		cfg := nio.DefaultTLS.ServerConfig()
+		cfg.NextProtos = []string{"dot"}
+		return cfg, nil
+	}
+	return &tls.Config{
+		NextProtos: []string{"dot"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return d.Certs.GetCertificate(hello.Context(), hello.ServerName)
+		},
+	}, nil
+}
+
+// serveTCP accepts connections until the listener is closed. Other accept
+// errors - like EMFILE - are retried with a backoff, like http.Server.
+func (s *DmDns) serveTCP(l net.Listener) {
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			log.Println("DNS: accept", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go func() {
+			defer c.Close()
+			s.DNSOverTCP(c, c)
+		}()
+	}
+}
+
+// DNSOverTCP implements DNS over TCP protocol. Used by the TCP and DoT
+// listeners, and in TCP capture for port 53.
+//
+// Queries are resolved concurrently, up to maxPipelined, and the responses
+// written as they complete. Returns nil when the client closes the
+// connection, after the pending responses are written. If in has a read
+// deadline, it is used to close idle connections.
+func (s *DmDns) DNSOverTCP(in io.ReadCloser, out io.Writer) error {
+	var wm sync.Mutex
+	var werr error
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, maxPipelined)
+
+	idle := s.TCPIdleTimeout
+	if idle == 0 {
+		idle = 30 * time.Second
+	}
+	dl, _ := in.(interface{ SetReadDeadline(time.Time) error })
+
+	var client netip.Addr
+	if c, ok := in.(net.Conn); ok {
+		client = clientAddr(c.RemoteAddr())
+	}
+
+	var lb [2]byte
+	for {
+		if dl != nil {
+			dl.SetReadDeadline(time.Now().Add(idle))
+		}
+		if _, err := io.ReadFull(in, lb[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(lb[:]))
+		if _, err := io.ReadFull(in, buf); err != nil {
+			return err
+		}
+
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			return err
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			res := s.DoClient(req, client)
+			resB, err := res.Pack()
+			if err != nil {
+				log.Println("DNS: pack", req.Question, err)
+				return
+			}
+			frame := binary.BigEndian.AppendUint16(make([]byte, 0, len(resB)+2), uint16(len(resB)))
+			wm.Lock()
+			defer wm.Unlock()
+			if werr == nil {
+				_, werr = out.Write(append(frame, resB...))
+			}
+		}()
+
+		wm.Lock()
+		err := werr
+		wm.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// udpSize returns the max response size for a UDP query.
+func udpSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/costinm/ugate/nio"
+	"github.com/miekg/dns"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestTCPAndDoT(t *testing.T) {
+	ns, _ := fakeUpstream(t, 300)
+
+	// Borrow the test certificate.
+	hs := httptest.NewTLSServer(nil)
+	cfg := hs.TLS.Clone()
+	hs.Close()
+
+	s := New()
+	s.Nameservers = []string{ns}
+	s.Port = freePort(t)
+	s.DoTPort = freePort(t)
+	s.TLSConfig = cfg
+	if err := s.Provision(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := "127.0.0.1:" + strconv.Itoa(s.Port)
+
+	m := new(dns.Msg)
+	m.SetQuestion("a.big.", dns.TypeA)
+
+	// The upstream truncates on UDP - retried on TCP. Our UDP answer is
+	// truncated again.
+	res, _, err := (&dns.Client{}).Exchange(m, addr)
+	if err != nil || !res.Truncated || len(res.Answer) == 50 {
+		t.Fatal("Expected truncated UDP response", res, err)
+	}
+	for _, c := range []*dns.Client{
+		{Net: "tcp"},
+		{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}},
+	} {
+		a := addr
+		if c.Net == "tcp-tls" {
+			a = "127.0.0.1:" + strconv.Itoa(s.DoTPort)
+		}
+		res, _, err := c.Exchange(m, a)
+		if err != nil || res.Truncated || len(res.Answer) != 50 {
+			t.Fatal("Unexpected response", c.Net, res, err)
+		}
+	}
+
+	// Pipelined queries on one connection.
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true,
+		NextProtos: []string{"dot"}}}
+	conn, err := c.Dial("127.0.0.1:" + strconv.Itoa(s.DoTPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if cs := conn.Conn.(*tls.Conn).ConnectionState(); cs.NegotiatedProtocol != "dot" {
+		t.Fatal("Unexpected ALPN", cs.NegotiatedProtocol)
+	}
+	// The slow query doesn't block the others - responses are sent as they
+	// complete.
+	names := []string{"a.slow.", "a.example.", "b.example.", "c.example."}
+	for i, n := range names {
+		q := new(dns.Msg)
+		q.SetQuestion(n, dns.TypeA)
+		q.Id = uint16(i + 1)
+		if err := conn.WriteMsg(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := range names {
+		res, err := conn.ReadMsg()
+		if err != nil || res.Id < 1 || int(res.Id) > len(names) ||
+			res.Question[0].Name != names[res.Id-1] || len(res.Answer) != 1 {
+			t.Fatal("Unexpected pipelined response", res, err)
+		}
+		if (i == len(names)-1) != (res.Id == 1) {
+			t.Fatal("Expected the slow response last", i, res.Id)
+		}
+	}
+}
+
+func TestDNSOverTCPIdle(t *testing.T) {
+	s := New()
+	s.TCPIdleTimeout = 50 * time.Millisecond
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	done := make(chan error, 1)
+	go func() { done <- s.DNSOverTCP(c2, c2) }()
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatal("Expected timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Idle connection not closed")
+	}
+
+	if _, err := (&DmDns{DoTPort: 853}).dotConfig(); err == nil {
+		t.Fatal("Expected error without certificates")
+	}
+	nio.DefaultTLS = testMeshTLS{}
+	defer func() { nio.DefaultTLS = nil }()
+	if cfg, err := (&DmDns{DoTPort: 853}).dotConfig(); err != nil || cfg.NextProtos[0] != "dot" {
+		t.Fatal("Expected the mesh config", err)
+	}
+}
+
+type testMeshTLS struct{}
+
+func (testMeshTLS) ServerConfig() *tls.Config { return &tls.Config{} }
+
+func (testMeshTLS) ClientConfig(sni string) *tls.Config { return &tls.Config{ServerName: sni} }
+
+// errListener fails Accept with EMFILE, then with ErrClosed.
+type errListener struct {
+	net.Listener
+	n int
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	l.n++
+	if l.n < 3 {
+		return nil, syscall.EMFILE
+	}
+	return nil, net.ErrClosed
+}
+
+func TestServeTCPRetry(t *testing.T) {
+	l := &errListener{}
+	New().serveTCP(l)
+	if l.n != 3 {
+		t.Fatal("Expected accept retried until closed", l.n)
+	}
+}
@@ -0,0 +1,32 @@
+package dns
+
+import (
+	"context"
+	"time"
+
+	"github.com/costinm/ugate/pkg/metrics"
+	"github.com/miekg/dns"
+)
+
+var (
+	upstreamLatency = metrics.NewHistogramVec("ugate_dns_upstream_latency_seconds",
+		"Latency of queries forwarded to upstream nameservers.", nil, "upstream")
+
+	upstreamRcode = metrics.NewCounterVec("ugate_dns_upstream_responses_total",
+		"Upstream responses by rcode, 'error' if no response.", "upstream", "rcode")
+)
+
+// exchange sends the query to one upstream, recording latency, rcode and
+// health.
+func (s *DmDns) exchange(req *dns.Msg, u *Upstream) (*dns.Msg, error) {
+	t0 := time.Now()
+	r, err := u.Exchange(context.Background(), s, req)
+	u.record(time.Since(t0), err)
+	upstreamLatency.With(u.Addr).ObserveDuration(t0)
+	rc := "error"
+	if err == nil {
+		rc = dns.RcodeToString[r.Rcode]
+	}
+	upstreamRcode.With(u.Addr, rc).Inc()
+	return r, err
+}
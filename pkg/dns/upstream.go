@@ -0,0 +1,513 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream resolvers.
+//
+// Each upstream has a protocol - UDP (with TCP retry for truncated
+// answers), TCP, DoT or DoH - and tracks its health and latency. After
+// consecutive failures an upstream is marked down for a while, and only
+// used if all others are down too.
+//
+// The strategy selects how the upstreams are used:
+//   - sequential: in configured order, failing over to the next on errors
+//     or SERVFAIL.
+//   - parallel: the query is sent to all, the first answer wins.
+//   - fastest: in order of the measured latency, with failover.
+
+// Upstream protocols.
+const (
+	ProtoUDP = "udp"
+	ProtoTCP = "tcp"
+	ProtoDoT = "dot"
+	ProtoDoH = "doh"
+)
+
+// Upstream selection strategies.
+const (
+	StrategySequential = "sequential"
+	StrategyParallel   = "parallel"
+	StrategyFastest    = "fastest"
+)
+
+const (
+	// upstreamFailures marks an upstream down.
+	upstreamFailures = 3
+
+	// upstreamDownTime is how long a failed upstream is skipped.
+	upstreamDownTime = 30 * time.Second
+
+	// maxIdleConns is the number of TCP and DoT connections kept for reuse.
+	maxIdleConns = 4
+)
+
+var ErrNoUpstream = errors.New("dns: no upstream resolvers")
+
+type Upstream struct {
+	// Addr is the address of the resolver:
+	//   - "1.1.1.1" or "1.1.1.1:53" - UDP
+	//   - "tcp://1.1.1.1:53"
+	//   - "tls://1.1.1.1:853" - DoT, port defaults to 853
+	//   - "https://cloudflare-dns.com/dns-query" - DoH
+	// Use IP addresses if Capture is set - the names would be resolved
+	// using this server.
+	Addr string `json:"addr"`
+
+	// Proto overrides the protocol in Addr.
+	Proto string `json:"proto,omitempty"`
+
+	// ServerName for DoT. Defaults to the host in Addr.
+	ServerName string `json:"server_name,omitempty"`
+
+	// TLSConfig for DoT - for example with the mesh roots.
+	TLSConfig *tls.Config `json:"-"`
+
+	// Timeout for a query. Default 2s, 5s for DoH.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// H2 is the client for DoH. Defaults to DmDns.H2 or
+	// http.DefaultClient.
+	H2 *http.Client `json:"-"`
+
+	host string
+	tls  *tls.Config
+
+	m         sync.Mutex
+	idle      []*dns.Conn
+	queries   int
+	errors    int
+	failures  int
+	latency   time.Duration
+	lastError string
+	downUntil time.Time
+}
+
+// UpstreamState is the health and latency of an upstream.
+type UpstreamState struct {
+	Addr                string        `json:"addr"`
+	Proto               string        `json:"proto"`
+	Healthy             bool          `json:"healthy"`
+	Queries             int           `json:"queries"`
+	Errors              int           `json:"errors"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	Latency             time.Duration `json:"latency"`
+	LastError           string        `json:"last_error,omitempty"`
+	DownUntil           time.Time     `json:"down_until,omitempty"`
+
+	// Zone of the upstream, empty for the default upstreams.
+	Zone string `json:"zone,omitempty"`
+}
+
+// init parses Addr.
+func (u *Upstream) init() error {
+	addr := u.Addr
+	proto := ProtoUDP
+	port := "53"
+	if i := strings.Index(addr, "://"); i > 0 {
+		switch addr[:i] {
+		case "udp":
+		case "tcp":
+			proto = ProtoTCP
+		case "tls", "dot":
+			proto = ProtoDoT
+			port = "853"
+		case "https":
+			proto = ProtoDoH
+		default:
+			return errors.New("dns: unknown upstream scheme " + addr)
+		}
+		if proto != ProtoDoH {
+			addr = addr[i+3:]
+		}
+	}
+	if u.Proto != "" {
+		proto = u.Proto
+	}
+	u.Proto = proto
+
+	if proto == ProtoDoH {
+		pu, err := url.Parse(addr)
+		if err != nil {
+			return err
+		}
+		u.host = pu.String()
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	u.host = addr
+	if proto == ProtoDoT {
+		sn := u.ServerName
+		if sn == "" {
+			sn, _, _ = net.SplitHostPort(addr)
+		}
+		u.tls = &tls.Config{}
+		if u.TLSConfig != nil {
+			u.tls = u.TLSConfig.Clone()
+		}
+		if u.tls.ServerName == "" {
+			u.tls.ServerName = sn
+		}
+		u.tls.NextProtos = []string{"dot"}
+	}
+	return nil
+}
+
+func (u *Upstream) timeout() time.Duration {
+	if u.Timeout != 0 {
+		return u.Timeout
+	}
+	if u.Proto == ProtoDoH {
+		return 5 * time.Second
+	}
+	return 2 * time.Second
+}
+
+func (u *Upstream) healthy(now time.Time) bool {
+	u.m.Lock()
+	defer u.m.Unlock()
+	return !now.Before(u.downUntil)
+}
+
+// record updates the health and the latency - a moving average.
+func (u *Upstream) record(d time.Duration, err error) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	u.queries++
+	if err != nil {
+		u.errors++
+		u.failures++
+		u.lastError = err.Error()
+		if u.failures >= upstreamFailures {
+			u.downUntil = time.Now().Add(upstreamDownTime)
+		}
+		return
+	}
+	u.failures = 0
+	u.downUntil = time.Time{}
+	if u.latency == 0 {
+		u.latency = d
+	} else {
+		u.latency = (7*u.latency + 3*d) / 10
+	}
+}
+
+// State returns the health and latency of the upstream.
+func (u *Upstream) State() *UpstreamState {
+	u.m.Lock()
+	defer u.m.Unlock()
+	return &UpstreamState{
+		Addr:                u.Addr,
+		Proto:               u.Proto,
+		Healthy:             !time.Now().Before(u.downUntil),
+		Queries:             u.queries,
+		Errors:              u.errors,
+		ConsecutiveFailures: u.failures,
+		Latency:             u.latency,
+		LastError:           u.lastError,
+		DownUntil:           u.downUntil,
+	}
+}
+
+// Exchange sends the query to the upstream.
+func (u *Upstream) Exchange(ctx context.Context, s *DmDns, req *dns.Msg) (*dns.Msg, error) {
+	ctx, cf := context.WithTimeout(ctx, u.timeout())
+	defer cf()
+	switch u.Proto {
+	case ProtoUDP:
+		c := s.dnsUDPclient
+		if c == nil {
+			c = &dns.Client{}
+		}
+		r, _, err := c.ExchangeContext(ctx, req, u.host)
+		if err == nil && r.Truncated {
+			return u.exchangeConn(ctx, req, "tcp")
+		}
+		return r, err
+	case ProtoTCP:
+		return u.exchangeConn(ctx, req, "tcp")
+	case ProtoDoT:
+		return u.exchangeConn(ctx, req, "tcp-tls")
+	case ProtoDoH:
+		return u.exchangeHTTP(ctx, s, req)
+	}
+	return nil, errors.New("dns: unknown upstream protocol " + u.Proto)
+}
+
+// exchangeConn sends the query on a TCP or DoT connection, reusing idle
+// connections. A failed reused connection is retried once on a new one -
+// the server may have closed it.
+func (u *Upstream) exchangeConn(ctx context.Context, req *dns.Msg, network string) (*dns.Msg, error) {
+	for {
+		conn, reused, err := u.conn(ctx, network)
+		if err != nil {
+			return nil, err
+		}
+		dl, _ := ctx.Deadline()
+		conn.SetDeadline(dl)
+		r, err := u.roundTrip(conn, req)
+		if err != nil {
+			conn.Close()
+			if reused {
+				continue
+			}
+			return nil, err
+		}
+		u.release(conn)
+		return r, nil
+	}
+}
+
+func (u *Upstream) roundTrip(conn *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	if err := conn.WriteMsg(req); err != nil {
+		return nil, err
+	}
+	r, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if r.Id != req.Id {
+		return nil, dns.ErrId
+	}
+	return r, nil
+}
+
+func (u *Upstream) conn(ctx context.Context, network string) (*dns.Conn, bool, error) {
+	u.m.Lock()
+	if n := len(u.idle); n > 0 {
+		c := u.idle[n-1]
+		u.idle = u.idle[:n-1]
+		u.m.Unlock()
+		return c, true, nil
+	}
+	u.m.Unlock()
+	c := &dns.Client{Net: network, TLSConfig: u.tls}
+	conn, err := c.DialContext(ctx, u.host)
+	return conn, false, err
+}
+
+func (u *Upstream) release(conn *dns.Conn) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if len(u.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	u.idle = append(u.idle, conn)
+}
+
+// exchangeHTTP sends the query using DoH (RFC 8484) with POST.
+func (u *Upstream) exchangeHTTP(ctx context.Context, s *DmDns, req *dns.Msg) (*dns.Msg, error) {
+	// ID 0 makes the requests cacheable.
+	q := req.Copy()
+	q.Id = 0
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.host, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("content-type", "application/dns-message")
+	hreq.Header.Set("accept", "application/dns-message")
+
+	hc := u.H2
+	if hc == nil {
+		hc = s.H2
+	}
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	res, err := hc.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("dns: DoH status " + res.Status)
+	}
+	rb, err := io.ReadAll(io.LimitReader(res.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(rb); err != nil {
+		return nil, err
+	}
+	r.Id = req.Id
+	return r, nil
+}
+
+// upstreams returns the configured upstreams, or the ones from Nameservers
+// and BaseUrl.
+func (s *DmDns) upstreams() []*Upstream {
+	s.upOnce.Do(func() {
+		ups := s.Upstreams
+		if len(ups) == 0 {
+			if s.BaseUrl != "" {
+				ups = append(ups, &Upstream{Addr: "https://" + s.BaseUrl + "/dns"})
+			}
+			for _, ns := range s.Nameservers {
+				ups = append(ups, &Upstream{Addr: ns})
+			}
+		}
+		s.activeUpstreams = initUpstreams(ups)
+	})
+	return s.activeUpstreams
+}
+
+func initUpstreams(ups []*Upstream) []*Upstream {
+	var res []*Upstream
+	for _, u := range ups {
+		if err := u.init(); err != nil {
+			log.Println("DNS: invalid upstream", u.Addr, err)
+			continue
+		}
+		res = append(res, u)
+	}
+	return res
+}
+
+// candidates returns the upstreams in the order to try, with the ones
+// marked down at the end. For the parallel strategy only the healthy
+// upstreams are returned, unless all are down.
+func candidates(ups []*Upstream, strategy string) []*Upstream {
+	now := time.Now()
+	var healthy, down []*Upstream
+	for _, u := range ups {
+		if u.healthy(now) {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	if strategy == StrategyFastest {
+		// Upstreams without a measurement first, to get one.
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].State().Latency < healthy[j].State().Latency
+		})
+	}
+	if strategy == StrategyParallel && len(healthy) > 0 {
+		return healthy
+	}
+	return append(healthy, down...)
+}
+
+// final returns true for responses that should not be retried on another
+// upstream.
+func final(r *dns.Msg) bool {
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError,
+		// NO RECOVERY
+		dns.RcodeFormatError, dns.RcodeRefused, dns.RcodeNotImplemented:
+		return true
+	}
+	return false
+}
+
+// ForwardRealDNS sends the query to the default upstream resolvers, using
+// the strategy.
+func (s *DmDns) ForwardRealDNS(req *dns.Msg) (*dns.Msg, error) {
+	return s.forwardTo(req, s.upstreams(), s.Strategy)
+}
+
+func (s *DmDns) forwardTo(req *dns.Msg, all []*Upstream, strategy string) (*dns.Msg, error) {
+	ups := candidates(all, strategy)
+	if len(ups) == 0 {
+		return nil, ErrNoUpstream
+	}
+	if strategy == StrategyParallel {
+		return s.race(req, ups)
+	}
+
+	var r *dns.Msg
+	var err error
+	for _, u := range ups {
+		r, err = s.exchange(req, u)
+		if err == nil && final(r) {
+			return r, nil
+		}
+	}
+	return r, err
+}
+
+type dnsRes struct {
+	msg *dns.Msg
+	err error
+}
+
+// race sends the query to all upstreams, returning the first final
+// response.
+func (s *DmDns) race(req *dns.Msg, ups []*Upstream) (*dns.Msg, error) {
+	res := make(chan dnsRes, len(ups))
+	for _, u := range ups {
+		q := req.Copy()
+		go func() {
+			r, err := s.exchange(q, u)
+			res <- dnsRes{msg: r, err: err}
+		}()
+	}
+	var last dnsRes
+	for range ups {
+		last = <-res
+		if last.err == nil && final(last.msg) {
+			return last.msg, nil
+		}
+	}
+	return last.msg, last.err
+}
+
+// UpstreamStates returns the health and latency of the default and zone
+// upstreams.
+func (s *DmDns) UpstreamStates() []*UpstreamState {
+	var res []*UpstreamState
+	for _, u := range s.upstreams() {
+		res = append(res, u.State())
+	}
+	for _, z := range s.zones() {
+		if len(z.Upstreams) == 0 {
+			continue
+		}
+		for _, u := range z.upstreams(s) {
+			st := u.State()
+			st.Zone = z.view
+			res = append(res, st)
+		}
+	}
+	return res
+}
+
+// HandleUpstreams returns the strategy and the upstream states as JSON.
+//
+// curl localhost:15000/debug/dnsupstreams
+func (s *DmDns) HandleUpstreams(w http.ResponseWriter, r *http.Request) {
+	st := s.Strategy
+	if st == "" {
+		st = StrategySequential
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Strategy  string           `json:"strategy"`
+		Upstreams []*UpstreamState `json:"upstreams"`
+	}{st, s.UpstreamStates()})
+}
@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamProtocols(t *testing.T) {
+	ns, cnt := fakeUpstream(t, 300)
+
+	// DoT, forwarding to the fake upstream.
+	hs := httptest.NewTLSServer(nil)
+	cfg := hs.TLS.Clone()
+	hs.Close()
+	fwd := New()
+	fwd.Cache = nil
+	fwd.Nameservers = []string{ns}
+	fwd.TLSConfig = cfg
+	dotCfg, _ := fwd.dotConfig()
+	dot, err := tls.Listen("tcp", "127.0.0.1:0", dotCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dot.Close()
+	go fwd.serveTCP(dot)
+
+	// DoH, using the DmDns handler.
+	doh := httptest.NewTLSServer(fwd)
+	defer doh.Close()
+
+	for _, u := range []*Upstream{
+		{Addr: ns},
+		{Addr: "udp://" + ns},
+		{Addr: "tcp://" + ns},
+		{Addr: "tls://" + dot.Addr().String(), TLSConfig: &tls.Config{InsecureSkipVerify: true}},
+		{Addr: doh.URL + "/dns-query", H2: doh.Client()},
+	} {
+		s := New()
+		s.Upstreams = []*Upstream{u}
+		for _, name := range []string{"a.example.", "b.big."} {
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			res, err := s.ForwardRealDNS(m)
+			if err != nil || len(res.Answer) == 0 || res.Id != m.Id {
+				t.Fatal("Unexpected response", u.Addr, name, res, err)
+			}
+		}
+	}
+	if cnt.Load() == 0 {
+		t.Fatal("Expected upstream queries")
+	}
+
+	// Connections are reused.
+	u := &Upstream{Addr: "tcp://" + ns}
+	s := New()
+	s.Upstreams = []*Upstream{u}
+	for i := 0; i < 3; i++ {
+		query(s, "c.example.")
+		s.Cache.Flush("")
+	}
+	if len(u.idle) != 1 {
+		t.Fatal("Expected one idle connection", len(u.idle))
+	}
+}
+
+// deadUpstream returns an UDP address that doesn't answer.
+func deadUpstream(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc.LocalAddr().String()
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	ns, cnt := fakeUpstream(t, 300)
+	dead := deadUpstream(t)
+
+	s := New()
+	s.Cache = nil
+	s.Upstreams = []*Upstream{
+		{Addr: dead, Timeout: 20 * time.Millisecond},
+		{Addr: ns},
+	}
+	for i := 0; i < upstreamFailures+1; i++ {
+		res := query(s, "a.example.")
+		if len(res.Answer) != 1 {
+			t.Fatal("Expected failover", res)
+		}
+	}
+	st := s.UpstreamStates()
+	if st[0].Healthy || st[0].Errors != upstreamFailures || !st[1].Healthy || st[1].Queries != upstreamFailures+1 {
+		t.Fatal("Unexpected states", st[0], st[1])
+	}
+	// The down upstream is tried last.
+	if c := candidates(s.upstreams(), s.Strategy); c[0].Addr != ns {
+		t.Fatal("Unexpected order", c[0].Addr)
+	}
+
+	// Parallel - the dead upstream is skipped while down.
+	s.Strategy = StrategyParallel
+	if c := candidates(s.upstreams(), s.Strategy); len(c) != 1 {
+		t.Fatal("Expected only healthy upstreams", len(c))
+	}
+	s.Upstreams[0].m.Lock()
+	s.Upstreams[0].downUntil = time.Time{}
+	s.Upstreams[0].m.Unlock()
+	n := cnt.Load()
+	res := query(s, "b.example.")
+	if len(res.Answer) != 1 || cnt.Load() != n+1 {
+		t.Fatal("Unexpected parallel response", res)
+	}
+
+	// No upstreams
+	s = New()
+	s.Cache = nil
+	if res := query(s, "a.example."); res.Rcode != dns.RcodeServerFailure {
+		t.Fatal("Expected SERVFAIL", res)
+	}
+}
+
+func TestUpstreamFastest(t *testing.T) {
+	s := New()
+	s.Strategy = StrategyFastest
+	s.Upstreams = []*Upstream{{Addr: "10.0.0.1"}, {Addr: "10.0.0.2"}, {Addr: "10.0.0.3"}}
+	s.upstreams()
+	s.Upstreams[0].record(50*time.Millisecond, nil)
+	s.Upstreams[1].record(10*time.Millisecond, nil)
+	c := candidates(s.upstreams(), s.Strategy)
+	if c[0].Addr != "10.0.0.3" || c[1].Addr != "10.0.0.2" || c[2].Addr != "10.0.0.1" {
+		t.Fatal("Unexpected order", c[0].Addr, c[1].Addr, c[2].Addr)
+	}
+
+	// Moving average
+	s.Upstreams[1].record(110*time.Millisecond, nil)
+	if l := s.Upstreams[1].State().Latency; l != 40*time.Millisecond {
+		t.Fatal("Unexpected latency", l)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(s.HandleUpstreams))
+	defer srv.Close()
+	r, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st struct {
+		Strategy  string
+		Upstreams []*UpstreamState
+	}
+	json.NewDecoder(r.Body).Decode(&st)
+	r.Body.Close()
+	if st.Strategy != StrategyFastest || len(st.Upstreams) != 3 || st.Upstreams[0].Proto != ProtoUDP {
+		t.Fatal("Unexpected state", st)
+	}
+}
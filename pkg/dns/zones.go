@@ -0,0 +1,237 @@
+package dns
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Zones map domain suffixes to upstreams or local records - conditional
+// forwarding, for example corp domains to the VPN resolver and
+// cluster.local to kube-dns.
+//
+// A zone can be limited to client subnets, for split-horizon views: the
+// same gateway can answer the home LAN and the mesh overlay with
+// different records or upstreams. The most specific domain wins, and for
+// the same domain a zone with Clients wins over one without.
+//
+// Queries not matching a zone use the default upstreams. The "dm." and
+// "m." zones are local unless configured.
+
+// Zone is a domain suffix with its upstreams or local records.
+type Zone struct {
+	// Domain suffix, for example "cluster.local". "." matches all names.
+	Domain string `json:"domain"`
+
+	// Clients limits the zone to client subnets, as CIDRs.
+	Clients []string `json:"clients,omitempty"`
+
+	// Upstreams for the zone. If empty, the default upstreams are used
+	// unless the zone is Local.
+	Upstreams []*Upstream `json:"upstreams,omitempty"`
+
+	// Strategy for the zone upstreams. Defaults to the DmDns strategy.
+	Strategy string `json:"strategy,omitempty"`
+
+	// Local zones are answered only from Records and the records added
+	// with AddRecord - NXDOMAIN if the name is not found.
+	Local bool `json:"local,omitempty"`
+
+	// Records are answered for the zone, by name and type - for example
+	// {"gw": {"A": ["192.168.1.1"]}}. Names without a trailing dot are
+	// relative to Domain.
+	Records map[string]Record `json:"records,omitempty"`
+
+	// TTL for Records. Default 60.
+	TTL uint32 `json:"ttl,omitempty"`
+
+	domain  string
+	clients []netip.Prefix
+	view    string
+	records map[string][]dns.RR
+
+	upOnce          sync.Once
+	activeUpstreams []*Upstream
+}
+
+func (z *Zone) init() error {
+	z.domain = dns.CanonicalName(z.Domain)
+	z.view = z.domain
+	for _, c := range z.Clients {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return err
+		}
+		z.clients = append(z.clients, p.Masked())
+	}
+	if len(z.Clients) > 0 {
+		z.view += " " + strings.Join(z.Clients, ",")
+	}
+
+	ttl := z.TTL
+	if ttl == 0 {
+		ttl = 60
+	}
+	z.records = map[string][]dns.RR{}
+	for name, rec := range z.Records {
+		if !dns.IsFqdn(name) {
+			if z.domain != "." {
+				name += "." + z.domain
+			}
+		}
+		name = dns.CanonicalName(name)
+		for typ, values := range rec {
+			for _, v := range values {
+				rr, err := dns.NewRR(name + " " + strconv.Itoa(int(ttl)) + " IN " + typ + " " + v)
+				if err != nil {
+					return err
+				}
+				z.records[name] = append(z.records[name], rr)
+			}
+		}
+	}
+	return nil
+}
+
+// matchClient returns true if the client is in one of the zone subnets,
+// or the zone is not limited to subnets.
+func (z *Zone) matchClient(client netip.Addr) bool {
+	if len(z.clients) == 0 {
+		return true
+	}
+	if !client.IsValid() {
+		return false
+	}
+	client = client.Unmap()
+	for _, p := range z.clients {
+		if p.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *Zone) upstreams(s *DmDns) []*Upstream {
+	z.upOnce.Do(func() {
+		z.activeUpstreams = initUpstreams(z.Upstreams)
+	})
+	if len(z.activeUpstreams) == 0 {
+		return s.upstreams()
+	}
+	return z.activeUpstreams
+}
+
+func (z *Zone) strategy(s *DmDns) string {
+	if z.Strategy != "" {
+		return z.Strategy
+	}
+	return s.Strategy
+}
+
+// zones returns the configured zones, with the default local zones.
+func (s *DmDns) zones() []*Zone {
+	s.zonesOnce.Do(func() {
+		hasDM, hasM := false, false
+		for _, z := range s.Zones {
+			if err := z.init(); err != nil {
+				log.Println("DNS: invalid zone", z.Domain, err)
+				continue
+			}
+			hasDM = hasDM || z.domain == "dm."
+			hasM = hasM || z.domain == "m."
+			s.activeZones = append(s.activeZones, z)
+		}
+		// TODO: resolve .m. to 'next hop' in the mesh
+		for _, d := range []struct {
+			name string
+			has  bool
+		}{{"dm.", hasDM}, {"m.", hasM}} {
+			if !d.has {
+				z := &Zone{Domain: d.name, Local: true}
+				z.init()
+				s.activeZones = append(s.activeZones, z)
+			}
+		}
+	})
+	return s.activeZones
+}
+
+// Match returns the zone for a name and client, or nil if the default
+// upstreams should be used.
+func (s *DmDns) Match(name string, client netip.Addr) *Zone {
+	name = dns.CanonicalName(name)
+	var best *Zone
+	bestLabels := -1
+	for _, z := range s.zones() {
+		if !dns.IsSubDomain(z.domain, name) || !z.matchClient(client) {
+			continue
+		}
+		l := dns.CountLabel(z.domain)
+		if l > bestLabels || l == bestLabels && len(z.clients) > 0 && len(best.clients) == 0 {
+			best, bestLabels = z, l
+		}
+	}
+	return best
+}
+
+// localAnswer answers a query from the zone records and the records added
+// with AddRecord. Returns nil if the name is not found and the zone is not
+// Local - the query is forwarded.
+func (s *DmDns) localAnswer(z *Zone, req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Compress = false
+	if req.Opcode != dns.OpcodeQuery {
+		m.Rcode = dns.RcodeNotImplemented
+		return m
+	}
+	m.Authoritative = z.Local
+
+	q := req.Question[0]
+	rrs, found := z.records[dns.CanonicalName(q.Name)]
+	found = found || s.hasRecords(q.Name)
+	if !found {
+		if !z.Local {
+			return nil
+		}
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if t == q.Qtype || t == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if rr, ok := s.getRecord(q.Name, q.Qtype); ok {
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+// clientAddr returns the IP of a client address.
+func clientAddr(a net.Addr) netip.Addr {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		return ip.Unmap()
+	case *net.TCPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		return ip.Unmap()
+	}
+	if a == nil {
+		return netip.Addr{}
+	}
+	ap, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
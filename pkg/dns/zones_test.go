@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func queryFrom(s *DmDns, name string, qtype uint16, client string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	var addr netip.Addr
+	if client != "" {
+		addr = netip.MustParseAddr(client)
+	}
+	return s.DoClient(m, addr)
+}
+
+func answerIP(m *dns.Msg) string {
+	if len(m.Answer) == 0 {
+		return ""
+	}
+	if a, ok := m.Answer[0].(*dns.A); ok {
+		return a.A.String()
+	}
+	return ""
+}
+
+func TestZonesForwarding(t *testing.T) {
+	ns1, cnt1 := fakeUpstream(t, 300)
+	ns2, cnt2 := fakeUpstream(t, 300)
+
+	s := New()
+	s.Nameservers = []string{ns1}
+	s.Zones = []*Zone{
+		{Domain: "inner.example", Upstreams: []*Upstream{{Addr: ns2}}},
+		// Mesh clients use another resolver for example.
+		{Domain: "example.", Clients: []string{"10.10.0.0/16"}, Upstreams: []*Upstream{{Addr: ns2}}},
+		// Local override, the rest is forwarded.
+		{Domain: "example.", Records: map[string]Record{"override": {"A": {"1.2.3.4"}}}},
+	}
+
+	queryFrom(s, "a.example.", dns.TypeA, "")
+	queryFrom(s, "a.inner.example.", dns.TypeA, "")
+	if cnt1.Load() != 1 || cnt2.Load() != 1 {
+		t.Fatal("Unexpected upstreams", cnt1.Load(), cnt2.Load())
+	}
+
+	// Split-horizon - the views are cached separately.
+	for i := 0; i < 2; i++ {
+		queryFrom(s, "b.example.", dns.TypeA, "10.10.1.1")
+		queryFrom(s, "b.example.", dns.TypeA, "192.168.1.2")
+	}
+	if cnt1.Load() != 2 || cnt2.Load() != 2 {
+		t.Fatal("Unexpected upstreams", cnt1.Load(), cnt2.Load())
+	}
+
+	if ip := answerIP(queryFrom(s, "override.example.", dns.TypeA, "")); ip != "1.2.3.4" {
+		t.Fatal("Unexpected override", ip)
+	}
+	if cnt1.Load() != 2 {
+		t.Fatal("Override forwarded", cnt1.Load())
+	}
+
+	st := s.UpstreamStates()
+	if len(st) != 3 || st[0].Zone != "" || st[1].Zone != "inner.example." {
+		t.Fatal("Unexpected upstream states", st)
+	}
+}
+
+func TestZonesLocal(t *testing.T) {
+	s := New()
+	s.Zones = []*Zone{
+		{Domain: "home", Local: true, Records: map[string]Record{
+			"gw":        {"A": {"192.168.1.1"}},
+			"nas.home.": {"A": {"192.168.1.2"}, "AAAA": {"fd00::2"}},
+			"printer":   {"CNAME": {"nas.home."}},
+		}},
+		{Domain: "home", Local: true, Clients: []string{"10.10.0.0/16"}, Records: map[string]Record{
+			"gw": {"A": {"10.10.0.1"}},
+		}},
+	}
+
+	if ip := answerIP(queryFrom(s, "GW.home.", dns.TypeA, "192.168.1.5")); ip != "192.168.1.1" {
+		t.Fatal("Unexpected LAN answer", ip)
+	}
+	if ip := answerIP(queryFrom(s, "gw.home.", dns.TypeA, "")); ip != "192.168.1.1" {
+		t.Fatal("Unexpected answer without client", ip)
+	}
+	if ip := answerIP(queryFrom(s, "gw.home.", dns.TypeA, "::ffff:10.10.2.3")); ip != "10.10.0.1" {
+		t.Fatal("Unexpected mesh answer", ip)
+	}
+	// The mesh view doesn't have the name.
+	if res := queryFrom(s, "nas.home.", dns.TypeA, "10.10.2.3"); res.Rcode != dns.RcodeNameError {
+		t.Fatal("Expected NXDOMAIN", res)
+	}
+
+	res := queryFrom(s, "nas.home.", dns.TypeAAAA, "")
+	if len(res.Answer) != 1 || !res.Authoritative || res.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::2" {
+		t.Fatal("Unexpected AAAA", res)
+	}
+	res = queryFrom(s, "printer.home.", dns.TypeA, "")
+	if len(res.Answer) != 1 || res.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatal("Expected CNAME", res)
+	}
+	res = queryFrom(s, "gw.home.", dns.TypeMX, "")
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 0 {
+		t.Fatal("Expected NODATA", res)
+	}
+	if res := queryFrom(s, "other.home.", dns.TypeA, ""); res.Rcode != dns.RcodeNameError {
+		t.Fatal("Expected NXDOMAIN", res)
+	}
+
+	// The default .dm. zone uses AddRecord.
+	s.AddRecord("a.dm.", dns.TypeA, &dns.A{
+		Hdr: dns.RR_Header{Name: "a.dm.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100},
+		A:   net.IPv4(1, 2, 3, 4)})
+	if ip := answerIP(queryFrom(s, "a.dm.", dns.TypeA, "")); ip != "1.2.3.4" {
+		t.Fatal("Unexpected .dm. answer", ip)
+	}
+	if res := queryFrom(s, "b.dm.", dns.TypeA, ""); res.Rcode != dns.RcodeNameError {
+		t.Fatal("Expected NXDOMAIN", res)
+	}
+
+	// Invalid zones are skipped
+	s = New()
+	s.Zones = []*Zone{{Domain: "bad.", Clients: []string{"10.0.0.1"}}}
+	if len(s.zones()) != 2 {
+		t.Fatal("Expected only the default zones", len(s.zones()))
+	}
+}
@@ -14,7 +14,7 @@ import (
 	"github.com/costinm/meshauth"
 	"github.com/costinm/meshauth/pkg/certs"
 	"github.com/costinm/ssh-mesh/pkg/h2"
-	"github.com/costinm/ugate/nio2"
+	"github.com/costinm/ugate/nio"
 )
 
 // Control handler, also used for testing
@@ -102,7 +102,7 @@ func GetStreamInfo(str net.Conn) *StreamInfo {
 		LocalAddr:  str.LocalAddr(),
 		RemoteAddr: str.RemoteAddr(),
 	}
-	if s, ok := str.(nio2.StreamMeta); ok {
+	if s, ok := str.(nio.StreamMeta); ok {
 		si.Meta = s.RequestHeader()
 		// TODO: extract identity - including UDS
 		if tc := s.TLSConnectionState(); tc != nil {
@@ -142,7 +142,7 @@ func (e *EchoHandler) handleStreams(in io.Reader, out io.Writer) {
 			if err == io.EOF && e.ServerFirst {
 				binary.BigEndian.PutUint32(d, uint32(n))
 				out.Write(d[0:4])
-				if cw, ok := out.(nio2.CloseWriter); ok {
+				if cw, ok := out.(nio.CloseWriter); ok {
 					cw.CloseWrite()
 				}
 			} else {
@@ -158,7 +158,7 @@ func (e *EchoHandler) handleStreams(in io.Reader, out io.Writer) {
 
 		// Client requests server graceful close
 		if d[0] == 0 {
-			if wc, ok := out.(nio2.CloseWriter); ok {
+			if wc, ok := out.(nio.CloseWriter); ok {
 				wc.CloseWrite()
 				writeClosed = true
 				// Continue to read ! The test can check the read byte counts
@@ -179,7 +179,7 @@ func (e *EchoHandler) handleStreams(in io.Reader, out io.Writer) {
 }
 
 // RemoteID returns the node WorkloadID based on authentication.
-func RemoteID(s nio2.Stream) string {
+func RemoteID(s nio.Stream) string {
 	tls := s.TLSConnectionState()
 	if tls != nil {
 		if len(tls.PeerCertificates) == 0 {
@@ -233,11 +233,11 @@ func (eh *EchoHandler) String() string {
 	return "Echo"
 }
 func (eh *EchoHandler) HandleConn(conn net.Conn) error {
-	s := conn.(nio2.Stream)
+	s := conn.(nio.Stream)
 	return eh.Handle(s)
 }
 
-func (eh *EchoHandler) Handle(ac nio2.Stream) error {
+func (eh *EchoHandler) Handle(ac nio.Stream) error {
 	if DebugEcho {
 		log.Println("ECHOS ", ac)
 	}
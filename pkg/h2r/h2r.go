@@ -2,14 +2,17 @@ package h2r
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/costinm/meshauth"
 	nio "github.com/costinm/ssh-mesh/pkg/h2"
+	unio "github.com/costinm/ugate/nio"
 
 	"golang.org/x/net/http2"
 )
@@ -37,6 +40,24 @@ type H2R struct {
 	peers map[string]*peer
 
 	Handler  http.Handler
+
+	// Dialer races the addresses and transports of a destination in DialMux.
+	// Defaults to unio.DefaultMultiDialer.
+	Dialer *unio.MultiDialer `json:"-"`
+
+	// Addrs has additional targets for destinations, keyed by Dest.Addr -
+	// other IPs, or protos with a dialer in Dialer.Dialers. Dest.Addr is
+	// always tried, as "h2".
+	Addrs map[string][]unio.DialTarget `json:"addrs,omitempty"`
+
+	// TLSConfig is used for "tcp" targets. Defaults to the Mesh config for
+	// the destination.
+	TLSConfig *tls.Config `json:"-"`
+
+	// Mesh provides the TLS config for each destination - roots, SANs and
+	// InsecureSkipTLSVerify of the Dest. Defaults to unio.DefaultDialer, if
+	// it is a Mesh.
+	Mesh *meshauth.Mesh `json:"-"`
 }
 
 // peer is a remote HTTP server, using a -R connection over SSH or an
@@ -77,9 +98,14 @@ func New() *H2R {
 
 
 func (t *H2R) DialMux(ctx context.Context, dm *meshauth.Dest, meta http.Header, ev func(t string)) (http.RoundTripper, error) {
-	// TODO: try all published addresses, including all protos
 	addr := dm.Addr
 
+	cc, err := t.dialDest(ctx, dm)
+	if err != nil {
+		log.Println("Failed to connect ", addr, err)
+		return nil, err
+	}
+
 	//str, err := t.ug.DialTLS(ctx, addr, []string{"h2r", "h2"})
 	//if err != nil {
 	//	log.Println("Failed to connect ", addr, err)
@@ -115,8 +141,9 @@ func (t *H2R) DialMux(ctx context.Context, dm *meshauth.Dest, meta http.Header,
 	//tok := wp.VAPIDToken(t.ug.Mesh, addr)
 	//postR.Header.Add("authorization", tok)
 
-	res, err := dm.RoundTrip(postR)
+	res, err := cc.RoundTrip(postR)
 	if err != nil {
+		cc.Close()
 		return nil, err
 	}
 
@@ -155,6 +182,65 @@ func (t *H2R) DialMux(ctx context.Context, dm *meshauth.Dest, meta http.Header,
 	return nil, nil
 }
 
+// dialDest connects to all published addresses and transports of the
+// destination, using happy eyeballs, and starts a H2 client connection on
+// the first that succeeds. The TLS handshake for "tcp" targets is part of
+// each attempt, so a target failing it falls back to the next. Other protos
+// use the dialers set in the MultiDialer, returning secure streams - targets
+// without a dialer fail right away.
+func (t *H2R) dialDest(ctx context.Context, dm *meshauth.Dest) (*http2.ClientConn, error) {
+	d := t.Dialer
+	if d == nil {
+		d = unio.DefaultMultiDialer
+	}
+	targets := append([]unio.DialTarget{{Proto: "h2", Addr: dm.Addr}}, t.Addrs[dm.Addr]...)
+	if _, ok := d.Dialers["h2"]; !ok {
+		// Plain TCP with TLS for the default h2 target.
+		for i := range targets {
+			if targets[i].Proto == "h2" {
+				targets[i].Proto = "tcp"
+			}
+		}
+	}
+
+	sni := dm.SNI
+	if sni == "" {
+		sni, _, _ = net.SplitHostPort(dm.Addr)
+	}
+	mesh := t.Mesh
+	if mesh == nil {
+		mesh, _ = unio.DefaultDialer.(*meshauth.Mesh)
+	}
+	var cfg *tls.Config
+	switch {
+	case t.TLSConfig != nil:
+		cfg = t.TLSConfig.Clone()
+		cfg.ServerName = sni
+	case mesh != nil:
+		cfg = mesh.TLSClientConf(dm, sni, "")
+	default:
+		cfg = unio.ClientTLSConfig(sni)
+	}
+	cfg.NextProtos = []string{"h2"}
+
+	c, won, err := d.DialTargetsTLS(ctx, dm.Addr, targets, cfg)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("H2R-Client: connected", dm.Addr, won.Proto, won.Addr)
+
+	h2t := t.h2t
+	if h2t == nil {
+		h2t = &http2.Transport{AllowHTTP: true}
+	}
+	cc, err := h2t.NewClientConn(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
 func (t *H2R) RoundTripper(k string) http.RoundTripper {
 	t.m.Lock()
 	n, _ := t.peers[k]
@@ -7,9 +7,11 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/costinm/meshauth"
-	"github.com/costinm/ugate/nio2"
+	"github.com/costinm/ugate/nio"
+	"github.com/costinm/ugate/pkg/lb"
 )
 
 // Used for HTTP_PROXY=localhost:port, to intercept outbound traffic using http
@@ -31,7 +33,65 @@ type HttpProxy struct {
 
 	NetListener net.Listener
 
+	// Transport for proxied requests. Defaults to http.DefaultTransport,
+	// dialing with the Dialer if DialContext is not set.
 	Transport *http.Transport
+
+	// Dialer is used for CONNECT and proxied requests. If not set, the mesh
+	// dialer is used. Can be a nio.RouteDialer, to use parent proxies for some
+	// destinations.
+	Dialer nio.ContextDialer `json:"-"`
+
+	// LB has the hosts with multiple endpoints. Defaults to lb.DefaultLB.
+	LB *lb.LB `json:"-"`
+
+	rtOnce sync.Once
+	rt     *http.Transport
+}
+
+// dialer returns the Dialer, or the mesh dialer.
+func (gw *HttpProxy) dialer() nio.ContextDialer {
+	if gw.Dialer != nil {
+		return gw.Dialer
+	}
+	if gw.gw != nil {
+		return gw.gw
+	}
+	return nio.MeshDialer{}
+}
+
+// dial connects using d, guarded by the circuit breakers.
+func dial(ctx context.Context, d nio.ContextDialer, network, addr string) (net.Conn, error) {
+	if cb := nio.DefaultBreakers; cb != nil {
+		return cb.Dial(ctx, d, network, addr)
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// transport returns a copy of the Transport, with the dials guarded by the
+// circuit breakers.
+func (gw *HttpProxy) transport() *http.Transport {
+	gw.rtOnce.Do(func() {
+		d := gw.dialer()
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		if gw.Transport != nil {
+			t = gw.Transport.Clone()
+			if t.DialContext != nil {
+				d = dialFunc(t.DialContext)
+			}
+		}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, d, network, addr)
+		}
+		gw.rt = t
+	})
+	return gw.rt
 }
 
 // RoundTripStart listening on the addr, as a HTTP_PROXY
@@ -54,21 +114,22 @@ func (gw *HttpProxy) Start(ctx context.Context) error {
 	return nil
 }
 
-func ForwardHTTP(c *meshauth.Dest, w http.ResponseWriter, r *http.Request, pathH string) error {
+// ForwardHTTP sends the request to the pathH address using rt.
+func ForwardHTTP(rt http.RoundTripper, w http.ResponseWriter, r *http.Request, pathH string) error {
 
 	r.Host = pathH
-	r1 := nio2.CreateUpstreamRequest(w, r)
+	r1 := nio.CreateUpstreamRequest(w, r)
 
 	r1.URL.Scheme = "http"
 
 	// will be used by RoundTrip.
 	r1.URL.Host = pathH
 
-	res, err := c.RoundTrip(r1)
+	res, err := rt.RoundTrip(r1)
 	if err != nil {
 		return err
 	}
-	nio2.SendBackResponse(w, r, res, err)
+	nio.SendBackResponse(w, r, res, err)
 	return nil
 }
 
@@ -76,18 +137,55 @@ func ForwardHTTP(c *meshauth.Dest, w http.ResponseWriter, r *http.Request, pathH
 // configured. Also hostnmae to file serving.
 func (gw *HttpProxy) proxy(w http.ResponseWriter, r *http.Request) bool {
 	// TODO: if host is XXXX.m.SUFFIX -> forward to node.
+	if c := gw.cluster(r.Host); c != nil {
+		gw.forwardCluster(c, w, r)
+		return true
+	}
 
+	if gw.gw == nil {
+		return false
+	}
 	host, err := gw.gw.Discover(r.Context(), r.Host)
 	if err != nil {
 		return false
 	}
 	if len(host.Addr) > 0 {
 		log.Println("FWDHTTP: ", r.Method, r.Host, r.RemoteAddr, r.URL)
-		ForwardHTTP(host, w, r, host.Addr)
+		ForwardHTTP(gw.transport(), w, r, host.Addr)
 	}
 	return true
 }
 
+func (gw *HttpProxy) cluster(host string) *lb.Cluster {
+	lbs := gw.LB
+	if lbs == nil {
+		lbs = lb.DefaultLB
+	}
+	if lbs == nil {
+		return nil
+	}
+	return lbs.Cluster(host)
+}
+
+// forwardCluster sends the request to one of the cluster endpoints.
+func (gw *HttpProxy) forwardCluster(c *lb.Cluster, w http.ResponseWriter, r *http.Request) {
+	ep := c.Pick(r)
+	if ep == nil {
+		http.Error(w, "no endpoints", http.StatusServiceUnavailable)
+		return
+	}
+	ep.Start()
+	defer ep.Done()
+
+	r1 := nio.CreateUpstreamRequest(w, r)
+	r1.URL.Scheme = "http"
+	r1.URL.Host = ep.Addr
+
+	log.Println("LBHTTP: ", r.Method, r.Host, ep.Addr, r.URL)
+	res, err := gw.transport().RoundTrip(r1)
+	nio.SendBackResponse(w, r, res, err)
+}
+
 // WIP: HTTP proxy with absolute address, to a QUIC server (or sidecar)`
 func (gw *HttpProxy) captureHttpProxyAbsURL(w http.ResponseWriter, r *http.Request) {
 	// HTTP proxy mode - uses the QUIC client to connect to the node
@@ -104,9 +202,7 @@ func (gw *HttpProxy) captureHttpProxyAbsURL(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	ht := gw.Transport
-
-	resp, err := ht.RoundTrip(r)
+	resp, err := gw.transport().RoundTrip(r)
 	if err != nil {
 		log.Println("XXX ", err)
 		http.Error(w, err.Error(), 500)
@@ -114,7 +210,7 @@ func (gw *HttpProxy) captureHttpProxyAbsURL(w http.ResponseWriter, r *http.Reque
 	}
 	origBody := resp.Body
 	defer origBody.Close()
-	nio2.CopyResponseHeaders(w.Header(), resp.Header)
+	nio.CopyResponseHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 
@@ -149,7 +245,7 @@ func (gw *HttpProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 
 	//ra := proxyClient.RemoteAddr().(*net.TCPAddr)
 
-	str := nio2.GetStream(proxyClient, proxyClient)
+	str := nio.GetStream(proxyClient, proxyClient)
 	if clientBuffer.Reader.Size() > 0 {
 
 	}
@@ -157,18 +253,20 @@ func (gw *HttpProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 	//defer gw.gw.OnStreamDone(str)
 
 	str.Dest = host
-	str.Direction = nio2.StreamTypeOut
+	str.Direction = nio.StreamTypeOut
+	str.ListenerName = "http_proxy"
 
-	nc, err := gw.gw.DialContext(context.Background(), "tcp", str.Dest)
+	nc, err := dial(nio.ContextWithClient(context.Background(), proxyClient), gw.dialer(), "tcp", str.Dest)
 
 	if err != nil {
-		w.WriteHeader(503)
-		w.Write([]byte("RoundTripStart error" + err.Error()))
+		// Connection is hijacked - can't use the ResponseWriter.
+		proxyClient.Write([]byte("HTTP/1.0 503 Service Unavailable\r\n\r\nRoundTripStart error " + err.Error()))
+		proxyClient.Close()
 		return
 	}
 	proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 
-	nio2.Proxy(nc, str, str, str.Dest)
+	nio.Proxy(nc, str, str, str.Dest)
 
 	//defer nc.Close()
 	//
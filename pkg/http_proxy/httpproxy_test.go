@@ -0,0 +1,59 @@
+package http_proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/costinm/ugate/nio"
+	"github.com/costinm/ugate/pkg/lb"
+)
+
+type countDialer struct {
+	dials atomic.Int32
+}
+
+func (d *countDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials.Add(1)
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+func TestHttpProxyBreakers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	// Closed port.
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := l.Addr().String()
+	l.Close()
+
+	lbs := &lb.LB{}
+	lbs.SetCluster("svc", &lb.Cluster{Endpoints: []*lb.Endpoint{{Addr: backend.Listener.Addr().String()}}})
+	lbs.SetCluster("down", &lb.Cluster{Endpoints: []*lb.Endpoint{{Addr: down}}})
+
+	nio.DefaultBreakers = &nio.CircuitBreakers{Default: nio.BreakerLimits{ConsecutiveFailures: 1}}
+	defer func() { nio.DefaultBreakers = nil }()
+	d := &countDialer{}
+	gw := &HttpProxy{LB: lbs, Dialer: d}
+
+	get := func(host string) int {
+		w := httptest.NewRecorder()
+		gw.captureHttpProxyAbsURL(w, httptest.NewRequest("GET", "http://"+host+"/", nil))
+		return w.Code
+	}
+	if code := get("svc"); code != 200 || d.dials.Load() != 1 {
+		t.Fatal("Unexpected response", code, d.dials.Load())
+	}
+	get("down")
+	get("down")
+	if d.dials.Load() != 2 {
+		t.Fatal("Expected the ejected endpoint not dialed", d.dials.Load())
+	}
+	if st := nio.DefaultBreakers.Breaker(down).State(); st.State != nio.BreakerOpen {
+		t.Fatal("Expected open breaker", st)
+	}
+}
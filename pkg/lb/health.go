@@ -0,0 +1,147 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/costinm/ugate/pkg/metrics"
+)
+
+var healthFailures = metrics.NewCounterVec("ugate_lb_health_failures_total",
+	"Failed endpoint health checks.", "cluster")
+
+// HealthCheck configures active health checks for the endpoints of a
+// cluster.
+type HealthCheck struct {
+	// Type is "tcp" (default) - connect only, or "http" - a GET expecting
+	// a 2xx response.
+	Type string `json:"type,omitempty"`
+
+	// Path for http checks. Default "/".
+	Path string `json:"path,omitempty"`
+
+	// Host header for http checks. Defaults to the endpoint address.
+	Host string `json:"host,omitempty"`
+
+	// Interval between checks. Default 10s.
+	Interval time.Duration `json:"interval,omitempty"`
+
+	// Timeout for a check. Default 2s.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// UnhealthyThreshold is the number of consecutive failures to mark the
+	// endpoint unhealthy. Default 2.
+	UnhealthyThreshold int `json:"unhealthy_threshold,omitempty"`
+
+	// HealthyThreshold is the number of consecutive successes to mark an
+	// unhealthy endpoint healthy. Default 1.
+	HealthyThreshold int `json:"healthy_threshold,omitempty"`
+}
+
+func (hc *HealthCheck) run(ctx context.Context, c *Cluster) {
+	interval := hc.Interval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		hc.CheckAll(ctx, c)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// CheckAll checks all endpoints of the cluster concurrently, and updates
+// their health.
+func (hc *HealthCheck) CheckAll(ctx context.Context, c *Cluster) {
+	unhealthyT := hc.UnhealthyThreshold
+	if unhealthyT == 0 {
+		unhealthyT = 2
+	}
+	healthyT := hc.HealthyThreshold
+	if healthyT == 0 {
+		healthyT = 1
+	}
+	wg := sync.WaitGroup{}
+	for _, ep := range c.Endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := hc.Check(ctx, ep.Addr)
+			if err != nil {
+				healthFailures.With(c.Name).Inc()
+				ep.successes = 0
+				ep.fails++
+				if ep.fails >= unhealthyT && !ep.unhealthy.Swap(true) {
+					slog.Info("lb-unhealthy", "cluster", c.Name, "addr", ep.Addr, "err", err)
+				}
+				return
+			}
+			ep.fails = 0
+			ep.successes++
+			if ep.successes >= healthyT && ep.unhealthy.Swap(false) {
+				slog.Info("lb-healthy", "cluster", c.Name, "addr", ep.Addr)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Check runs one health check on the address.
+func (hc *HealthCheck) Check(ctx context.Context, addr string) error {
+	to := hc.Timeout
+	if to == 0 {
+		to = 2 * time.Second
+	}
+	ctx, cf := context.WithTimeout(ctx, to)
+	defer cf()
+
+	if hc.Type != "http" {
+		d := &net.Dialer{}
+		c, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+
+	path := hc.Path
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	if hc.Host != "" {
+		req.Host = hc.Host
+	}
+	req.Header.Set("user-agent", "ugate-health")
+	res, err := healthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.New("health check status " + strconv.Itoa(res.StatusCode))
+	}
+	return nil
+}
+
+// healthClient doesn't keep connections - each check tests a new one.
+var healthClient = &http.Client{
+	Transport: &http.Transport{DisableKeepAlives: true},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
@@ -0,0 +1,324 @@
+// Package lb selects one of the endpoints of a destination, using
+// round-robin, least-request, weighted or consistent-hash policies, with
+// active health checks.
+//
+// It lets one gateway front a small replicated service without Envoy. The
+// policies follow the Envoy names, but are simpler: no zone awareness, no
+// slow start.
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/costinm/ugate/pkg/metrics"
+)
+
+// Policies
+const (
+	RoundRobin   = "round_robin"
+	LeastRequest = "least_request"
+	Weighted     = "weighted"
+	Hash         = "hash"
+)
+
+var (
+	lbRequests = metrics.NewCounterVec("ugate_lb_requests_total",
+		"Requests sent to a load balanced endpoint.", "cluster")
+	lbNoEndpoint = metrics.NewCounterVec("ugate_lb_no_endpoint_total",
+		"Requests without an available endpoint.", "cluster")
+)
+
+// Endpoint is one backend of a cluster.
+type Endpoint struct {
+	Addr string `json:"addr"`
+
+	// Weight is used by the weighted, least_request and hash policies.
+	// Default 1.
+	Weight int `json:"weight,omitempty"`
+
+	unhealthy atomic.Bool
+	active    atomic.Int64
+	total     atomic.Int64
+
+	// Health check state, used by the checker goroutine.
+	fails     int
+	successes int
+
+	// Smooth weighted round robin state, guarded by Cluster.m.
+	current int
+}
+
+func (ep *Endpoint) weight() int {
+	if ep.Weight <= 0 {
+		return 1
+	}
+	return ep.Weight
+}
+
+// Healthy returns false if the endpoint failed the health checks.
+func (ep *Endpoint) Healthy() bool {
+	return !ep.unhealthy.Load()
+}
+
+// Start records a request to the endpoint. Done must be called when the
+// request completes.
+func (ep *Endpoint) Start() {
+	ep.active.Add(1)
+	ep.total.Add(1)
+}
+
+// Done records the end of a request.
+func (ep *Endpoint) Done() {
+	ep.active.Add(-1)
+}
+
+// Cluster is a destination with multiple endpoints.
+type Cluster struct {
+	Name string `json:"name,omitempty"`
+
+	Endpoints []*Endpoint `json:"endpoints"`
+
+	// Policy is round_robin (default), least_request, weighted or hash.
+	Policy string `json:"policy,omitempty"`
+
+	// HashHeader is the request header used by the hash policy. If empty
+	// or missing from the request, the source IP is used.
+	HashHeader string `json:"hash_header,omitempty"`
+
+	// HealthCheck enables active health checks.
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+
+	m    sync.Mutex
+	next atomic.Uint64
+}
+
+// healthy returns the healthy endpoints. If all are unhealthy, all are
+// returned - like the Envoy panic threshold, sending to a possibly broken
+// endpoint is better than failing all requests.
+func (c *Cluster) healthy() []*Endpoint {
+	res := make([]*Endpoint, 0, len(c.Endpoints))
+	for _, ep := range c.Endpoints {
+		if ep.Healthy() {
+			res = append(res, ep)
+		}
+	}
+	if len(res) == 0 {
+		return c.Endpoints
+	}
+	return res
+}
+
+// Pick selects the endpoint for the request, or nil if the cluster has no
+// endpoints.
+func (c *Cluster) Pick(r *http.Request) *Endpoint {
+	key := ""
+	if c.Policy == Hash {
+		if c.HashHeader != "" {
+			key = r.Header.Get(c.HashHeader)
+		}
+		if key == "" {
+			key, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+	}
+	return c.PickKey(key)
+}
+
+// PickKey selects an endpoint, using key for the hash policy - for L4
+// streams, the source IP.
+func (c *Cluster) PickKey(key string) *Endpoint {
+	eps := c.healthy()
+	if len(eps) == 0 {
+		lbNoEndpoint.With(c.Name).Inc()
+		return nil
+	}
+	lbRequests.With(c.Name).Inc()
+	switch c.Policy {
+	case LeastRequest:
+		return c.leastRequest(eps)
+	case Weighted:
+		return c.weighted(eps)
+	case Hash:
+		return rendezvous(eps, key)
+	}
+	return eps[c.next.Add(1)%uint64(len(eps))]
+}
+
+// leastRequest picks the endpoint with the fewest active requests relative
+// to the weight. The scan starts at a rotating offset, so ties are spread.
+func (c *Cluster) leastRequest(eps []*Endpoint) *Endpoint {
+	start := int(c.next.Add(1) % uint64(len(eps)))
+	var best *Endpoint
+	var bestLoad float64
+	for i := range eps {
+		ep := eps[(start+i)%len(eps)]
+		load := float64(ep.active.Load()) / float64(ep.weight())
+		if best == nil || load < bestLoad {
+			best, bestLoad = ep, load
+		}
+	}
+	return best
+}
+
+// weighted is the smooth weighted round robin from nginx - the endpoints
+// are interleaved instead of sent in bursts.
+func (c *Cluster) weighted(eps []*Endpoint) *Endpoint {
+	c.m.Lock()
+	defer c.m.Unlock()
+	total := 0
+	var best *Endpoint
+	for _, ep := range eps {
+		w := ep.weight()
+		ep.current += w
+		total += w
+		if best == nil || ep.current > best.current {
+			best = ep
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// rendezvous is weighted highest-random-weight hashing: each key maps to
+// the endpoint with the highest score, so removing an endpoint only moves
+// the keys that mapped to it.
+func rendezvous(eps []*Endpoint, key string) *Endpoint {
+	var best *Endpoint
+	bestScore := math.Inf(-1)
+	for _, ep := range eps {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(ep.Addr))
+		// Uniform in (0, 1)
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -float64(ep.weight()) / math.Log(u)
+		if score > bestScore {
+			best, bestScore = ep, score
+		}
+	}
+	return best
+}
+
+// LB holds the clusters, keyed by host.
+type LB struct {
+	// Clusters by host or host:port.
+	Clusters map[string]*Cluster `json:"clusters,omitempty"`
+
+	// Mux is used for the /debug/lb handler. Defaults to
+	// http.DefaultServeMux.
+	Mux *http.ServeMux `json:"-"`
+
+	m sync.RWMutex
+}
+
+// DefaultLB is set when a LB is provisioned, and used by http_proxy.
+var DefaultLB *LB
+
+func (lb *LB) Provision(ctx context.Context) error {
+	lb.m.Lock()
+	for k, c := range lb.Clusters {
+		if c.Name == "" {
+			c.Name = k
+		}
+	}
+	lb.m.Unlock()
+	mux := lb.Mux
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("/debug/lb", lb.HandleClusters)
+	DefaultLB = lb
+	return nil
+}
+
+// Start runs the health checks until ctx is done.
+func (lb *LB) Start(ctx context.Context) error {
+	lb.m.RLock()
+	defer lb.m.RUnlock()
+	for _, c := range lb.Clusters {
+		if c.HealthCheck != nil {
+			go c.HealthCheck.run(ctx, c)
+		}
+	}
+	return nil
+}
+
+// SetCluster adds or replaces a cluster. Health checks are not started.
+func (lb *LB) SetCluster(host string, c *Cluster) {
+	if c.Name == "" {
+		c.Name = host
+	}
+	lb.m.Lock()
+	if lb.Clusters == nil {
+		lb.Clusters = map[string]*Cluster{}
+	}
+	lb.Clusters[host] = c
+	lb.m.Unlock()
+}
+
+// Cluster returns the cluster for a host or host:port, or nil.
+func (lb *LB) Cluster(host string) *Cluster {
+	host = strings.ToLower(host)
+	lb.m.RLock()
+	defer lb.m.RUnlock()
+	if c, ok := lb.Clusters[host]; ok {
+		return c
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return lb.Clusters[h]
+	}
+	return nil
+}
+
+// EndpointStats is the state of an endpoint.
+type EndpointStats struct {
+	Addr    string
+	Weight  int
+	Healthy bool
+	Active  int64
+	Total   int64
+}
+
+// ClusterStats is the state of a cluster.
+type ClusterStats struct {
+	Host      string
+	Policy    string
+	Endpoints []*EndpointStats
+}
+
+// Stats returns the clusters, sorted by host.
+func (lb *LB) Stats() []*ClusterStats {
+	lb.m.RLock()
+	defer lb.m.RUnlock()
+	res := []*ClusterStats{}
+	for h, c := range lb.Clusters {
+		cs := &ClusterStats{Host: h, Policy: c.Policy}
+		if cs.Policy == "" {
+			cs.Policy = RoundRobin
+		}
+		for _, ep := range c.Endpoints {
+			cs.Endpoints = append(cs.Endpoints, &EndpointStats{Addr: ep.Addr, Weight: ep.weight(),
+				Healthy: ep.Healthy(), Active: ep.active.Load(), Total: ep.total.Load()})
+		}
+		res = append(res, cs)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Host < res[j].Host })
+	return res
+}
+
+// HandleClusters returns the clusters and endpoint state as JSON.
+//
+// curl localhost:15000/debug/lb
+func (lb *LB) HandleClusters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(lb.Stats())
+}
@@ -0,0 +1,194 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func cluster(policy string, weights ...int) *Cluster {
+	c := &Cluster{Name: "test", Policy: policy}
+	for i, w := range weights {
+		c.Endpoints = append(c.Endpoints, &Endpoint{Addr: fmt.Sprintf("10.0.0.%d:80", i+1), Weight: w})
+	}
+	return c
+}
+
+func count(c *Cluster, n int, key func(i int) string) map[string]int {
+	res := map[string]int{}
+	for i := 0; i < n; i++ {
+		res[c.PickKey(key(i)).Addr]++
+	}
+	return res
+}
+
+func TestPolicies(t *testing.T) {
+	noKey := func(int) string { return "" }
+
+	t.Run("round_robin", func(t *testing.T) {
+		c := cluster("", 1, 5, 1)
+		res := count(c, 300, noKey)
+		for _, ep := range c.Endpoints {
+			if res[ep.Addr] != 100 {
+				t.Fatal("Unexpected distribution", res)
+			}
+		}
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		c := cluster(Weighted, 1, 3)
+		res := count(c, 400, noKey)
+		if res["10.0.0.1:80"] != 100 || res["10.0.0.2:80"] != 300 {
+			t.Fatal("Unexpected distribution", res)
+		}
+		// Smooth - no burst of 3 for the heavy endpoint.
+		seq := ""
+		for i := 0; i < 8; i++ {
+			seq += c.PickKey("").Addr[7:8]
+		}
+		if strings.Contains(seq, "2222") {
+			t.Fatal("Expected interleaving", seq)
+		}
+	})
+
+	t.Run("least_request", func(t *testing.T) {
+		c := cluster(LeastRequest, 1, 1, 2)
+		c.Endpoints[0].Start()
+		c.Endpoints[0].Start()
+		c.Endpoints[1].Start()
+		c.Endpoints[2].Start()
+		// Loads: 2, 1, 0.5
+		if ep := c.PickKey(""); ep != c.Endpoints[2] {
+			t.Fatal("Expected least loaded", ep.Addr)
+		}
+		c.Endpoints[2].Start()
+		c.Endpoints[2].Start()
+		// Loads: 2, 1, 1.5
+		if ep := c.PickKey(""); ep != c.Endpoints[1] {
+			t.Fatal("Expected least loaded", ep.Addr)
+		}
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		c := cluster(Hash, 1, 1, 1, 1)
+		key := func(i int) string { return fmt.Sprintf("user-%d", i) }
+		before := map[string]string{}
+		for i := 0; i < 1000; i++ {
+			before[key(i)] = c.PickKey(key(i)).Addr
+			if c.PickKey(key(i)).Addr != before[key(i)] {
+				t.Fatal("Hash not stable")
+			}
+		}
+		res := count(c, 1000, key)
+		for _, n := range res {
+			if n < 150 || n > 350 {
+				t.Fatal("Unbalanced", res)
+			}
+		}
+
+		// Only keys on the removed endpoint move.
+		removed := c.Endpoints[3].Addr
+		c.Endpoints = c.Endpoints[:3]
+		for i := 0; i < 1000; i++ {
+			if old := before[key(i)]; old != removed && c.PickKey(key(i)).Addr != old {
+				t.Fatal("Key moved", key(i))
+			}
+		}
+
+		c.HashHeader = "x-session"
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.168.1.1:1234"
+		bySrc := c.Pick(r)
+		if c.PickKey("192.168.1.1") != bySrc {
+			t.Fatal("Expected source IP hash")
+		}
+		r.Header.Set("x-session", "user-1")
+		if c.Pick(r) != c.PickKey("user-1") {
+			t.Fatal("Expected header hash")
+		}
+	})
+
+	t.Run("unhealthy", func(t *testing.T) {
+		c := cluster("", 1, 1)
+		c.Endpoints[0].unhealthy.Store(true)
+		res := count(c, 10, noKey)
+		if res["10.0.0.2:80"] != 10 {
+			t.Fatal("Unhealthy endpoint used", res)
+		}
+		c.Endpoints[1].unhealthy.Store(true)
+		if c.PickKey("") == nil {
+			t.Fatal("Expected panic mode")
+		}
+		if (&Cluster{}).PickKey("") != nil {
+			t.Fatal("Expected nil")
+		}
+	})
+}
+
+func TestHealthCheck(t *testing.T) {
+	status := 200
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := l.Addr().String()
+	l.Close()
+
+	ctx := context.Background()
+	live := srv.Listener.Addr().String()
+	c := &Cluster{Name: "hc", Endpoints: []*Endpoint{{Addr: live}, {Addr: dead}}}
+
+	tcp := &HealthCheck{}
+	tcp.CheckAll(ctx, c)
+	if !c.Endpoints[1].Healthy() {
+		t.Fatal("Expected threshold of 2")
+	}
+	tcp.CheckAll(ctx, c)
+	if !c.Endpoints[0].Healthy() || c.Endpoints[1].Healthy() {
+		t.Fatal("Unexpected tcp health")
+	}
+
+	hc := &HealthCheck{Type: "http", Path: "/healthz", UnhealthyThreshold: 1}
+	hc.CheckAll(ctx, c)
+	if !c.Endpoints[0].Healthy() {
+		t.Fatal("Expected healthy")
+	}
+	status = 503
+	hc.CheckAll(ctx, c)
+	if c.Endpoints[0].Healthy() {
+		t.Fatal("Expected unhealthy on 503")
+	}
+	status = 204
+	hc.CheckAll(ctx, c)
+	if !c.Endpoints[0].Healthy() {
+		t.Fatal("Expected recovery")
+	}
+}
+
+func TestLB(t *testing.T) {
+	mux := http.NewServeMux()
+	lb := &LB{Mux: mux, Clusters: map[string]*Cluster{"svc.local": cluster(Weighted, 2, 1)}}
+	lb.Provision(context.Background())
+	defer func() { DefaultLB = nil }()
+
+	if lb.Cluster("SVC.local:8080") == nil || lb.Cluster("other") != nil {
+		t.Fatal("Unexpected lookup")
+	}
+	lb.Cluster("svc.local").PickKey("").Start()
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/debug/lb", nil))
+	if !strings.Contains(rr.Body.String(), `"Host":"svc.local","Policy":"weighted"`) ||
+		!strings.Contains(rr.Body.String(), `"Active":1`) {
+		t.Fatal("Unexpected stats", rr.Body.String())
+	}
+}
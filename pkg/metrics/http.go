@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Metrics registers the /metrics handler.
+//
+// curl localhost:15000/metrics
+type Metrics struct {
+	// Mux is used for the /metrics handler. Defaults to http.DefaultServeMux.
+	Mux *http.ServeMux `json:"-"`
+}
+
+func (m *Metrics) Provision(ctx context.Context) error {
+	mux := m.Mux
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.HandleFunc("/metrics", HandleMetrics)
+	return nil
+}
+
+// HandleMetrics writes all registered metrics in Prometheus text format
+// (version 0.0.4).
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	sb := &strings.Builder{}
+	for _, m := range All() {
+		sb.WriteString("# HELP ")
+		sb.WriteString(m.Name())
+		sb.WriteByte(' ')
+		sb.WriteString(strings.ReplaceAll(m.Help(), "\n", " "))
+		sb.WriteString("\n# TYPE ")
+		sb.WriteString(m.Name())
+		sb.WriteByte(' ')
+		sb.WriteString(m.Type())
+		sb.WriteByte('\n')
+		m.write(sb)
+	}
+	w.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(sb.String()))
+}
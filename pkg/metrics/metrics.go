@@ -0,0 +1,379 @@
+// Package metrics has counters, gauges and histograms for the gateway
+// modules, exported as Prometheus text on /metrics and as expvar JSON on
+// /debug/vars.
+//
+// It is intentionally small and has no dependencies - modules create the
+// metrics as package variables, like expvar.
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metric types, as used in the TYPE line.
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// Metric is a registered metric family.
+type Metric interface {
+	Name() string
+	Help() string
+	Type() string
+
+	// write appends the samples in text format.
+	write(sb *strings.Builder)
+}
+
+var (
+	mu      sync.Mutex
+	metrics = map[string]Metric{}
+)
+
+// Register adds the metric to the /metrics output and publishes it in
+// expvar. Panics on duplicate names, like expvar.
+func Register(m Metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := metrics[m.Name()]; ok {
+		panic("metrics: duplicate " + m.Name())
+	}
+	metrics[m.Name()] = m
+	if v, ok := m.(expvar.Var); ok && expvar.Get(m.Name()) == nil {
+		expvar.Publish(m.Name(), v)
+	}
+}
+
+// All returns the registered metrics, sorted by name.
+func All() []Metric {
+	mu.Lock()
+	res := make([]Metric, 0, len(metrics))
+	for _, m := range metrics {
+		res = append(res, m)
+	}
+	mu.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Name() < res[j].Name() })
+	return res
+}
+
+type desc struct {
+	name string
+	help string
+	typ  string
+}
+
+func (d *desc) Name() string { return d.name }
+func (d *desc) Help() string { return d.help }
+func (d *desc) Type() string { return d.typ }
+
+// Counter is a monotonic counter. Also implements expvar.Var.
+type Counter struct {
+	desc
+	v atomic.Int64
+}
+
+// NewCounter creates and registers a counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{desc: desc{name, help, TypeCounter}}
+	Register(c)
+	return c
+}
+
+func (c *Counter) Add(n int64) { c.v.Add(n) }
+func (c *Counter) Inc()        { c.v.Add(1) }
+func (c *Counter) Value() int64 {
+	return c.v.Load()
+}
+func (c *Counter) String() string {
+	return strconv.FormatInt(c.v.Load(), 10)
+}
+
+func (c *Counter) write(sb *strings.Builder) {
+	writeSample(sb, c.name, "", float64(c.v.Load()))
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	desc
+	v atomic.Int64
+}
+
+// NewGauge creates and registers a gauge.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{desc: desc{name, help, TypeGauge}}
+	Register(g)
+	return g
+}
+
+func (g *Gauge) Add(n int64) { g.v.Add(n) }
+func (g *Gauge) Set(n int64) { g.v.Store(n) }
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+func (g *Gauge) String() string {
+	return strconv.FormatInt(g.v.Load(), 10)
+}
+
+func (g *Gauge) write(sb *strings.Builder) {
+	writeSample(sb, g.name, "", float64(g.v.Load()))
+}
+
+// expvarMetric exports an existing expvar.Int or expvar.Func.
+type expvarMetric struct {
+	desc
+	v expvar.Var
+}
+
+// Expvar registers an existing expvar variable with a numeric value - the
+// expvar name and JSON view are unchanged.
+func Expvar(name, help, typ string, v expvar.Var) {
+	Register(&expvarMetric{desc: desc{name, help, typ}, v: v})
+}
+
+func (e *expvarMetric) write(sb *strings.Builder) {
+	f, err := strconv.ParseFloat(e.v.String(), 64)
+	if err != nil {
+		return
+	}
+	writeSample(sb, e.name, "", f)
+}
+
+// DefBuckets are latency buckets in seconds, from 1ms to 1 min.
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	desc
+	labels  string
+	buckets []float64
+
+	m      sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a histogram. If buckets is nil,
+// DefBuckets is used.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(name, help, "", buckets)
+	Register(h)
+	return h
+}
+
+func newHistogram(name, help, labels string, buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	return &Histogram{desc: desc{name, help, TypeHistogram}, labels: labels,
+		buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe adds a value.
+func (h *Histogram) Observe(v float64) {
+	h.m.Lock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+	h.m.Unlock()
+}
+
+// ObserveDuration adds the time since t0, in seconds.
+func (h *Histogram) ObserveDuration(t0 time.Time) {
+	h.Observe(time.Since(t0).Seconds())
+}
+
+func (h *Histogram) String() string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	b, _ := json.Marshal(map[string]any{"count": h.count, "sum": h.sum})
+	return string(b)
+}
+
+func (h *Histogram) write(sb *strings.Builder) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for i, b := range h.buckets {
+		writeSample(sb, h.name+"_bucket", joinLabels(h.labels, `le="`+formatFloat(b)+`"`), float64(h.counts[i]))
+	}
+	writeSample(sb, h.name+"_bucket", joinLabels(h.labels, `le="+Inf"`), float64(h.count))
+	writeSample(sb, h.name+"_sum", h.labels, h.sum)
+	writeSample(sb, h.name+"_count", h.labels, float64(h.count))
+}
+
+// vec holds the children of a metric with labels.
+type vec[T any] struct {
+	desc
+	labelNames []string
+	newChild   func(labels string) T
+
+	m        sync.RWMutex
+	children map[string]T
+}
+
+func (v *vec[T]) with(values []string) T {
+	if len(values) != len(v.labelNames) {
+		panic("metrics: wrong label count for " + v.name)
+	}
+	ls := make([]string, len(values))
+	for i, n := range v.labelNames {
+		ls[i] = n + `="` + escapeLabel(values[i]) + `"`
+	}
+	key := strings.Join(ls, ",")
+
+	v.m.RLock()
+	c, ok := v.children[key]
+	v.m.RUnlock()
+	if ok {
+		return c
+	}
+	v.m.Lock()
+	defer v.m.Unlock()
+	if c, ok = v.children[key]; ok {
+		return c
+	}
+	c = v.newChild(key)
+	v.children[key] = c
+	return c
+}
+
+func (v *vec[T]) keys() []string {
+	v.m.RLock()
+	defer v.m.RUnlock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a counter with labels.
+type CounterVec struct {
+	vec[*Counter]
+}
+
+// NewCounterVec creates and registers a counter with labels.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{vec[*Counter]{desc: desc{name, help, TypeCounter}, labelNames: labels,
+		children: map[string]*Counter{},
+		newChild: func(string) *Counter { return &Counter{desc: desc{name, help, TypeCounter}} }}}
+	Register(cv)
+	return cv
+}
+
+// With returns the counter for the label values, in the order of the names.
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.with(values)
+}
+
+func (cv *CounterVec) String() string {
+	res := map[string]int64{}
+	cv.m.RLock()
+	for k, c := range cv.children {
+		res[k] = c.Value()
+	}
+	cv.m.RUnlock()
+	b, _ := json.Marshal(res)
+	return string(b)
+}
+
+func (cv *CounterVec) write(sb *strings.Builder) {
+	for _, k := range cv.keys() {
+		cv.m.RLock()
+		c := cv.children[k]
+		cv.m.RUnlock()
+		writeSample(sb, cv.name, k, float64(c.Value()))
+	}
+}
+
+// HistogramVec is a histogram with labels.
+type HistogramVec struct {
+	vec[*Histogram]
+}
+
+// NewHistogramVec creates and registers a histogram with labels.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	hv := &HistogramVec{vec[*Histogram]{desc: desc{name, help, TypeHistogram}, labelNames: labels,
+		children: map[string]*Histogram{},
+		newChild: func(l string) *Histogram { return newHistogram(name, help, l, buckets) }}}
+	Register(hv)
+	return hv
+}
+
+// With returns the histogram for the label values.
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.with(values)
+}
+
+func (hv *HistogramVec) String() string {
+	res := map[string]json.RawMessage{}
+	for _, k := range hv.keys() {
+		hv.m.RLock()
+		h := hv.children[k]
+		hv.m.RUnlock()
+		res[k] = json.RawMessage(h.String())
+	}
+	b, _ := json.Marshal(res)
+	return string(b)
+}
+
+func (hv *HistogramVec) write(sb *strings.Builder) {
+	for _, k := range hv.keys() {
+		hv.m.RLock()
+		h := hv.children[k]
+		hv.m.RUnlock()
+		h.write(sb)
+	}
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func writeSample(sb *strings.Builder, name, labels string, v float64) {
+	sb.WriteString(name)
+	if labels != "" {
+		sb.WriteByte('{')
+		sb.WriteString(labels)
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(formatFloat(v))
+	sb.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
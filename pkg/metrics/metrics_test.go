@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests.")
+	c.Add(3)
+	g := NewGauge("test_active", "Active.")
+	g.Add(2)
+	g.Add(-1)
+	cv := NewCounterVec("test_rcode_total", "By rcode.", "upstream", "rcode")
+	cv.With("1.1.1.1:53", "NOERROR").Inc()
+	cv.With("1.1.1.1:53", "NOERROR").Inc()
+	cv.With("8.8.8.8:53", `a"b`).Inc()
+	h := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	hv := NewHistogramVec("test_dur_seconds", "Duration.", []float64{1}, "proto")
+	hv.With("tls").Observe(0.5)
+	ev := expvar.NewInt("test_expvar_total")
+	ev.Add(7)
+	Expvar("test_expvar_total", "Existing expvar.", TypeCounter, ev)
+
+	mux := http.NewServeMux()
+	(&Metrics{Mux: mux}).Provision(nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	out := rr.Body.String()
+
+	for _, l := range []string{
+		"# HELP test_requests_total Requests.",
+		"# TYPE test_requests_total counter",
+		"test_requests_total 3",
+		"# TYPE test_active gauge",
+		"test_active 1",
+		`test_rcode_total{upstream="1.1.1.1:53",rcode="NOERROR"} 2`,
+		`test_rcode_total{upstream="8.8.8.8:53",rcode="a\"b"} 1`,
+		`test_latency_seconds_bucket{le="0.1"} 1`,
+		`test_latency_seconds_bucket{le="1"} 2`,
+		`test_latency_seconds_bucket{le="+Inf"} 3`,
+		"test_latency_seconds_sum 5.55",
+		"test_latency_seconds_count 3",
+		`test_dur_seconds_bucket{proto="tls",le="1"} 1`,
+		"test_expvar_total 7",
+	} {
+		if !strings.Contains(out, l+"\n") {
+			t.Error("Missing", l, out)
+		}
+	}
+
+	// The JSON view is kept.
+	if expvar.Get("test_requests_total").String() != "3" {
+		t.Error("Missing expvar")
+	}
+	if !strings.Contains(expvar.Get("test_rcode_total").String(), "NOERROR") {
+		t.Error("Missing expvar", expvar.Get("test_rcode_total"))
+	}
+}
@@ -0,0 +1,62 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/costinm/ugate/nio"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// H3Conn adapts a HTTP/3 client connection to nio.MuxConn, for
+// nio.ConnPool. It is also a RoundTripper, for H2Dialer streams.
+type H3Conn struct {
+	*http3.ClientConn
+
+	conn *quic.Conn
+}
+
+// Ping returns an error if the connection is closed. QUIC doesn't expose
+// PING frames - the keep-alives close dead connections after the idle
+// timeout.
+func (c *H3Conn) Ping(ctx context.Context) error {
+	return context.Cause(c.conn.Context())
+}
+
+// Available returns false if the connection is closed.
+func (c *H3Conn) Available() bool {
+	return c.conn.Context().Err() == nil
+}
+
+func (c *H3Conn) Close() error {
+	return c.conn.CloseWithError(0, "")
+}
+
+// H3ConnDialer returns a nio.ConnPool Dial function creating HTTP/3
+// connections. If tlsConfig is nil the mesh client config is used.
+func (qd *Quic) H3ConnDialer(tlsConfig *tls.Config) func(ctx context.Context, dest string) (nio.MuxConn, error) {
+	t := &http3.Transport{EnableDatagrams: true}
+	return func(ctx context.Context, dest string) (nio.MuxConn, error) {
+		host, _, _ := net.SplitHostPort(dest)
+		var cfg *tls.Config
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+			if cfg.ServerName == "" {
+				cfg.ServerName = host
+			}
+		} else {
+			cfg = nio.ClientTLSConfig(host)
+		}
+		cfg.NextProtos = []string{http3.NextProtoH3}
+		qc := qd.quicConfig()
+		qc.KeepAlivePeriod = 15 * time.Second
+		conn, err := quic.DialAddr(ctx, dest, cfg, qc)
+		if err != nil {
+			return nil, err
+		}
+		return &H3Conn{ClientConn: t.NewClientConn(conn), conn: conn}, nil
+	}
+}
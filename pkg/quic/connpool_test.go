@@ -0,0 +1,48 @@
+package quic
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/costinm/ugate/nio"
+)
+
+func TestH3ConnPool(t *testing.T) {
+	qa := New()
+	qa.Mux = http.NewServeMux()
+	qa.Mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.Proto))
+	})
+	addr, cfg := startH3(t, qa)
+
+	p := &nio.ConnPool{Dial: qa.H3ConnDialer(cfg)}
+	defer p.Close()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		pc, err := p.Get(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := http.NewRequest("GET", "https://"+addr+"/hello", nil)
+		res, err := pc.Conn.(http.RoundTripper).RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		pc.Release()
+		if string(b) != "hello HTTP/3.0" {
+			t.Fatal("Unexpected response", string(b))
+		}
+	}
+	st := p.Stats()
+	if len(st) != 1 || len(st[0].Conns) != 1 || st[0].Conns[0].Total != 2 {
+		t.Fatal("Expected one pooled connection", st)
+	}
+	p.CheckHealth(ctx)
+	if len(p.Stats()) != 1 {
+		t.Fatal("Healthy connection evicted")
+	}
+}
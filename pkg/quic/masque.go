@@ -0,0 +1,78 @@
+package quic
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/costinm/ugate/pkg/udp"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// CONNECT-UDP over HTTP/3 - the UDP payloads are sent as QUIC datagrams,
+// using the quic-go HTTP Datagram support. The protocol and server are in
+// pkg/udp.
+
+// H3Datagrams sends CONNECT-UDP requests on a HTTP/3 connection. Use as
+// udp.MasqueDialer Transport.
+//
+// The connection must be created by a http3.Transport with
+// EnableDatagrams.
+type H3Datagrams struct {
+	Conn *http3.ClientConn
+}
+
+var errNoH3Datagrams = errors.New("masque: peer doesn't support HTTP datagrams or extended CONNECT")
+
+func (h *H3Datagrams) RoundTripDatagrams(r *http.Request) (*http.Response, udp.DatagramStream, io.Closer, error) {
+	ctx := r.Context()
+	select {
+	case <-h.Conn.ReceivedSettings():
+	case <-ctx.Done():
+		return nil, nil, nil, ctx.Err()
+	}
+	if s := h.Conn.Settings(); !s.EnableDatagrams || !s.EnableExtendedConnect {
+		return nil, nil, nil, errNoH3Datagrams
+	}
+
+	str, err := h.Conn.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// Proto is sent as :protocol for CONNECT.
+	if err := str.SendRequestHeader(r); err != nil {
+		str.Close()
+		return nil, nil, nil, err
+	}
+	res, err := str.ReadResponse()
+	if err != nil {
+		str.Close()
+		return nil, nil, nil, err
+	}
+	closer := closerFunc(func() error {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		return str.Close()
+	})
+	if res.StatusCode != http.StatusOK {
+		closer.Close()
+		return res, nil, nil, nil
+	}
+	return res, str, closer, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// MasqueH3Stream returns the stream of a HTTP/3 request, after sending the
+// response headers. Set as udp.MasqueServer DatagramStream - returns nil for
+// H2, where capsules are used.
+func MasqueH3Stream(w http.ResponseWriter) udp.DatagramStream {
+	hs, ok := w.(http3.HTTPStreamer)
+	if !ok {
+		return nil
+	}
+	w.WriteHeader(http.StatusOK)
+	return hs.HTTPStream()
+}
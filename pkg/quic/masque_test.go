@@ -0,0 +1,94 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/costinm/ugate/pkg/udp"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startH3 starts the server on a random port, with a test certificate.
+// Returns the address and a client config.
+func startH3(t *testing.T, qa *Quic) (string, *tls.Config) {
+	hs := httptest.NewTLSServer(nil)
+	cfg := hs.TLS.Clone()
+	hs.Close()
+
+	ctx := context.Background()
+	qa.Address = "127.0.0.1:0"
+	qa.TLSConfig = cfg
+	if err := qa.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := qa.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { qa.listener.Close() })
+	addr := qa.listener.Addr().(*net.UDPAddr)
+	addr.IP = net.IPv4(127, 0, 0, 1)
+
+	return addr.String(), &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       cfg.Certificates,
+		NextProtos:         []string{http3.NextProtoH3},
+	}
+}
+
+// TestMasqueH3 sends UDP through the HTTP/3 server, using QUIC datagrams.
+func TestMasqueH3(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(append([]byte("echo "), b[:n]...), addr)
+		}
+	}()
+
+	ctx := context.Background()
+	qa := New()
+	qa.Masque = &udp.MasqueServer{Allow: []string{"127.0.0.1"}}
+	addr, cfg := startH3(t, qa)
+
+	conn, err := quic.DialAddr(ctx, addr, cfg, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	h3 := &http3.Transport{EnableDatagrams: true}
+	md := &udp.MasqueDialer{URL: "https://" + addr,
+		Transport: &H3Datagrams{Conn: h3.NewClientConn(conn)}}
+
+	c, err := md.DialContext(ctx, "udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b := make([]byte, 1500)
+	for _, m := range []string{"one", "two"} {
+		c.Write([]byte(m))
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := c.Read(b)
+		if err != nil || string(b[:n]) != "echo "+m {
+			t.Fatal("Unexpected response", string(b[:n]), err)
+		}
+	}
+
+	// Targets not allowed by the MasqueServer are rejected.
+	if _, err := md.DialContext(ctx, "udp", "10.1.1.1:53"); err == nil {
+		t.Fatal("Expected forbidden")
+	}
+}
@@ -2,7 +2,10 @@ package quic
 
 import (
 	"context"
+	"errors"
+	"time"
 
+	"github.com/costinm/ugate/nio"
 	"github.com/quic-go/quic-go"
 
 	//"io"
@@ -13,16 +16,16 @@ import (
 // QuicMUX is a mux to a specific node. May be accepted or dialed.
 // Equivalent with quic/h3/client.go ( when dialing ), and Quic server when accepting.
 type QuicMUX struct {
-
 	Dialer ContextDialer
 	client bool
 
 	// Can be accepted or dialed - the protocol is symmetric.
-	s    quic.EarlyConnection
+	s    *quic.Conn
 	Addr string
 }
 
 const errorNoError = 0x100
+
 var Debug = false
 
 func (ugs *QuicMUX) Close() error {
@@ -32,7 +35,6 @@ func (ugs *QuicMUX) Close() error {
 	return ugs.s.CloseWithError(0, "")
 }
 
-
 //func (ugs *QuicMUX) DialStream(ctx context.Context, addr string, inStream util.Stream) (util.Stream, error) {
 //	//if UseRawStream {
 //	s, err := ugs.s.OpenStream()
@@ -73,21 +75,41 @@ func (ugs *QuicMUX) Close() error {
 //	return str, nil
 //}
 
-// DialContext uses the current association to open a stream.
+// DialContext uses the current association to open a stream. The
+// destination is sent in a metadata frame, and the peer responds with the
+// status after dialing it - see Quic.handleRaw.
 //
 // Note that H3 is handled separately - this is an L4 use of QUIC, similar to SSH.
-//
 func (ugs *QuicMUX) DialContext(ctx context.Context, net, addr string) (net.Conn, error) {
-	str, err := ugs.s.OpenStream()
+	qs, err := ugs.s.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		qs.SetDeadline(d)
+	}
+
+	str := nio.GetStream(qs, qs)
+	str.Header().Set("dest", addr)
+	err = str.SendHeader(qs, str.Header())
+	if err == nil {
+		err = str.ReadHeader(qs)
+	}
+	if err == nil && str.InHeader.Get("status") != "200" {
+		err = errors.New("quic: dial " + addr + ": " + str.InHeader.Get("error"))
+	}
 	if err != nil {
+		qs.CancelRead(errorNoError)
+		qs.CancelWrite(errorNoError)
 		return nil, err
 	}
+	qs.SetDeadline(time.Time{})
 
-	return &QuicNetCon{Stream: str}, nil
+	return &QuicNetCon{Stream: qs}, nil
 }
 
 type QuicNetCon struct {
-	quic.Stream
+	*quic.Stream
 }
 
 func (q QuicNetCon) LocalAddr() net.Addr {
@@ -0,0 +1,136 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/costinm/ugate/nio"
+	"github.com/quic-go/quic-go"
+)
+
+// TestRawStream dials TCP through a raw QUIC stream - the destination and
+// dial status are sent as metadata frames.
+func TestRawStream(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	// Closed port
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := l.Addr().String()
+	l.Close()
+
+	ctx := context.Background()
+	qa := New()
+	qa.Dialer = &net.Dialer{}
+	addr, cfg := startH3(t, qa)
+	cfg.NextProtos = []string{"h3r"}
+
+	conn, err := quic.DialAddr(ctx, addr, cfg, qa.quicConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	mux := &QuicMUX{s: conn, client: true}
+
+	c, err := mux.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatal("Unexpected", string(b), err)
+	}
+	c.Close()
+
+	if _, err := mux.DialContext(ctx, "tcp", down); err == nil {
+		t.Fatal("Expected dial error")
+	}
+}
+
+// TestRawStreamMetadata sends headers, a framed body and trailers over a raw
+// QUIC stream.
+func TestRawStreamMetadata(t *testing.T) {
+	hs := httptest.NewTLSServer(nil)
+	cfg := hs.TLS.Clone()
+	hs.Close()
+	cfg.NextProtos = []string{"h3r"}
+
+	ctx := context.Background()
+	l, err := quic.ListenAddr("127.0.0.1:0", cfg, &quic.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := quic.DialAddr(ctx, l.Addr().String(),
+			&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h3r"}}, &quic.Config{})
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.CloseWithError(0, "")
+		qs, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			errc <- err
+			return
+		}
+		str := nio.GetStream(qs, qs)
+		err = str.SendHeader(qs, http.Header{"Dest": {"example.com:443"}})
+		if err == nil {
+			_, err = (&nio.MetadataBodyWriter{W: qs}).Write([]byte("hello"))
+		}
+		if err == nil {
+			err = str.SendTrailer(qs, http.Header{"Status": {"0"}})
+		}
+		qs.Close()
+		// Wait for the peer before closing the connection.
+		io.Copy(io.Discard, qs)
+		errc <- err
+	}()
+
+	conn, err := l.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs, err := conn.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := nio.GetStream(qs, qs)
+	if err := str.ReadHeader(qs); err != nil || str.InHeader.Get("dest") != "example.com:443" {
+		t.Fatal(err, str.InHeader)
+	}
+	mr := &nio.MetadataBodyReader{R: qs}
+	if b, err := io.ReadAll(mr); err != nil || string(b) != "hello" {
+		t.Fatal(err, string(b))
+	}
+	if err := str.ReadTrailer(mr); err != nil || str.InTrailer.Get("status") != "0" {
+		t.Fatal(err, str.InTrailer)
+	}
+	qs.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -11,30 +12,43 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/costinm/meshauth/pkg/certs"
+	"github.com/costinm/meshauth"
 
 	"github.com/costinm/ugate/nio"
+	"github.com/costinm/ugate/pkg/udp"
 	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 
 	"github.com/quic-go/webtransport-go"
 )
 
 // Quic is the adapter to QUIC/H3/MASQUE for uGate.
+//
+// Accepted connections negotiating "h3" are served by a HTTP/3 server with
+// datagrams and extended CONNECT (WebTransport, CONNECT-UDP), using Mux.
+// Other connections use raw streams, with nio metadata frames.
 type Quic struct {
-	Auth *certs.Cert
+	Auth *meshauth.Mesh `json:"-"`
 
-	// Incoming streams are mapped to HTTP
-	//HTTPHandler http.Handler
-	//server      *http3.Server
+	// TLSConfig overrides the mesh server config.
+	TLSConfig *tls.Config `json:"-"`
 
 	tlsServerConfig *tls.Config
 
-	Mux *http.ServeMux
+	// h3 serves HTTP/3 connections - the webtransport server wraps the
+	// http3.Server.
+	h3 *webtransport.Server
 
-	Dialer    ContextDialer
-	Address   string
+	listener *quic.EarlyListener
 
-	MeshTrust *certs.MeshTrust
+	Mux *http.ServeMux `json:"-"`
+
+	Dialer  ContextDialer `json:"-"`
+	Address string
+
+	// Masque, if set, serves CONNECT-UDP on H3 with datagrams. The targets
+	// must be allowed in the MasqueServer config.
+	Masque *udp.MasqueServer `json:"masque,omitempty"`
 
 	Peers map[string]*Peer
 }
@@ -43,16 +57,14 @@ type ContextDialer interface {
 	DialContext(ctx context.Context, net, addr string) (net.Conn, error)
 }
 
-
 type Peer struct {
 }
 
 // DataSreamer is implemented by response writer on server side to take over the stream.
 type DataStreamer interface {
-	DataStream() quic.Stream
+	DataStream() *quic.Stream
 }
 
-
 func New() *Quic {
 	return &Quic{
 		Address: ":4443",
@@ -67,20 +79,44 @@ func (qa *Quic) Provision(ctx context.Context) error {
 	}
 
 	if qa.Dialer == nil {
-		qa.Dialer = &net.Dialer{}
+		qa.Dialer = nio.Dialer(nil)
 	}
 
-	wts := webtransport.Server{}
+	qa.h3 = &webtransport.Server{
+		H3: http3.Server{
+			Handler:         qa.Mux,
+			EnableDatagrams: true,
+			QUICConfig:      qa.quicConfig(),
+		},
+	}
 	qa.Mux.HandleFunc("/.well-known/webtransport", func(writer http.ResponseWriter, request *http.Request) {
 		// expects CONNECT - can't be handled by muxConn
-		wts.Upgrade(writer, request)
+		qa.h3.Upgrade(writer, request)
 	})
 
+	// CONNECT-UDP, with QUIC datagrams.
+	if qa.Masque != nil {
+		if qa.Masque.Dialer == nil {
+			qa.Masque.Dialer = qa.Dialer
+		}
+		qa.Masque.DatagramStream = MasqueH3Stream
+		qa.Mux.Handle(udp.MasqueTemplate, qa.Masque)
+	}
 
-	mtlsServerConfig := qa.Auth.GenerateTLSConfigServer(qa.MeshTrust)
+	var mtlsServerConfig *tls.Config
+	switch {
+	case qa.TLSConfig != nil:
+		mtlsServerConfig = qa.TLSConfig.Clone()
+	case qa.Auth != nil:
+		mtlsServerConfig = qa.Auth.GenerateTLSConfigServer(true)
+	case nio.DefaultTLS != nil:
+		mtlsServerConfig = nio.DefaultTLS.ServerConfig()
+	default:
+		return errors.New("quic: no mesh certificates")
+	}
 
-	// Overrides
-	mtlsServerConfig.NextProtos = []string{"h3r", "h3-34"}
+	// Overrides - h3 is served by the HTTP/3 server.
+	mtlsServerConfig.NextProtos = []string{http3.NextProtoH3, "h3r", "h3-34"}
 
 	// called with ClientAuth is RequestClientCert or RequireAnyClientCert
 	mtlsServerConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
@@ -99,38 +135,18 @@ func (qa *Quic) Provision(ctx context.Context) error {
 
 	qa.tlsServerConfig = mtlsServerConfig
 
-	//quicServer := &http3.Server{
-	//	QuicConfig: &quic.Config{
-	//		MaxIdleTimeout: 60 * time.Second, // should be very large - but need to test recovery
-	//		KeepAlive:      true,             // 1/2 idle timeout
-	//		//Versions:    []quic.VersionNumber{101},
-	//
-	//		MaxIncomingStreams:    30000,
-	//		MaxIncomingUniStreams: 30000,
-	//
-	//		EnableDatagrams: true,
-	//	},
-	//
-	//	Server: &http.Server{
-	//		Addr:        ":" + strconv.Itoa(qa.Port),
-	//		Handler:     qa.HTTPHandler,
-	//		TLSConfig:   mtlsServerConfig,
-	//		ReadTimeout: 5 * time.Second,
-	//	},
-	//}
-	//
-	//qa.server = quicServer
-	//quicServer.Init()
-
 	return nil
 }
 
-
 // Either direction - h3 is indicated by a header frame.
 // Format is: i(type) i(len) payload[len]
 // Type: data(0), header(1),
-func (q *Quic) handleRaw(qs quic.Stream) {
-	str := nio2.GetStream(qs, qs)
+//
+// Raw streams start with a nio metadata frame (type 2) with the headers,
+// followed by the body. The response frame has the status of the dial to
+// "dest" - "200", or "503" with the error.
+func (q *Quic) handleRaw(qs *quic.Stream) {
+	str := nio.GetStream(qs, qs)
 
 	err := str.ReadHeader(qs)
 	if err != nil {
@@ -142,7 +158,12 @@ func (q *Quic) handleRaw(qs quic.Stream) {
 	log.Println("QUIC stream IN", str.StreamId, str.Dest)
 
 	str.PostDialHandler = func(conn net.Conn, err error) {
-		str.Header().Set("status", "200")
+		if err != nil {
+			str.Header().Set("status", "503")
+			str.Header().Set("error", err.Error())
+		} else {
+			str.Header().Set("status", "200")
+		}
 		str.SendHeader(qs, str.Header())
 		log.Println("QUIC stream IN rcv", str.StreamId, str.InHeader)
 	}
@@ -150,16 +171,15 @@ func (q *Quic) handleRaw(qs quic.Stream) {
 	nc, err := q.Dialer.DialContext(qs.Context(), "tcp", str.Dest)
 	if err != nil {
 		str.PostDialHandler(nil, err)
+		qs.Close()
 		return
 	}
 	str.PostDialHandler(nil, nil)
 
-	nio2.Proxy(nc, str, str, str.Dest)
+	nio.Proxy(nc, str, str, str.Dest)
 
 }
 
-
-
 func (q *Quic) quicConfig() *quic.Config {
 	return &quic.Config{
 		//RequestConnectionIDOmission: false,
@@ -190,7 +210,7 @@ func (q *Quic) quicConfig() *quic.Config {
 func (qd *Quic) DialContext(ctx context.Context, net, addr string) (net.Conn, error) {
 
 	// Quic maintains 'associations' and mux connections.
-	ugc := &QuicMUX{Addr: addr , client: true}
+	ugc := &QuicMUX{Addr: addr, client: true}
 
 	err := qd.DialMux(ctx, ugc)
 	if err != nil {
@@ -199,12 +219,12 @@ func (qd *Quic) DialContext(ctx context.Context, net, addr string) (net.Conn, er
 	return ugc.DialContext(ctx, net, addr)
 }
 
-func (qd *Quic) DialMux(ctx context.Context, ugc *QuicMUX) (error) {
+func (qd *Quic) DialMux(ctx context.Context, ugc *QuicMUX) error {
 	tlsConf := &tls.Config{
 		// VerifyPeerCertificate used instead
 		InsecureSkipVerify: true,
 
-		Certificates: []tls.Certificate{*qd.Auth.Certificate},
+		Certificates: []tls.Certificate{*qd.Auth.Cert},
 
 		NextProtos: []string{"h3r", "h3-29"},
 	}
@@ -236,7 +256,7 @@ func (qd *Quic) DialMux(ctx context.Context, ugc *QuicMUX) (error) {
 
 	go func() {
 		<-session.Context().Done()
-		log.Println("H3: stop on ", qd.Auth.PubB32(), "for", ugc.Addr, session.RemoteAddr())
+		log.Println("H3: stop on ", qd.Auth.PubID32(), "for", ugc.Addr, session.RemoteAddr())
 	}()
 
 	//decoder := qpack.NewDecoder(nil)
@@ -253,7 +273,7 @@ func (qd *Quic) DialMux(ctx context.Context, ugc *QuicMUX) (error) {
 	}()
 
 	go qd.handleMessages(ugc)
-	return  nil
+	return nil
 }
 
 func GetPort(a string, dp int32) int32 {
@@ -285,6 +305,7 @@ func (qd *Quic) Start(ctx context.Context) error {
 		log.Println("H3: Failed to start server ", err)
 		return err
 	}
+	qd.listener = l
 
 	go func() {
 		for {
@@ -294,6 +315,11 @@ func (qd *Quic) Start(ctx context.Context) error {
 				return
 			}
 
+			if s.ConnectionState().TLS.NegotiatedProtocol == http3.NextProtoH3 {
+				go qd.h3.ServeQUICConn(s)
+				continue
+			}
+
 			ugc := &QuicMUX{s: s, client: false}
 
 			// QUIC supports 0-RTT, meaning that mTLS handshake may not complete until later.
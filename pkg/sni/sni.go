@@ -11,24 +11,66 @@ import (
 )
 
 type SNIHandler struct {
-	UGate    *meshauth.Mesh
-	Dialer   net.Dialer
+	UGate *meshauth.Mesh
+
+	// Dialer for the upstream connection. If not set, UGate or the mesh
+	// dialer is used.
+	// Can be a nio.RouteDialer, to use parent proxies for some destinations.
+	Dialer nio.ContextDialer `json:"-"`
+
+	// Routes maps "SNI/ALPN", "/ALPN" or "SNI" to an upstream address, checked
+	// in this order. ALPN is the first protocol offered by the client - h2 and
+	// http/1.1 can be sent to different backends. Without a match the conn
+	// is forwarded to SNI:443.
+	Routes map[string]string `json:"routes,omitempty"`
+
 	Listener net.Listener
 }
 
+// route returns the upstream address for the ClientHello, or "".
+func (snih *SNIHandler) route(ch *nio.ClientHelloMsg) string {
+	if len(snih.Routes) == 0 {
+		return ""
+	}
+	alpn := ""
+	if len(ch.AlpnProtocols) > 0 {
+		alpn = ch.AlpnProtocols[0]
+	}
+	if alpn != "" {
+		if a, ok := snih.Routes[ch.ServerName+"/"+alpn]; ok {
+			return a
+		}
+		if a, ok := snih.Routes["/"+alpn]; ok {
+			return a
+		}
+	}
+	return snih.Routes[ch.ServerName]
+}
+
 // HandleSNIConn implements SNI based routing. This can be used for compat
 // with Istio. Was original method to tunnel for serverless.
 //
 // This can be used for a legacy CNI to UGate bridge. The old Istio client expects an mTLS connection
 // to the other end - the UGate proxy is untrusted.
 func (snih *SNIHandler) HandleConn(conn net.Conn) error {
-	hb := snih.UGate
+	hb := snih.Dialer
+	if hb == nil && snih.UGate != nil {
+		hb = snih.UGate
+	}
+	hb = nio.Dialer(hb)
+	if nio.DefaultBreakers != nil {
+		hb = nio.DefaultBreakers.Wrap(hb)
+	}
 
-	s := nio2.NewBufferReader(conn)
+	str, ok := conn.(*nio.StreamConn)
+	if !ok {
+		str = nio.NewStreamConn(conn)
+	}
+	s := nio.NewBufferReader(conn)
 	defer conn.Close()
 	defer s.Buffer.Recycle()
 
-	cn, sni, err := nio2.SniffClientHello(s)
+	cn, sni, err := nio.SniffClientHello(s)
 	if err != nil {
 		return err
 	}
@@ -40,9 +82,18 @@ func (snih *SNIHandler) HandleConn(conn net.Conn) error {
 	// At this point we have a SNI service name. Need to convert it to a real service
 	// name, RoundTripStart and proxy.
 
+	str.ClientHello = cn
+	str.Proto = nio.ProtoTLS
+	if str.ListenerName == "" {
+		str.ListenerName = "sni"
+	}
+
 	addr := sni + ":443"
+	if ra := snih.route(cn); ra != "" {
+		addr = ra
+	}
 	// Based on SNI, make a hbone request, using JWT auth.
-	if strings.HasPrefix(sni, "outbound_.") {
+	if strings.HasPrefix(sni, "outbound_.") && addr == sni+":443" {
 		// Current Istio SNI looks like:
 		//
 		// outbound_.9090_._.prometheus-1-prometheus.mon.svc.cluster.local
@@ -59,12 +110,12 @@ func (snih *SNIHandler) HandleConn(conn net.Conn) error {
 		addr = net.JoinHostPort(remoteService, parts[1])
 	}
 
-	ctx := context.Background()
+	ctx := nio.ContextWithClient(context.Background(), str)
 	nc, err := hb.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return err
 	}
-	err = nio2.Proxy(nc, s, conn, addr)
+	err = nio.Proxy(nc, s, str, addr)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,525 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/costinm/meshauth"
+	"github.com/costinm/ugate/nio"
+	"github.com/costinm/ugate/pkg/udp"
+)
+
+// Egress capture using SOCKS5 (RFC 1928), for browsers and CLI tools that
+// only support SOCKS.
+//
+// curl --socks5-hostname 127.0.0.1:15004 ....
+// export HTTPS_PROXY=socks5h://127.0.0.1:15004
+//
+// CONNECT is dialed using the mesh, so mesh hostnames and routes apply.
+// UDP ASSOCIATE uses the UDP NAT.
+//
+// Note: max DNS size is 255 ( including trailing 0, and len labels )
+
+const (
+	ConnectCommand   = uint8(1)
+	BindCommand      = uint8(2)
+	AssociateCommand = uint8(3)
+	ipv4Address      = uint8(1)
+	fqdnAddress      = uint8(3)
+	ipv6Address      = uint8(4)
+)
+
+const (
+	successReply uint8 = iota
+	serverFailure
+	ruleFailure
+	networkUnreachable
+	hostUnreachable
+	connectionRefused
+	ttlExpired
+	commandNotSupported
+	addrTypeNotSupported
+)
+
+const (
+	NoAuth          = uint8(0)
+	UserPassAuth    = uint8(2)
+	noAcceptable    = uint8(255)
+	userAuthVersion = uint8(1)
+	authSuccess     = uint8(0)
+	authFailure     = uint8(1)
+)
+
+var (
+	errInvalidHeader = errors.New("socks: invalid header")
+	errAuth          = errors.New("socks: authentication failed")
+)
+
+// Socks is a SOCKS5 server module.
+type Socks struct {
+	// Address to listen on, if NetListener is not set. Should be bound to
+	// localhost unless Users is set. Default 127.0.0.1:15004
+	Address string `json:"address,omitempty"`
+
+	// Users enables username/password authentication (RFC 1929).
+	// If empty, only 'no auth' is accepted.
+	Users map[string]string `json:"users,omitempty"`
+
+	// Mesh is used to dial CONNECT requests, if Dialer is not set.
+	Mesh *meshauth.Mesh `json:"-"`
+
+	// Dialer for CONNECT and UDP ASSOCIATE. Defaults to Mesh, or the
+	// nio.DefaultDialer.
+	Dialer nio.ContextDialer `json:"-"`
+
+	// UDP NAT used for UDP ASSOCIATE. If nil, a NAT using the Dialer is
+	// created, unless NoUDP is set.
+	UDP *udp.UDPListener `json:"-"`
+
+	// NoUDP rejects UDP ASSOCIATE.
+	NoUDP bool `json:"no_udp,omitempty"`
+
+	// Bandwidth, if set, limits each CONNECT stream.
+	Bandwidth *nio.Bandwidth `json:"bandwidth,omitempty"`
+
+	// Timeouts, if set, apply to each CONNECT stream.
+	Timeouts *nio.Timeouts `json:"timeouts,omitempty"`
+
+	NetListener net.Listener `json:"-"`
+}
+
+func New() *Socks {
+	return &Socks{}
+}
+
+func (s *Socks) Provision(ctx context.Context) error {
+	if s.Dialer == nil {
+		if s.Mesh != nil {
+			s.Dialer = s.Mesh
+		} else {
+			s.Dialer = nio.MeshDialer{}
+		}
+	}
+	if s.UDP == nil && !s.NoUDP {
+		s.UDP = udp.New()
+		s.UDP.Dialer = s.Dialer
+	}
+	if s.NetListener == nil {
+		if s.Address == "" {
+			s.Address = "127.0.0.1:15004"
+		}
+		l, err := net.Listen("tcp", s.Address)
+		if err != nil {
+			return err
+		}
+		s.NetListener = l
+	}
+	return nil
+}
+
+func (s *Socks) Start(ctx context.Context) error {
+	go s.serve()
+	return nil
+}
+
+func (s *Socks) serve() {
+	for {
+		c, err := s.NetListener.Accept()
+		if err != nil {
+			if ne, ok := err.(interface {
+				Temporary() bool
+			}); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go s.HandleConn(c)
+	}
+}
+
+// HandleConn handles one SOCKS5 connection. Can also be used as a handler
+// for a nio.SniffListener.
+func (s *Socks) HandleConn(conn net.Conn) error {
+	defer conn.Close()
+	br := nio.NewBufferReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	err := s.handshake(br, conn)
+	if err != nil {
+		return err
+	}
+
+	cmd, dest, err := readRequest(br)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		if err == errAddrType {
+			writeReply(conn, addrTypeNotSupported, nil)
+		}
+		return err
+	}
+
+	switch cmd {
+	case ConnectCommand:
+		return s.connect(br, conn, dest)
+	case AssociateCommand:
+		return s.associate(br, conn, dest)
+	default:
+		writeReply(conn, commandNotSupported, nil)
+		return errors.New("socks: unsupported command " + strconv.Itoa(int(cmd)))
+	}
+}
+
+// handshake negotiates the auth method, and validates user/password.
+//
+//	Client: 0x05 NMETHODS METHODS...
+//	Server: 0x05 METHOD
+func (s *Socks) handshake(br *nio.BufferReader, w io.Writer) error {
+	head, err := br.Peek(2)
+	if err != nil {
+		return err
+	}
+	if head[0] != 5 {
+		return errInvalidHeader
+	}
+	n := int(head[1])
+	head, err = br.Peek(2 + n)
+	if err != nil {
+		return err
+	}
+	methods := head[2 : 2+n]
+
+	want := NoAuth
+	if len(s.Users) > 0 {
+		want = UserPassAuth
+	}
+	found := false
+	for _, m := range methods {
+		if m == want {
+			found = true
+		}
+	}
+	br.Discard(2 + n)
+	if !found {
+		w.Write([]byte{5, noAcceptable})
+		return errAuth
+	}
+	w.Write([]byte{5, want})
+	if want == NoAuth {
+		return nil
+	}
+
+	// RFC 1929: VER=1 ULEN UNAME PLEN PASSWD
+	head, err = br.Peek(2)
+	if err != nil {
+		return err
+	}
+	if head[0] != userAuthVersion {
+		return errInvalidHeader
+	}
+	ulen := int(head[1])
+	head, err = br.Peek(2 + ulen + 1)
+	if err != nil {
+		return err
+	}
+	user := string(head[2 : 2+ulen])
+	plen := int(head[2+ulen])
+	head, err = br.Peek(3 + ulen + plen)
+	if err != nil {
+		return err
+	}
+	pass := string(head[3+ulen : 3+ulen+plen])
+	br.Discard(3 + ulen + plen)
+
+	if p, ok := s.Users[user]; !ok || p != pass {
+		w.Write([]byte{userAuthVersion, authFailure})
+		return errAuth
+	}
+	_, err = w.Write([]byte{userAuthVersion, authSuccess})
+	return err
+}
+
+var errAddrType = errors.New("socks: address type not supported")
+
+// readRequest parses the request, returning the command and destination.
+//
+//	VER CMD RSV ATYP DST.ADDR DST.PORT
+func readRequest(br *nio.BufferReader) (byte, string, error) {
+	head, err := br.Peek(4)
+	if err != nil {
+		return 0, "", err
+	}
+	if head[0] != 5 {
+		return 0, "", errInvalidHeader
+	}
+	cmd := head[1]
+	dest, n, err := readAddr(br, 3)
+	if err != nil {
+		return 0, "", err
+	}
+	br.Discard(n)
+	return cmd, dest, nil
+}
+
+// readAddr reads ATYP ADDR PORT starting at off, returns host:port and the
+// offset after the address.
+func readAddr(br *nio.BufferReader, off int) (string, int, error) {
+	head, err := br.Peek(off + 2)
+	if err != nil {
+		return "", 0, err
+	}
+	n := 0
+	switch head[off] {
+	case ipv4Address:
+		n = 1 + 4 + 2
+	case ipv6Address:
+		n = 1 + 16 + 2
+	case fqdnAddress:
+		n = 1 + 1 + int(head[off+1]) + 2
+	default:
+		return "", 0, errAddrType
+	}
+	head, err = br.Peek(off + n)
+	if err != nil {
+		return "", 0, err
+	}
+	dest, n, err := parseAddr(head[off:])
+	return dest, off + n, err
+}
+
+// parseAddr parses ATYP ADDR PORT from a complete buffer, returning host:port
+// and the number of bytes used.
+func parseAddr(b []byte) (string, int, error) {
+	if len(b) < 2 {
+		return "", 0, errInvalidHeader
+	}
+	var host string
+	off := 1
+	switch b[0] {
+	case ipv4Address:
+		if len(b) < off+4+2 {
+			return "", 0, errInvalidHeader
+		}
+		host = net.IP(b[off : off+4]).String()
+		off += 4
+	case ipv6Address:
+		if len(b) < off+16+2 {
+			return "", 0, errInvalidHeader
+		}
+		host = net.IP(b[off : off+16]).String()
+		off += 16
+	case fqdnAddress:
+		dlen := int(b[off])
+		off++
+		if len(b) < off+dlen+2 {
+			return "", 0, errInvalidHeader
+		}
+		host = string(b[off : off+dlen])
+		off += dlen
+	default:
+		return "", 0, errAddrType
+	}
+	port := binary.BigEndian.Uint16(b[off:])
+	off += 2
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), off, nil
+}
+
+// appendAddr appends ATYP ADDR PORT for a TCP or UDP address.
+func appendAddr(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, ipv4Address)
+		b = append(b, ip4...)
+	} else if ip != nil {
+		b = append(b, ipv6Address)
+		b = append(b, ip.To16()...)
+	} else {
+		b = append(b, ipv4Address, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// appendHostPort appends ATYP ADDR PORT for a "host:port" - host may be a
+// domain name.
+func appendHostPort(b []byte, hostPort string) []byte {
+	host, ps, _ := net.SplitHostPort(hostPort)
+	port, _ := strconv.Atoi(ps)
+	if ip := net.ParseIP(host); ip != nil || len(host) > 255 {
+		return appendAddr(b, ip, port)
+	}
+	b = append(b, fqdnAddress, byte(len(host)))
+	b = append(b, host...)
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// writeReply sends VER REP RSV BND.ADDR BND.PORT
+func writeReply(w io.Writer, code uint8, addr net.Addr) error {
+	r := []byte{5, code, 0}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		r = appendAddr(r, a.IP, a.Port)
+	case *net.UDPAddr:
+		r = appendAddr(r, a.IP, a.Port)
+	default:
+		r = appendAddr(r, nil, 0)
+	}
+	_, err := w.Write(r)
+	return err
+}
+
+func replyCode(err error) uint8 {
+	var ne *net.OpError
+	if errors.As(err, &ne) {
+		if ne.Timeout() {
+			return ttlExpired
+		}
+		return connectionRefused
+	}
+	return hostUnreachable
+}
+
+func (s *Socks) connect(br *nio.BufferReader, conn net.Conn, dest string) error {
+	nc, err := s.Dialer.DialContext(nio.ContextWithClient(context.Background(), conn), "tcp", dest)
+	if err != nil {
+		writeReply(conn, replyCode(err), nil)
+		return err
+	}
+	// Not accurate for tcp-over-http, the local address is the tunnel.
+	err = writeReply(conn, successReply, nc.LocalAddr())
+	if err != nil {
+		nc.Close()
+		return err
+	}
+
+	// Keep the state of a SniffListener stream - limiter, timeouts, PROXY
+	// header.
+	str, ok := conn.(*nio.StreamConn)
+	if !ok {
+		str = nio.NewStreamConn(conn)
+	}
+	str.Dest = dest
+	str.Proto = nio.ProtoSocks5
+	if str.ListenerName == "" {
+		str.ListenerName = "socks"
+	}
+	if s.Bandwidth != nil {
+		str.Limiter = nio.NewLimiter(*s.Bandwidth)
+	}
+	if s.Timeouts != nil {
+		str.Timeouts = s.Timeouts
+	}
+
+	// Any bytes remaining in br are eager sent by client.
+	return nio.Proxy(nc, br, str, dest)
+}
+
+// associate handles UDP ASSOCIATE - the association is valid until the TCP
+// connection is closed.
+func (s *Socks) associate(br *nio.BufferReader, conn net.Conn, dest string) error {
+	if s.UDP == nil || s.NoUDP {
+		writeReply(conn, commandNotSupported, nil)
+		return errors.New("socks: UDP not enabled")
+	}
+	tcpLocal, _ := conn.LocalAddr().(*net.TCPAddr)
+	tcpRemote, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if tcpLocal == nil || tcpRemote == nil {
+		writeReply(conn, serverFailure, nil)
+		return errors.New("socks: UDP requires TCP control connection")
+	}
+
+	// Bind on the same IP the client used to reach us.
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpLocal.IP})
+	if err != nil {
+		writeReply(conn, serverFailure, nil)
+		return err
+	}
+	defer uc.Close()
+
+	a := &udpAssociation{
+		s:      s,
+		conn:   uc,
+		client: tcpRemote.IP,
+	}
+	// Client may announce the address it will send from - port 0 or
+	// unspecified means unknown.
+	if ua, err := net.ResolveUDPAddr("udp", dest); err == nil && ua.Port != 0 {
+		a.clientPort = ua.Port
+	}
+
+	err = writeReply(conn, successReply, uc.LocalAddr())
+	if err != nil {
+		return err
+	}
+	go a.readLoop()
+
+	// Wait for the TCP connection to close.
+	io.Copy(io.Discard, br)
+	return nil
+}
+
+// udpAssociation forwards UDP between a SOCKS client and the UDP NAT.
+type udpAssociation struct {
+	s *Socks
+
+	// Socket returned to the client in the ASSOCIATE reply.
+	conn *net.UDPConn
+
+	// Packets are only accepted from the client IP (and port, if provided)
+	client     net.IP
+	clientPort int
+}
+
+// readLoop reads encapsulated packets from the client, until the socket is
+// closed. Each destination has a NAT entry - the destination is resolved by
+// the NAT Dialer. The NAT entries of the association are removed on return.
+//
+//	RSV(2) FRAG ATYP DST.ADDR DST.PORT DATA
+func (a *udpAssociation) readLoop() {
+	keys := map[string]struct{}{}
+	defer func() {
+		for k := range keys {
+			a.s.UDP.RemoveNat(k)
+		}
+	}()
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !src.IP.Equal(a.client) || (a.clientPort != 0 && src.Port != a.clientPort) {
+			continue
+		}
+		// Fragmentation is not supported - drop.
+		if n < 10 || buf[2] != 0 {
+			continue
+		}
+		dest, off, err := parseAddr(buf[3:n])
+		if err != nil {
+			continue
+		}
+		off += 3
+		keys[udp.NatKey(src, dest)] = struct{}{}
+		a.s.UDP.HandleUdpDest(src, dest, buf[off:n], &destWriter{a: a, dest: dest})
+	}
+}
+
+// destWriter implements udp.UdpWriter for one destination of the
+// association - called by the NAT with packets from the remote, to send
+// back to the client with the destination the client used.
+type destWriter struct {
+	a    *udpAssociation
+	dest string
+}
+
+func (dw *destWriter) WriteTo(data []byte, dstAddr *net.UDPAddr, srcAddr *net.UDPAddr) (int, error) {
+	b := make([]byte, 0, len(data)+262)
+	b = append(b, 0, 0, 0)
+	b = appendHostPort(b, dw.dest)
+	b = append(b, data...)
+	return dw.a.conn.WriteToUDP(b, dstAddr)
+}
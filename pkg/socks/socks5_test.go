@@ -0,0 +1,224 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/costinm/ugate/nio"
+	"github.com/costinm/ugate/pkg/udp"
+	"golang.org/x/net/proxy"
+)
+
+func echoTCP(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func echoUDP(t *testing.T) *net.UDPConn {
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, a, err := uc.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			uc.WriteToUDP(b[0:n], a)
+		}
+	}()
+	return uc
+}
+
+func TestSocks(t *testing.T) {
+	ctx := context.Background()
+	s := &Socks{
+		Address: "127.0.0.1:0",
+		Users:   map[string]string{"u": "p"},
+		UDP:     udp.New(),
+	}
+	if err := s.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.Start(ctx)
+	defer s.NetListener.Close()
+
+	el := echoTCP(t)
+	defer el.Close()
+
+	t.Run("connect", func(t *testing.T) {
+		d, _ := proxy.SOCKS5("tcp", s.NetListener.Addr().String(), &proxy.Auth{User: "u", Password: "p"}, proxy.Direct)
+		c, err := d.Dial("tcp", el.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte("hello"))
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+			t.Fatal("Unexpected", string(b), err)
+		}
+	})
+
+	t.Run("badauth", func(t *testing.T) {
+		d, _ := proxy.SOCKS5("tcp", s.NetListener.Addr().String(), &proxy.Auth{User: "u", Password: "x"}, proxy.Direct)
+		_, err := d.Dial("tcp", el.Addr().String())
+		if err == nil {
+			t.Fatal("Expected auth failure")
+		}
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		eu := echoUDP(t)
+		defer eu.Close()
+		eu2 := echoUDP(t)
+		defer eu2.Close()
+
+		c, err := net.Dial("tcp", s.NetListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte{5, 1, UserPassAuth, userAuthVersion, 1, 'u', 1, 'p'})
+		c.Write([]byte{5, AssociateCommand, 0, ipv4Address, 0, 0, 0, 0, 0, 0})
+		res := make([]byte, 2+2+10)
+		if _, err := io.ReadFull(c, res); err != nil {
+			t.Fatal(err)
+		}
+		if res[5] != successReply {
+			t.Fatal("Associate failed", res)
+		}
+		relay, _, err := parseAddr(res[7:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uc, err := net.Dial("udp", relay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uc.SetDeadline(time.Now().Add(5 * time.Second))
+		ea := eu.LocalAddr().(*net.UDPAddr)
+		pkt := appendAddr([]byte{0, 0, 0}, ea.IP, ea.Port)
+		uc.Write(append(pkt, []byte("ping")...))
+
+		b := make([]byte, 2048)
+		n, err := uc.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[0:n], append(pkt, []byte("ping")...)) {
+			t.Fatal("Unexpected response", b[0:n])
+		}
+
+		// Each destination of the association has its own NAT entry.
+		ea2 := eu2.LocalAddr().(*net.UDPAddr)
+		pkt2 := appendAddr([]byte{0, 0, 0}, ea2.IP, ea2.Port)
+		uc.Write(append(pkt2, []byte("ping2")...))
+		n, err = uc.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[0:n], append(pkt2, []byte("ping2")...)) {
+			t.Fatal("Unexpected response", b[0:n])
+		}
+
+		// Closing the control connection ends the association and the NAT.
+		if s.UDP.NatCount() != 2 {
+			t.Fatal("Expected a NAT entry per destination", s.UDP.NatCount())
+		}
+		c.Close()
+		for i := 0; i < 100 && s.UDP.NatCount() != 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if s.UDP.NatCount() != 0 {
+			t.Fatal("Expected the NAT entry removed", s.UDP.NatCount())
+		}
+	})
+
+	t.Run("chain", func(t *testing.T) {
+		pd, err := nio.NewProxyDialer("socks5://u:p@" + s.NetListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := pd.DialContext(ctx, "tcp", el.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte("hello"))
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+			t.Fatal("Unexpected", string(b), err)
+		}
+	})
+
+	t.Run("chain-udp", func(t *testing.T) {
+		eu := echoUDP(t)
+		defer eu.Close()
+
+		pd, _ := nio.NewProxyDialer("socks5://u:p@" + s.NetListener.Addr().String())
+		uc, err := pd.DialContext(ctx, "udp", eu.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer uc.Close()
+		uc.SetDeadline(time.Now().Add(5 * time.Second))
+		uc.Write([]byte("ping"))
+		b := make([]byte, 2048)
+		n, err := uc.Read(b)
+		if err != nil || string(b[0:n]) != "ping" {
+			t.Fatal("Unexpected response", b[0:n], err)
+		}
+	})
+}
+
+func TestSocksDefaults(t *testing.T) {
+	s := New()
+	s.Address = "127.0.0.1:0"
+	if err := s.Provision(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.NetListener.Close()
+	if _, ok := s.Dialer.(nio.MeshDialer); !ok || s.UDP == nil || s.UDP.Dialer != s.Dialer {
+		t.Fatal("Expected the mesh dialer for CONNECT and UDP", s.Dialer, s.UDP)
+	}
+
+	s = &Socks{Address: "127.0.0.1:0", NoUDP: true}
+	s.Provision(context.Background())
+	defer s.NetListener.Close()
+	if s.UDP != nil {
+		t.Fatal("Unexpected UDP NAT")
+	}
+}
+
+func TestAppendHostPort(t *testing.T) {
+	for _, hp := range []string{"10.1.1.1:53", "[fd00::1]:443", "dns.example.com:853"} {
+		a, n, err := parseAddr(appendHostPort(nil, hp))
+		if err != nil || a != hp || n == 0 {
+			t.Error("Unexpected", hp, a, err)
+		}
+	}
+}
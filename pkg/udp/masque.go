@@ -0,0 +1,598 @@
+package udp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/costinm/ugate/nio"
+	"github.com/costinm/ugate/pkg/metrics"
+	"golang.org/x/net/http2"
+)
+
+// MASQUE CONNECT-UDP (RFC 9298) - UDP proxied over HTTP.
+//
+// The client sends an extended CONNECT with :protocol=connect-udp to a URL
+// template like /.well-known/masque/udp/{target_host}/{target_port}/. The
+// UDP payloads are sent as HTTP Datagrams (RFC 9297) with context ID 0 -
+// QUIC datagrams for H3, DATAGRAM capsules on the stream for H2.
+//
+// This file has the protocol, the server handler and the H2 transport. The
+// H3 transport and streams are in pkg/quic.
+
+const (
+	// MasqueProtocol is the :protocol of CONNECT-UDP requests.
+	MasqueProtocol = "connect-udp"
+
+	// MasqueTemplate is the default URI template.
+	MasqueTemplate = "/.well-known/masque/udp/{target_host}/{target_port}/"
+
+	capsuleDatagram = 0
+
+	// maxCapsule limits the capsules read on H2 streams.
+	maxCapsule = 65535 + 8
+)
+
+var (
+	ErrCapsuleTooLarge = errors.New("masque: capsule too large")
+
+	masqueStreams = metrics.NewCounterVec("ugate_masque_streams_total",
+		"CONNECT-UDP streams.", "side")
+	masqueDatagrams = metrics.NewCounterVec("ugate_masque_datagrams_total",
+		"UDP payloads sent as HTTP Datagrams.", "dir")
+)
+
+// DatagramStream sends and receives HTTP Datagrams on a request stream.
+// The quic-go http3 Stream and RequestStream implement it; for H2 the
+// datagrams are sent as capsules.
+type DatagramStream interface {
+	SendDatagram(b []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+}
+
+// DatagramRoundTripper sends a CONNECT-UDP request, returning the response
+// and the stream carrying the datagrams.
+type DatagramRoundTripper interface {
+	RoundTripDatagrams(r *http.Request) (*http.Response, DatagramStream, io.Closer, error)
+}
+
+// appendVarint appends a QUIC variable length integer (RFC 9000 16).
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func readVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		b, err = r.ReadByte()
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// parseVarint returns the varint at the start of b and its length, or 0
+// length if b is too short.
+func parseVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n
+}
+
+// capsuleStream sends HTTP Datagrams as DATAGRAM capsules (RFC 9297 3.5)
+// on a H2 stream. Other capsule types are skipped.
+type capsuleStream struct {
+	w     io.Writer
+	flush func() error
+
+	wm   sync.Mutex
+	wbuf []byte
+
+	in  chan []byte
+	err error
+}
+
+func newCapsuleStream(r io.Reader, w io.Writer, flush func() error) *capsuleStream {
+	cs := &capsuleStream{w: w, flush: flush, in: make(chan []byte, 64)}
+	go cs.readLoop(bufio.NewReader(r))
+	return cs
+}
+
+func (cs *capsuleStream) readLoop(br *bufio.Reader) {
+	defer close(cs.in)
+	for {
+		typ, err := readVarint(br)
+		if err != nil {
+			cs.err = err
+			return
+		}
+		l, err := readVarint(br)
+		if err != nil {
+			cs.err = err
+			return
+		}
+		if l > maxCapsule {
+			cs.err = ErrCapsuleTooLarge
+			return
+		}
+		if typ != capsuleDatagram {
+			if _, err := br.Discard(int(l)); err != nil {
+				cs.err = err
+				return
+			}
+			continue
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(br, b); err != nil {
+			cs.err = err
+			return
+		}
+		select {
+		case cs.in <- b:
+		default:
+			// Like UDP, drop if the reader is slow or gone.
+			masqueDatagrams.With("drop").Inc()
+		}
+	}
+}
+
+func (cs *capsuleStream) SendDatagram(b []byte) error {
+	cs.wm.Lock()
+	defer cs.wm.Unlock()
+	buf := appendVarint(cs.wbuf[:0], capsuleDatagram)
+	buf = appendVarint(buf, uint64(len(b)))
+	buf = append(buf, b...)
+	cs.wbuf = buf
+	if _, err := cs.w.Write(buf); err != nil {
+		return err
+	}
+	if cs.flush != nil {
+		return cs.flush()
+	}
+	return nil
+}
+
+func (cs *capsuleStream) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case b, ok := <-cs.in:
+		if !ok {
+			if cs.err == nil || cs.err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, cs.err
+		}
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// CapsuleTransport sends CONNECT-UDP requests over H2, with capsules.
+type CapsuleTransport struct {
+	// RoundTripper must support extended CONNECT - a x/net/http2 Transport
+	// or ClientConn.
+	RoundTripper http.RoundTripper
+}
+
+func (ct *CapsuleTransport) RoundTripDatagrams(r *http.Request) (*http.Response, DatagramStream, io.Closer, error) {
+	pr, pw := io.Pipe()
+	r = r.Clone(r.Context())
+	r.Body = pr
+	r.Header.Set(":protocol", r.Proto)
+	res, err := ct.RoundTripper.RoundTrip(r)
+	if err != nil {
+		pw.Close()
+		return nil, nil, nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		pw.Close()
+		res.Body.Close()
+		return res, nil, nil, nil
+	}
+	closer := closerFunc(func() error {
+		pw.Close()
+		return res.Body.Close()
+	})
+	return res, newCapsuleStream(res.Body, pw, nil), closer, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// MasqueDialer dials UDP destinations through a CONNECT-UDP proxy. Each
+// Write on the returned conn sends one datagram, each Read returns one.
+//
+// Set as UDPListener.Masque to send captured UDP through a remote gateway.
+type MasqueDialer struct {
+	// URL of the proxy - a template with {target_host} and {target_port},
+	// or a base URL where MasqueTemplate is appended.
+	URL string `json:"url"`
+
+	// Transport for the requests. Defaults to a CapsuleTransport over a
+	// H2 transport. Use pkg/quic H3Datagrams for HTTP/3.
+	Transport DatagramRoundTripper `json:"-"`
+
+	// Header is added to the requests - for example Authorization.
+	Header http.Header `json:"header,omitempty"`
+
+	m sync.Mutex
+}
+
+// ExpandTemplate returns the URL for the target, escaping the host - IPv6
+// addresses have ':'.
+func ExpandTemplate(tmpl, host, port string) string {
+	if !strings.Contains(tmpl, "{target_host}") {
+		tmpl = strings.TrimSuffix(tmpl, "/") + MasqueTemplate
+	}
+	host = strings.ReplaceAll(url.PathEscape(host), ":", "%3A")
+	tmpl = strings.ReplaceAll(tmpl, "{target_host}", host)
+	return strings.ReplaceAll(tmpl, "{target_port}", url.PathEscape(port))
+}
+
+func (md *MasqueDialer) transport() DatagramRoundTripper {
+	md.m.Lock()
+	defer md.m.Unlock()
+	if md.Transport == nil {
+		md.Transport = &CapsuleTransport{RoundTripper: &http2.Transport{}}
+	}
+	return md.Transport
+}
+
+// DialContext opens a CONNECT-UDP stream to addr. ctx is only used for the
+// request - the stream lasts until the conn is closed.
+func (md *MasqueDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "udp") {
+		return nil, errors.New("masque: unsupported network " + network)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	sctx, cancel := context.WithCancel(context.Background())
+	r, err := http.NewRequestWithContext(sctx, http.MethodConnect, ExpandTemplate(md.URL, host, port), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r.Proto = MasqueProtocol
+	for k, v := range md.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Capsule-Protocol", "?1")
+
+	type result struct {
+		res    *http.Response
+		ds     DatagramStream
+		closer io.Closer
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		res, ds, closer, err := md.transport().RoundTripDatagrams(r)
+		ch <- result{res, ds, closer, err}
+	}()
+	var rt result
+	select {
+	case rt = <-ch:
+	case <-ctx.Done():
+		cancel()
+		go func() {
+			if rt := <-ch; rt.closer != nil {
+				rt.closer.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+	if rt.err != nil {
+		cancel()
+		return nil, rt.err
+	}
+	if rt.res.StatusCode != http.StatusOK {
+		cancel()
+		return nil, errors.New("masque: proxy status " + rt.res.Status)
+	}
+	masqueStreams.With("client").Inc()
+	return &masqueConn{ds: rt.ds, closer: rt.closer, cancel: cancel,
+		raddr: masqueAddr(addr), laddr: masqueAddr(md.URL)}, nil
+}
+
+// masqueConn is a datagram conn on a CONNECT-UDP stream.
+type masqueConn struct {
+	ds     DatagramStream
+	closer io.Closer
+	cancel context.CancelFunc
+
+	raddr net.Addr
+	laddr net.Addr
+
+	readDeadline atomic.Pointer[time.Time]
+	closed       atomic.Bool
+}
+
+func (c *masqueConn) Read(b []byte) (int, error) {
+	ctx := context.Background()
+	if dl := c.readDeadline.Load(); dl != nil && !dl.IsZero() {
+		var cf context.CancelFunc
+		ctx, cf = context.WithDeadline(ctx, *dl)
+		defer cf()
+	}
+	for {
+		d, err := c.ds.ReceiveDatagram(ctx)
+		if err != nil {
+			if c.closed.Load() {
+				return 0, net.ErrClosed
+			}
+			if err == context.DeadlineExceeded {
+				return 0, &timeoutError{}
+			}
+			return 0, err
+		}
+		id, n := parseVarint(d)
+		if n == 0 || id != 0 {
+			continue // unknown context
+		}
+		masqueDatagrams.With("in").Inc()
+		return copy(b, d[n:]), nil
+	}
+}
+
+func (c *masqueConn) Write(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	d := make([]byte, 0, len(b)+1)
+	d = append(d, 0) // context ID
+	d = append(d, b...)
+	if err := c.ds.SendDatagram(d); err != nil {
+		return 0, err
+	}
+	masqueDatagrams.With("out").Inc()
+	return len(b), nil
+}
+
+func (c *masqueConn) Close() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+	c.cancel()
+	return c.closer.Close()
+}
+
+func (c *masqueConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *masqueConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *masqueConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *masqueConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(&t)
+	return nil
+}
+
+// SetWriteDeadline is not supported - datagram writes don't block for long.
+func (c *masqueConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type masqueAddr string
+
+func (a masqueAddr) Network() string { return "masque" }
+func (a masqueAddr) String() string  { return string(a) }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// MasqueServer is a http.Handler for CONNECT-UDP requests, for H2 (with
+// capsules) and H3 (with datagrams). Register it with MasqueTemplate as
+// pattern, or the target is taken from the last 2 path segments.
+//
+// Authentication is expected to be done by the handler chain in front. The
+// targets must be allowed by Allow or Authorize - by default all requests
+// are rejected, to avoid an open relay.
+type MasqueServer struct {
+	// Dialer for the UDP targets. Defaults to the mesh dialer.
+	Dialer nio.ContextDialer `json:"-"`
+
+	// Allow is the list of allowed targets - see nio.AllowDest.
+	Allow []string `json:"allow,omitempty"`
+
+	// Authorize, if set, is called for targets not in Allow. A nil error
+	// allows the request.
+	Authorize func(r *http.Request, dest string) error `json:"-"`
+
+	// IdleTimeout closes the stream if no datagram is received in either
+	// direction. Default 60s.
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+
+	// DatagramStream returns the H3 stream for a request, or nil for H2.
+	// Set by pkg/quic.
+	DatagramStream func(w http.ResponseWriter) DatagramStream `json:"-"`
+}
+
+// IsMasque returns true for CONNECT-UDP requests - :protocol on H2, Proto
+// on H3.
+func IsMasque(r *http.Request) bool {
+	return r.Method == http.MethodConnect &&
+		(r.Header.Get(":protocol") == MasqueProtocol || r.Proto == MasqueProtocol)
+}
+
+func masqueTarget(r *http.Request) (string, string) {
+	host, port := r.PathValue("target_host"), r.PathValue("target_port")
+	if host != "" && port != "" {
+		return host, port
+	}
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	if len(parts) < 2 {
+		return "", ""
+	}
+	host, _ = url.PathUnescape(parts[len(parts)-2])
+	port, _ = url.PathUnescape(parts[len(parts)-1])
+	return host, port
+}
+
+func (ms *MasqueServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsMasque(r) {
+		http.Error(w, "CONNECT-UDP required", http.StatusBadRequest)
+		return
+	}
+	host, port := masqueTarget(r)
+	if host == "" || port == "" {
+		http.Error(w, "missing target", http.StatusBadRequest)
+		return
+	}
+	dest := net.JoinHostPort(host, port)
+	if !ms.allowed(r, dest) {
+		http.Error(w, "target not allowed", http.StatusForbidden)
+		return
+	}
+
+	d := nio.Dialer(ms.Dialer)
+	if nio.DefaultBreakers != nil {
+		d = nio.DefaultBreakers.Wrap(d)
+	}
+	ctx, cf := context.WithTimeout(r.Context(), 10*time.Second)
+	uc, err := d.DialContext(ctx, "udp", dest)
+	cf()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer uc.Close()
+
+	w.Header().Set("Capsule-Protocol", "?1")
+	var ds DatagramStream
+	if ms.DatagramStream != nil {
+		ds = ms.DatagramStream(w)
+	}
+	if c, ok := ds.(io.Closer); ok {
+		// Taken over H3 streams are closed by the handler.
+		defer c.Close()
+	}
+	if ds == nil {
+		rc := http.NewResponseController(w)
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		ds = newCapsuleStream(r.Body, w, rc.Flush)
+	}
+	masqueStreams.With("server").Inc()
+
+	idle := ms.IdleTimeout
+	if idle == 0 {
+		idle = 60 * time.Second
+	}
+	relayDatagrams(r.Context(), ds, uc, idle)
+	slog.Debug("masque-done", "dest", dest, "peer", r.RemoteAddr)
+}
+
+func (ms *MasqueServer) allowed(r *http.Request, dest string) bool {
+	if nio.AllowDest(ms.Allow, dest) {
+		return true
+	}
+	if ms.Authorize == nil {
+		return false
+	}
+	err := ms.Authorize(r, dest)
+	if err != nil {
+		slog.Info("masque-denied", "dest", dest, "peer", r.RemoteAddr, "err", err)
+	}
+	return err == nil
+}
+
+// relayDatagrams copies between the stream and the UDP conn, until the
+// stream ends or both directions are idle. The stream is not used after it
+// returns - H2 handlers can't write after returning.
+func relayDatagrams(ctx context.Context, ds DatagramStream, uc net.Conn, idle time.Duration) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+
+	done := make(chan struct{})
+	defer func() {
+		cancel()
+		uc.SetReadDeadline(time.Now())
+		<-done
+	}()
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		buf := bufferPoolUdp.Get().([]byte)
+		defer bufferPoolUdp.Put(buf)
+		buf = buf[:cap(buf)]
+		buf[0] = 0 // context ID
+		for {
+			uc.SetReadDeadline(time.Now().Add(idle))
+			n, err := uc.Read(buf[1:])
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if ctx.Err() == nil && time.Since(time.Unix(0, last.Load())) < idle {
+					continue
+				}
+				return
+			}
+			if err != nil {
+				return
+			}
+			last.Store(time.Now().UnixNano())
+			if ds.SendDatagram(buf[:n+1]) != nil {
+				return
+			}
+			masqueDatagrams.With("out").Inc()
+		}
+	}()
+
+	for {
+		d, err := ds.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		id, n := parseVarint(d)
+		if n == 0 || id != 0 {
+			continue
+		}
+		last.Store(time.Now().UnixNano())
+		masqueDatagrams.With("in").Inc()
+		uc.Write(d[n:])
+	}
+}
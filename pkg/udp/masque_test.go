@@ -0,0 +1,195 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// TestMain re-runs the tests with extended CONNECT enabled in the HTTP/2
+// server - the setting is only read from the environment at init.
+func TestMain(m *testing.M) {
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], os.Args[1:]...)
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1,"+os.Getenv("GODEBUG"))
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			if ee, ok := err.(*exec.ExitError); ok {
+				os.Exit(ee.ExitCode())
+			}
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30, 1<<62 - 1} {
+		b := appendVarint(nil, v)
+		got, n := parseVarint(b)
+		if got != v || n != len(b) {
+			t.Fatal("Unexpected varint", v, got, n, len(b))
+		}
+		got, err := readVarint(bytes.NewReader(b))
+		if err != nil || got != v {
+			t.Fatal("Unexpected varint", v, got, err)
+		}
+	}
+	if _, n := parseVarint([]byte{0x40}); n != 0 {
+		t.Fatal("Expected short varint")
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	if u := ExpandTemplate("https://gw:443", "2001:db8::1", "53"); u !=
+		"https://gw:443/.well-known/masque/udp/2001%3Adb8%3A%3A1/53/" {
+		t.Fatal("Unexpected URL", u)
+	}
+	if u := ExpandTemplate("https://gw/udp?h={target_host}&p={target_port}", "example.com", "443"); u !=
+		"https://gw/udp?h=example.com&p=443" {
+		t.Fatal("Unexpected URL", u)
+	}
+}
+
+// udpEcho echoes datagrams, prefixed with "echo ".
+func udpEcho(t *testing.T) *net.UDPAddr {
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { uc.Close() })
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, addr, err := uc.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			uc.WriteToUDP(append([]byte("echo "), b[:n]...), addr)
+		}
+	}()
+	return uc.LocalAddr().(*net.UDPAddr)
+}
+
+func masqueGateway(t *testing.T) *MasqueDialer {
+	mux := http.NewServeMux()
+	mux.Handle(MasqueTemplate, &MasqueServer{Allow: []string{"127.0.0.0/8"},
+		Authorize: func(r *http.Request, dest string) error {
+			if strings.HasPrefix(dest, "localhost:") {
+				return nil
+			}
+			return errors.New("denied")
+		}})
+	srv := httptest.NewUnstartedServer(mux)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	h2 := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	t.Cleanup(h2.CloseIdleConnections)
+	return &MasqueDialer{URL: srv.URL, Transport: &CapsuleTransport{RoundTripper: h2}}
+}
+
+func TestMasqueH2(t *testing.T) {
+	md := masqueGateway(t)
+	echo := udpEcho(t)
+
+	c, err := md.DialContext(context.Background(), "udp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	b := make([]byte, 2048)
+	for _, m := range []string{"one", "two", strings.Repeat("x", 1200)} {
+		c.Write([]byte(m))
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := c.Read(b)
+		if err != nil || string(b[:n]) != "echo "+m {
+			t.Fatal("Unexpected response", n, err)
+		}
+	}
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Read(b); err == nil || !err.(net.Error).Timeout() {
+		t.Fatal("Expected timeout", err)
+	}
+
+	c.Close()
+	if _, err := c.Write([]byte("x")); err != net.ErrClosed {
+		t.Fatal("Expected closed", err)
+	}
+
+	// Plain requests are rejected
+	rt := md.Transport.(*CapsuleTransport).RoundTripper
+	r, _ := http.NewRequest("GET", ExpandTemplate(md.URL, "127.0.0.1", "53"), nil)
+	res, err := rt.RoundTrip(r)
+	if err != nil || res.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400", res, err)
+	}
+	res.Body.Close()
+	if _, err := md.DialContext(context.Background(), "tcp", echo.String()); err == nil {
+		t.Fatal("Expected tcp to fail")
+	}
+
+	// Targets not in Allow are checked by Authorize, before dialing.
+	lc, err := md.DialContext(context.Background(), "udp", "localhost:"+strconv.Itoa(echo.Port))
+	if err != nil {
+		t.Fatal("Expected authorized", err)
+	}
+	lc.Close()
+	for _, dest := range []string{"10.1.1.1:53", "example.com:53"} {
+		if _, err := md.DialContext(context.Background(), "udp", dest); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatal("Expected forbidden", dest)
+		}
+	}
+}
+
+type capturedWriter struct {
+	ch chan []byte
+}
+
+func (w *capturedWriter) WriteTo(data []byte, dstAddr *net.UDPAddr, srcAddr *net.UDPAddr) (int, error) {
+	w.ch <- append([]byte(srcAddr.String()+" "), data...)
+	return len(data), nil
+}
+
+// TestMasqueNAT sends captured UDP through the gateway.
+func TestMasqueNAT(t *testing.T) {
+	echo := udpEcho(t)
+	ul := &UDPListener{ActiveUdp: map[string]*UdpNat{}, ConnTimeout: time.Minute,
+		Masque: masqueGateway(t)}
+	defer ul.Close()
+	w := &capturedWriter{ch: make(chan []byte, 4)}
+
+	src := net.IPv4(10, 0, 0, 2)
+	ul.HandleUdpWriter(echo.IP, uint16(echo.Port), src, 1234, []byte("hi"), w)
+	ul.HandleUdpWriter(echo.IP, uint16(echo.Port), src, 1234, []byte("again"), w)
+	for _, m := range []string{"hi", "again"} {
+		select {
+		case got := <-w.ch:
+			if string(got) != echo.String()+" echo "+m {
+				t.Fatal("Unexpected response", string(got))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout")
+		}
+	}
+	if len(ul.ActiveUdp) != 1 {
+		t.Fatal("Expected one NAT entry", len(ul.ActiveUdp))
+	}
+}
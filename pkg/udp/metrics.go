@@ -0,0 +1,11 @@
+package udp
+
+import "github.com/costinm/ugate/pkg/metrics"
+
+var (
+	udpNatActive = metrics.NewGauge("ugate_udp_nat_active",
+		"Entries in the UDP NAT tables.")
+
+	udpNatTotal = metrics.NewCounter("ugate_udp_nat_total",
+		"UDP NAT entries created.")
+)
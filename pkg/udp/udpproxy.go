@@ -25,16 +25,18 @@ package udp
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/costinm/meshauth"
-	"github.com/costinm/ugate/nio2"
+	"github.com/costinm/ugate/nio"
 )
 
 // TODO: For TUN capture, we can process the UDP packet directly, without going through the stack.
@@ -112,7 +114,7 @@ var (
 // This should be sufficient for local capture and small p2p nets.
 // In the mesh, UDP should be encapsulated in WebRTC or quic.
 type UdpNat struct {
-	nio2.Stats
+	nio.Stats
 
 	// External address - string
 	Dest string
@@ -123,6 +125,16 @@ type UdpNat struct {
 	// bound to a local port (on the real network).
 	UDP *net.UDPConn
 
+	// Conn is set instead of UDP if the NAT was created using a Dialer,
+	// for example a SOCKS5 parent proxy. It is connected to DestAddr.
+	Conn net.Conn `json:"-"`
+
+	// Packets received while the Dialer is connecting are queued.
+	dialM   sync.Mutex
+	dialing bool
+	pending [][]byte
+	closed  bool
+
 	Closed bool
 
 	// For captured traffic / NAT
@@ -174,6 +186,15 @@ type UDPListener struct {
 
 	// Timeout for UDP sockets. Default 60 sec.
 	ConnTimeout time.Duration
+
+	// Dialer is used to create the NAT for captured packets, if set.
+	// Typically a nio.RouteDialer - packets to some destinations use a
+	// SOCKS5 parent proxy.
+	Dialer nio.ContextDialer `json:"-"`
+
+	// Masque, if set, sends captured UDP through a remote gateway using
+	// CONNECT-UDP, instead of the Dialer or direct.
+	Masque *MasqueDialer `json:"masque,omitempty"`
 	//l           *meshauth.Module
 
 	Mux *http.ServeMux
@@ -227,16 +248,8 @@ func (udpg *UDPListener) HttpUDPNat(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(udpg.ActiveUdp)
 }
 
-//// Server side of 'UDP-over-H2+QUIC'.
-//// 3 modes:
-//// - /udp/ - allocates a pair of ports. No encryption.
-//// - TODO: /udptcp/ UDP encapsulated in H2 stream.
-//// - TODO: /udps/ - negotiate an encryption key. Use a single UDP port. Encrypt and header.
-//func (gw *Gateway) HTTPTunnelUDP(w http.ResponseWriter, r *http.Request) {
-//
-//	// remote address and port
-//
-//}
+// Server side of 'UDP-over-H2+QUIC' is MasqueServer - CONNECT-UDP, with
+// capsules on H2 streams and datagrams on H3.
 
 // NAT will open one port per clientIP+port, and forward back to the local app.
 // This is the loop reading from remote and forwarding to 'local', equivalent with
@@ -348,9 +361,7 @@ func forwardReadLoop(gw *UDPListener, udpL *net.UDPConn) {
 			udpN.Open = time.Now()
 			udpN.LocalPort = udpCon.LocalAddr().(*net.UDPAddr).Port
 
-			gw.udpLock.Lock()
-			gw.ActiveUdp[packetSourceString] = udpN
-			gw.udpLock.Unlock()
+			gw.addNat(packetSourceString, udpN)
 
 			log.Println("UDP-FW open: client:", srcAddr, "nat:", udpCon.LocalAddr(), "fw:", remoteA)
 
@@ -399,6 +410,15 @@ func (udpg *UDPListener) Run(ctx context.Context) {
 // netstack TUN.
 // Will create a NAT, using a local port as source and translating back.
 func (udpg *UDPListener) HandleUdp(dstAddr net.IP, dstPort uint16, localAddr net.IP, localPort uint16, data []byte) {
+	udpg.HandleUdpWriter(dstAddr, dstPort, localAddr, localPort, data, nil)
+}
+
+// HandleUdpWriter is similar with HandleUdp, but packets received on a new NAT
+// entry are sent back using w instead of the transparent writer.
+//
+// Used for UDP received over other protocols - like SOCKS UDP ASSOCIATE - where
+// the response needs to be encapsulated. DNS capture is only applied if w is nil.
+func (udpg *UDPListener) HandleUdpWriter(dstAddr net.IP, dstPort uint16, localAddr net.IP, localPort uint16, data []byte, w UdpWriter) {
 	if dstPort == 1900 {
 		return
 	}
@@ -412,7 +432,7 @@ func (udpg *UDPListener) HandleUdp(dstAddr net.IP, dstPort uint16, localAddr net
 		return
 	}
 
-	if dstPort == 53 && udpg.DNSHandler != nil {
+	if dstPort == 53 && udpg.DNSHandler != nil && w == nil {
 		udpg.DNSHandler.HandleUdp(dstAddr, dstPort, localAddr, localPort, data)
 		return
 	}
@@ -424,7 +444,10 @@ func (udpg *UDPListener) HandleUdp(dstAddr net.IP, dstPort uint16, localAddr net
 	udpN, found := udpg.ActiveUdp[packetSourceString]
 	udpg.udpLock.RUnlock()
 
-	if !found {
+	if !found && (udpg.Dialer != nil || udpg.Masque != nil) {
+		udpN, found = udpg.dialNat(packetSourceString, src,
+			net.JoinHostPort(dstAddr.String(), strconv.Itoa(int(dstPort))), w)
+	} else if !found {
 		udpCon, err := net.ListenUDP("udp", &net.UDPAddr{
 			Port: 0,
 		})
@@ -441,7 +464,10 @@ func (udpg *UDPListener) HandleUdp(dstAddr net.IP, dstPort uint16, localAddr net
 			UDP: udpCon,
 		}
 
-		l, _ := udpg.cfg.Discover(context.Background(), net.JoinHostPort(dstAddr.String(), strconv.Itoa(int(dstPort)))) //FindRoutePrefix(dstAddr, dstPort, "udp://")
+		var l *meshauth.Dest
+		if udpg.cfg != nil {
+			l, _ = udpg.cfg.Discover(context.Background(), net.JoinHostPort(dstAddr.String(), strconv.Itoa(int(dstPort)))) //FindRoutePrefix(dstAddr, dstPort, "udp://")
+		}
 		if l != nil {
 			udpN.DestAddr, err = net.ResolveUDPAddr("udp", l.Addr)
 			if err != nil {
@@ -458,11 +484,11 @@ func (udpg *UDPListener) HandleUdp(dstAddr net.IP, dstPort uint16, localAddr net
 		}
 
 		udpN.LocalPort = udpCon.LocalAddr().(*net.UDPAddr).Port
-		udpg.udpLock.Lock()
-		udpg.ActiveUdp[packetSourceString] = udpN
-		udpg.udpLock.Unlock()
+		udpg.addNat(packetSourceString, udpN)
 
-		w := udpg.TransparentUDPWriter
+		if w == nil {
+			w = udpg.TransparentUDPWriter
+		}
 		if w == nil {
 			w = TransparentUDPWriter
 		}
@@ -470,7 +496,7 @@ func (udpg *UDPListener) HandleUdp(dstAddr net.IP, dstPort uint16, localAddr net
 		go remoteConnectionReadLoop(udpg, src, udpCon, udpN, w)
 	}
 
-	n, err := udpN.UDP.WriteTo(data, udpN.DestAddr)
+	n, err := udpN.write(data)
 
 	udpN.LastWrite = time.Now()
 	udpN.SentPackets++
@@ -481,12 +507,247 @@ func (udpg *UDPListener) HandleUdp(dstAddr net.IP, dstPort uint16, localAddr net
 		if found {
 			log.Println("UDP OFW ", src, "->", udpN.DestAddr, n)
 		} else {
-			log.Println("UDP open ", src, "->", udpN.UDP.LocalAddr(), "->", udpN.DestAddr, n, err)
+			log.Println("UDP open ", src, "->", udpN.localAddr(), "->", udpN.DestAddr, n, err)
 		}
-		log.Println("UDP open ", src, "->", udpN.UDP.LocalAddr(), "->", udpN.DestAddr, n)
 	}
 }
 
+// HandleUdpDest forwards a packet from src to dest "host:port", using a NAT
+// entry for each source and destination. The dest may be a hostname - it is
+// resolved by the Dialer, in background. Responses are sent back using w.
+//
+// Used for UDP received over other protocols, like SOCKS UDP ASSOCIATE,
+// where each packet has its own destination.
+func (udpg *UDPListener) HandleUdpDest(src *net.UDPAddr, dest string, data []byte, w UdpWriter) {
+	key := NatKey(src, dest)
+	udpg.udpLock.RLock()
+	udpN, found := udpg.ActiveUdp[key]
+	udpg.udpLock.RUnlock()
+	if !found {
+		udpN, found = udpg.dialNat(key, src, dest, w)
+	}
+
+	n, err := udpN.write(data)
+
+	udpN.LastWrite = time.Now()
+	udpN.SentPackets++
+	udpN.SentBytes += len(data)
+
+	if DumpUdp && !found {
+		log.Println("UDP open ", src, "->", dest, n, err)
+	}
+}
+
+// NatKey returns the key of the NAT entry for a source and destination,
+// created by HandleUdpDest.
+func NatKey(src *net.UDPAddr, dest string) string {
+	return src.String() + "/" + dest
+}
+
+// addNat adds an entry to the NAT table.
+func (udpg *UDPListener) addNat(key string, udpN *UdpNat) {
+	udpg.udpLock.Lock()
+	if _, ok := udpg.ActiveUdp[key]; !ok {
+		udpNatActive.Add(1)
+	}
+	udpg.ActiveUdp[key] = udpN
+	udpg.udpLock.Unlock()
+	udpNatTotal.Inc()
+}
+
+// maxPending is the number of packets queued while a NAT entry is dialing.
+const maxPending = 16
+
+// dialNat returns the NAT entry for key, creating it if needed. The Dialer
+// is called in the background - it may take seconds, and the packet path
+// can't wait. Packets for the entry are queued until it connects, and
+// dropped if the dial fails. Responses are sent back to src using w.
+//
+// Returns true if the entry was created by a concurrent packet.
+func (udpg *UDPListener) dialNat(key string, src *net.UDPAddr, dest string, w UdpWriter) (*UdpNat, bool) {
+	udpN := &UdpNat{
+		Dest:    dest,
+		dialing: true,
+	}
+	if ap, err := netip.ParseAddrPort(dest); err == nil {
+		udpN.DestAddr = net.UDPAddrFromAddrPort(ap)
+		udpN.ReverseSrcAddr = udpN.DestAddr
+	}
+
+	udpg.udpLock.Lock()
+	if cur, ok := udpg.ActiveUdp[key]; ok {
+		udpg.udpLock.Unlock()
+		return cur, true
+	}
+	udpg.ActiveUdp[key] = udpN
+	udpNatActive.Add(1)
+	udpg.udpLock.Unlock()
+	udpNatTotal.Inc()
+
+	d := nio.Dialer(udpg.Dialer)
+	if udpg.Masque != nil {
+		d = udpg.Masque
+	}
+	if nio.DefaultBreakers != nil {
+		d = nio.DefaultBreakers.Wrap(d)
+	}
+	if w == nil {
+		w = udpg.TransparentUDPWriter
+	}
+	if w == nil {
+		w = TransparentUDPWriter
+	}
+
+	go func() {
+		ctx, cf := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cf()
+		nc, err := d.DialContext(ctx, "udp", dest)
+		if err != nil {
+			log.Println("udp proxy failed to dial", dest, err)
+			udpg.removeNat(key, udpN)
+			return
+		}
+
+		udpN.dialM.Lock()
+		if udpN.closed {
+			udpN.dialM.Unlock()
+			nc.Close()
+			return
+		}
+		udpN.Conn = nc
+		if la, ok := nc.LocalAddr().(*net.UDPAddr); ok {
+			udpN.LocalPort = la.Port
+		}
+		pending := udpN.pending
+		udpN.pending = nil
+		udpN.dialing = false
+		udpN.dialM.Unlock()
+
+		for _, p := range pending {
+			nc.Write(p)
+		}
+		dialedConnectionReadLoop(src, udpN, w)
+	}()
+	return udpN, false
+}
+
+// removeNat removes the entry if it is still the active one for the key.
+func (udpg *UDPListener) removeNat(key string, udpN *UdpNat) {
+	udpg.udpLock.Lock()
+	if udpg.ActiveUdp[key] == udpN {
+		delete(udpg.ActiveUdp, key)
+		udpNatActive.Add(-1)
+	}
+	udpg.udpLock.Unlock()
+	udpN.close()
+}
+
+// NatCount returns the number of NAT entries.
+func (udpg *UDPListener) NatCount() int {
+	udpg.udpLock.RLock()
+	defer udpg.udpLock.RUnlock()
+	return len(udpg.ActiveUdp)
+}
+
+// RemoveNat closes and removes the NAT entry for the source "ip:port" key.
+// Used when the source goes away - like a SOCKS UDP association.
+func (udpg *UDPListener) RemoveNat(key string) {
+	udpg.udpLock.RLock()
+	udpN, ok := udpg.ActiveUdp[key]
+	udpg.udpLock.RUnlock()
+	if ok {
+		udpg.removeNat(key, udpN)
+	}
+}
+
+// write sends the packet to the destination, or queues it if the entry is
+// dialing.
+func (udpN *UdpNat) write(data []byte) (int, error) {
+	udpN.dialM.Lock()
+	if udpN.closed {
+		udpN.dialM.Unlock()
+		return 0, net.ErrClosed
+	}
+	if udpN.dialing {
+		defer udpN.dialM.Unlock()
+		if len(udpN.pending) >= maxPending {
+			return 0, errNatDialing
+		}
+		// The caller reuses the buffer.
+		udpN.pending = append(udpN.pending, append([]byte(nil), data...))
+		return len(data), nil
+	}
+	udpN.dialM.Unlock()
+	if udpN.Conn != nil {
+		return udpN.Conn.Write(data)
+	}
+	if udpN.UDP == nil {
+		return 0, net.ErrClosed
+	}
+	return udpN.UDP.WriteTo(data, udpN.DestAddr)
+}
+
+var errNatDialing = errors.New("udp: NAT entry dialing, queue full")
+
+// dialedConnectionReadLoop sends packets received on a dialed NAT back to the
+// client. Without a writer there is no way to send back, packets are dropped.
+func dialedConnectionReadLoop(localAddr *net.UDPAddr, udpN *UdpNat, writer UdpWriter) {
+	buffer := bufferPoolUdp.Get().([]byte)
+	defer bufferPoolUdp.Put(buffer)
+
+	for {
+		size, err := udpN.Conn.Read(buffer[0:cap(buffer)])
+		if err != nil {
+			log.Println("UDP: close dialed read loop for ", localAddr, err)
+			return
+		}
+		if writer != nil {
+			writer.WriteTo(buffer[:size], localAddr, udpN.ReverseSrcAddr)
+		}
+
+		udpN.LastRead = time.Now()
+		udpN.RcvdPackets++
+		udpN.RcvdBytes += size
+	}
+}
+
+func (udpN *UdpNat) dest() string {
+	if udpN.Dest != "" {
+		return udpN.Dest
+	}
+	return udpN.DestAddr.String()
+}
+
+func (udpN *UdpNat) localAddr() net.Addr {
+	udpN.dialM.Lock()
+	c := udpN.Conn
+	udpN.dialM.Unlock()
+	if c != nil {
+		return c.LocalAddr()
+	}
+	if udpN.UDP != nil {
+		return udpN.UDP.LocalAddr()
+	}
+	// Dialing
+	return nil
+}
+
+func (udpN *UdpNat) close() error {
+	udpN.dialM.Lock()
+	udpN.closed = true
+	udpN.pending = nil
+	c := udpN.Conn
+	udpN.dialM.Unlock()
+	if c != nil {
+		return c.Close()
+	}
+	if udpN.UDP == nil {
+		// Still dialing - the conn is closed when the dial completes.
+		return nil
+	}
+	return udpN.UDP.Close()
+}
+
 const bufferSize = (1 << 20) * 2
 
 // Called on the periodic cleanup thread (~60sec), or if too many sockets open.
@@ -500,12 +761,12 @@ func FreeIdleSockets(gw *UDPListener) {
 	t0 := time.Now()
 	for client, remote := range gw.ActiveUdp {
 		if t0.Sub(remote.LastWrite) > gw.ConnTimeout {
-			log.Printf("UDPC: %s:%d rcv=%d/%d snd=%d/%d ac=%v ra=%v op=%v lr=%s:%d la=%s %s",
-				remote.DestAddr.IP, remote.DestAddr.Port,
+			log.Printf("UDPC: %s rcv=%d/%d snd=%d/%d ac=%v ra=%v op=%v lr=%s:%d la=%s %s",
+				remote.dest(),
 				remote.RcvdPackets, remote.RcvdBytes,
 				remote.SentPackets, remote.SentBytes,
 				time.Since(remote.LastWrite), time.Since(remote.LastRead), time.Since(remote.Open),
-				remote.LastRemoteIP, remote.LastsRemotePort, remote.UDP.LocalAddr(), client)
+				remote.LastRemoteIP, remote.LastsRemotePort, remote.localAddr(), client)
 			remote.Closed = true
 			clientsToTimeout = append(clientsToTimeout, client)
 
@@ -535,8 +796,9 @@ func FreeIdleSockets(gw *UDPListener) {
 	}
 	gw.udpLock.Lock()
 	for _, client := range clientsToTimeout {
-		gw.ActiveUdp[client].UDP.Close()
+		gw.ActiveUdp[client].close()
 		delete(gw.ActiveUdp, client)
+		udpNatActive.Add(-1)
 	}
 	gw.udpLock.Unlock()
 }
@@ -545,8 +807,10 @@ func (gw *UDPListener) Close() error {
 	gw.udpLock.Lock()
 	//gw.closed = true
 	for _, conn := range gw.ActiveUdp {
-		conn.UDP.Close()
+		conn.close()
 	}
+	udpNatActive.Add(-int64(len(gw.ActiveUdp)))
+	clear(gw.ActiveUdp)
 	gw.udpLock.Unlock()
 	return nil
 }
@@ -0,0 +1,67 @@
+package udp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type slowDialer struct {
+	delay time.Duration
+	fail  bool
+	calls atomic.Int32
+}
+
+func (d *slowDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.calls.Add(1)
+	time.Sleep(d.delay)
+	if d.fail {
+		return nil, errors.New("unreachable")
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+// TestDialNat checks the dial doesn't block the packet path, and packets
+// sent while dialing are queued on a single NAT entry.
+func TestDialNat(t *testing.T) {
+	echo := udpEcho(t)
+	d := &slowDialer{delay: 200 * time.Millisecond}
+	ul := &UDPListener{ActiveUdp: map[string]*UdpNat{}, ConnTimeout: time.Minute, Dialer: d}
+	defer ul.Close()
+	w := &capturedWriter{ch: make(chan []byte, 4)}
+
+	src := net.IPv4(10, 0, 0, 2)
+	t0 := time.Now()
+	for _, m := range []string{"a", "b", "c"} {
+		ul.HandleUdpWriter(echo.IP, uint16(echo.Port), src, 1234, []byte(m), w)
+	}
+	if time.Since(t0) >= d.delay {
+		t.Fatal("Packet path waited for the dial", time.Since(t0))
+	}
+	for _, m := range []string{"a", "b", "c"} {
+		select {
+		case got := <-w.ch:
+			if string(got) != echo.String()+" echo "+m {
+				t.Fatal("Unexpected response", string(got))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout")
+		}
+	}
+	if d.calls.Load() != 1 || len(ul.ActiveUdp) != 1 {
+		t.Fatal("Expected one NAT entry", d.calls.Load(), len(ul.ActiveUdp))
+	}
+
+	// A failed dial removes the entry, the next packet dials again.
+	d.fail, d.delay = true, 0
+	ul.HandleUdpWriter(echo.IP, uint16(echo.Port), src, 1235, []byte("x"), w)
+	for i := 0; i < 100 && ul.NatCount() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ul.NatCount() != 1 {
+		t.Fatal("Expected the failed entry removed", ul.NatCount())
+	}
+}
@@ -0,0 +1,11 @@
+package webpush
+
+import "github.com/costinm/ugate/pkg/metrics"
+
+var (
+	msgSent = metrics.NewCounter("ugate_msg_sent_total",
+		"Messages sent to the Mux.")
+
+	msgDeliveries = metrics.NewCounterVec("ugate_msg_deliveries_total",
+		"Messages delivered to local handlers or remote connections.", "target")
+)
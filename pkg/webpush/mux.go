@@ -133,6 +133,7 @@ func (mux *Mux) SendMessage(ev *Message) error {
 	}
 
 	parts := strings.Split(ev.To, "/")
+	msgSent.Inc()
 
 	mux.HandleMessageForNode(ev)
 
@@ -147,6 +148,7 @@ func (mux *Mux) SendMessage(ev *Message) error {
 			ch := mux.connections[h]
 			if ch != nil {
 				ch.SendMessageToRemote(ev)
+				msgDeliveries.With("remote").Inc()
 			} else {
 				// TODO: return err or send to 'master'
 			}
@@ -197,6 +199,7 @@ func (ms *MsgConnection) maybeSend(parts []string, ev *Message, k string) {
 	}
 
 	ms.SendMessageToRemote(ev)
+	msgDeliveries.With("remote").Inc()
 	log.Println("/mux/Remote", ev.To, ms.Name)
 }
 
@@ -238,6 +241,7 @@ func (mux *Mux) HandleMessageForNode(ev *Message) error {
 
 	if h, f := mux.handlers["*"]; f {
 		h.HandleMessage(context.Background(), ev.To, ev.Meta, payload)
+		msgDeliveries.With("local").Inc()
 	}
 
 	if mux.ServeMux != nil {
@@ -252,15 +256,18 @@ func (mux *Mux) HandleMessageForNode(ev *Message) error {
 			log.Println("Server handler: ", ev.To)
 			w := &rw{}
 			h.ServeHTTP(w, r)
+			msgDeliveries.With("local").Inc()
 		}
 		return nil
 	}
 
 	if h, f := mux.handlers[topic]; f {
 		h.HandleMessage(context.Background(), ev.To, ev.Meta, payload)
+		msgDeliveries.With("local").Inc()
 	} else if h, f = mux.handlers[""]; f {
 		log.Println("UNHANDLED: ", ev.To)
 		h.HandleMessage(context.Background(), ev.To, ev.Meta, payload)
+		msgDeliveries.With("local").Inc()
 	}
 	return nil
 }
@@ -0,0 +1,170 @@
+package ws
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/costinm/ugate/nio"
+)
+
+// IsWebSocket returns true for a HTTP/1.1 Upgrade or a RFC 8441 extended
+// CONNECT request for websocket.
+func IsWebSocket(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return r.Header.Get(":protocol") == "websocket"
+	}
+	return r.Method == http.MethodGet && hasToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Accept completes the WebSocket handshake. resHeader is added to the
+// response - for example Sec-WebSocket-Protocol.
+//
+// On error a response is sent. For HTTP/2, the handler must not return
+// until the Conn is done - the stream ends with the handler.
+func Accept(w http.ResponseWriter, r *http.Request, resHeader http.Header) (*Conn, error) {
+	if !IsWebSocket(r) {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	c := &Conn{
+		StreamState: nio.StreamState{Stats: nio.Stats{Open: time.Now()},
+			Proto: "ws", PeerAddr: r.RemoteAddr},
+		Request:        r,
+		ResponseHeader: w.Header(),
+		TLS:            r.TLS,
+		ctx:            r.Context(),
+	}
+	for k, v := range resHeader {
+		w.Header()[k] = v
+	}
+	if la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.localAddr = la
+	}
+	c.remoteAddr, _ = net.ResolveTCPAddr("tcp", r.RemoteAddr)
+
+	if r.ProtoMajor >= 2 {
+		// RFC 8441 - a 200 response, then the stream carries the frames.
+		c.H2 = true
+		c.rc = http.NewResponseController(w)
+		w.WriteHeader(http.StatusOK)
+		if err := c.rc.Flush(); err != nil {
+			return nil, err
+		}
+		c.r = r.Body
+		c.w = w
+		c.flush = c.rc.Flush
+		c.closer = r.Body.Close
+		return c, nil
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	nc, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "hijack not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	// The header map of a hijacked ResponseWriter can't be used.
+	c.ResponseHeader = c.ResponseHeader.Clone()
+	c.ResponseHeader.Set("Upgrade", "websocket")
+	c.ResponseHeader.Set("Connection", "Upgrade")
+	c.ResponseHeader.Set("Sec-WebSocket-Accept", acceptKey(key))
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	c.ResponseHeader.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	// The client may send frames right after the request.
+	c.r = brw.Reader
+	c.w = nc
+	c.conn = nc
+	c.closer = nc.Close
+	c.localAddr = nc.LocalAddr()
+	c.remoteAddr = nc.RemoteAddr()
+	return c, nil
+}
+
+// WS is a http.Handler accepting WebSocket tunnels, and proxying them to a
+// TCP destination.
+//
+// Authentication is expected to be done by the handler chain in front.
+type WS struct {
+	// Dest is the destination of all tunnels - for example the local SSH
+	// server. If empty, the "dest" path value is used, for routes like
+	// "/ws/{dest}".
+	Dest string `json:"dest,omitempty"`
+
+	// Allow is the list of destinations allowed in the path - see
+	// nio.AllowDest. If empty, only Dest is used.
+	Allow []string `json:"allow,omitempty"`
+
+	// Dialer for the destination. Defaults to the mesh dialer.
+	Dialer nio.ContextDialer `json:"-"`
+}
+
+func (ws *WS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dest := ws.Dest
+	if dest == "" {
+		dest = r.PathValue("dest")
+		if dest == "" {
+			http.Error(w, "missing destination", http.StatusBadRequest)
+			return
+		}
+		if !nio.AllowDest(ws.Allow, dest) {
+			http.Error(w, "destination not allowed", http.StatusForbidden)
+			return
+		}
+	}
+	d := nio.Dialer(ws.Dialer)
+	if nio.DefaultBreakers != nil {
+		d = nio.DefaultBreakers.Wrap(d)
+	}
+
+	// Dial first, so errors can use a HTTP status.
+	ctx, cf := context.WithTimeout(r.Context(), 10*time.Second)
+	nc, err := d.DialContext(ctx, "tcp", dest)
+	cf()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	c, err := Accept(w, r, nil)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	c.Dest = dest
+	c.ListenerName = "ws"
+	defer c.Close()
+
+	nio.Proxy(nc, c, c, dest)
+}
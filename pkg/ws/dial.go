@@ -0,0 +1,199 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/costinm/ugate/nio"
+)
+
+// Dialer opens WebSocket tunnels.
+type Dialer struct {
+	// H2 is used for RFC 8441 tunnels, if set. Must support extended
+	// CONNECT - a golang.org/x/net/http2 Transport or ClientConn. The
+	// standard library transport rejects the :protocol header.
+	H2 http.RoundTripper `json:"-"`
+
+	// Dialer for HTTP/1.1 tunnels. Defaults to net.Dialer.
+	Dialer nio.ContextDialer `json:"-"`
+
+	// TLSConfig for wss URLs on HTTP/1.1.
+	TLSConfig *tls.Config `json:"-"`
+}
+
+// Dial opens a tunnel to a ws:// or wss:// (or http/https) URL, sending the
+// extra headers - for example Authorization.
+//
+// For HTTP/2, ctx is the context of the stream and must not be canceled
+// while the tunnel is used.
+func (d *Dialer) Dial(ctx context.Context, addr string, h http.Header) (*Conn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	if d.H2 != nil {
+		return d.dialH2(ctx, u, h)
+	}
+	return d.dialH1(ctx, u, h)
+}
+
+func (d *Dialer) dialH2(ctx context.Context, u *url.URL, h http.Header) (*Conn, error) {
+	pr, pw := io.Pipe()
+	r, err := http.NewRequestWithContext(ctx, http.MethodConnect, u.String(), pr)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		r.Header[k] = v
+	}
+	r.Header.Set(":protocol", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+
+	res, err := d.H2.RoundTrip(r)
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		pw.Close()
+		return nil, errors.New("ws: handshake status " + res.Status)
+	}
+	c := &Conn{
+		StreamState: nio.StreamState{Stats: nio.Stats{Open: time.Now()},
+			Proto: "ws", Dest: u.Host},
+		Request:        r,
+		ResponseHeader: res.Header,
+		H2:             true,
+		TLS:            res.TLS,
+		ctx:            ctx,
+		client:         true,
+		r:              res.Body,
+		w:              pw,
+		closeWrite:     pw.Close,
+	}
+	c.closer = func() error {
+		pw.Close()
+		return res.Body.Close()
+	}
+	return c, nil
+}
+
+func (d *Dialer) dialH1(ctx context.Context, u *url.URL, h http.Header) (*Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	var nd nio.ContextDialer = d.Dialer
+	if nd == nil {
+		nd = &net.Dialer{}
+	}
+	nc, err := nd.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	var cs *tls.ConnectionState
+	if u.Scheme == "https" {
+		tc := d.TLSConfig.Clone()
+		if tc == nil {
+			tc = &tls.Config{}
+		}
+		if tc.ServerName == "" {
+			tc.ServerName = u.Hostname()
+		}
+		// Upgrade is only defined for HTTP/1.1.
+		tc.NextProtos = []string{"http/1.1"}
+		tlsc := tls.Client(nc, tc)
+		if err := tlsc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		st := tlsc.ConnectionState()
+		cs = &st
+		nc = tlsc
+	}
+
+	c, err := clientHandshake(ctx, nc, u, h)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	c.TLS = cs
+	return c, nil
+}
+
+func clientHandshake(ctx context.Context, nc net.Conn, u *url.URL, h http.Header) (*Conn, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(dl)
+		defer nc.SetDeadline(time.Time{})
+	}
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		r.Header[k] = v
+	}
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Key", key)
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	if err := r.Write(nc); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(nc)
+	res, err := http.ReadResponse(br, r)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		res.Body.Close()
+		return nil, errors.New("ws: handshake status " + res.Status)
+	}
+	if !strings.EqualFold(res.Header.Get("Upgrade"), "websocket") ||
+		res.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, ErrBadHandshake
+	}
+
+	return &Conn{
+		StreamState: nio.StreamState{Stats: nio.Stats{Open: time.Now()},
+			Proto: "ws", Dest: u.Host},
+		Request:        r,
+		ResponseHeader: res.Header,
+		ctx:            ctx,
+		client:         true,
+		r:              br,
+		w:              nc,
+		conn:           nc,
+		closer:         nc.Close,
+		localAddr:      nc.LocalAddr(),
+		remoteAddr:     nc.RemoteAddr(),
+	}, nil
+}
@@ -0,0 +1,382 @@
+// Package ws implements WebSocket tunnels: RFC 6455 binary frames carrying a
+// byte stream, over a HTTP/1.1 Upgrade or a RFC 8441 extended CONNECT stream
+// on HTTP/2.
+//
+// Browsers, CDNs and some corporate proxies only allow WebSocket - a Conn is a
+// nio.Stream, so mesh TCP tunnels (SSH, CONNECT) can use them.
+//
+// Only binary and text frames are read, as a stream - message boundaries are
+// not preserved. No extensions (compression) are negotiated.
+//
+// The Go HTTP/2 server only advertises extended CONNECT with
+// GODEBUG=http2xconnect=1 in the environment.
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/costinm/ugate/nio"
+)
+
+// Frame opcodes
+const (
+	opContinuation = 0
+	opText         = 1
+	opBinary       = 2
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// CloseNormal is the close status sent by CloseWrite.
+const CloseNormal = 1000
+
+var (
+	ErrBadHandshake = errors.New("ws: bad handshake")
+	ErrProtocol     = errors.New("ws: protocol error")
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// acceptKey computes the Sec-WebSocket-Accept for a Sec-WebSocket-Key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Conn is a WebSocket connection, used as a byte stream. Like StreamConn,
+// the stats are updated by the proxy copying the stream.
+//
+// Read returns the payload of data frames, replies to pings and returns
+// io.EOF when a close frame is received. CloseWrite sends a close frame -
+// the other direction stays open until the peer sends its close, so a
+// proxied stream can drain like a TCP half close.
+type Conn struct {
+	nio.StreamState
+
+	// Request is the accepted request on the server side, or the request
+	// sent by the client.
+	Request *http.Request
+
+	// ResponseHeader is the response header - sent by the server or
+	// received by the client.
+	ResponseHeader http.Header
+
+	// H2 is set if the connection is a RFC 8441 stream.
+	H2 bool
+
+	TLS *tls.ConnectionState
+
+	ctx    context.Context
+	client bool
+
+	r io.Reader
+	w io.Writer
+
+	// flush is called after each frame is written, for HTTP/2 streams.
+	flush func() error
+
+	// closeWrite is called after the close frame is sent - to end the
+	// HTTP/2 request body.
+	closeWrite func() error
+
+	// closer closes the transport.
+	closer func() error
+
+	// conn is set for HTTP/1.1 - used for addresses and deadlines.
+	conn net.Conn
+
+	// deadlines for HTTP/2 server streams
+	rc *http.ResponseController
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	// Read state - a single reader is expected.
+	remaining int64
+	masked    bool
+	maskKey   [4]byte
+	maskPos   int
+	readErr   error
+	hdr       [14]byte
+
+	wm        sync.Mutex
+	wbuf      []byte
+	closeSent bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var _ nio.Stream = &Conn{}
+
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+func (c *Conn) State() *nio.StreamState {
+	return &c.StreamState
+}
+
+func (c *Conn) Header() http.Header {
+	return c.ResponseHeader
+}
+
+func (c *Conn) RequestHeader() http.Header {
+	return c.Request.Header
+}
+
+func (c *Conn) TLSConnectionState() *tls.ConnectionState {
+	return c.TLS
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	if c.rc != nil {
+		return c.rc.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	if c.rc != nil {
+		return c.rc.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// Read returns the payload of the data frames.
+func (c *Conn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= c.maskKey[(c.maskPos+i)&3]
+		}
+		c.maskPos += n
+	}
+	c.remaining -= int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		c.readErr = err
+	}
+	if err == io.EOF {
+		// End of the transport is only valid after a close frame.
+		err = nil
+		c.readErr = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame with a payload is found,
+// handling control frames. Returns io.EOF on a close frame.
+func (c *Conn) nextFrame() error {
+	for {
+		h := c.hdr[:]
+		if _, err := io.ReadFull(c.r, h[:2]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		fin := h[0]&0x80 != 0
+		if h[0]&0x70 != 0 {
+			return ErrProtocol // no extensions negotiated
+		}
+		op := h[0] & 0x0f
+		masked := h[1]&0x80 != 0
+		if masked == c.client {
+			// Client frames must be masked, server frames must not.
+			return ErrProtocol
+		}
+		plen := int64(h[1] & 0x7f)
+		switch plen {
+		case 126:
+			if _, err := io.ReadFull(c.r, h[:2]); err != nil {
+				return err
+			}
+			plen = int64(binary.BigEndian.Uint16(h[:2]))
+		case 127:
+			if _, err := io.ReadFull(c.r, h[:8]); err != nil {
+				return err
+			}
+			plen = int64(binary.BigEndian.Uint64(h[:8]))
+			if plen < 0 {
+				return ErrProtocol
+			}
+		}
+		c.masked = masked
+		c.maskPos = 0
+		if masked {
+			if _, err := io.ReadFull(c.r, c.maskKey[:]); err != nil {
+				return err
+			}
+		}
+
+		switch op {
+		case opContinuation, opText, opBinary:
+			if plen > 0 {
+				c.remaining = plen
+				return nil
+			}
+			continue
+		case opClose, opPing, opPong:
+			if !fin || plen > 125 {
+				return ErrProtocol
+			}
+		default:
+			return ErrProtocol
+		}
+
+		payload := h[:plen]
+		if plen > int64(len(h)) {
+			payload = make([]byte, plen)
+		}
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= c.maskKey[i&3]
+			}
+		}
+		switch op {
+		case opClose:
+			return io.EOF
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil && err != net.ErrClosed {
+				return err
+			}
+		}
+	}
+}
+
+// Write sends b as one binary frame.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	b := c.wbuf[:0]
+	b = append(b, 0x80|op)
+	var mbit byte
+	if c.client {
+		mbit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, mbit|byte(n))
+	case n <= 0xffff:
+		b = append(b, mbit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, mbit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	if c.client {
+		var key [4]byte
+		rand.Read(key[:])
+		b = append(b, key[:]...)
+		start := len(b)
+		b = append(b, payload...)
+		for i := range payload {
+			b[start+i] ^= key[i&3]
+		}
+	} else {
+		b = append(b, payload...)
+	}
+	if cap(b) <= 64*1024 {
+		c.wbuf = b
+	}
+
+	if _, err := c.w.Write(b); err != nil {
+		return err
+	}
+	if c.flush != nil {
+		return c.flush()
+	}
+	return nil
+}
+
+// CloseWrite sends a close frame. The peer will get io.EOF, but can keep
+// sending until it closes its side.
+func (c *Conn) CloseWrite() error {
+	err := c.writeFrame(opClose, binary.BigEndian.AppendUint16(nil, CloseNormal))
+	if err == net.ErrClosed {
+		return nil
+	}
+	if c.closeWrite != nil {
+		if err1 := c.closeWrite(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// Close sends a close frame, if not sent, and closes the transport.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		// Don't block on a peer that is not reading.
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		c.CloseWrite()
+		c.closeErr = c.closer()
+	})
+	return c.closeErr
+}
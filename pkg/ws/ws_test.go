@@ -0,0 +1,217 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// TestMain re-runs the tests with extended CONNECT enabled in the HTTP/2
+// server - the setting is only read from the environment at init.
+func TestMain(m *testing.M) {
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], os.Args[1:]...)
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1,"+os.Getenv("GODEBUG"))
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			if ee, ok := err.(*exec.ExitError); ok {
+				os.Exit(ee.ExitCode())
+			}
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func connPair() (*Conn, *Conn) {
+	c1, c2 := net.Pipe()
+	client := &Conn{ctx: context.Background(), client: true, r: c1, w: c1, conn: c1, closer: c1.Close}
+	server := &Conn{ctx: context.Background(), r: c2, w: c2, conn: c2, closer: c2.Close}
+	return client, server
+}
+
+func TestAcceptKey(t *testing.T) {
+	// RFC 6455 section 1.3
+	if k := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); k != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal("Unexpected key", k)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	client, server := connPair()
+	defer client.Close()
+	defer server.Close()
+
+	big := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, m := range [][]byte{[]byte("hello"), make([]byte, 200), big} {
+		go client.Write(m)
+		got := make([]byte, len(m))
+		if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, m) {
+			t.Fatal("Unexpected data", len(m), err)
+		}
+	}
+
+	// Ping is answered while reading - the client gets the pong before the
+	// data.
+	go func() {
+		server.writeFrame(opPing, []byte("p"))
+		server.Write([]byte("after"))
+	}()
+	go io.Copy(io.Discard, server)
+	b := make([]byte, 10)
+	n, err := client.Read(b)
+	if err != nil || string(b[:n]) != "after" {
+		t.Fatal("Unexpected read after ping", string(b[:n]), err)
+	}
+
+	// Unmasked client frames are rejected.
+	c1, c2 := net.Pipe()
+	s := &Conn{r: c2, w: c2, closer: c2.Close}
+	go c1.Write([]byte{0x82, 1, 'x'})
+	if _, err := s.Read(b); err != ErrProtocol {
+		t.Fatal("Expected protocol error", err)
+	}
+	c1.Close()
+}
+
+func TestHalfClose(t *testing.T) {
+	client, server := connPair()
+	defer server.Close()
+
+	go func() {
+		client.Write([]byte("req"))
+		client.CloseWrite()
+	}()
+	req, err := io.ReadAll(server)
+	if err != nil || string(req) != "req" {
+		t.Fatal("Unexpected request", string(req), err)
+	}
+	// The server can still respond after the client close frame.
+	go func() {
+		server.Write([]byte("res"))
+		server.Close()
+	}()
+	res, err := io.ReadAll(client)
+	if err != nil || string(res) != "res" {
+		t.Fatal("Unexpected response", string(res), err)
+	}
+	if _, err := client.Write([]byte("x")); err != net.ErrClosed {
+		t.Fatal("Expected write after close to fail", err)
+	}
+	client.Close()
+}
+
+// echoServer echoes TCP connections, and closes after the client FIN.
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func testTunnel(t *testing.T, c *Conn) {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, m := range []string{"hello", "world"} {
+		c.Write([]byte(m))
+		b := make([]byte, len(m))
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != m {
+			t.Fatal("Unexpected echo", string(b), err)
+		}
+	}
+	c.CloseWrite()
+	if rest, err := io.ReadAll(c); err != nil || len(rest) != 0 {
+		t.Fatal("Expected EOF", rest, err)
+	}
+	c.Close()
+}
+
+func TestTunnelH1(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/ws/{dest}", &WS{Allow: []string{"127.0.0.1"}})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	d := &Dialer{}
+	c, err := d.Dial(context.Background(), "ws://"+srv.Listener.Addr().String()+"/ws/"+echoServer(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.H2 || c.RemoteAddr() == nil {
+		t.Fatal("Unexpected conn", c.H2, c.RemoteAddr())
+	}
+	testTunnel(t, c)
+
+	// Plain requests and bad destinations fail with a status.
+	res, err := http.Get(srv.URL + "/ws/" + echoServer(t))
+	if err != nil || res.StatusCode != http.StatusUpgradeRequired {
+		t.Fatal("Expected 426", res, err)
+	}
+	_, err = d.Dial(context.Background(), "ws://"+srv.Listener.Addr().String()+"/ws/127.0.0.1:1", nil)
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatal("Expected 502", err)
+	}
+	_, err = d.Dial(context.Background(), "ws://"+srv.Listener.Addr().String()+"/ws/10.1.1.1:22", nil)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatal("Expected 403", err)
+	}
+}
+
+func TestTunnelH2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(&WS{Dest: echoServer(t)})
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	h2 := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer h2.CloseIdleConnections()
+	d := &Dialer{H2: h2}
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	c, err := d.Dial(ctx, "wss://"+srv.Listener.Addr().String()+"/ws", http.Header{"X-Test": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.H2 || c.TLS == nil {
+		t.Fatal("Expected h2 tunnel")
+	}
+	testTunnel(t, c)
+
+	// HTTP/1.1 upgrade on the same server
+	d1 := &Dialer{TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	c, err = d1.Dial(context.Background(), "wss://"+srv.Listener.Addr().String()+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.H2 || c.TLS == nil {
+		t.Fatal("Expected h1 tunnel")
+	}
+	testTunnel(t, c)
+}